@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"gophermart/internal/accrualsim"
+	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	defer cancel()
+
+	l, err := zap.NewProduction()
+	if err != nil {
+		log.Fatalf("error on create logger: %v", err)
+	}
+	logger := l.Sugar()
+	defer logger.Sync()
+
+	cnfg, err := accrualsim.NewConfig()
+	if err != nil {
+		logger.Fatalf("failed to parse config, %v", err)
+	}
+	logger.Infof("config is %v", cnfg)
+
+	sim, err := accrualsim.NewServer(cnfg)
+	if err != nil {
+		logger.Fatalf("failed to create simulator, %v", err)
+	}
+
+	server := &http.Server{Addr: cnfg.Address, Handler: sim.Handler()}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatalf("server start error: %v", err)
+		}
+	}()
+	logger.Infof("accrual simulator started on %v", cnfg.Address)
+
+	<-ctx.Done()
+	if err := server.Shutdown(context.Background()); err != nil {
+		logger.Errorf("simulator shutdown failed: %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"gophermart/internal/app"
+	"gophermart/internal/config"
+	"log"
+	"os/signal"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	defer cancel()
+
+	l, err := zap.NewProduction()
+	if err != nil {
+		log.Fatalf("error on create logger: %v", err)
+	}
+	logger := l.Sugar()
+	defer logger.Sync()
+
+	cnfg, err := config.NewConfig(config.ModeWorker)
+	if err != nil {
+		logger.Fatalf("failed to parse config, %v", err)
+	}
+	logger.Infof("config is %v", cnfg)
+
+	if err := app.Run(ctx, cnfg, logger); err != nil {
+		logger.Fatalf("failed to run worker, %v", err)
+	}
+}
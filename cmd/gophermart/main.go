@@ -2,20 +2,20 @@ package main
 
 import (
 	"context"
+	"gophermart/internal/app"
+	"gophermart/internal/cli"
 	"gophermart/internal/config"
-	"gophermart/internal/db"
-	"gophermart/internal/processing"
-	mainServer "gophermart/internal/server"
-	"gophermart/internal/utils"
 	"log"
-	"net/http"
+	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 
 	"go.uber.org/zap"
 )
 
+// usage: gophermart [serve|worker|all]
+//
+//	gophermart deadletter ...
 func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 	defer cancel()
@@ -27,20 +27,29 @@ func main() {
 	logger := l.Sugar()
 	defer logger.Sync()
 
-	cnfg, err := config.NewConfig()
-	if err != nil {
-		logger.Fatalf("failed to parse config, %w", err)
-	}
-	logger.Infof("config is %v", cnfg)
-	storage, err := db.NewStorage(cnfg.DBURL, ctx, logger)
-	if err != nil {
-		logger.Fatalf("failed to create storage, %w", err)
+	if len(os.Args) > 1 && cli.IsCommand(os.Args[1]) {
+		cnfg, err := config.NewConfig(config.ModeCLI)
+		if err != nil {
+			logger.Fatalf("failed to parse config, %v", err)
+		}
+		if err := app.RunCommand(ctx, cnfg, logger, os.Args[1:], os.Stdout); err != nil {
+			logger.Fatalf("failed to run %v, %v", os.Args[1], err)
+		}
+		return
 	}
 
-	wg := &sync.WaitGroup{}
+	mode := ""
+	if len(os.Args) > 1 {
+		mode = os.Args[1]
+	}
 
-	processing.RunDaemon(http.Client{}, cnfg.ProcessingAddress, storage, logger, ctx, wg, cnfg)
-	mainServer.Run(storage, utils.TestSecret, cnfg, logger, ctx)
+	cnfg, err := config.NewConfig(mode)
+	if err != nil {
+		logger.Fatalf("failed to parse config, %v", err)
+	}
+	logger.Infof("config is %v", cnfg)
 
-	wg.Wait()
+	if err := app.Run(ctx, cnfg, logger); err != nil {
+		logger.Fatalf("failed to run %v, %v", cnfg.Mode, err)
+	}
 }
@@ -4,31 +4,53 @@ import (
 	"encoding/json"
 	"errors"
 	"gophermart/internal/db"
+	"gophermart/internal/money"
 	"gophermart/internal/utils"
 	"net/http"
 	"strconv"
+	"time"
+
+	accountModel "gophermart/internal/account/model/db"
 
 	"go.uber.org/zap"
 )
 
 type handler struct {
-	db     db.Storage
-	secret string
-	logger *zap.SugaredLogger
+	db      db.Storage
+	secret  string
+	holdTTL time.Duration
+	// expiringWithin is the period of points shown as expiring soon, 0 hides them.
+	expiringWithin time.Duration
+	logger         *zap.SugaredLogger
+}
+
+func NewAccountHandler(db db.Storage, secret string, holdTTL, expiringWithin time.Duration, logger *zap.SugaredLogger) *handler {
+	return &handler{db, secret, holdTTL, expiringWithin, logger}
 }
 
-func NewAccountHandler(db db.Storage, secret string, logger *zap.SugaredLogger) *handler {
-	return &handler{db, secret, logger}
+func (h *handler) getAccount(UserID, currency string) (*accountModel.Account, error) {
+	account, err := h.db.GetAccount(UserID, currency)
+	if err != nil || h.expiringWithin <= 0 {
+		return account, err
+	}
+	if account.ExpiringSoon, err = h.db.GetExpiringPoints(UserID, currency, h.expiringWithin); err != nil {
+		return nil, err
+	}
+	return account, nil
 }
 
+// GetAccount returns the balance in the currency of the query parameter, the platform's own points without it.
 func (h *handler) GetAccount(w http.ResponseWriter, r *http.Request) {
 	if UserID, isAuthed := utils.GetUserID(r, h.secret); !isAuthed {
 		// 401 — пользователь не авторизован.
 		h.logger.Warn("failed to auth user")
 		w.WriteHeader(http.StatusUnauthorized)
-	} else if account, err := h.db.GetAccount(UserID); err != nil {
+	} else if account, err := h.getAccount(UserID, r.URL.Query().Get(CurrencyParam)); err != nil {
 		if err == db.ErrUserNotFound {
 			w.WriteHeader(http.StatusNoContent)
+		} else if err == db.ErrUnknownCurrency {
+			// 400 — неизвестная валюта.
+			w.WriteHeader(http.StatusBadRequest)
 		} else {
 			w.WriteHeader(http.StatusInternalServerError)
 		}
@@ -41,9 +63,62 @@ func (h *handler) GetAccount(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// CurrencyParam is the query parameter of the balance currency.
+const CurrencyParam = "currency"
+
+// Codes of withdrawal limits returned in LimitError.
+const (
+	LimitMinSum      = "MIN_SUM"
+	LimitMaxSum      = "MAX_SUM"
+	LimitDailySum    = "DAILY_LIMIT"
+	LimitMonthlySum  = "MONTHLY_LIMIT"
+	LimitHourlyCount = "HOURLY_COUNT"
+	LimitCoolingOff  = "COOLING_OFF"
+)
+
+// LimitError is the body of response to a withdrawal rejected by a limit.
+type LimitError struct {
+	Code string `json:"code"`
+}
+
+type limit struct {
+	err    error
+	code   string
+	status int
+}
+
+var limits = []limit{
+	{db.ErrWithdrawalBelowMin, LimitMinSum, http.StatusForbidden},
+	{db.ErrWithdrawalAboveMax, LimitMaxSum, http.StatusForbidden},
+	{db.ErrWithdrawalDailyLimit, LimitDailySum, http.StatusForbidden},
+	{db.ErrWithdrawalMonthlyLimit, LimitMonthlySum, http.StatusForbidden},
+	{db.ErrWithdrawalHourlyCount, LimitHourlyCount, http.StatusTooManyRequests},
+	{db.ErrWithdrawalCoolingOff, LimitCoolingOff, http.StatusForbidden},
+}
+
+func findLimit(err error) (limit, bool) {
+	for _, l := range limits {
+		if errors.Is(err, l.err) {
+			return l, true
+		}
+	}
+	return limit{}, false
+}
+
 type WithdrawData struct {
-	Order string  `json:"order"`
-	Sum   float64 `json:"sum"`
+	Order string      `json:"order"`
+	Sum   money.Money `json:"sum"`
+	// Hold creates a pending withdrawal to be confirmed or cancelled later.
+	Hold bool `json:"hold"`
+	// Currency of the withdrawn points, empty for the platform's own points.
+	Currency string `json:"currency"`
+}
+
+func (h *handler) withdraw(UserID string, data WithdrawData, order uint64) error {
+	if data.Hold {
+		return h.db.HoldWithdrawal(UserID, data.Currency, data.Sum, order, h.holdTTL)
+	}
+	return h.db.WithdrawFromAccount(UserID, data.Currency, data.Sum, order)
 }
 
 func (h *handler) PostWithdraw(w http.ResponseWriter, r *http.Request) {
@@ -54,24 +129,39 @@ func (h *handler) PostWithdraw(w http.ResponseWriter, r *http.Request) {
 	} else if err := json.NewDecoder(r.Body).Decode(&withdrawData); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		h.logger.Warnf("failed to PostWithdraw: %w", err)
-	} else if order, err := strconv.ParseUint(withdrawData.Order, 10, 64); err != nil || withdrawData.Sum < 0 {
+	} else if order, err := strconv.ParseUint(withdrawData.Order, 10, 64); err != nil || withdrawData.Sum <= 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		h.logger.Warnf("failed to PostWithdraw: %w", err)
 	} else if !utils.IsValidOrder(order) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		h.logger.Warnf("failed to PostWithdraw: invalid order")
-	} else if err := h.db.WithdrawFromAccount(UserID, withdrawData.Sum, order); err != nil {
+	} else if err := h.withdraw(UserID, withdrawData, order); err != nil {
 		if errors.Is(err, db.ErrUserNotFound) {
 			// 404 - account not found
 			w.WriteHeader(http.StatusNotFound)
 		} else if errors.Is(err, db.ErrBalanceLimitExhausted) {
 			// 402 — на счету недостаточно средств
 			w.WriteHeader(http.StatusPaymentRequired)
+		} else if errors.Is(err, db.ErrDuplicateWithdrawal) {
+			// 409 — списание по номеру заказа уже было
+			w.WriteHeader(http.StatusConflict)
+		} else if errors.Is(err, db.ErrUnknownCurrency) {
+			// 400 — неизвестная валюта
+			w.WriteHeader(http.StatusBadRequest)
+		} else if limit, ok := findLimit(err); ok {
+			// 403 — нарушено ограничение на списания, 429 — слишком много списаний за час;
+			// код ограничения передаётся в теле ответа
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(limit.status)
+			json.NewEncoder(w).Encode(LimitError{Code: limit.code})
 		} else {
 			// 500 — внутренняя ошибка сервера.
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 		h.logger.Warnf("failed to PostWithdraw: %w", err)
+	} else if withdrawData.Hold {
+		// 202 — баллы зарезервированы до подтверждения списания;
+		w.WriteHeader(http.StatusAccepted)
 	} else {
 		// 202 -  новый номер заказа принят в обработку;
 		w.WriteHeader(http.StatusOK)
@@ -5,14 +5,22 @@ import (
 	"encoding/json"
 	"errors"
 	"gophermart/internal/db"
+	"gophermart/internal/money"
 	"gophermart/internal/order/model"
 	"gophermart/internal/utils"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	accountApi "gophermart/internal/account/model/api"
 	accountModel "gophermart/internal/account/model/db"
+	adjustmentModel "gophermart/internal/adjustment/model/db"
+	campaignModel "gophermart/internal/campaign/model/db"
+	referralModel "gophermart/internal/referral/model/db"
+	statementModel "gophermart/internal/statement/model/db"
+	transferModel "gophermart/internal/transfer/model/db"
 	withdrawalsModel "gophermart/internal/withdrawals/model/db"
 
 	"github.com/stretchr/testify/assert"
@@ -24,7 +32,7 @@ type mockDBStorage struct {
 	mock.Mock
 }
 
-func (m *mockDBStorage) Register(login string, password string) (string, error) {
+func (m *mockDBStorage) Register(login, password, referralCode, ip string) (string, error) {
 	return "", nil
 }
 
@@ -32,7 +40,7 @@ func (m *mockDBStorage) GetByLoginPassword(login string, password string) (strin
 	return "", nil
 }
 
-func (m *mockDBStorage) SaveOrder(UserID string, number uint64) error {
+func (m *mockDBStorage) SaveOrder(UserID string, number uint64, merchantID, provider string) error {
 	args := m.Called(UserID, number)
 	return args.Error(0)
 }
@@ -42,14 +50,14 @@ func (m *mockDBStorage) GetOrders(UserID string) ([]model.Order, error) {
 	return args.Get(0).([]model.Order), args.Error(1)
 }
 
-func (m *mockDBStorage) GetAccount(UserID string) (*accountModel.Account, error) {
-	args := m.Called(UserID)
+func (m *mockDBStorage) GetAccount(UserID, currency string) (*accountModel.Account, error) {
+	args := m.Called(UserID, currency)
 	r := args.Get(0).(accountModel.Account)
 	return &r, args.Error(1)
 }
 
-func (m *mockDBStorage) WithdrawFromAccount(UserID string, sum float64, number uint64) error {
-	args := m.Called(UserID, sum, number)
+func (m *mockDBStorage) WithdrawFromAccount(UserID, currency string, sum money.Money, number uint64) error {
+	args := m.Called(UserID, currency, sum, number)
 	r := args.Get(0)
 	if r == nil {
 		return nil
@@ -57,25 +65,190 @@ func (m *mockDBStorage) WithdrawFromAccount(UserID string, sum float64, number u
 	return r.(error)
 }
 
-func (m *mockDBStorage) GetWithdrawals(UserID string) ([]withdrawalsModel.Withdrawals, error) {
+func (m *mockDBStorage) HoldWithdrawal(UserID, currency string, sum money.Money, number uint64, ttl time.Duration) error {
+	args := m.Called(UserID, currency, sum, number, ttl)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) ConfirmWithdrawal(UserID string, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) CancelWithdrawal(UserID string, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) ExpireWithdrawals() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) ExpirePoints() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) RecalculateTiers() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) CreateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaigns() ([]campaignModel.Campaign, error) {
+	args := m.Called()
+	return args.Get(0).([]campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaign(ID int64) (*campaignModel.Campaign, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) UpdateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) DeleteCampaign(ID int64) error {
+	args := m.Called(ID)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) CreateAdjustment(login string, amount money.Money, reason, ticket, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(login, amount, reason, ticket, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) ApproveAdjustment(ID int64, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) RejectAdjustment(ID int64, actor, reason string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor, reason)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustments() ([]adjustmentModel.Adjustment, error) {
+	args := m.Called()
+	return args.Get(0).([]adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustment(ID int64) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetExpiringPoints(UserID, currency string, within time.Duration) ([]accountModel.ExpiringPoints, error) {
+	args := m.Called(UserID, currency, within)
+	return args.Get(0).([]accountModel.ExpiringPoints), args.Error(1)
+}
+
+func (m *mockDBStorage) RefundWithdrawal(number uint64, sum money.Money, actor, reason string) (*withdrawalsModel.Withdrawals, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetWithdrawals(UserID, currency string) ([]withdrawalsModel.Withdrawals, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) TransferPoints(UserID, login string, sum money.Money) (*transferModel.Transfer, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetTransfers(UserID string) ([]transferModel.Transfer, error) {
 	return nil, nil
 }
-func (m *mockDBStorage) CalcAmounts(offset, limit int, updF func(nums []int64) map[int64]db.CalcAmountsUpdateResult) (int, error) {
+
+func (m *mockDBStorage) GetReferrals(UserID string) (*referralModel.Referrals, error) {
+	args := m.Called(UserID)
+	return args.Get(0).(*referralModel.Referrals), args.Error(1)
+}
+
+func (m *mockDBStorage) GetStatement(UserID string, from, to *time.Time, offset, limit int) (*statementModel.Statement, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) ReserveIdempotencyKey(UserID, scope, key, requestHash string, ttl, lease time.Duration) (*db.IdempotentResponse, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) SaveIdempotentResponse(UserID, scope, key string, statusCode int, contentType string, body []byte) error {
+	return nil
+}
+
+func (m *mockDBStorage) ReleaseIdempotencyKey(UserID, scope, key string) error {
+	return nil
+}
+
+func (m *mockDBStorage) CalcAmounts(shard db.Shard, providers []string, offset, limit int, updF func(nums []int64) map[int64]db.CalcAmountsUpdateResult) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) ApplyCalcResults(providers []string, updates map[int64]db.CalcAmountsUpdateResult) (int, error) {
 	return 0, nil
 }
 
+func (m *mockDBStorage) SaveCallbackSignature(signature string, ttl time.Duration) error {
+	args := m.Called(signature, ttl)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) TryAcquireLease(instanceID string, shard int) (*db.Lease, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetLeaders() ([]db.Leader, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) CheckLedger() ([]db.LedgerMismatch, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) Reconcile(save bool) (*db.ReconciliationReport, error) {
+	args := m.Called(save)
+	return args.Get(0).(*db.ReconciliationReport), args.Error(1)
+}
+
+func (m *mockDBStorage) Ping() error {
+	return nil
+}
+
+func (m *mockDBStorage) GetOrderHistory(UserID string, number uint64) ([]model.OrderEvent, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) DeadLetterOrders(maxFailedAttempts int) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) GetDeadLetterOrders() ([]model.DeadLetterOrder, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) RetryDeadLetterOrder(number uint64, actor string) error {
+	return nil
+}
+
+func (m *mockDBStorage) ResolveDeadLetterOrder(number uint64, status model.OrderStatus, accrual money.Money, actor, reason string) error {
+	return nil
+}
+
 var logger = zap.NewExample().Sugar()
 
 func Test_handler_GetAccount(t *testing.T) {
 	defaultStorage := new(mockDBStorage)
 	defaultHandler := func() *handler {
-		return &handler{defaultStorage, utils.TestSecret, logger}
+		return &handler{defaultStorage, utils.TestSecret, time.Minute, 0, logger}
 	}
 
 	tests := []struct {
 		name             string
 		code             int
 		token            string
+		query            string
 		getHandler       func() *handler
 		checkResponeBody func(res *http.Response)
 	}{
@@ -86,14 +259,56 @@ func Test_handler_GetAccount(t *testing.T) {
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
 
-				storage.On("GetAccount", "1").Return(accountModel.Account{UserID: "1", Current: 10, Withdrawn: 10}, nil)
+				storage.On("GetAccount", "1", "").Return(accountModel.Account{UserID: "1", Current: money.MustParse("10.29"), Withdrawn: money.MustParse("10")}, nil)
 				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
 			},
 			checkResponeBody: func(res *http.Response) {
-				var result accountApi.Account
-				json.NewDecoder(res.Body).Decode(&result)
-
-				assert.Equal(t, accountApi.Account{Current: 10, Withdrawn: 10}, result, "wrong response")
+				body, _ := io.ReadAll(res.Body)
+				assert.JSONEq(t, `{"current": 10.29, "withdrawn": 10, "held": 0}`, string(body), "wrong response")
+			},
+		},
+		{
+			name:  "уровень и баллы, которые скоро сгорят",
+			code:  200,
+			token: utils.TestToken,
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				expiresAt, _ := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+				tier := "gold"
+				storage.On("GetAccount", "1", "").Return(accountModel.Account{UserID: "1", Current: money.MustParse("10.29"), Tier: &tier}, nil)
+				storage.On("GetExpiringPoints", "1", "", time.Hour).Return([]accountModel.ExpiringPoints{{Sum: money.MustParse("5"), ExpiresAt: expiresAt}}, nil)
+				return &handler{db: storage, secret: utils.TestSecret, expiringWithin: time.Hour, logger: logger}
+			},
+			checkResponeBody: func(res *http.Response) {
+				body, _ := io.ReadAll(res.Body)
+				assert.JSONEq(t, `{"current": 10.29, "withdrawn": 0, "held": 0, "tier": "gold",
+					"expiring_soon": [{"sum": 5, "expires_at": "2020-12-10T15:15:45+03:00"}]}`, string(body), "wrong response")
+			},
+		},
+		{
+			name:  "баланс в валюте партнёра",
+			code:  200,
+			token: utils.TestToken,
+			query: "?currency=MILES",
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("GetAccount", "1", "MILES").Return(accountModel.Account{UserID: "1", Currency: "MILES", Current: money.MustParse("7")}, nil)
+				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
+			},
+			checkResponeBody: func(res *http.Response) {
+				body, _ := io.ReadAll(res.Body)
+				assert.JSONEq(t, `{"currency": "MILES", "current": 7, "withdrawn": 0, "held": 0}`, string(body), "wrong response")
+			},
+		},
+		{
+			name:  "неизвестная валюта",
+			code:  400,
+			token: utils.TestToken,
+			query: "?currency=UNKNOWN",
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("GetAccount", "1", "UNKNOWN").Return(accountModel.Account{}, db.ErrUnknownCurrency)
+				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
 			},
 		},
 		{
@@ -102,7 +317,7 @@ func Test_handler_GetAccount(t *testing.T) {
 			token: utils.TestToken,
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
-				storage.On("GetAccount", "1").Return(accountModel.Account{}, db.ErrUserNotFound)
+				storage.On("GetAccount", "1", "").Return(accountModel.Account{}, db.ErrUserNotFound)
 				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
 			},
 			checkResponeBody: func(res *http.Response) {
@@ -123,14 +338,14 @@ func Test_handler_GetAccount(t *testing.T) {
 			token: utils.TestToken,
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
-				storage.On("GetAccount", "1").Return(accountModel.Account{}, errors.New("unexpected exception"))
+				storage.On("GetAccount", "1", "").Return(accountModel.Account{}, errors.New("unexpected exception"))
 				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
 			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			request := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+			request := httptest.NewRequest(http.MethodGet, "/api/user/balance"+tt.query, nil)
 			request.AddCookie(&http.Cookie{Name: "token", Value: tt.token})
 
 			w := httptest.NewRecorder()
@@ -150,7 +365,7 @@ func Test_handler_GetAccount(t *testing.T) {
 func Test_handler_Withdraw(t *testing.T) {
 	defaultStorage := new(mockDBStorage)
 	defaultHandler := func() *handler {
-		return &handler{defaultStorage, utils.TestSecret, logger}
+		return &handler{defaultStorage, utils.TestSecret, time.Minute, 0, logger}
 	}
 	defaultBody := func() string { return `{"order": "79927398713","sum": 5.0}` }
 	var defaultNumber uint64 = 79927398713
@@ -161,6 +376,7 @@ func Test_handler_Withdraw(t *testing.T) {
 		token      string
 		body       func() string
 		getHandler func() *handler
+		respBody   string
 	}{
 		{
 			name: "успешная обработка запроса",
@@ -170,7 +386,7 @@ func Test_handler_Withdraw(t *testing.T) {
 			body:  defaultBody,
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
-				storage.On("WithdrawFromAccount", "1", 5.0, defaultNumber).Return(nil)
+				storage.On("WithdrawFromAccount", "1", "", money.MustParse("5"), defaultNumber).Return(nil)
 				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
 			},
 		},
@@ -181,7 +397,97 @@ func Test_handler_Withdraw(t *testing.T) {
 			body:  defaultBody,
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
-				storage.On("WithdrawFromAccount", "1", 5.0, defaultNumber).Return(db.ErrBalanceLimitExhausted)
+				storage.On("WithdrawFromAccount", "1", "", money.MustParse("5"), defaultNumber).Return(db.ErrBalanceLimitExhausted)
+				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
+			},
+		},
+		{
+			name:  "резервирование баллов",
+			code:  202,
+			token: utils.TestToken,
+			body:  func() string { return `{"order": "79927398713","sum": 5, "hold": true}` },
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("HoldWithdrawal", "1", "", money.MustParse("5"), defaultNumber, time.Minute).Return(nil)
+				return &handler{db: storage, secret: utils.TestSecret, holdTTL: time.Minute, logger: logger}
+			},
+		},
+		{
+			name:  "на счету недостаточно средств для резервирования",
+			code:  402,
+			token: utils.TestToken,
+			body:  func() string { return `{"order": "79927398713","sum": 5, "hold": true}` },
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("HoldWithdrawal", "1", "", money.MustParse("5"), defaultNumber, time.Minute).Return(db.ErrBalanceLimitExhausted)
+				return &handler{db: storage, secret: utils.TestSecret, holdTTL: time.Minute, logger: logger}
+			},
+		},
+		{
+			name:  "списание по номеру заказа уже было",
+			code:  409,
+			token: utils.TestToken,
+			body:  defaultBody,
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("WithdrawFromAccount", "1", "", money.MustParse("5"), defaultNumber).Return(db.ErrDuplicateWithdrawal)
+				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
+			},
+		},
+		{
+			name:  "превышен дневной лимит списаний",
+			code:  403,
+			token: utils.TestToken,
+			body:  defaultBody,
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("WithdrawFromAccount", "1", "", money.MustParse("5"), defaultNumber).Return(db.ErrWithdrawalDailyLimit)
+				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
+			},
+			respBody: `{"code": "DAILY_LIMIT"}`,
+		},
+		{
+			name:  "слишком много списаний за час",
+			code:  429,
+			token: utils.TestToken,
+			body:  func() string { return `{"order": "79927398713","sum": 5, "hold": true}` },
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("HoldWithdrawal", "1", "", money.MustParse("5"), defaultNumber, time.Minute).Return(db.ErrWithdrawalHourlyCount)
+				return &handler{db: storage, secret: utils.TestSecret, holdTTL: time.Minute, logger: logger}
+			},
+			respBody: `{"code": "HOURLY_COUNT"}`,
+		},
+		{
+			name:  "списание в валюте партнёра",
+			code:  200,
+			token: utils.TestToken,
+			body:  func() string { return `{"order": "79927398713","sum": 5, "currency": "MILES"}` },
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("WithdrawFromAccount", "1", "MILES", money.MustParse("5"), defaultNumber).Return(nil)
+				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
+			},
+		},
+		{
+			name:  "списание в неизвестной валюте",
+			code:  400,
+			token: utils.TestToken,
+			body:  func() string { return `{"order": "79927398713","sum": 5, "currency": "UNKNOWN"}` },
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("WithdrawFromAccount", "1", "UNKNOWN", money.MustParse("5"), defaultNumber).Return(db.ErrUnknownCurrency)
+				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
+			},
+		},
+		{
+			name:  "сумма без потери точности",
+			code:  200,
+			token: utils.TestToken,
+			body:  func() string { return `{"order": "79927398713","sum": 0.29}` },
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("WithdrawFromAccount", "1", "", money.Money(29), defaultNumber).Return(nil)
 				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
 			},
 		},
@@ -193,6 +499,27 @@ func Test_handler_Withdraw(t *testing.T) {
 			body:       func() string { return "abc" },
 			getHandler: defaultHandler,
 		},
+		{
+			name:       "неверный формат суммы",
+			code:       400,
+			token:      utils.TestToken,
+			body:       func() string { return `{"order": "79927398713","sum": "5,0"}` },
+			getHandler: defaultHandler,
+		},
+		{
+			name:       "нулевая сумма списания",
+			code:       400,
+			token:      utils.TestToken,
+			body:       func() string { return `{"order": "79927398713","sum": 0}` },
+			getHandler: defaultHandler,
+		},
+		{
+			name:       "отрицательная сумма списания",
+			code:       400,
+			token:      utils.TestToken,
+			body:       func() string { return `{"order": "79927398713","sum": -5}` },
+			getHandler: defaultHandler,
+		},
 		{
 			name: "пользователь не аутентифицирован",
 			code: 401,
@@ -216,7 +543,7 @@ func Test_handler_Withdraw(t *testing.T) {
 			body:  defaultBody,
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
-				storage.On("WithdrawFromAccount", "1", 5.0, defaultNumber).Return(errors.New("unexpected error"))
+				storage.On("WithdrawFromAccount", "1", "", money.MustParse("5"), defaultNumber).Return(errors.New("unexpected error"))
 				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
 			},
 		},
@@ -233,6 +560,10 @@ func Test_handler_Withdraw(t *testing.T) {
 			res := w.Result()
 			defer res.Body.Close()
 			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+			if tt.respBody != "" {
+				body, _ := io.ReadAll(res.Body)
+				assert.JSONEq(t, tt.respBody, string(body), "wrong response")
+			}
 		})
 	}
 }
@@ -1,6 +1,22 @@
 package api
 
+import (
+	"gophermart/internal/money"
+	"time"
+)
+
 type Account struct {
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	// Currency is empty for the platform's own points.
+	Currency  string      `json:"currency,omitempty"`
+	Current   money.Money `json:"current"`
+	Withdrawn money.Money `json:"withdrawn"`
+	Held      money.Money `json:"held"`
+	Tier      string      `json:"tier,omitempty"`
+	// ExpiringSoon are points of Current that expire soon.
+	ExpiringSoon []ExpiringPoints `json:"expiring_soon,omitempty"`
+}
+
+type ExpiringPoints struct {
+	Sum       money.Money `json:"sum"`
+	ExpiresAt time.Time   `json:"expires_at"`
 }
@@ -2,15 +2,35 @@ package db
 
 import (
 	"gophermart/internal/account/model/api"
-	"gophermart/internal/utils"
+	"gophermart/internal/money"
+	"time"
 )
 
 type Account struct {
-	UserID    string `db:"user_id"`
-	Current   int64  `db:"current"`
-	Withdrawn int64  `db:"withdrawn"`
+	UserID    string      `db:"user_id"`
+	Currency  string      `db:"currency"`
+	Current   money.Money `db:"current"`
+	Withdrawn money.Money `db:"withdrawn"`
+	// Held is the sum of pending withdrawals, it is already deducted from Current.
+	Held money.Money `db:"held"`
+	// Tier is the loyalty tier of the user, nil if the user has not reached any.
+	Tier         *string          `db:"tier"`
+	ExpiringSoon []ExpiringPoints `db:"-"`
+}
+
+// ExpiringPoints is the sum of points that expire at the same time.
+type ExpiringPoints struct {
+	Sum       money.Money `db:"sum"`
+	ExpiresAt time.Time   `db:"expires_at"`
 }
 
 func (a *Account) ToAPI() api.Account {
-	return api.Account{Current: utils.GetAPIAccrual(a.Current), Withdrawn: utils.GetAPIAccrual(a.Withdrawn)}
+	account := api.Account{Currency: a.Currency, Current: a.Current, Withdrawn: a.Withdrawn, Held: a.Held}
+	if a.Tier != nil {
+		account.Tier = *a.Tier
+	}
+	for _, p := range a.ExpiringSoon {
+		account.ExpiringSoon = append(account.ExpiringSoon, api.ExpiringPoints{Sum: p.Sum, ExpiresAt: p.ExpiresAt})
+	}
+	return account
 }
@@ -0,0 +1,64 @@
+package accrualsim
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/caarlos0/env/v6"
+)
+
+const (
+	RewardPercent = "%"
+	RewardPoints  = "pt"
+)
+
+// Rule describes reward for orders whose number matches Match regexp.
+// Reward is a percent of Config.OrderAmount when RewardType is "%" and fixed points when "pt".
+type Rule struct {
+	Match      string  `json:"match"`
+	Reward     float64 `json:"reward"`
+	RewardType string  `json:"reward_type"`
+}
+
+type Config struct {
+	Address         string        `env:"ACCRUAL_SIM_ADDRESS" envDefault:"localhost:8081"`
+	RulesFile       string        `env:"ACCRUAL_SIM_RULES_FILE"`
+	OrderAmount     float64       `env:"ACCRUAL_SIM_ORDER_AMOUNT" envDefault:"1000"`
+	Latency         time.Duration `env:"ACCRUAL_SIM_LATENCY" envDefault:"0s"`
+	RegisteredPolls int           `env:"ACCRUAL_SIM_REGISTERED_POLLS" envDefault:"1"`
+	ProcessingPolls int           `env:"ACCRUAL_SIM_PROCESSING_POLLS" envDefault:"1"`
+	InvalidRate     float64       `env:"ACCRUAL_SIM_INVALID_RATE" envDefault:"0"`
+	// UnregisteredRate is a share of numbers never registered in the simulator, they get 204.
+	UnregisteredRate float64 `env:"ACCRUAL_SIM_UNREGISTERED_RATE" envDefault:"0"`
+	TooManyRate      float64 `env:"ACCRUAL_SIM_429_RATE" envDefault:"0"`
+	InternalErrRate  float64 `env:"ACCRUAL_SIM_500_RATE" envDefault:"0"`
+	RetryAfter       int     `env:"ACCRUAL_SIM_RETRY_AFTER" envDefault:"60"`
+	Seed             int64   `env:"ACCRUAL_SIM_SEED" envDefault:"1"`
+	BatchDisabled    bool    `env:"ACCRUAL_SIM_BATCH_DISABLED" envDefault:"false"`
+	Rules            []Rule
+}
+
+// DefaultRules rewards every order with 10 percent of the order amount.
+var DefaultRules = []Rule{{Match: ".*", Reward: 10, RewardType: RewardPercent}}
+
+func NewConfig() (*Config, error) {
+	var cfg Config
+	if err := env.Parse(&cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.RulesFile == "" {
+		cfg.Rules = DefaultRules
+		return &cfg, nil
+	}
+
+	data, err := os.ReadFile(cfg.RulesFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &cfg.Rules); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
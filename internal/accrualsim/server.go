@@ -0,0 +1,228 @@
+package accrualsim
+
+import (
+	"encoding/json"
+	"fmt"
+	"gophermart/internal/utils"
+	"math"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const (
+	Registered = "REGISTERED"
+	Processing = "PROCESSING"
+	Invalid    = "INVALID"
+	Processed  = "PROCESSED"
+)
+
+type response struct {
+	Order   string   `json:"order"`
+	Status  string   `json:"status"`
+	Accrual *float64 `json:"accrual,omitempty"`
+}
+
+type compiledRule struct {
+	match *regexp.Regexp
+	Rule
+}
+
+type order struct {
+	unregistered bool
+	polls        int
+	final        string
+	accrual      float64
+}
+
+// Server imitates accrual system: every order but unregistered ones becomes known on the first request
+// and goes REGISTERED -> PROCESSING -> PROCESSED/INVALID as it is polled.
+type Server struct {
+	cfg    *Config
+	rules  []compiledRule
+	mu     sync.Mutex
+	orders map[string]*order
+	rnd    *rand.Rand
+}
+
+func NewServer(cfg *Config) (*Server, error) {
+	rules := make([]compiledRule, len(cfg.Rules))
+	for i, r := range cfg.Rules {
+		if r.RewardType != RewardPercent && r.RewardType != RewardPoints {
+			return nil, fmt.Errorf("rule %v: unknown reward type %q", r.Match, r.RewardType)
+		}
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rule %v: %w", r.Match, err)
+		}
+		rules[i] = compiledRule{re, r}
+	}
+	return &Server{
+		cfg:    cfg,
+		rules:  rules,
+		orders: make(map[string]*order),
+		rnd:    rand.New(rand.NewSource(cfg.Seed)),
+	}, nil
+}
+
+func (s *Server) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/api/orders/{number}", s.GetOrder)
+	if !s.cfg.BatchDisabled {
+		r.Post("/api/orders/batch", s.PostOrdersBatch)
+	}
+	return r
+}
+
+func (s *Server) GetOrder(w http.ResponseWriter, r *http.Request) {
+	if !s.wait(r) {
+		return
+	}
+
+	number := chi.URLParam(r, "number")
+	n, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail(w) {
+		return
+	}
+
+	resp, ok := s.poll(number, n)
+	if !ok {
+		// 204 — заказ не зарегистрирован в системе расчёта
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// PostOrdersBatch accepts an array of order numbers and responds with an array of their statuses,
+// unregistered orders are left out, failures are simulated for the whole batch.
+func (s *Server) PostOrdersBatch(w http.ResponseWriter, r *http.Request) {
+	if !s.wait(r) {
+		return
+	}
+
+	var numbers []string
+	if err := json.NewDecoder(r.Body).Decode(&numbers); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	parsed := make([]uint64, len(numbers))
+	for i, number := range numbers {
+		n, err := strconv.ParseUint(number, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		parsed[i] = n
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail(w) {
+		return
+	}
+
+	resp := make([]response, 0, len(numbers))
+	for i, number := range numbers {
+		if r, ok := s.poll(number, parsed[i]); ok {
+			resp = append(resp, r)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// wait simulates latency, it returns false when the client has gone.
+func (s *Server) wait(r *http.Request) bool {
+	if s.cfg.Latency > 0 {
+		select {
+		case <-time.After(s.cfg.Latency):
+		case <-r.Context().Done():
+			return false
+		}
+	}
+	return true
+}
+
+// fail writes 429 or 500 response according to configured rates.
+func (s *Server) fail(w http.ResponseWriter) bool {
+	roll := s.rnd.Float64()
+	if roll < s.cfg.TooManyRate {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Retry-After", strconv.Itoa(s.cfg.RetryAfter))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, "No more than N requests per minute allowed")
+		return true
+	}
+	if roll < s.cfg.TooManyRate+s.cfg.InternalErrRate {
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+	return false
+}
+
+// poll returns false for unregistered orders.
+func (s *Server) poll(number string, n uint64) (response, bool) {
+	o, ok := s.orders[number]
+	if !ok {
+		o = s.register(number, n)
+		s.orders[number] = o
+	}
+	if o.unregistered {
+		return response{}, false
+	}
+	o.polls++
+
+	resp := response{Order: number}
+	switch {
+	case o.polls <= s.cfg.RegisteredPolls:
+		resp.Status = Registered
+	case o.polls <= s.cfg.RegisteredPolls+s.cfg.ProcessingPolls:
+		resp.Status = Processing
+	default:
+		resp.Status = o.final
+		if o.final == Processed {
+			accrual := o.accrual
+			resp.Accrual = &accrual
+		}
+	}
+	return resp, true
+}
+
+func (s *Server) register(number string, n uint64) *order {
+	// the rate is rolled only when set, so the seed gives the same orders as before the rate existed
+	if s.cfg.UnregisteredRate > 0 && s.rnd.Float64() < s.cfg.UnregisteredRate {
+		return &order{unregistered: true}
+	}
+	if !utils.IsValidOrder(n) || s.rnd.Float64() < s.cfg.InvalidRate {
+		return &order{final: Invalid}
+	}
+	for _, r := range s.rules {
+		if !r.match.MatchString(number) {
+			continue
+		}
+		accrual := r.Reward
+		if r.RewardType == RewardPercent {
+			accrual = s.cfg.OrderAmount * r.Reward / 100
+		}
+		return &order{final: Processed, accrual: math.Round(accrual*100) / 100}
+	}
+	return &order{final: Invalid}
+}
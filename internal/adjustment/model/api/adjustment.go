@@ -0,0 +1,36 @@
+package api
+
+import (
+	"gophermart/internal/money"
+	"time"
+)
+
+const (
+	Applied = "APPLIED"
+	// Pending adjustments above the approval threshold wait for another admin.
+	Pending  = "PENDING"
+	Rejected = "REJECTED"
+)
+
+// Adjustment is a manual credit, or a debit when Amount is negative, of the user's balance.
+type Adjustment struct {
+	ID        int64             `json:"id"`
+	Login     string            `json:"login"`
+	Amount    money.Money       `json:"amount"`
+	Reason    string            `json:"reason"`
+	Ticket    string            `json:"ticket"`
+	Status    string            `json:"status"`
+	CreatedBy string            `json:"created_by"`
+	CreatedAt time.Time         `json:"created_at"`
+	DecidedBy string            `json:"decided_by,omitempty"`
+	DecidedAt *time.Time        `json:"decided_at,omitempty"`
+	History   []AdjustmentEvent `json:"history,omitempty"`
+}
+
+// AdjustmentEvent is a change of the adjustment status made by Actor.
+type AdjustmentEvent struct {
+	Status    string    `json:"status"`
+	Actor     string    `json:"actor"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
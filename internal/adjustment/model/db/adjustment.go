@@ -0,0 +1,73 @@
+package db
+
+import (
+	"gophermart/internal/adjustment/model/api"
+	"gophermart/internal/money"
+	"time"
+)
+
+type AdjustmentStatus int
+
+const (
+	Applied AdjustmentStatus = iota
+	Pending
+	Rejected
+)
+
+var statusNames = map[AdjustmentStatus]string{
+	Applied:  api.Applied,
+	Pending:  api.Pending,
+	Rejected: api.Rejected,
+}
+
+func (s AdjustmentStatus) ToAPI() string {
+	return statusNames[s]
+}
+
+type Adjustment struct {
+	ID        int64            `db:"id"`
+	UserID    string           `db:"user_id"`
+	Login     string           `db:"login"`
+	Amount    money.Money      `db:"amount"`
+	Reason    string           `db:"reason"`
+	Ticket    string           `db:"ticket"`
+	Status    AdjustmentStatus `db:"status"`
+	CreatedBy string           `db:"created_by"`
+	CreatedAt time.Time        `db:"created_at"`
+	DecidedBy *string          `db:"decided_by"`
+	DecidedAt *time.Time       `db:"decided_at"`
+	// History is the audit trail, it is loaded only for a single adjustment.
+	History []AdjustmentEvent `db:"-"`
+}
+
+type AdjustmentEvent struct {
+	Status    AdjustmentStatus `db:"status"`
+	Actor     string           `db:"actor"`
+	Comment   *string          `db:"comment"`
+	CreatedAt time.Time        `db:"created_at"`
+}
+
+func (a *Adjustment) ToAPI() api.Adjustment {
+	adjustment := api.Adjustment{
+		ID:        a.ID,
+		Login:     a.Login,
+		Amount:    a.Amount,
+		Reason:    a.Reason,
+		Ticket:    a.Ticket,
+		Status:    a.Status.ToAPI(),
+		CreatedBy: a.CreatedBy,
+		CreatedAt: a.CreatedAt,
+		DecidedAt: a.DecidedAt,
+	}
+	if a.DecidedBy != nil {
+		adjustment.DecidedBy = *a.DecidedBy
+	}
+	for _, e := range a.History {
+		event := api.AdjustmentEvent{Status: e.Status.ToAPI(), Actor: e.Actor, CreatedAt: e.CreatedAt}
+		if e.Comment != nil {
+			event.Comment = *e.Comment
+		}
+		adjustment.History = append(adjustment.History, event)
+	}
+	return adjustment
+}
@@ -0,0 +1,162 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"gophermart/internal/adjustment/model/api"
+	"gophermart/internal/db"
+	"gophermart/internal/money"
+	"net/http"
+	"strconv"
+
+	adjustmentModel "gophermart/internal/adjustment/model/db"
+
+	"github.com/go-chi/chi"
+)
+
+type adjustmentData struct {
+	Login string `json:"login"`
+	// Amount is credited to the user, negative amount is debited.
+	Amount money.Money `json:"amount"`
+	Reason string      `json:"reason"`
+	// Ticket is the support ticket the adjustment is made for.
+	Ticket string `json:"ticket"`
+}
+
+// PostAdjustment credits or debits the balance of the user, adjustments above the approval threshold
+// are applied once another admin approves them.
+func (h *handler) PostAdjustment(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := h.auth(w, r)
+	if !ok {
+		return
+	}
+	var data adjustmentData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Login == "" || data.Amount == 0 ||
+		data.Reason == "" || data.Ticket == "" {
+		// 400 — неверный формат запроса, причина и номер обращения обязательны.
+		h.logger.Warnf("failed to PostAdjustment: bad request %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if adjustment, err := h.db.CreateAdjustment(data.Login, data.Amount, data.Reason, data.Ticket, adminID); err != nil {
+		h.writeAdjustmentErr(w, "PostAdjustment", err)
+	} else if adjustment.Status == adjustmentModel.Pending {
+		// 202 — корректировка ждёт подтверждения другим администратором.
+		h.logger.Infof("admin %v requested adjustment %v of %v by %v: %v", adminID, adjustment.ID, data.Login, data.Amount, data.Ticket)
+		h.writeAdjustment(w, http.StatusAccepted, adjustment)
+	} else {
+		h.logger.Infof("admin %v adjusted %v by %v: %v", adminID, data.Login, data.Amount, data.Ticket)
+		h.writeAdjustment(w, http.StatusOK, adjustment)
+	}
+}
+
+func (h *handler) GetAdjustments(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.auth(w, r); !ok {
+		return
+	}
+	if adjustments, err := h.db.GetAdjustments(); err != nil {
+		// 500 — внутренняя ошибка сервера.
+		h.logger.Errorf("failed to GetAdjustments: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	} else if len(adjustments) == 0 {
+		// 204 — нет данных для ответа.
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		apiAdjustments := make([]api.Adjustment, len(adjustments))
+		for i := 0; i < len(adjustments); i++ {
+			apiAdjustments[i] = adjustments[i].ToAPI()
+		}
+		json.NewEncoder(w).Encode(apiAdjustments)
+	}
+}
+
+// GetAdjustment returns the adjustment with its history.
+func (h *handler) GetAdjustment(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.auth(w, r); !ok {
+		return
+	}
+	if id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64); err != nil {
+		// 400 — неверный формат идентификатора корректировки.
+		h.logger.Warnf("failed to GetAdjustment: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if adjustment, err := h.db.GetAdjustment(id); err != nil {
+		h.writeAdjustmentErr(w, "GetAdjustment", err)
+	} else {
+		h.writeAdjustment(w, http.StatusOK, adjustment)
+	}
+}
+
+// PostApproveAdjustment applies the pending adjustment created by another admin.
+func (h *handler) PostApproveAdjustment(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := h.auth(w, r)
+	if !ok {
+		return
+	}
+	if id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64); err != nil {
+		// 400 — неверный формат идентификатора корректировки.
+		h.logger.Warnf("failed to PostApproveAdjustment: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if adjustment, err := h.db.ApproveAdjustment(id, adminID); err != nil {
+		h.writeAdjustmentErr(w, "PostApproveAdjustment", err)
+	} else {
+		h.logger.Infof("admin %v approved adjustment %v", adminID, id)
+		h.writeAdjustment(w, http.StatusOK, adjustment)
+	}
+}
+
+type rejectAdjustmentData struct {
+	Reason string `json:"reason"`
+}
+
+// PostRejectAdjustment rejects the pending adjustment.
+func (h *handler) PostRejectAdjustment(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := h.auth(w, r)
+	if !ok {
+		return
+	}
+	var data rejectAdjustmentData
+	if id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64); err != nil {
+		// 400 — неверный формат идентификатора корректировки.
+		h.logger.Warnf("failed to PostRejectAdjustment: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Reason == "" {
+		// 400 — неверный формат запроса, причина обязательна.
+		h.logger.Warnf("failed to PostRejectAdjustment: bad request %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if adjustment, err := h.db.RejectAdjustment(id, adminID, data.Reason); err != nil {
+		h.writeAdjustmentErr(w, "PostRejectAdjustment", err)
+	} else {
+		h.logger.Infof("admin %v rejected adjustment %v: %v", adminID, id, data.Reason)
+		h.writeAdjustment(w, http.StatusOK, adjustment)
+	}
+}
+
+func (h *handler) writeAdjustment(w http.ResponseWriter, statusCode int, adjustment *adjustmentModel.Adjustment) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(adjustment.ToAPI())
+}
+
+func (h *handler) writeAdjustmentErr(w http.ResponseWriter, method string, err error) {
+	if errors.Is(err, db.ErrUserNotFound) || errors.Is(err, db.ErrAdjustmentNotFound) {
+		// 404 — пользователь или корректировка не найдены.
+		h.logger.Warnf("failed to %v: %v", method, err)
+		w.WriteHeader(http.StatusNotFound)
+	} else if errors.Is(err, db.ErrBalanceLimitExhausted) {
+		// 402 — на счету недостаточно средств для списания.
+		h.logger.Warnf("failed to %v: %v", method, err)
+		w.WriteHeader(http.StatusPaymentRequired)
+	} else if errors.Is(err, db.ErrAdjustmentSelfApproval) {
+		// 403 — корректировку подтверждает другой администратор.
+		h.logger.Warnf("failed to %v: %v", method, err)
+		w.WriteHeader(http.StatusForbidden)
+	} else if errors.Is(err, db.ErrAdjustmentNotPending) {
+		// 409 — корректировка уже применена или отклонена.
+		h.logger.Warnf("failed to %v: %v", method, err)
+		w.WriteHeader(http.StatusConflict)
+	} else {
+		// 500 — внутренняя ошибка сервера.
+		h.logger.Errorf("failed to %v: %v", method, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
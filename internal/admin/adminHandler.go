@@ -0,0 +1,200 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"gophermart/internal/db"
+	"gophermart/internal/money"
+	"gophermart/internal/order/model"
+	"gophermart/internal/order/model/api"
+	"gophermart/internal/utils"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+)
+
+type handler struct {
+	db     db.Storage
+	secret string
+	admins []string
+	logger *zap.SugaredLogger
+}
+
+func NewHandler(db db.Storage, secret string, admins []string, logger *zap.SugaredLogger) *handler {
+	return &handler{db, secret, admins, logger}
+}
+
+// auth writes 401 or 403 and returns false when the request is not made by an admin.
+func (h *handler) auth(w http.ResponseWriter, r *http.Request) (string, bool) {
+	adminID, isAuthed, isAdmin := utils.GetAdminID(r, h.secret, h.admins)
+	if !isAuthed {
+		// 401 — пользователь не авторизован.
+		h.logger.Warn("failed to auth admin")
+		w.WriteHeader(http.StatusUnauthorized)
+		return "", false
+	}
+	if !isAdmin {
+		// 403 — пользователь не администратор.
+		h.logger.Warnf("user %v is not admin", adminID)
+		w.WriteHeader(http.StatusForbidden)
+		return "", false
+	}
+	return adminID, true
+}
+
+func (h *handler) GetDeadLetterOrders(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.auth(w, r); !ok {
+		return
+	}
+	if orders, err := h.db.GetDeadLetterOrders(); err != nil {
+		// 500 — внутренняя ошибка сервера.
+		h.logger.Errorf("failed to GetDeadLetterOrders: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	} else if len(orders) == 0 {
+		// 204 — нет данных для ответа.
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		apiOrders := make([]api.DeadLetterOrder, len(orders))
+		for i := 0; i < len(orders); i++ {
+			apiOrders[i] = orders[i].ToAPI()
+		}
+		json.NewEncoder(w).Encode(apiOrders)
+	}
+}
+
+func (h *handler) PostRetryOrder(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := h.auth(w, r)
+	if !ok {
+		return
+	}
+	if number, err := strconv.ParseUint(chi.URLParam(r, "number"), 10, 64); err != nil {
+		// 400 — неверный формат номера заказа.
+		h.logger.Warnf("failed to PostRetryOrder: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if err := h.db.RetryDeadLetterOrder(number, adminID); err != nil {
+		h.writeOrderErr(w, "PostRetryOrder", err)
+	} else {
+		h.logger.Infof("admin %v returned dead letter order %v to processing", adminID, number)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type resolveData struct {
+	Status  string      `json:"status"`
+	Accrual money.Money `json:"accrual"`
+	Reason  string      `json:"reason"`
+}
+
+func (h *handler) PostResolveOrder(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := h.auth(w, r)
+	if !ok {
+		return
+	}
+	var data resolveData
+	if number, err := strconv.ParseUint(chi.URLParam(r, "number"), 10, 64); err != nil {
+		// 400 — неверный формат номера заказа.
+		h.logger.Warnf("failed to PostResolveOrder: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Reason == "" || data.Accrual < 0 {
+		// 400 — неверный формат запроса, причина обязательна.
+		h.logger.Warnf("failed to PostResolveOrder: bad request %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if status, ok := model.ParseFinalStatus(data.Status); !ok {
+		// 400 — заказ можно перевести только в PROCESSED или INVALID.
+		h.logger.Warnf("failed to PostResolveOrder: bad status %q", data.Status)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if err := h.db.ResolveDeadLetterOrder(number, status, data.Accrual, adminID, data.Reason); err != nil {
+		h.writeOrderErr(w, "PostResolveOrder", err)
+	} else {
+		h.logger.Infof("admin %v resolved dead letter order %v as %v: %v", adminID, number, data.Status, data.Reason)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type refundData struct {
+	// Sum is the refunded part of the withdrawal, zero refunds the rest of it.
+	Sum    money.Money `json:"sum"`
+	Reason string      `json:"reason"`
+}
+
+// PostRefundWithdrawal credits the withdrawal sum or a part of it back to the user.
+func (h *handler) PostRefundWithdrawal(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := h.auth(w, r)
+	if !ok {
+		return
+	}
+	var data refundData
+	if number, err := strconv.ParseUint(chi.URLParam(r, "number"), 10, 64); err != nil {
+		// 400 — неверный формат номера заказа.
+		h.logger.Warnf("failed to PostRefundWithdrawal: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Reason == "" || data.Sum < 0 {
+		// 400 — неверный формат запроса, причина обязательна.
+		h.logger.Warnf("failed to PostRefundWithdrawal: bad request %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if withdrawal, err := h.db.RefundWithdrawal(number, data.Sum, adminID, data.Reason); err != nil {
+		WriteRefundErr(w, h.logger, err)
+	} else {
+		h.logger.Infof("admin %v refunded withdrawal %v: %v", adminID, number, data.Reason)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(withdrawal.ToAPI())
+	}
+}
+
+// WriteRefundErr writes the status of failed refund.
+func WriteRefundErr(w http.ResponseWriter, logger *zap.SugaredLogger, err error) {
+	if errors.Is(err, db.ErrWithdrawalNotFound) {
+		// 404 — списание не найдено.
+		logger.Warnf("failed to refund withdrawal: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+	} else if errors.Is(err, db.ErrWithdrawalNotRefundable) {
+		// 409 — списание не проведено или уже возвращено полностью.
+		logger.Warnf("failed to refund withdrawal: %v", err)
+		w.WriteHeader(http.StatusConflict)
+	} else if errors.Is(err, db.ErrRefundExceedsWithdrawal) {
+		// 422 — сумма возврата больше невозвращённой суммы списания.
+		logger.Warnf("failed to refund withdrawal: %v", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	} else {
+		// 500 — внутренняя ошибка сервера.
+		logger.Errorf("failed to refund withdrawal: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// GetLedgerCheck lists accounts whose balance differs from the sum of their ledger entries.
+func (h *handler) GetLedgerCheck(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.auth(w, r); !ok {
+		return
+	}
+	if mismatches, err := h.db.CheckLedger(); err != nil {
+		// 500 — внутренняя ошибка сервера.
+		h.logger.Errorf("failed to GetLedgerCheck: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	} else if len(mismatches) == 0 {
+		// 204 — балансы сходятся с журналом проводок.
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		h.logger.Warnf("%v accounts differ from the ledger", len(mismatches))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(mismatches)
+	}
+}
+
+func (h *handler) writeOrderErr(w http.ResponseWriter, method string, err error) {
+	if errors.Is(err, db.ErrOrderNotFound) {
+		// 404 — заказ не найден среди недоставленных.
+		h.logger.Warnf("failed to %v: %v", method, err)
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		// 500 — внутренняя ошибка сервера.
+		h.logger.Errorf("failed to %v: %v", method, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
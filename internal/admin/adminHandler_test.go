@@ -0,0 +1,828 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"gophermart/internal/db"
+	"gophermart/internal/money"
+	"gophermart/internal/order/model"
+	"gophermart/internal/order/model/api"
+	"gophermart/internal/utils"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	accountModel "gophermart/internal/account/model/db"
+	adjustmentModel "gophermart/internal/adjustment/model/db"
+	campaignModel "gophermart/internal/campaign/model/db"
+	referralModel "gophermart/internal/referral/model/db"
+	statementModel "gophermart/internal/statement/model/db"
+	transferModel "gophermart/internal/transfer/model/db"
+	withdrawalsModel "gophermart/internal/withdrawals/model/db"
+
+	"github.com/go-chi/chi"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.uber.org/zap"
+)
+
+type mockDBStorage struct {
+	mock.Mock
+}
+
+func (m *mockDBStorage) Register(login, password, referralCode, ip string) (string, error) {
+	return "", nil
+}
+
+func (m *mockDBStorage) GetByLoginPassword(login string, password string) (string, error) {
+	return "", nil
+}
+
+func (m *mockDBStorage) SaveOrder(UserID string, number uint64, merchantID, provider string) error {
+	return nil
+}
+
+func (m *mockDBStorage) GetOrders(UserID string) ([]model.Order, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetAccount(UserID, currency string) (*accountModel.Account, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) WithdrawFromAccount(UserID, currency string, sum money.Money, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) HoldWithdrawal(UserID, currency string, sum money.Money, number uint64, ttl time.Duration) error {
+	return nil
+}
+
+func (m *mockDBStorage) ConfirmWithdrawal(UserID string, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) CancelWithdrawal(UserID string, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) ExpireWithdrawals() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) ExpirePoints() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) RecalculateTiers() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) CreateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaigns() ([]campaignModel.Campaign, error) {
+	args := m.Called()
+	return args.Get(0).([]campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaign(ID int64) (*campaignModel.Campaign, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) UpdateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) DeleteCampaign(ID int64) error {
+	args := m.Called(ID)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) CreateAdjustment(login string, amount money.Money, reason, ticket, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(login, amount, reason, ticket, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) ApproveAdjustment(ID int64, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) RejectAdjustment(ID int64, actor, reason string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor, reason)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustments() ([]adjustmentModel.Adjustment, error) {
+	args := m.Called()
+	return args.Get(0).([]adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustment(ID int64) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetExpiringPoints(UserID, currency string, within time.Duration) ([]accountModel.ExpiringPoints, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) RefundWithdrawal(number uint64, sum money.Money, actor, reason string) (*withdrawalsModel.Withdrawals, error) {
+	args := m.Called(number, sum, actor, reason)
+	return args.Get(0).(*withdrawalsModel.Withdrawals), args.Error(1)
+}
+
+func (m *mockDBStorage) GetWithdrawals(UserID, currency string) ([]withdrawalsModel.Withdrawals, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) TransferPoints(UserID, login string, sum money.Money) (*transferModel.Transfer, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetTransfers(UserID string) ([]transferModel.Transfer, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetReferrals(UserID string) (*referralModel.Referrals, error) {
+	args := m.Called(UserID)
+	return args.Get(0).(*referralModel.Referrals), args.Error(1)
+}
+
+func (m *mockDBStorage) GetStatement(UserID string, from, to *time.Time, offset, limit int) (*statementModel.Statement, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) ReserveIdempotencyKey(UserID, scope, key, requestHash string, ttl, lease time.Duration) (*db.IdempotentResponse, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) SaveIdempotentResponse(UserID, scope, key string, statusCode int, contentType string, body []byte) error {
+	return nil
+}
+
+func (m *mockDBStorage) ReleaseIdempotencyKey(UserID, scope, key string) error {
+	return nil
+}
+
+func (m *mockDBStorage) CalcAmounts(shard db.Shard, providers []string, offset, limit int,
+	updF func(nums []int64) map[int64]db.CalcAmountsUpdateResult) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) ApplyCalcResults(providers []string, updates map[int64]db.CalcAmountsUpdateResult) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) SaveCallbackSignature(signature string, ttl time.Duration) error {
+	args := m.Called(signature, ttl)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) TryAcquireLease(instanceID string, shard int) (*db.Lease, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetLeaders() ([]db.Leader, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) CheckLedger() ([]db.LedgerMismatch, error) {
+	args := m.Called()
+	return args.Get(0).([]db.LedgerMismatch), args.Error(1)
+}
+
+func (m *mockDBStorage) Reconcile(save bool) (*db.ReconciliationReport, error) {
+	args := m.Called(save)
+	return args.Get(0).(*db.ReconciliationReport), args.Error(1)
+}
+
+func (m *mockDBStorage) Ping() error {
+	return nil
+}
+
+func (m *mockDBStorage) GetOrderHistory(UserID string, number uint64) ([]model.OrderEvent, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) DeadLetterOrders(maxFailedAttempts int) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) GetDeadLetterOrders() ([]model.DeadLetterOrder, error) {
+	args := m.Called()
+	return args.Get(0).([]model.DeadLetterOrder), args.Error(1)
+}
+
+func (m *mockDBStorage) RetryDeadLetterOrder(number uint64, actor string) error {
+	args := m.Called(number, actor)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) ResolveDeadLetterOrder(number uint64, status model.OrderStatus, accrual money.Money, actor, reason string) error {
+	args := m.Called(number, status, accrual, actor, reason)
+	return args.Error(0)
+}
+
+var logger = zap.NewExample().Sugar()
+
+var admins = []string{"1"}
+
+func withNumber(r *http.Request, number string) *http.Request {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("number", number)
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+}
+
+func Test_handler_GetDeadLetterOrders(t *testing.T) {
+	defaultStorage := new(mockDBStorage)
+	defaultHandler := func() *handler {
+		return &handler{defaultStorage, utils.TestSecret, admins, logger}
+	}
+
+	tests := []struct {
+		name             string
+		code             int
+		token            string
+		getHandler       func() *handler
+		checkResponeBody func(res *http.Response)
+	}{
+		{
+			name:  "успешная обработка запроса",
+			code:  200,
+			token: utils.TestToken,
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				lastError := "accrual system responded 500 Internal Server Error"
+				order := model.DeadLetterOrder{
+					Order:          *model.NewOrder(79927398713, "2", model.DeadLetter, 0),
+					Attempts:       120,
+					FailedAttempts: 100,
+					LastError:      &lastError,
+				}
+				order.UploadedAt, _ = time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+				storage.On("GetDeadLetterOrders").Return([]model.DeadLetterOrder{order}, nil)
+				return &handler{storage, utils.TestSecret, admins, logger}
+			},
+			checkResponeBody: func(res *http.Response) {
+				uploadedAt, _ := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+				expected := []api.DeadLetterOrder{{
+					Number:         "79927398713",
+					UserID:         "2",
+					Status:         "DEAD_LETTER",
+					UploadedAt:     uploadedAt,
+					Attempts:       120,
+					FailedAttempts: 100,
+					LastError:      "accrual system responded 500 Internal Server Error",
+				}}
+				var result []api.DeadLetterOrder
+				json.NewDecoder(res.Body).Decode(&result)
+				assert.Equal(t, expected, result, "wrong response")
+			},
+		},
+		{
+			name:  "нет данных для ответа",
+			code:  204,
+			token: utils.TestToken,
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("GetDeadLetterOrders").Return([]model.DeadLetterOrder{}, nil)
+				return &handler{storage, utils.TestSecret, admins, logger}
+			},
+			checkResponeBody: func(res *http.Response) {
+				var result []api.DeadLetterOrder
+				e := json.NewDecoder(res.Body).Decode(&result)
+				assert.ErrorIs(t, e, io.EOF)
+			},
+		},
+		{
+			name:       "пользователь не аутентифицирован",
+			code:       401,
+			token:      "wrong token",
+			getHandler: defaultHandler,
+		},
+		{
+			name:  "пользователь не администратор",
+			code:  403,
+			token: utils.TestToken,
+			getHandler: func() *handler {
+				return &handler{defaultStorage, utils.TestSecret, []string{"2"}, logger}
+			},
+		},
+		{
+			name:  "внутренняя ошибка сервера.",
+			code:  500,
+			token: utils.TestToken,
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("GetDeadLetterOrders").Return([]model.DeadLetterOrder{}, errors.New("unexpected exception"))
+				return &handler{storage, utils.TestSecret, admins, logger}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/admin/orders/dead-letter", nil)
+			request.AddCookie(&http.Cookie{Name: "token", Value: tt.token})
+
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc(tt.getHandler().GetDeadLetterOrders)
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+			if tt.checkResponeBody != nil {
+				tt.checkResponeBody(res)
+			}
+
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+		})
+	}
+}
+
+func Test_handler_PostRetryOrder(t *testing.T) {
+	defaultStorage := new(mockDBStorage)
+	defaultHandler := func() *handler {
+		return &handler{defaultStorage, utils.TestSecret, admins, logger}
+	}
+	var defaultNumber uint64 = 79927398713
+
+	tests := []struct {
+		name       string
+		code       int
+		token      string
+		number     string
+		getHandler func() *handler
+	}{
+		{
+			name:   "заказ возвращён в обработку",
+			code:   200,
+			token:  utils.TestToken,
+			number: "79927398713",
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("RetryDeadLetterOrder", defaultNumber, "1").Return(nil)
+				return &handler{storage, utils.TestSecret, admins, logger}
+			},
+		},
+		{
+			name:       "неверный формат номера заказа",
+			code:       400,
+			token:      utils.TestToken,
+			number:     "abc",
+			getHandler: defaultHandler,
+		},
+		{
+			name:       "пользователь не аутентифицирован",
+			code:       401,
+			token:      "wrong token",
+			number:     "79927398713",
+			getHandler: defaultHandler,
+		},
+		{
+			name:   "пользователь не администратор",
+			code:   403,
+			token:  utils.TestToken,
+			number: "79927398713",
+			getHandler: func() *handler {
+				return &handler{defaultStorage, utils.TestSecret, nil, logger}
+			},
+		},
+		{
+			name:   "заказ не найден",
+			code:   404,
+			token:  utils.TestToken,
+			number: "79927398713",
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("RetryDeadLetterOrder", defaultNumber, "1").Return(db.ErrOrderNotFound)
+				return &handler{storage, utils.TestSecret, admins, logger}
+			},
+		},
+		{
+			name:   "внутренняя ошибка сервера.",
+			code:   500,
+			token:  utils.TestToken,
+			number: "79927398713",
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("RetryDeadLetterOrder", defaultNumber, "1").Return(errors.New("unexpected exception"))
+				return &handler{storage, utils.TestSecret, admins, logger}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/admin/orders/"+tt.number+"/retry", nil)
+			request.AddCookie(&http.Cookie{Name: "token", Value: tt.token})
+			request = withNumber(request, tt.number)
+
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc(tt.getHandler().PostRetryOrder)
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+		})
+	}
+}
+
+func Test_handler_PostResolveOrder(t *testing.T) {
+	defaultStorage := new(mockDBStorage)
+	defaultHandler := func() *handler {
+		return &handler{defaultStorage, utils.TestSecret, admins, logger}
+	}
+	var defaultNumber uint64 = 79927398713
+	defaultBody := `{"status": "PROCESSED", "accrual": 12.5, "reason": "accrual confirmed by partner"}`
+
+	tests := []struct {
+		name       string
+		code       int
+		token      string
+		body       string
+		getHandler func() *handler
+	}{
+		{
+			name:  "заказ переведён в PROCESSED",
+			code:  200,
+			token: utils.TestToken,
+			body:  defaultBody,
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("ResolveDeadLetterOrder", defaultNumber, model.Processed, money.MustParse("12.5"), "1", "accrual confirmed by partner").Return(nil)
+				return &handler{storage, utils.TestSecret, admins, logger}
+			},
+		},
+		{
+			name:  "заказ переведён в INVALID",
+			code:  200,
+			token: utils.TestToken,
+			body:  `{"status": "INVALID", "reason": "rejected by partner"}`,
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("ResolveDeadLetterOrder", defaultNumber, model.Invalid, money.Money(0), "1", "rejected by partner").Return(nil)
+				return &handler{storage, utils.TestSecret, admins, logger}
+			},
+		},
+		{
+			name:       "нет причины",
+			code:       400,
+			token:      utils.TestToken,
+			body:       `{"status": "PROCESSED", "accrual": 12.5}`,
+			getHandler: defaultHandler,
+		},
+		{
+			name:       "недопустимый статус",
+			code:       400,
+			token:      utils.TestToken,
+			body:       `{"status": "PROCESSING", "reason": "reason"}`,
+			getHandler: defaultHandler,
+		},
+		{
+			name:       "пользователь не аутентифицирован",
+			code:       401,
+			token:      "wrong token",
+			body:       defaultBody,
+			getHandler: defaultHandler,
+		},
+		{
+			name:  "заказ не найден",
+			code:  404,
+			token: utils.TestToken,
+			body:  defaultBody,
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("ResolveDeadLetterOrder", defaultNumber, model.Processed, money.MustParse("12.5"), "1", "accrual confirmed by partner").Return(db.ErrOrderNotFound)
+				return &handler{storage, utils.TestSecret, admins, logger}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/admin/orders/79927398713/resolve", bytes.NewReader([]byte(tt.body)))
+			request.Header.Set("Content-Type", "application/json")
+			request.AddCookie(&http.Cookie{Name: "token", Value: tt.token})
+			request = withNumber(request, "79927398713")
+
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc(tt.getHandler().PostResolveOrder)
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+		})
+	}
+}
+
+func Test_handler_GetLedgerCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		code       int
+		mismatches []db.LedgerMismatch
+		err        error
+		body       string
+	}{
+		{
+			name:       "балансы расходятся с журналом",
+			code:       200,
+			mismatches: []db.LedgerMismatch{{UserID: "2", Current: 1050, LedgerCurrent: 1000}},
+			body:       `[{"user_id":"2","current":10.5,"withdrawn":0,"ledger_current":10,"ledger_withdrawn":0,"held":0,"ledger_held":0}]`,
+		},
+		{
+			name:       "балансы сходятся",
+			code:       204,
+			mismatches: []db.LedgerMismatch{},
+		},
+		{
+			name:       "внутренняя ошибка сервера",
+			code:       500,
+			mismatches: []db.LedgerMismatch{},
+			err:        errors.New("unexpected exception"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := new(mockDBStorage)
+			storage.On("CheckLedger").Return(tt.mismatches, tt.err)
+			request := httptest.NewRequest(http.MethodGet, "/api/admin/ledger/check", nil)
+			request.AddCookie(&http.Cookie{Name: "token", Value: utils.TestToken})
+
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc((&handler{storage, utils.TestSecret, admins, logger}).GetLedgerCheck)
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+			if tt.body != "" {
+				body, _ := io.ReadAll(res.Body)
+				assert.JSONEq(t, tt.body, string(body))
+			}
+		})
+	}
+}
+
+func Test_handler_PostRefundWithdrawal(t *testing.T) {
+	var defaultNumber uint64 = 9278923470
+	reason := "order cancelled"
+	refunded := &withdrawalsModel.Withdrawals{
+		UserID: "2", Number: defaultNumber, Sum: 1000, Refunded: 400,
+		Status: withdrawalsModel.PartiallyRefunded, ReversalReason: &reason,
+	}
+	refunded.ProcessedAt, _ = time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+
+	tests := []struct {
+		name  string
+		body  string
+		err   error
+		code  int
+		resp  string
+		calls bool
+	}{
+		{
+			name:  "частичный возврат",
+			body:  `{"sum": 4, "reason": "order cancelled"}`,
+			code:  200,
+			calls: true,
+			resp: `{"order": "9278923470", "sum": 10, "status": "PARTIALLY_REFUNDED", "refunded": 4,
+				"reversal_reason": "order cancelled", "processed_at": "2020-12-10T15:15:45+03:00"}`,
+		},
+		{name: "нет причины", body: `{"sum": 4}`, code: 400},
+		{name: "отрицательная сумма", body: `{"sum": -4, "reason": "order cancelled"}`, code: 400},
+		{name: "списание не найдено", body: `{"sum": 4, "reason": "order cancelled"}`, err: db.ErrWithdrawalNotFound, code: 404, calls: true},
+		{name: "списание уже возвращено", body: `{"sum": 4, "reason": "order cancelled"}`, err: db.ErrWithdrawalNotRefundable, code: 409, calls: true},
+		{name: "сумма больше списания", body: `{"sum": 4, "reason": "order cancelled"}`, err: db.ErrRefundExceedsWithdrawal, code: 422, calls: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := new(mockDBStorage)
+			if tt.calls {
+				storage.On("RefundWithdrawal", defaultNumber, money.MustParse("4"), "1", "order cancelled").Return(refunded, tt.err)
+			}
+			request := httptest.NewRequest(http.MethodPost, "/api/admin/withdrawals/9278923470/refund", bytes.NewReader([]byte(tt.body)))
+			request.AddCookie(&http.Cookie{Name: "token", Value: utils.TestToken})
+			request = withNumber(request, "9278923470")
+
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc((&handler{storage, utils.TestSecret, admins, logger}).PostRefundWithdrawal)
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+			if tt.resp != "" {
+				body, _ := io.ReadAll(res.Body)
+				assert.JSONEq(t, tt.resp, string(body))
+			}
+			storage.AssertExpectations(t)
+		})
+	}
+}
+
+func withID(r *http.Request, id string) *http.Request {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", id)
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+}
+
+func Test_handler_PostCampaign(t *testing.T) {
+	startsAt, _ := time.Parse(time.RFC3339, "2020-12-12T00:00:00Z")
+	endsAt := startsAt.Add(48 * time.Hour)
+	toSave := campaignModel.Campaign{
+		Name: "double points", StartsAt: startsAt, EndsAt: &endsAt,
+		Tiers: pq.StringArray{"gold"}, Providers: pq.StringArray{}, BonusPercent: "100", Budget: 100000,
+	}
+	saved := toSave
+	saved.ID, saved.CreatedAt = 7, startsAt
+
+	tests := []struct {
+		name  string
+		body  string
+		err   error
+		code  int
+		resp  string
+		calls bool
+	}{
+		{
+			name: "кампания создана",
+			body: `{"name": "double points", "starts_at": "2020-12-12T00:00:00Z", "ends_at": "2020-12-14T00:00:00Z",
+				"tiers": ["gold"], "bonus_percent": 100, "budget": 1000}`,
+			code:  201,
+			calls: true,
+			resp: `{"id": 7, "name": "double points", "starts_at": "2020-12-12T00:00:00Z", "ends_at": "2020-12-14T00:00:00Z",
+				"tiers": ["gold"], "bonus_percent": 100, "budget": 1000, "spent": 0, "created_at": "2020-12-12T00:00:00Z"}`,
+		},
+		{name: "нет бонуса", body: `{"name": "nothing", "starts_at": "2020-12-12T00:00:00Z"}`, code: 400},
+		{name: "отрицательный процент", body: `{"name": "minus", "starts_at": "2020-12-12T00:00:00Z", "bonus_percent": -5}`, code: 400},
+		{
+			name: "пустой период",
+			body: `{"name": "empty", "starts_at": "2020-12-12T00:00:00Z", "ends_at": "2020-12-12T00:00:00Z", "bonus_fixed": 100}`,
+			code: 400,
+		},
+		{name: "нет названия", body: `{"starts_at": "2020-12-12T00:00:00Z", "bonus_fixed": 100}`, code: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := new(mockDBStorage)
+			if tt.calls {
+				storage.On("CreateCampaign", toSave).Return(&saved, tt.err)
+			}
+			request := httptest.NewRequest(http.MethodPost, "/api/admin/campaigns", bytes.NewReader([]byte(tt.body)))
+			request.AddCookie(&http.Cookie{Name: "token", Value: utils.TestToken})
+
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc((&handler{storage, utils.TestSecret, admins, logger}).PostCampaign)
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+			if tt.resp != "" {
+				body, _ := io.ReadAll(res.Body)
+				assert.JSONEq(t, tt.resp, string(body))
+			}
+			storage.AssertExpectations(t)
+		})
+	}
+}
+
+func Test_handler_DeleteCampaign(t *testing.T) {
+	tests := []struct {
+		name  string
+		id    string
+		err   error
+		code  int
+		calls bool
+	}{
+		{name: "кампания удалена", id: "7", code: 200, calls: true},
+		{name: "неверный идентификатор", id: "abc", code: 400},
+		{name: "кампания не найдена", id: "7", err: db.ErrCampaignNotFound, code: 404, calls: true},
+		{name: "кампания уже начисляла бонусы", id: "7", err: db.ErrCampaignInUse, code: 409, calls: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := new(mockDBStorage)
+			if tt.calls {
+				storage.On("DeleteCampaign", int64(7)).Return(tt.err)
+			}
+			request := httptest.NewRequest(http.MethodDelete, "/api/admin/campaigns/"+tt.id, nil)
+			request.AddCookie(&http.Cookie{Name: "token", Value: utils.TestToken})
+			request = withID(request, tt.id)
+
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc((&handler{storage, utils.TestSecret, admins, logger}).DeleteCampaign)
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+			storage.AssertExpectations(t)
+		})
+	}
+}
+
+func Test_handler_PostAdjustment(t *testing.T) {
+	createdAt, _ := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+	adjustment := func(status adjustmentModel.AdjustmentStatus) *adjustmentModel.Adjustment {
+		return &adjustmentModel.Adjustment{
+			ID: 3, UserID: "2", Login: "login", Amount: 50000, Reason: "lost accrual", Ticket: "SUP-1",
+			Status: status, CreatedBy: "1", CreatedAt: createdAt,
+			History: []adjustmentModel.AdjustmentEvent{{Status: status, Actor: "1", CreatedAt: createdAt}},
+		}
+	}
+	body := `{"login": "login", "amount": 500, "reason": "lost accrual", "ticket": "SUP-1"}`
+
+	tests := []struct {
+		name       string
+		body       string
+		adjustment *adjustmentModel.Adjustment
+		err        error
+		code       int
+		resp       string
+		calls      bool
+	}{
+		{
+			name:       "корректировка применена",
+			body:       body,
+			adjustment: adjustment(adjustmentModel.Applied),
+			code:       200,
+			calls:      true,
+			resp: `{"id": 3, "login": "login", "amount": 500, "reason": "lost accrual", "ticket": "SUP-1", "status": "APPLIED",
+				"created_by": "1", "created_at": "2020-12-10T15:15:45+03:00",
+				"history": [{"status": "APPLIED", "actor": "1", "created_at": "2020-12-10T15:15:45+03:00"}]}`,
+		},
+		{name: "корректировка ждёт подтверждения", body: body, adjustment: adjustment(adjustmentModel.Pending), code: 202, calls: true},
+		{name: "нет номера обращения", body: `{"login": "login", "amount": 500, "reason": "lost accrual"}`, code: 400},
+		{name: "нулевая сумма", body: `{"login": "login", "amount": 0, "reason": "lost accrual", "ticket": "SUP-1"}`, code: 400},
+		{name: "пользователь не найден", body: body, err: db.ErrUserNotFound, code: 404, calls: true},
+		{name: "недостаточно средств", body: body, err: db.ErrBalanceLimitExhausted, code: 402, calls: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := new(mockDBStorage)
+			if tt.calls {
+				storage.On("CreateAdjustment", "login", money.MustParse("500"), "lost accrual", "SUP-1", "1").Return(tt.adjustment, tt.err)
+			}
+			request := httptest.NewRequest(http.MethodPost, "/api/admin/adjustments", bytes.NewReader([]byte(tt.body)))
+			request.AddCookie(&http.Cookie{Name: "token", Value: utils.TestToken})
+
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc((&handler{storage, utils.TestSecret, admins, logger}).PostAdjustment)
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+			if tt.resp != "" {
+				body, _ := io.ReadAll(res.Body)
+				assert.JSONEq(t, tt.resp, string(body))
+			}
+			storage.AssertExpectations(t)
+		})
+	}
+}
+
+func Test_handler_PostApproveAdjustment(t *testing.T) {
+	tests := []struct {
+		name  string
+		id    string
+		err   error
+		code  int
+		calls bool
+	}{
+		{name: "корректировка подтверждена", id: "3", code: 200, calls: true},
+		{name: "неверный идентификатор", id: "abc", code: 400},
+		{name: "подтверждение своей корректировки", id: "3", err: db.ErrAdjustmentSelfApproval, code: 403, calls: true},
+		{name: "корректировка не найдена", id: "3", err: db.ErrAdjustmentNotFound, code: 404, calls: true},
+		{name: "корректировка уже применена", id: "3", err: db.ErrAdjustmentNotPending, code: 409, calls: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := new(mockDBStorage)
+			if tt.calls {
+				storage.On("ApproveAdjustment", int64(3), "1").Return(&adjustmentModel.Adjustment{ID: 3}, tt.err)
+			}
+			request := httptest.NewRequest(http.MethodPost, "/api/admin/adjustments/"+tt.id+"/approve", nil)
+			request.AddCookie(&http.Cookie{Name: "token", Value: utils.TestToken})
+			request = withID(request, tt.id)
+
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc((&handler{storage, utils.TestSecret, admins, logger}).PostApproveAdjustment)
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+			storage.AssertExpectations(t)
+		})
+	}
+}
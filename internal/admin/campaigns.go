@@ -0,0 +1,154 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"gophermart/internal/campaign/model/api"
+	"gophermart/internal/db"
+	"math/big"
+	"net/http"
+	"strconv"
+
+	campaignModel "gophermart/internal/campaign/model/db"
+
+	"github.com/go-chi/chi"
+)
+
+// PostCampaign creates a promotional campaign.
+func (h *handler) PostCampaign(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := h.auth(w, r)
+	if !ok {
+		return
+	}
+	var data api.Campaign
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || !validCampaign(data) {
+		// 400 — неверный формат кампании.
+		h.logger.Warnf("failed to PostCampaign: bad request %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if campaign, err := h.db.CreateCampaign(campaignModel.FromAPI(data)); err != nil {
+		h.writeCampaignErr(w, "PostCampaign", err)
+	} else {
+		h.logger.Infof("admin %v created campaign %v %q", adminID, campaign.ID, campaign.Name)
+		h.writeCampaign(w, http.StatusCreated, campaign)
+	}
+}
+
+func (h *handler) GetCampaigns(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.auth(w, r); !ok {
+		return
+	}
+	if campaigns, err := h.db.GetCampaigns(); err != nil {
+		// 500 — внутренняя ошибка сервера.
+		h.logger.Errorf("failed to GetCampaigns: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	} else if len(campaigns) == 0 {
+		// 204 — нет данных для ответа.
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		apiCampaigns := make([]api.Campaign, len(campaigns))
+		for i := 0; i < len(campaigns); i++ {
+			apiCampaigns[i] = campaigns[i].ToAPI()
+		}
+		json.NewEncoder(w).Encode(apiCampaigns)
+	}
+}
+
+func (h *handler) GetCampaign(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.auth(w, r); !ok {
+		return
+	}
+	if id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64); err != nil {
+		// 400 — неверный формат идентификатора кампании.
+		h.logger.Warnf("failed to GetCampaign: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if campaign, err := h.db.GetCampaign(id); err != nil {
+		h.writeCampaignErr(w, "GetCampaign", err)
+	} else {
+		h.writeCampaign(w, http.StatusOK, campaign)
+	}
+}
+
+// PutCampaign replaces the rules of the campaign, the spent sum is kept.
+func (h *handler) PutCampaign(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := h.auth(w, r)
+	if !ok {
+		return
+	}
+	var data api.Campaign
+	if id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64); err != nil {
+		// 400 — неверный формат идентификатора кампании.
+		h.logger.Warnf("failed to PutCampaign: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if err := json.NewDecoder(r.Body).Decode(&data); err != nil || !validCampaign(data) {
+		// 400 — неверный формат кампании.
+		h.logger.Warnf("failed to PutCampaign: bad request %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		data.ID = id
+		if campaign, err := h.db.UpdateCampaign(campaignModel.FromAPI(data)); err != nil {
+			h.writeCampaignErr(w, "PutCampaign", err)
+		} else {
+			h.logger.Infof("admin %v updated campaign %v %q", adminID, campaign.ID, campaign.Name)
+			h.writeCampaign(w, http.StatusOK, campaign)
+		}
+	}
+}
+
+// DeleteCampaign deletes the campaign that has not credited bonuses yet.
+func (h *handler) DeleteCampaign(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := h.auth(w, r)
+	if !ok {
+		return
+	}
+	if id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64); err != nil {
+		// 400 — неверный формат идентификатора кампании.
+		h.logger.Warnf("failed to DeleteCampaign: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if err := h.db.DeleteCampaign(id); err != nil {
+		h.writeCampaignErr(w, "DeleteCampaign", err)
+	} else {
+		h.logger.Infof("admin %v deleted campaign %v", adminID, id)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// validCampaign checks that the campaign has a name, a window that is not empty and a positive bonus.
+func validCampaign(c api.Campaign) bool {
+	if c.Name == "" || c.StartsAt.IsZero() || (c.EndsAt != nil && !c.EndsAt.After(c.StartsAt)) {
+		return false
+	}
+	if c.MinAccrual < 0 || c.BonusFixed < 0 || c.Budget < 0 {
+		return false
+	}
+	percent := new(big.Rat)
+	if c.BonusPercent != "" {
+		if _, ok := percent.SetString(c.BonusPercent.String()); !ok || percent.Sign() < 0 {
+			return false
+		}
+	}
+	return c.BonusFixed > 0 || percent.Sign() > 0
+}
+
+func (h *handler) writeCampaign(w http.ResponseWriter, statusCode int, campaign *campaignModel.Campaign) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(campaign.ToAPI())
+}
+
+func (h *handler) writeCampaignErr(w http.ResponseWriter, method string, err error) {
+	if errors.Is(err, db.ErrCampaignNotFound) {
+		// 404 — кампания не найдена.
+		h.logger.Warnf("failed to %v: %v", method, err)
+		w.WriteHeader(http.StatusNotFound)
+	} else if errors.Is(err, db.ErrCampaignInUse) {
+		// 409 — кампания уже начисляла бонусы, её можно только завершить.
+		h.logger.Warnf("failed to %v: %v", method, err)
+		w.WriteHeader(http.StatusConflict)
+	} else {
+		// 500 — внутренняя ошибка сервера.
+		h.logger.Errorf("failed to %v: %v", method, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
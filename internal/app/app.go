@@ -0,0 +1,169 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"gophermart/internal/cli"
+	"gophermart/internal/config"
+	"gophermart/internal/db"
+	"gophermart/internal/money"
+	"gophermart/internal/processing"
+	mainServer "gophermart/internal/server"
+	"gophermart/internal/utils"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// configureMoney applies money settings of cfg, they are validated by config.
+func configureMoney(cfg *config.Config) error {
+	rounding, err := money.ParseRounding(cfg.MoneyRounding)
+	if err != nil {
+		return err
+	}
+	return money.Configure(cfg.MoneyScale, rounding)
+}
+
+// storagePolicy builds business rules of the storage from cfg, money must be configured before.
+func storagePolicy(cfg *config.Config) (db.Policy, error) {
+	policy := db.Policy{PointsExpireMonths: cfg.PointsExpireMonths}
+	limits := &policy.WithdrawalLimits
+	sums := []struct {
+		value string
+		sum   *money.Money
+	}{
+		{cfg.WithdrawalMinSum, &limits.MinSum},
+		{cfg.WithdrawalMaxSum, &limits.MaxSum},
+		{cfg.WithdrawalDailySum, &limits.DailySum},
+		{cfg.WithdrawalMonthlySum, &limits.MonthlySum},
+		{cfg.TransferMinSum, &policy.TransferRules.MinSum},
+		{cfg.TransferMaxSum, &policy.TransferRules.MaxSum},
+		{cfg.TransferDailySum, &policy.TransferRules.DailySum},
+		{cfg.TransferFeeFixed, &policy.TransferRules.FeeFixed},
+		{cfg.ReferralReferrerBonus, &policy.ReferralRules.ReferrerBonus},
+		{cfg.ReferralRefereeBonus, &policy.ReferralRules.RefereeBonus},
+		{cfg.AdjustmentApprovalThreshold, &policy.AdjustmentRules.ApprovalThreshold},
+	}
+	for _, s := range sums {
+		if s.value == "" {
+			continue
+		}
+		sum, err := money.Parse(s.value)
+		if err != nil {
+			return policy, err
+		}
+		*s.sum = sum
+	}
+	limits.HourlyCount = cfg.WithdrawalHourlyCount
+	limits.CoolingOff = cfg.WithdrawalCoolingOff
+	if cfg.TransferFeePercent != "" {
+		percent, ok := new(big.Rat).SetString(cfg.TransferFeePercent)
+		if !ok || percent.Sign() < 0 {
+			return policy, fmt.Errorf("invalid transfer fee percent %q", cfg.TransferFeePercent)
+		}
+		policy.TransferRules.FeeRate = percent.Quo(percent, big.NewRat(100, 1))
+	}
+	tiers, err := parseTiers(cfg.LoyaltyTiers)
+	if err != nil {
+		return policy, err
+	}
+	policy.TierRules = db.TierRules{Tiers: tiers, Basis: cfg.LoyaltyTierBasis, Period: cfg.LoyaltyTierPeriod}
+	policy.ProviderCurrencies = map[string]string{}
+	for _, p := range cfg.AccrualProviders {
+		if p.Currency != db.DefaultCurrency {
+			policy.ProviderCurrencies[p.Name] = p.Currency
+		}
+	}
+	return policy, nil
+}
+
+// parseTiers parses tiers as name:threshold:multiplier separated by commas, multipliers are at least 1.
+func parseTiers(s string) ([]db.Tier, error) {
+	tiers := []db.Tier{}
+	if s == "" {
+		return tiers, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid loyalty tier %q", item)
+		}
+		threshold, err := money.Parse(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold of loyalty tier %q: %w", item, err)
+		}
+		multiplier, ok := new(big.Rat).SetString(parts[2])
+		if !ok || multiplier.Cmp(big.NewRat(1, 1)) < 0 {
+			return nil, fmt.Errorf("invalid multiplier of loyalty tier %q", item)
+		}
+		tiers = append(tiers, db.Tier{Name: parts[0], Threshold: threshold, Multiplier: multiplier})
+	}
+	return tiers, nil
+}
+
+// Run starts the parts of the service selected by cfg.Mode and blocks until ctx is done.
+func Run(ctx context.Context, cfg *config.Config, logger *zap.SugaredLogger) error {
+	if err := configureMoney(cfg); err != nil {
+		return err
+	}
+	policy, err := storagePolicy(cfg)
+	if err != nil {
+		return err
+	}
+	storage, err := db.NewStorage(cfg.DBURL, ctx, policy, logger)
+	if err != nil {
+		return err
+	}
+
+	wg := &sync.WaitGroup{}
+
+	switch cfg.Mode {
+	case config.ModeServe:
+		mainServer.Run(storage, utils.TestSecret, cfg, logger, ctx)
+	case config.ModeWorker:
+		if err := processing.RunDaemon(http.Client{}, storage, logger, ctx, wg, cfg); err != nil {
+			return err
+		}
+		mainServer.RunWorker(storage, cfg, logger, ctx)
+	default:
+		if err := processing.RunDaemon(http.Client{}, storage, logger, ctx, wg, cfg); err != nil {
+			return err
+		}
+		// processing status is not public, it is served on the health address as in worker mode
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mainServer.RunWorker(storage, cfg, logger, ctx)
+		}()
+		mainServer.Run(storage, utils.TestSecret, cfg, logger, ctx)
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// RunCommand executes maintenance command args, see cli.Run.
+func RunCommand(ctx context.Context, cfg *config.Config, logger *zap.SugaredLogger, args []string, out io.Writer) error {
+	if err := configureMoney(cfg); err != nil {
+		return err
+	}
+	policy, err := storagePolicy(cfg)
+	if err != nil {
+		return err
+	}
+	storage, err := db.NewStorage(cfg.DBURL, ctx, policy, logger)
+	if err != nil {
+		return err
+	}
+
+	actor := "cli"
+	if user := os.Getenv("USER"); user != "" {
+		actor = "cli:" + user
+	}
+	return cli.Run(storage, actor, args, out)
+}
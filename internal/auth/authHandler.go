@@ -23,6 +23,8 @@ func NewHandler(db db.Storage, secret string, logger *zap.SugaredLogger) *handle
 type authData struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
+	// ReferralCode is the code of the user who referred the registered one, it is optional.
+	ReferralCode string `json:"referral_code"`
 }
 
 func parseAuthErr(authData authData, err error) string {
@@ -44,9 +46,12 @@ func (h *handler) Register(w http.ResponseWriter, r *http.Request) {
 		msg := parseAuthErr(authData, err)
 		h.logger.Warnf("failed to register: %v", msg)
 		http.Error(w, msg, http.StatusBadRequest)
-	} else if id, err := h.db.Register(authData.Login, authData.Password); err != nil {
+	} else if id, err := h.db.Register(authData.Login, authData.Password, authData.ReferralCode, utils.GetClientIP(r)); err != nil {
 		if errors.Is(err, db.ErrDuplicateLogin) {
 			w.WriteHeader(http.StatusConflict)
+		} else if errors.Is(err, db.ErrReferralCodeNotFound) {
+			// 400 — неизвестный реферальный код.
+			http.Error(w, err.Error(), http.StatusBadRequest)
 		} else {
 			w.WriteHeader(http.StatusInternalServerError)
 		}
@@ -5,11 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"gophermart/internal/db"
+	"gophermart/internal/money"
 	"gophermart/internal/order/model"
 	"gophermart/internal/utils"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/assert"
@@ -17,6 +19,11 @@ import (
 	"go.uber.org/zap"
 
 	accountModel "gophermart/internal/account/model/db"
+	adjustmentModel "gophermart/internal/adjustment/model/db"
+	campaignModel "gophermart/internal/campaign/model/db"
+	referralModel "gophermart/internal/referral/model/db"
+	statementModel "gophermart/internal/statement/model/db"
+	transferModel "gophermart/internal/transfer/model/db"
 	withdrawalsModel "gophermart/internal/withdrawals/model/db"
 )
 
@@ -24,8 +31,8 @@ type mockDBStorage struct {
 	mock.Mock
 }
 
-func (m *mockDBStorage) Register(login string, password string) (string, error) {
-	args := m.Called(login, password)
+func (m *mockDBStorage) Register(login, password, referralCode, ip string) (string, error) {
+	args := m.Called(login, password, referralCode, ip)
 	return args.String(0), args.Error(1)
 }
 
@@ -34,7 +41,7 @@ func (m *mockDBStorage) GetByLoginPassword(login string, password string) (strin
 	return args.String(0), args.Error(1)
 }
 
-func (m *mockDBStorage) SaveOrder(UserID string, number uint64) error {
+func (m *mockDBStorage) SaveOrder(UserID string, number uint64, merchantID, provider string) error {
 	return nil
 }
 
@@ -42,23 +49,184 @@ func (m *mockDBStorage) GetOrders(UserID string) ([]model.Order, error) {
 	return nil, nil
 }
 
-func (m *mockDBStorage) GetAccount(UserID string) (*accountModel.Account, error) {
+func (m *mockDBStorage) GetAccount(UserID, currency string) (*accountModel.Account, error) {
 	return nil, nil
 }
 
-func (m *mockDBStorage) WithdrawFromAccount(UserID string, sum float64, number uint64) error {
+func (m *mockDBStorage) WithdrawFromAccount(UserID, currency string, sum money.Money, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) HoldWithdrawal(UserID, currency string, sum money.Money, number uint64, ttl time.Duration) error {
+	return nil
+}
+
+func (m *mockDBStorage) ConfirmWithdrawal(UserID string, number uint64) error {
 	return nil
 }
 
-func (m *mockDBStorage) GetWithdrawals(UserID string) ([]withdrawalsModel.Withdrawals, error) {
+func (m *mockDBStorage) CancelWithdrawal(UserID string, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) ExpireWithdrawals() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) ExpirePoints() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) RecalculateTiers() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) CreateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaigns() ([]campaignModel.Campaign, error) {
+	args := m.Called()
+	return args.Get(0).([]campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaign(ID int64) (*campaignModel.Campaign, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) UpdateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) DeleteCampaign(ID int64) error {
+	args := m.Called(ID)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) CreateAdjustment(login string, amount money.Money, reason, ticket, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(login, amount, reason, ticket, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) ApproveAdjustment(ID int64, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) RejectAdjustment(ID int64, actor, reason string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor, reason)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustments() ([]adjustmentModel.Adjustment, error) {
+	args := m.Called()
+	return args.Get(0).([]adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustment(ID int64) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetExpiringPoints(UserID, currency string, within time.Duration) ([]accountModel.ExpiringPoints, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) RefundWithdrawal(number uint64, sum money.Money, actor, reason string) (*withdrawalsModel.Withdrawals, error) {
 	return nil, nil
 }
 
-func (m *mockDBStorage) CalcAmounts(offset, limit int,
+func (m *mockDBStorage) GetWithdrawals(UserID, currency string) ([]withdrawalsModel.Withdrawals, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) TransferPoints(UserID, login string, sum money.Money) (*transferModel.Transfer, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetTransfers(UserID string) ([]transferModel.Transfer, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetReferrals(UserID string) (*referralModel.Referrals, error) {
+	args := m.Called(UserID)
+	return args.Get(0).(*referralModel.Referrals), args.Error(1)
+}
+
+func (m *mockDBStorage) GetStatement(UserID string, from, to *time.Time, offset, limit int) (*statementModel.Statement, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) ReserveIdempotencyKey(UserID, scope, key, requestHash string, ttl, lease time.Duration) (*db.IdempotentResponse, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) SaveIdempotentResponse(UserID, scope, key string, statusCode int, contentType string, body []byte) error {
+	return nil
+}
+
+func (m *mockDBStorage) ReleaseIdempotencyKey(UserID, scope, key string) error {
+	return nil
+}
+
+func (m *mockDBStorage) CalcAmounts(shard db.Shard, providers []string, offset, limit int,
 	updF func(nums []int64) map[int64]db.CalcAmountsUpdateResult) (int, error) {
 	return 0, nil
 }
 
+func (m *mockDBStorage) ApplyCalcResults(providers []string, updates map[int64]db.CalcAmountsUpdateResult) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) SaveCallbackSignature(signature string, ttl time.Duration) error {
+	args := m.Called(signature, ttl)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) TryAcquireLease(instanceID string, shard int) (*db.Lease, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetLeaders() ([]db.Leader, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) CheckLedger() ([]db.LedgerMismatch, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) Reconcile(save bool) (*db.ReconciliationReport, error) {
+	args := m.Called(save)
+	return args.Get(0).(*db.ReconciliationReport), args.Error(1)
+}
+
+func (m *mockDBStorage) Ping() error {
+	return nil
+}
+
+func (m *mockDBStorage) GetOrderHistory(UserID string, number uint64) ([]model.OrderEvent, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) DeadLetterOrders(maxFailedAttempts int) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) GetDeadLetterOrders() ([]model.DeadLetterOrder, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) RetryDeadLetterOrder(number uint64, actor string) error {
+	return nil
+}
+
+func (m *mockDBStorage) ResolveDeadLetterOrder(number uint64, status model.OrderStatus, accrual money.Money, actor, reason string) error {
+	return nil
+}
+
 var logger = zap.NewExample().Sugar()
 
 func TestRegistration(t *testing.T) {
@@ -87,7 +255,7 @@ func TestRegistration(t *testing.T) {
 			},
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
-				storage.On("Register", "login", "password").Return("1", nil)
+				storage.On("Register", "login", "password", "", "192.0.2.1").Return("1", nil)
 				return &handler{storage, utils.TestSecret, logger}
 			},
 		},
@@ -141,7 +309,21 @@ func TestRegistration(t *testing.T) {
 			},
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
-				storage.On("Register", "already_taken_login", "password").Return("", db.ErrDuplicateLogin)
+				storage.On("Register", "already_taken_login", "password", "", "192.0.2.1").Return("", db.ErrDuplicateLogin)
+				return &handler{storage, utils.TestSecret, logger}
+			},
+		},
+		{
+			name:     "unknown referral code",
+			code:     400,
+			login:    "referred_login",
+			password: "password",
+			body: func(login string, password string) string {
+				return fmt.Sprintf(`{"login": "%v","password": "%v","referral_code": "NOSUCHCODE"}`, login, password)
+			},
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("Register", "referred_login", "password", "NOSUCHCODE", "192.0.2.1").Return("", db.ErrReferralCodeNotFound)
 				return &handler{storage, utils.TestSecret, logger}
 			},
 		},
@@ -155,7 +337,7 @@ func TestRegistration(t *testing.T) {
 			},
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
-				storage.On("Register", "internal_error_login", "password").Return("", errors.New("unexpected exception"))
+				storage.On("Register", "internal_error_login", "password", "", "192.0.2.1").Return("", errors.New("unexpected exception"))
 				return &handler{storage, utils.TestSecret, logger}
 			},
 		},
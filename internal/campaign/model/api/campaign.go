@@ -0,0 +1,27 @@
+package api
+
+import (
+	"encoding/json"
+	"gophermart/internal/money"
+	"time"
+)
+
+// Campaign credits a bonus for orders processed in [StartsAt, EndsAt) that match all of its conditions, the bonus
+// is BonusFixed plus BonusPercent of the order accrual. Campaigns with a non zero Budget stop once it is spent.
+type Campaign struct {
+	ID       int64      `json:"id"`
+	Name     string     `json:"name"`
+	StartsAt time.Time  `json:"starts_at"`
+	EndsAt   *time.Time `json:"ends_at,omitempty"`
+	// FirstOrder limits the campaign to the first processed order of the user.
+	FirstOrder bool        `json:"first_order,omitempty"`
+	MinAccrual money.Money `json:"min_accrual,omitempty"`
+	// Tiers and Providers limit the campaign to users of the loyalty tiers and to orders of the accrual providers.
+	Tiers        []string    `json:"tiers,omitempty"`
+	Providers    []string    `json:"providers,omitempty"`
+	BonusFixed   money.Money `json:"bonus_fixed,omitempty"`
+	BonusPercent json.Number `json:"bonus_percent,omitempty"`
+	Budget       money.Money `json:"budget,omitempty"`
+	Spent        money.Money `json:"spent"`
+	CreatedAt    time.Time   `json:"created_at"`
+}
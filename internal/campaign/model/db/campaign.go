@@ -0,0 +1,81 @@
+package db
+
+import (
+	"encoding/json"
+	"gophermart/internal/campaign/model/api"
+	"gophermart/internal/money"
+	"math/big"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Campaign is a promotional campaign, BonusPercent is a decimal stored as numeric.
+type Campaign struct {
+	ID           int64          `db:"id"`
+	Name         string         `db:"name"`
+	StartsAt     time.Time      `db:"starts_at"`
+	EndsAt       *time.Time     `db:"ends_at"`
+	FirstOrder   bool           `db:"first_order"`
+	MinAccrual   money.Money    `db:"min_accrual"`
+	Tiers        pq.StringArray `db:"tiers"`
+	Providers    pq.StringArray `db:"providers"`
+	BonusFixed   money.Money    `db:"bonus_fixed"`
+	BonusPercent string         `db:"bonus_percent"`
+	Budget       money.Money    `db:"budget"`
+	Spent        money.Money    `db:"spent"`
+	CreatedAt    time.Time      `db:"created_at"`
+}
+
+// Rate is the share of the accrual credited as bonus, it is zero when BonusPercent is not a number.
+func (c *Campaign) Rate() *big.Rat {
+	rate, ok := new(big.Rat).SetString(c.BonusPercent)
+	if !ok {
+		return new(big.Rat)
+	}
+	return rate.Quo(rate, big.NewRat(100, 1))
+}
+
+func (c *Campaign) ToAPI() api.Campaign {
+	campaign := api.Campaign{
+		ID:         c.ID,
+		Name:       c.Name,
+		StartsAt:   c.StartsAt,
+		EndsAt:     c.EndsAt,
+		FirstOrder: c.FirstOrder,
+		MinAccrual: c.MinAccrual,
+		Tiers:      c.Tiers,
+		Providers:  c.Providers,
+		BonusFixed: c.BonusFixed,
+		Budget:     c.Budget,
+		Spent:      c.Spent,
+		CreatedAt:  c.CreatedAt,
+	}
+	if rate := c.Rate(); rate.Sign() != 0 {
+		campaign.BonusPercent = json.Number(c.BonusPercent)
+	}
+	return campaign
+}
+
+// FromAPI makes the campaign to save, the id, the spent sum and the creation time are kept by the storage.
+func FromAPI(c api.Campaign) Campaign {
+	campaign := Campaign{
+		ID:           c.ID,
+		Name:         c.Name,
+		StartsAt:     c.StartsAt,
+		EndsAt:       c.EndsAt,
+		FirstOrder:   c.FirstOrder,
+		MinAccrual:   c.MinAccrual,
+		Tiers:        pq.StringArray{},
+		Providers:    pq.StringArray{},
+		BonusFixed:   c.BonusFixed,
+		BonusPercent: c.BonusPercent.String(),
+		Budget:       c.Budget,
+	}
+	campaign.Tiers = append(campaign.Tiers, c.Tiers...)
+	campaign.Providers = append(campaign.Providers, c.Providers...)
+	if campaign.BonusPercent == "" {
+		campaign.BonusPercent = "0"
+	}
+	return campaign
+}
@@ -0,0 +1,38 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"gophermart/internal/db"
+	"io"
+)
+
+var ErrUsage = errors.New(`usage:
+	deadletter list
+	deadletter retry <number>
+	deadletter resolve <number> <PROCESSED|INVALID> <accrual> <reason>
+	ledger check
+	reconcile [save]`)
+
+var commands = map[string]func(storage db.Storage, actor string, args []string, out io.Writer) error{
+	"deadletter": deadLetter,
+	"ledger":     ledger,
+	"reconcile":  reconcile,
+}
+
+func IsCommand(name string) bool {
+	_, ok := commands[name]
+	return ok
+}
+
+// Run executes maintenance command args[0] on behalf of actor.
+func Run(storage db.Storage, actor string, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n%w", args[0], ErrUsage)
+	}
+	return command(storage, actor, args[1:], out)
+}
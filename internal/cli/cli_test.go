@@ -0,0 +1,348 @@
+package cli
+
+import (
+	"bytes"
+	"gophermart/internal/db"
+	"gophermart/internal/money"
+	"gophermart/internal/order/model"
+	"testing"
+	"time"
+
+	accountModel "gophermart/internal/account/model/db"
+	adjustmentModel "gophermart/internal/adjustment/model/db"
+	campaignModel "gophermart/internal/campaign/model/db"
+	referralModel "gophermart/internal/referral/model/db"
+	statementModel "gophermart/internal/statement/model/db"
+	transferModel "gophermart/internal/transfer/model/db"
+	withdrawalsModel "gophermart/internal/withdrawals/model/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockDBStorage struct {
+	mock.Mock
+}
+
+func (m *mockDBStorage) Register(login, password, referralCode, ip string) (string, error) {
+	return "", nil
+}
+
+func (m *mockDBStorage) GetByLoginPassword(login string, password string) (string, error) {
+	return "", nil
+}
+
+func (m *mockDBStorage) SaveOrder(UserID string, number uint64, merchantID, provider string) error {
+	return nil
+}
+
+func (m *mockDBStorage) GetOrders(UserID string) ([]model.Order, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetAccount(UserID, currency string) (*accountModel.Account, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) WithdrawFromAccount(UserID, currency string, sum money.Money, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) HoldWithdrawal(UserID, currency string, sum money.Money, number uint64, ttl time.Duration) error {
+	return nil
+}
+
+func (m *mockDBStorage) ConfirmWithdrawal(UserID string, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) CancelWithdrawal(UserID string, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) ExpireWithdrawals() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) ExpirePoints() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) RecalculateTiers() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) CreateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaigns() ([]campaignModel.Campaign, error) {
+	args := m.Called()
+	return args.Get(0).([]campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaign(ID int64) (*campaignModel.Campaign, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) UpdateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) DeleteCampaign(ID int64) error {
+	args := m.Called(ID)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) CreateAdjustment(login string, amount money.Money, reason, ticket, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(login, amount, reason, ticket, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) ApproveAdjustment(ID int64, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) RejectAdjustment(ID int64, actor, reason string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor, reason)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustments() ([]adjustmentModel.Adjustment, error) {
+	args := m.Called()
+	return args.Get(0).([]adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustment(ID int64) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetExpiringPoints(UserID, currency string, within time.Duration) ([]accountModel.ExpiringPoints, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) RefundWithdrawal(number uint64, sum money.Money, actor, reason string) (*withdrawalsModel.Withdrawals, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetWithdrawals(UserID, currency string) ([]withdrawalsModel.Withdrawals, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) TransferPoints(UserID, login string, sum money.Money) (*transferModel.Transfer, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetTransfers(UserID string) ([]transferModel.Transfer, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetReferrals(UserID string) (*referralModel.Referrals, error) {
+	args := m.Called(UserID)
+	return args.Get(0).(*referralModel.Referrals), args.Error(1)
+}
+
+func (m *mockDBStorage) GetStatement(UserID string, from, to *time.Time, offset, limit int) (*statementModel.Statement, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) ReserveIdempotencyKey(UserID, scope, key, requestHash string, ttl, lease time.Duration) (*db.IdempotentResponse, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) SaveIdempotentResponse(UserID, scope, key string, statusCode int, contentType string, body []byte) error {
+	return nil
+}
+
+func (m *mockDBStorage) ReleaseIdempotencyKey(UserID, scope, key string) error {
+	return nil
+}
+
+func (m *mockDBStorage) CalcAmounts(shard db.Shard, providers []string, offset, limit int,
+	updF func(nums []int64) map[int64]db.CalcAmountsUpdateResult) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) ApplyCalcResults(providers []string, updates map[int64]db.CalcAmountsUpdateResult) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) SaveCallbackSignature(signature string, ttl time.Duration) error {
+	args := m.Called(signature, ttl)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) TryAcquireLease(instanceID string, shard int) (*db.Lease, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetLeaders() ([]db.Leader, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) CheckLedger() ([]db.LedgerMismatch, error) {
+	args := m.Called()
+	return args.Get(0).([]db.LedgerMismatch), args.Error(1)
+}
+
+func (m *mockDBStorage) Reconcile(save bool) (*db.ReconciliationReport, error) {
+	args := m.Called(save)
+	return args.Get(0).(*db.ReconciliationReport), args.Error(1)
+}
+
+func (m *mockDBStorage) Ping() error {
+	return nil
+}
+
+func (m *mockDBStorage) GetOrderHistory(UserID string, number uint64) ([]model.OrderEvent, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) DeadLetterOrders(maxFailedAttempts int) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) GetDeadLetterOrders() ([]model.DeadLetterOrder, error) {
+	args := m.Called()
+	return args.Get(0).([]model.DeadLetterOrder), args.Error(1)
+}
+
+func (m *mockDBStorage) RetryDeadLetterOrder(number uint64, actor string) error {
+	args := m.Called(number, actor)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) ResolveDeadLetterOrder(number uint64, status model.OrderStatus, accrual money.Money, actor, reason string) error {
+	args := m.Called(number, status, accrual, actor, reason)
+	return args.Error(0)
+}
+
+func TestRun_deadletter(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		storage func() *mockDBStorage
+		check   func(out string, err error)
+	}{
+		{
+			name: "list",
+			args: []string{"deadletter", "list"},
+			storage: func() *mockDBStorage {
+				storage := new(mockDBStorage)
+				storage.On("GetDeadLetterOrders").Return([]model.DeadLetterOrder{
+					{Order: *model.NewOrder(79927398713, "1", model.DeadLetter, 0), FailedAttempts: 100},
+				}, nil)
+				return storage
+			},
+			check: func(out string, err error) {
+				assert.NoError(t, err)
+				assert.Contains(t, out, `"number":"79927398713"`)
+				assert.Contains(t, out, `"failed_attempts":100`)
+			},
+		},
+		{
+			name: "retry",
+			args: []string{"deadletter", "retry", "79927398713"},
+			storage: func() *mockDBStorage {
+				storage := new(mockDBStorage)
+				storage.On("RetryDeadLetterOrder", uint64(79927398713), "cli:test").Return(nil)
+				return storage
+			},
+			check: func(out string, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, "order 79927398713 returned to processing\n", out)
+			},
+		},
+		{
+			name: "resolve with reason of several words",
+			args: []string{"deadletter", "resolve", "79927398713", "PROCESSED", "10.5", "confirmed", "by", "partner"},
+			storage: func() *mockDBStorage {
+				storage := new(mockDBStorage)
+				storage.On("ResolveDeadLetterOrder", uint64(79927398713), model.Processed, money.MustParse("10.5"), "cli:test", "confirmed by partner").Return(nil)
+				return storage
+			},
+			check: func(out string, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:    "resolve without reason",
+			args:    []string{"deadletter", "resolve", "79927398713", "PROCESSED", "10.5"},
+			storage: func() *mockDBStorage { return new(mockDBStorage) },
+			check: func(out string, err error) {
+				assert.ErrorIs(t, err, ErrUsage)
+			},
+		},
+		{
+			name:    "resolve with bad status",
+			args:    []string{"deadletter", "resolve", "79927398713", "NEW", "0", "reason"},
+			storage: func() *mockDBStorage { return new(mockDBStorage) },
+			check: func(out string, err error) {
+				assert.ErrorIs(t, err, db.ErrInvalidResolveStatus)
+			},
+		},
+		{
+			name:    "unknown command",
+			args:    []string{"unknown"},
+			storage: func() *mockDBStorage { return new(mockDBStorage) },
+			check: func(out string, err error) {
+				assert.ErrorIs(t, err, ErrUsage)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			err := Run(tt.storage(), "cli:test", tt.args, out)
+			tt.check(out.String(), err)
+		})
+	}
+}
+
+func TestRun_ledger(t *testing.T) {
+	t.Run("consistent", func(t *testing.T) {
+		storage := new(mockDBStorage)
+		storage.On("CheckLedger").Return([]db.LedgerMismatch{}, nil)
+		out := &bytes.Buffer{}
+		assert.NoError(t, Run(storage, "cli:test", []string{"ledger", "check"}, out))
+		assert.Equal(t, "accounts are consistent with the ledger\n", out.String())
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		storage := new(mockDBStorage)
+		storage.On("CheckLedger").Return([]db.LedgerMismatch{{UserID: "1", Current: 1050, LedgerCurrent: 1000}}, nil)
+		out := &bytes.Buffer{}
+		assert.ErrorIs(t, Run(storage, "cli:test", []string{"ledger", "check"}, out), ErrLedgerMismatch)
+		assert.Contains(t, out.String(), `"user_id":"1","current":10.5`)
+	})
+}
+
+func TestRun_reconcile(t *testing.T) {
+	t.Run("reconciled", func(t *testing.T) {
+		storage := new(mockDBStorage)
+		storage.On("Reconcile", false).Return(&db.ReconciliationReport{Accounts: 3, Discrepancies: []db.Discrepancy{}}, nil)
+		out := &bytes.Buffer{}
+		assert.NoError(t, Run(storage, "cli:test", []string{"reconcile"}, out))
+		assert.Equal(t, "3 accounts are reconciled\n", out.String())
+	})
+
+	t.Run("discrepancy saved", func(t *testing.T) {
+		storage := new(mockDBStorage)
+		storage.On("Reconcile", true).Return(&db.ReconciliationReport{
+			ID: 7, Accounts: 3, Discrepancies: []db.Discrepancy{{UserID: "1", Current: 1050, ExpectedCurrent: 1000}},
+		}, nil)
+		out := &bytes.Buffer{}
+		assert.ErrorIs(t, Run(storage, "cli:test", []string{"reconcile", "save"}, out), ErrReconciliationMismatch)
+		assert.Contains(t, out.String(), `"user_id":"1","current":10.5,"expected_current":10`)
+		assert.Contains(t, out.String(), "report 7 saved\n")
+	})
+
+	t.Run("usage", func(t *testing.T) {
+		assert.ErrorIs(t, Run(new(mockDBStorage), "cli:test", []string{"reconcile", "now"}, &bytes.Buffer{}), ErrUsage)
+	})
+}
@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"gophermart/internal/db"
+	"gophermart/internal/money"
+	"gophermart/internal/order/model"
+	"io"
+	"strconv"
+	"strings"
+)
+
+func deadLetter(storage db.Storage, actor string, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+	switch args[0] {
+	case "list":
+		orders, err := storage.GetDeadLetterOrders()
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(out)
+		for i := 0; i < len(orders); i++ {
+			if err := encoder.Encode(orders[i].ToAPI()); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "retry":
+		if len(args) != 2 {
+			return ErrUsage
+		}
+		number, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		if err := storage.RetryDeadLetterOrder(number, actor); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "order %v returned to processing\n", number)
+		return nil
+
+	case "resolve":
+		if len(args) < 5 {
+			return ErrUsage
+		}
+		number, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		status, ok := model.ParseFinalStatus(args[2])
+		if !ok {
+			return db.ErrInvalidResolveStatus
+		}
+		accrual, err := money.Parse(args[3])
+		if err != nil || accrual < 0 {
+			return fmt.Errorf("bad accrual %q", args[3])
+		}
+		reason := strings.Join(args[4:], " ")
+		if err := storage.ResolveDeadLetterOrder(number, status, accrual, actor, reason); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "order %v resolved as %v\n", number, args[2])
+		return nil
+	}
+	return ErrUsage
+}
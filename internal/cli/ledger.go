@@ -0,0 +1,33 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gophermart/internal/db"
+	"io"
+)
+
+var ErrLedgerMismatch = errors.New("accounts differ from the ledger")
+
+// ledger check prints accounts inconsistent with the ledger and fails if there are any.
+func ledger(storage db.Storage, actor string, args []string, out io.Writer) error {
+	if len(args) != 1 || args[0] != "check" {
+		return ErrUsage
+	}
+	mismatches, err := storage.CheckLedger()
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(out)
+	for i := 0; i < len(mismatches); i++ {
+		if err := encoder.Encode(mismatches[i]); err != nil {
+			return err
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%w: %v accounts", ErrLedgerMismatch, len(mismatches))
+	}
+	fmt.Fprintln(out, "accounts are consistent with the ledger")
+	return nil
+}
@@ -0,0 +1,37 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gophermart/internal/db"
+	"io"
+)
+
+var ErrReconciliationMismatch = errors.New("accounts differ from recomputed balances")
+
+// reconcile prints accounts whose balances differ from the ones recomputed from orders, withdrawals and
+// other operations and fails if there are any, "reconcile save" also saves the report.
+func reconcile(storage db.Storage, actor string, args []string, out io.Writer) error {
+	if len(args) > 1 || (len(args) == 1 && args[0] != "save") {
+		return ErrUsage
+	}
+	report, err := storage.Reconcile(len(args) == 1)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(out)
+	for i := 0; i < len(report.Discrepancies); i++ {
+		if err := encoder.Encode(report.Discrepancies[i]); err != nil {
+			return err
+		}
+	}
+	if report.ID != 0 {
+		fmt.Fprintf(out, "report %v saved\n", report.ID)
+	}
+	if len(report.Discrepancies) > 0 {
+		return fmt.Errorf("%w: %v of %v accounts", ErrReconciliationMismatch, len(report.Discrepancies), report.Accounts)
+	}
+	fmt.Fprintf(out, "%v accounts are reconciled\n", report.Accounts)
+	return nil
+}
@@ -1,20 +1,209 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"gophermart/internal/money"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+
 	"github.com/caarlos0/env/v6"
 )
 
+// Modes select which parts of the service are run by the process.
+const (
+	ModeServe  = "serve"
+	ModeWorker = "worker"
+	ModeAll    = "all"
+	// ModeCLI is used by maintenance commands, they need only the database.
+	ModeCLI = "cli"
+)
+
 type Config struct {
-	Address                string `env:"RUN_ADDRESS,required"`
-	DBURL                  string `env:"DATABASE_URI,required"`
-	ProcessingAddress      string `env:"ACCRUAL_SYSTEM_ADDRESS,required"`
+	Mode              string `env:"MODE" envDefault:"all"`
+	Address           string `env:"RUN_ADDRESS"`
+	HealthAddress     string `env:"HEALTH_ADDRESS" envDefault:"localhost:8090"`
+	DBURL             string `env:"DATABASE_URI,required"`
+	ProcessingAddress string `env:"ACCRUAL_SYSTEM_ADDRESS"`
+	// AccrualCallbackSecret verifies callbacks of the default provider unless it sets callback_secret.
+	AccrualCallbackSecret string `env:"ACCRUAL_CALLBACK_SECRET"`
+	// AccrualCallbackMaxAge is how far the signed time of an accrual callback may be from now.
+	AccrualCallbackMaxAge  time.Duration `env:"ACCRUAL_CALLBACK_MAX_AGE" envDefault:"5m"`
+	PartnerAPISecret       string        `env:"PARTNER_API_SECRET"`
 	OrdersUpdateCountInPar int
+
+	// AccrualStatuses maps extra accrual system statuses on order statuses, e.g. "ACCEPTED:REGISTERED,CALCULATING:PROCESSING".
+	AccrualStatuses map[string]string `env:"ACCRUAL_STATUS_MAPPING"`
+	// AccrualBatchLookup polls orders with POST /api/orders/batch, per order lookups are used when it is not supported.
+	AccrualBatchLookup bool `env:"ACCRUAL_BATCH_LOOKUP" envDefault:"false"`
+	// AccrualProvidersFile is a JSON registry of accrual providers and routing rules, see loadProviders.
+	AccrualProvidersFile   string `env:"ACCRUAL_PROVIDERS_FILE"`
+	AccrualProviders       []AccrualProvider
+	AccrualRoutes          []AccrualRoute
+	DefaultAccrualProvider string
+	// MerchantSecrets verify merchants of uploaded orders by merchant id.
+	MerchantSecrets map[string]string
+	AccrualAuth     AccrualAuth
+
+	// InstanceID identifies the replica in processing leader election, hostname-pid by default.
+	InstanceID          string        `env:"INSTANCE_ID"`
+	ProcessingShards    int           `env:"PROCESSING_SHARDS" envDefault:"1"`
+	ProcessingMaxShards int           `env:"PROCESSING_MAX_SHARDS" envDefault:"0"`
+	LeaseRenewInterval  time.Duration `env:"PROCESSING_LEASE_RENEW_INTERVAL" envDefault:"1s"`
+	LeaseTTL            time.Duration `env:"PROCESSING_LEASE_TTL" envDefault:"5s"`
+	// MaxFailedAttempts moves an order to dead letter after so many failed lookups in a row, 0 disables the policy.
+	MaxFailedAttempts int `env:"PROCESSING_MAX_FAILED_ATTEMPTS" envDefault:"100"`
+
+	// WithdrawalHoldTTL is how long a pending withdrawal holds points before it expires.
+	WithdrawalHoldTTL time.Duration `env:"WITHDRAWAL_HOLD_TTL" envDefault:"15m"`
+
+	// Withdrawal limits, sums are decimal numbers of points parsed with the money settings, empty or 0 disables a rule.
+	WithdrawalMinSum      string        `env:"WITHDRAWAL_MIN_SUM"`
+	WithdrawalMaxSum      string        `env:"WITHDRAWAL_MAX_SUM"`
+	WithdrawalDailySum    string        `env:"WITHDRAWAL_DAILY_LIMIT"`
+	WithdrawalMonthlySum  string        `env:"WITHDRAWAL_MONTHLY_LIMIT"`
+	WithdrawalHourlyCount int           `env:"WITHDRAWAL_HOURLY_COUNT" envDefault:"0"`
+	WithdrawalCoolingOff  time.Duration `env:"WITHDRAWAL_COOLING_OFF" envDefault:"0s"`
+
+	// Transfer limits and fees, sums are parsed as withdrawal limits, TransferFeePercent is a decimal percent of the sum.
+	TransferMinSum     string `env:"TRANSFER_MIN_SUM"`
+	TransferMaxSum     string `env:"TRANSFER_MAX_SUM"`
+	TransferDailySum   string `env:"TRANSFER_DAILY_LIMIT"`
+	TransferFeeFixed   string `env:"TRANSFER_FEE_FIXED"`
+	TransferFeePercent string `env:"TRANSFER_FEE_PERCENT"`
+
+	// Referral bonuses credited to the referrer and the referred user for the first processed order of the latter,
+	// sums are parsed as withdrawal limits.
+	ReferralReferrerBonus string `env:"REFERRAL_REFERRER_BONUS"`
+	ReferralRefereeBonus  string `env:"REFERRAL_REFEREE_BONUS"`
+
+	// AdjustmentApprovalThreshold is the largest absolute manual adjustment applied without approval of another admin,
+	// it is parsed as withdrawal limits, empty or 0 applies all adjustments at once.
+	AdjustmentApprovalThreshold string `env:"ADJUSTMENT_APPROVAL_THRESHOLD"`
+
+	// LoyaltyTiers are tiers as name:threshold:multiplier separated by commas, e.g. "silver:1000:1.1,gold:5000:1.25",
+	// thresholds are compared with accruals or spend of the user in LoyaltyTierPeriod.
+	LoyaltyTiers              string        `env:"LOYALTY_TIERS"`
+	LoyaltyTierBasis          string        `env:"LOYALTY_TIER_BASIS" envDefault:"accrual"`
+	LoyaltyTierPeriod         time.Duration `env:"LOYALTY_TIER_PERIOD" envDefault:"2160h"`
+	LoyaltyTierRecalcInterval time.Duration `env:"LOYALTY_TIER_RECALC_INTERVAL" envDefault:"1h"`
+
+	// PointsExpireMonths is how many months accrued points live, 0 keeps them forever.
+	PointsExpireMonths int `env:"POINTS_EXPIRE_MONTHS" envDefault:"0"`
+	// PointsExpiringWithin is the period of the expiring soon section of the balance, 0 hides the section.
+	PointsExpiringWithin time.Duration `env:"POINTS_EXPIRING_WITHIN" envDefault:"720h"`
+
+	// ReconciliationHour is the UTC hour when balances are reconciled once a day, -1 disables the job.
+	ReconciliationHour int `env:"RECONCILIATION_HOUR" envDefault:"3"`
+	// ReconciliationReport saves reports of the job to reconciliation_reports.
+	ReconciliationReport bool `env:"RECONCILIATION_REPORT" envDefault:"false"`
+
+	// IdempotencyKeyTTL is how long responses are replayed for retries with the same Idempotency-Key.
+	IdempotencyKeyTTL time.Duration `env:"IDEMPOTENCY_KEY_TTL" envDefault:"24h"`
+	// IdempotencyKeyLease is how long a key stays reserved by a request that has not saved its response.
+	IdempotencyKeyLease time.Duration `env:"IDEMPOTENCY_KEY_LEASE" envDefault:"1m"`
+
+	// AdminIDs are ids of users allowed to call admin endpoints.
+	AdminIDs []string `env:"ADMIN_IDS" envSeparator:","`
+
+	// MoneyScale is the number of stored fraction digits of points, it must not change once amounts are stored.
+	MoneyScale    int    `env:"MONEY_SCALE" envDefault:"2"`
+	MoneyRounding string `env:"MONEY_ROUNDING" envDefault:"half_up"`
 }
 
-func NewConfig() (*Config, error) {
+// NewConfig parses config from environment, non empty mode overrides MODE variable.
+func NewConfig(mode string) (*Config, error) {
 	var cfg Config
-	err := env.Parse(&cfg)
+	if err := env.Parse(&cfg); err != nil {
+		return nil, err
+	}
 	cfg.OrdersUpdateCountInPar = 10
 
-	return &cfg, err
+	if mode != "" {
+		cfg.Mode = mode
+	}
+	if cfg.InstanceID == "" {
+		hostname, _ := os.Hostname()
+		cfg.InstanceID = fmt.Sprintf("%v-%v", hostname, os.Getpid())
+	}
+	if cfg.ProcessingShards < 1 {
+		cfg.ProcessingShards = 1
+	}
+	if err := cfg.loadProviders(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, cfg.validate()
+}
+
+// String hides secrets and the database password, so that the config can be logged.
+func (cfg Config) String() string {
+	type plain Config
+	c := plain(cfg)
+	c.DBURL = redactDBURL(c.DBURL)
+	c.AccrualCallbackSecret = redact(c.AccrualCallbackSecret)
+	c.PartnerAPISecret = redact(c.PartnerAPISecret)
+	c.AccrualAuth = c.AccrualAuth.redacted()
+	c.MerchantSecrets = make(map[string]string, len(cfg.MerchantSecrets))
+	for id, secret := range cfg.MerchantSecrets {
+		c.MerchantSecrets[id] = redact(secret)
+	}
+	c.AccrualProviders = make([]AccrualProvider, len(cfg.AccrualProviders))
+	for i, p := range cfg.AccrualProviders {
+		c.AccrualProviders[i] = p.redacted()
+	}
+	return fmt.Sprintf("%+v", c)
+}
+
+const redactedValue = "xxxxx"
+
+var dsnPassword = regexp.MustCompile(`(password=)('[^']*'|[^\s&]*)`)
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// redactDBURL hides the password of both URL and key=value connection strings.
+func redactDBURL(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		dsn = u.Redacted()
+	}
+	return dsnPassword.ReplaceAllString(dsn, "${1}"+redactedValue)
+}
+
+func (cfg *Config) validate() error {
+	if _, err := money.ParseRounding(cfg.MoneyRounding); err != nil {
+		return err
+	}
+	if cfg.MoneyScale < 0 || cfg.MoneyScale > money.MaxScale {
+		return fmt.Errorf("money scale %v is out of [0, %v]", cfg.MoneyScale, money.MaxScale)
+	}
+	if cfg.LoyaltyTierBasis != "accrual" && cfg.LoyaltyTierBasis != "spend" {
+		return fmt.Errorf("unknown loyalty tier basis %q", cfg.LoyaltyTierBasis)
+	}
+	if cfg.ReconciliationHour < -1 || cfg.ReconciliationHour > 23 {
+		return fmt.Errorf("reconciliation hour %v is out of [-1, 23]", cfg.ReconciliationHour)
+	}
+	if cfg.PointsExpireMonths < 0 {
+		return fmt.Errorf("points expire months %v is negative", cfg.PointsExpireMonths)
+	}
+	switch cfg.Mode {
+	case ModeServe, ModeWorker, ModeAll:
+	case ModeCLI:
+		return nil
+	default:
+		return fmt.Errorf("unknown mode %q", cfg.Mode)
+	}
+	if cfg.Mode != ModeWorker && cfg.Address == "" {
+		return errors.New(`required environment variable "RUN_ADDRESS" is not set`)
+	}
+	if err := validateStatuses(cfg.AccrualStatuses); err != nil {
+		return err
+	}
+	return cfg.validateProviders()
 }
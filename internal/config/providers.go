@@ -0,0 +1,222 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gophermart/internal/order/model"
+	"os"
+)
+
+// DefaultProvider is the name of the provider built from ACCRUAL_SYSTEM_ADDRESS when no providers file is set.
+const DefaultProvider = "default"
+
+// Outbound authentication strategies of accrual providers.
+const (
+	AuthNone   = ""
+	AuthAPIKey = "api_key"
+	AuthHMAC   = "hmac"
+	AuthMTLS   = "mtls"
+)
+
+// maxCurrencyLength is the length of currency codes stored with accounts.
+const maxCurrencyLength = 16
+
+// AccrualAuth is outbound authentication of requests to an accrual provider,
+// env variables configure the provider built from ACCRUAL_SYSTEM_ADDRESS.
+type AccrualAuth struct {
+	// AuthType is one of the strategies, api key is used when it is empty and APIKey is set.
+	AuthType     string `json:"auth_type" env:"ACCRUAL_AUTH_TYPE"`
+	APIKey       string `json:"api_key" env:"ACCRUAL_API_KEY"`
+	APIKeyHeader string `json:"api_key_header" env:"ACCRUAL_API_KEY_HEADER" envDefault:"X-Api-Key"`
+	HMACSecret   string `json:"hmac_secret" env:"ACCRUAL_HMAC_SECRET"`
+	CertFile     string `json:"cert_file" env:"ACCRUAL_CLIENT_CERT_FILE"`
+	KeyFile      string `json:"key_file" env:"ACCRUAL_CLIENT_KEY_FILE"`
+	// CAFile is a PEM bundle verifying the provider certificate, system roots are used when it is empty.
+	CAFile string `json:"ca_file" env:"ACCRUAL_CA_FILE"`
+}
+
+// redacted hides the api key and the hmac secret.
+func (a AccrualAuth) redacted() AccrualAuth {
+	a.APIKey = redact(a.APIKey)
+	a.HMACSecret = redact(a.HMACSecret)
+	return a
+}
+
+// Strategy resolves empty AuthType.
+func (a AccrualAuth) Strategy() string {
+	if a.AuthType == AuthNone && a.APIKey != "" {
+		return AuthAPIKey
+	}
+	return a.AuthType
+}
+
+func (a AccrualAuth) validate() error {
+	switch a.Strategy() {
+	case AuthNone:
+	case AuthAPIKey:
+		if a.APIKey == "" {
+			return errors.New("api key is not set")
+		}
+	case AuthHMAC:
+		if a.HMACSecret == "" {
+			return errors.New("hmac secret is not set")
+		}
+	case AuthMTLS:
+		if a.CertFile == "" || a.KeyFile == "" {
+			return errors.New("client certificate and key files are required by mtls")
+		}
+	default:
+		return fmt.Errorf("unknown auth type %q", a.AuthType)
+	}
+	return nil
+}
+
+// AccrualProvider is an accrual system computing rewards for the orders routed to it.
+type AccrualProvider struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	AccrualAuth
+	// RateLimit is a number of requests per minute, 0 means no limit.
+	RateLimit int  `json:"rate_limit"`
+	Batch     bool `json:"batch"`
+	// Statuses override ACCRUAL_STATUS_MAPPING for the provider.
+	Statuses map[string]string `json:"statuses"`
+	// Currency is the code of the points the provider pays accruals in, empty code is the platform's own points.
+	Currency string `json:"currency"`
+	// CallbackSecret verifies callbacks of the provider, callbacks are disabled when it is empty.
+	CallbackSecret string `json:"callback_secret"`
+}
+
+// redacted hides secrets of the provider.
+func (p AccrualProvider) redacted() AccrualProvider {
+	p.AccrualAuth = p.AccrualAuth.redacted()
+	p.CallbackSecret = redact(p.CallbackSecret)
+	return p
+}
+
+// AccrualRoute sends orders to Provider when all of the set conditions match:
+// number starts with Prefix, number is within [From, To], order is uploaded for Merchant verified by its secret.
+type AccrualRoute struct {
+	Provider string `json:"provider"`
+	Prefix   string `json:"prefix"`
+	From     uint64 `json:"from"`
+	To       uint64 `json:"to"`
+	Merchant string `json:"merchant"`
+}
+
+type providersFile struct {
+	Default   string            `json:"default"`
+	Providers []AccrualProvider `json:"providers"`
+	Routes    []AccrualRoute    `json:"routes"`
+	Merchants map[string]string `json:"merchants"`
+}
+
+// loadProviders reads providers registry from ACCRUAL_PROVIDERS_FILE,
+// without the file all orders go to ACCRUAL_SYSTEM_ADDRESS.
+func (cfg *Config) loadProviders() error {
+	if cfg.AccrualProvidersFile == "" {
+		cfg.AccrualProviders = []AccrualProvider{{
+			Name:           DefaultProvider,
+			URL:            cfg.ProcessingAddress,
+			AccrualAuth:    cfg.AccrualAuth,
+			Batch:          cfg.AccrualBatchLookup,
+			CallbackSecret: cfg.AccrualCallbackSecret,
+		}}
+		cfg.DefaultAccrualProvider = DefaultProvider
+		return nil
+	}
+
+	data, err := os.ReadFile(cfg.AccrualProvidersFile)
+	if err != nil {
+		return err
+	}
+	var file providersFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%v: %w", cfg.AccrualProvidersFile, err)
+	}
+	for i := range file.Providers {
+		if file.Providers[i].APIKeyHeader == "" {
+			file.Providers[i].APIKeyHeader = cfg.AccrualAuth.APIKeyHeader
+		}
+	}
+	cfg.AccrualProviders = file.Providers
+	cfg.AccrualRoutes = file.Routes
+	cfg.MerchantSecrets = file.Merchants
+	cfg.DefaultAccrualProvider = file.Default
+	if cfg.DefaultAccrualProvider == "" && len(file.Providers) > 0 {
+		cfg.DefaultAccrualProvider = file.Providers[0].Name
+	}
+	// ACCRUAL_CALLBACK_SECRET is kept for callbacks of the default provider only
+	for i := range cfg.AccrualProviders {
+		if p := &cfg.AccrualProviders[i]; p.Name == cfg.DefaultAccrualProvider && p.CallbackSecret == "" {
+			p.CallbackSecret = cfg.AccrualCallbackSecret
+		}
+	}
+	return nil
+}
+
+// HasAccrualCallbacks reports whether any provider may push accrual results.
+func (cfg *Config) HasAccrualCallbacks() bool {
+	for _, p := range cfg.AccrualProviders {
+		if p.CallbackSecret != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *Config) validateProviders() error {
+	if len(cfg.AccrualProviders) == 0 {
+		return errors.New("no accrual providers configured")
+	}
+	names := make(map[string]bool, len(cfg.AccrualProviders))
+	for _, p := range cfg.AccrualProviders {
+		if p.Name == "" || names[p.Name] {
+			return fmt.Errorf("accrual provider name %q is empty or duplicated", p.Name)
+		}
+		names[p.Name] = true
+		if cfg.Mode != ModeServe && p.URL == "" {
+			if p.Name == DefaultProvider && cfg.AccrualProvidersFile == "" {
+				return errors.New(`required environment variable "ACCRUAL_SYSTEM_ADDRESS" is not set`)
+			}
+			return fmt.Errorf("accrual provider %v has no url", p.Name)
+		}
+		if p.RateLimit < 0 {
+			return fmt.Errorf("accrual provider %v has negative rate limit", p.Name)
+		}
+		if err := p.AccrualAuth.validate(); err != nil {
+			return fmt.Errorf("accrual provider %v: %w", p.Name, err)
+		}
+		if err := validateStatuses(p.Statuses); err != nil {
+			return fmt.Errorf("accrual provider %v: %w", p.Name, err)
+		}
+		if len(p.Currency) > maxCurrencyLength {
+			return fmt.Errorf("accrual provider %v: currency code %q is longer than %v", p.Name, p.Currency, maxCurrencyLength)
+		}
+	}
+	if !names[cfg.DefaultAccrualProvider] {
+		return fmt.Errorf("unknown default accrual provider %q", cfg.DefaultAccrualProvider)
+	}
+	for i, r := range cfg.AccrualRoutes {
+		if !names[r.Provider] {
+			return fmt.Errorf("route %v: unknown accrual provider %q", i, r.Provider)
+		}
+		if r.To != 0 && r.From > r.To {
+			return fmt.Errorf("route %v: empty range [%v, %v]", i, r.From, r.To)
+		}
+		if r.Merchant != "" && cfg.MerchantSecrets[r.Merchant] == "" {
+			return fmt.Errorf("route %v: merchant %q has no secret", i, r.Merchant)
+		}
+	}
+	return nil
+}
+
+func validateStatuses(statuses map[string]string) error {
+	for external, name := range statuses {
+		if status, ok := model.ParseStatus(name); !ok || status == model.New || status == model.DeadLetter {
+			return fmt.Errorf("accrual status %v can't be mapped on %q", external, name)
+		}
+	}
+	return nil
+}
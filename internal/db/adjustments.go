@@ -0,0 +1,175 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"gophermart/internal/money"
+
+	accountModel "gophermart/internal/account/model/db"
+	adjustmentModel "gophermart/internal/adjustment/model/db"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// AdjustmentRules decide which manual adjustments need a second admin.
+type AdjustmentRules struct {
+	// ApprovalThreshold is the largest absolute amount applied without approval, 0 applies all adjustments at once.
+	ApprovalThreshold money.Money
+}
+
+var ErrAdjustmentNotFound = errors.New("adjustment not found")
+var ErrAdjustmentNotPending = errors.New("the adjustment is already applied or rejected")
+var ErrAdjustmentSelfApproval = errors.New("the adjustment must be approved by another admin")
+
+const (
+	selectAdjustmentsSQL = `
+	select a.id, a.user_id, u.login, a.amount, a.reason, a.ticket, a.status, a.created_by, a.created_at, a.decided_by, a.decided_at
+	from adjustments a join users u on u.id = a.user_id`
+	selectAllAdjustmentsSQL      = selectAdjustmentsSQL + ` order by a.created_at, a.id`
+	selectAdjustmentSQL          = selectAdjustmentsSQL + ` where a.id = $1`
+	selectAdjustmentForUpdateSQL = `select id, user_id, amount, status, created_by from adjustments where id = $1 for update`
+	insertAdjustmentSQL          = `
+	insert into adjustments(user_id, amount, reason, ticket, status, created_by) values($1, $2, $3, $4, $5, $6) returning id`
+	decideAdjustmentSQL       = `update adjustments set status = $2, decided_by = $3, decided_at = now() where id = $1`
+	insertAdjustmentEventSQL  = `insert into adjustment_events(adjustment_id, status, actor, comment) values($1, $2, $3, $4)`
+	selectAdjustmentEventsSQL = `
+	select status, actor, comment, created_at from adjustment_events where adjustment_id = $1 order by created_at, id`
+	insertAdjustmentEntrySQL = `insert into ledger_entries(user_id, amount, type, adjustment_id) values($1, $2, $3, $4)`
+)
+
+// CreateAdjustment credits amount to the user with login, negative amount is a debit. Adjustments above
+// the approval threshold stay Pending until another admin approves them.
+func (db *storageImpl) CreateAdjustment(login string, amount money.Money, reason, ticket, actor string) (*adjustmentModel.Adjustment, error) {
+	var UserID string
+	if err := db.xdb.GetContext(db.ctx, &UserID, getUserIDByLoginSQL, login); err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.xdb.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	status := adjustmentModel.Applied
+	threshold := db.policy.AdjustmentRules.ApprovalThreshold
+	if threshold > 0 && (amount > threshold || -amount > threshold) {
+		status = adjustmentModel.Pending
+	}
+	var ID int64
+	if err := tx.GetContext(db.ctx, &ID, insertAdjustmentSQL, UserID, amount, reason, ticket, status, actor); err != nil {
+		return nil, err
+	}
+	if status == adjustmentModel.Applied {
+		if err := db.applyAdjustment(tx, ID, UserID, amount); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.ExecContext(db.ctx, insertAdjustmentEventSQL, ID, status, actor, nil); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return db.GetAdjustment(ID)
+}
+
+// ApproveAdjustment applies the pending adjustment, it can't be approved by the admin who created it.
+func (db *storageImpl) ApproveAdjustment(ID int64, actor string) (*adjustmentModel.Adjustment, error) {
+	return db.decideAdjustment(ID, adjustmentModel.Applied, actor, "")
+}
+
+// RejectAdjustment rejects the pending adjustment, the balance is not changed.
+func (db *storageImpl) RejectAdjustment(ID int64, actor, reason string) (*adjustmentModel.Adjustment, error) {
+	return db.decideAdjustment(ID, adjustmentModel.Rejected, actor, reason)
+}
+
+func (db *storageImpl) decideAdjustment(ID int64, status adjustmentModel.AdjustmentStatus, actor, comment string) (*adjustmentModel.Adjustment, error) {
+	tx, err := db.xdb.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var adjustment adjustmentModel.Adjustment
+	if err := tx.GetContext(db.ctx, &adjustment, selectAdjustmentForUpdateSQL, ID); err == sql.ErrNoRows {
+		return nil, ErrAdjustmentNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if adjustment.Status != adjustmentModel.Pending {
+		return nil, ErrAdjustmentNotPending
+	}
+	if status == adjustmentModel.Applied {
+		if adjustment.CreatedBy == actor {
+			return nil, ErrAdjustmentSelfApproval
+		}
+		if err := db.applyAdjustment(tx, ID, adjustment.UserID, adjustment.Amount); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.ExecContext(db.ctx, decideAdjustmentSQL, ID, status, actor); err != nil {
+		return nil, err
+	}
+	var eventComment *string
+	if comment != "" {
+		eventComment = &comment
+	}
+	if _, err := tx.ExecContext(db.ctx, insertAdjustmentEventSQL, ID, status, actor, eventComment); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return db.GetAdjustment(ID)
+}
+
+// applyAdjustment changes the balance in the default currency, a debit takes the points from the earliest expiring lots and
+// can't exceed the current balance.
+func (db *storageImpl) applyAdjustment(tx *sqlx.Tx, ID int64, UserID string, amount money.Money) error {
+	var acc accountModel.Account
+	if err := tx.GetContext(db.ctx, &acc, getUserAccountForUpdate, UserID, DefaultCurrency); err == sql.ErrNoRows {
+		return ErrUserNotFound
+	} else if err != nil {
+		return err
+	}
+	if amount < 0 {
+		if acc.Current < -amount {
+			return ErrBalanceLimitExhausted
+		}
+		if _, err := db.takeFromLots(tx, UserID, DefaultCurrency, 0, -amount); err != nil {
+			return err
+		}
+	} else if _, err := tx.ExecContext(db.ctx, insertLotSQL, UserID, nil, amount, db.lotExpiresAt(), DefaultCurrency); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(db.ctx, creditAccountSQL, UserID, amount, DefaultCurrency); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(db.ctx, insertAdjustmentEntrySQL, UserID, amount, LedgerAdjustment, ID)
+	return err
+}
+
+func (db *storageImpl) GetAdjustments() ([]adjustmentModel.Adjustment, error) {
+	adjustments := []adjustmentModel.Adjustment{}
+	if err := db.xdb.SelectContext(db.ctx, &adjustments, selectAllAdjustmentsSQL); err != nil {
+		return nil, err
+	}
+	return adjustments, nil
+}
+
+// GetAdjustment returns the adjustment with its history.
+func (db *storageImpl) GetAdjustment(ID int64) (*adjustmentModel.Adjustment, error) {
+	var adjustment adjustmentModel.Adjustment
+	if err := db.xdb.GetContext(db.ctx, &adjustment, selectAdjustmentSQL, ID); err == sql.ErrNoRows {
+		return nil, ErrAdjustmentNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if err := db.xdb.SelectContext(db.ctx, &adjustment.History, selectAdjustmentEventsSQL, ID); err != nil {
+		return nil, err
+	}
+	return &adjustment, nil
+}
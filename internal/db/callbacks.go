@@ -0,0 +1,37 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrCallbackReplayed = errors.New("accrual callback is already received")
+
+const (
+	deleteExpiredCallbacksSQL = `delete from accrual_callbacks where received_at < now() - $1 * interval '1 millisecond'`
+	insertCallbackSQL         = `insert into accrual_callbacks(signature) values($1) on conflict do nothing`
+)
+
+// SaveCallbackSignature remembers the signature of an accrual callback for ttl, the same signature is
+// rejected with ErrCallbackReplayed until then.
+func (db *storageImpl) SaveCallbackSignature(signature string, ttl time.Duration) error {
+	tx, err := db.xdb.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(db.ctx, deleteExpiredCallbacksSQL, ttl.Milliseconds()); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(db.ctx, insertCallbackSQL, signature)
+	if err != nil {
+		return err
+	}
+	if inserted, err := res.RowsAffected(); err != nil {
+		return err
+	} else if inserted == 0 {
+		return ErrCallbackReplayed
+	}
+	return tx.Commit()
+}
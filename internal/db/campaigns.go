@@ -0,0 +1,211 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"gophermart/internal/money"
+	"gophermart/internal/order/model"
+
+	campaignModel "gophermart/internal/campaign/model/db"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrCampaignNotFound = errors.New("campaign not found")
+var ErrCampaignInUse = errors.New("the campaign has credited bonuses")
+
+const (
+	campaignColumns = `
+	id, name, starts_at, ends_at, first_order, min_accrual, tiers, providers, bonus_fixed, bonus_percent, budget, spent, created_at`
+	insertCampaignSQL = `
+	insert into campaigns(name, starts_at, ends_at, first_order, min_accrual, tiers, providers, bonus_fixed, bonus_percent, budget)
+	values(:name, :starts_at, :ends_at, :first_order, :min_accrual, :tiers, :providers, :bonus_fixed, :bonus_percent, :budget)
+	returning ` + campaignColumns
+	updateCampaignSQL = `
+	update campaigns set name = :name, starts_at = :starts_at, ends_at = :ends_at, first_order = :first_order,
+		min_accrual = :min_accrual, tiers = :tiers, providers = :providers, bonus_fixed = :bonus_fixed,
+		bonus_percent = :bonus_percent, budget = :budget
+	where id = :id
+	returning ` + campaignColumns
+	selectCampaignsSQL         = `select ` + campaignColumns + ` from campaigns order by id`
+	selectCampaignSQL          = `select ` + campaignColumns + ` from campaigns where id = $1`
+	selectCampaignForUpdateSQL = `select spent from campaigns where id = $1 for update`
+	deleteCampaignSQL          = `delete from campaigns where id = $1`
+
+	// running campaigns are locked so that concurrent batches don't overspend their budgets
+	selectRunningCampaignsSQL = `
+	select ` + campaignColumns + ` from campaigns
+	where starts_at <= now() and (ends_at is null or ends_at > now()) and (budget = 0 or spent < budget)
+	order by id for update`
+	// processed_before counts processed orders of the user outside of the batch, bonuses are credited for
+	// accruals in the default currency only
+	selectCampaignOrdersSQL = `
+	select o.number, o.user_id, o.accrual, coalesce(o.provider, '') as provider, coalesce(a.tier, '') as tier, (
+		select count(1) from orders p where p.user_id = o.user_id and p.status = ? and p.number not in (?)
+	) as processed_before
+	from orders o join accounts a on a.user_id = o.user_id and a.currency = o.currency
+	where o.number in (?) and o.status = ? and o.currency = ?
+	order by o.uploaded_at, o.number`
+	addCampaignSpentSQL    = `update campaigns set spent = spent + $2 where id = $1`
+	insertCampaignEntrySQL = `
+	insert into ledger_entries(user_id, amount, type, order_number, campaign_id) values($1, $2, $3, $4, $5)`
+)
+
+func (db *storageImpl) CreateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	return db.saveCampaign(insertCampaignSQL, campaign)
+}
+
+// UpdateCampaign changes the rules of the campaign, bonuses already credited are kept.
+func (db *storageImpl) UpdateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	return db.saveCampaign(updateCampaignSQL, campaign)
+}
+
+func (db *storageImpl) saveCampaign(query string, campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	rows, err := db.xdb.NamedQueryContext(db.ctx, query, campaign)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrCampaignNotFound
+	}
+	var saved campaignModel.Campaign
+	if err := rows.StructScan(&saved); err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+func (db *storageImpl) GetCampaigns() ([]campaignModel.Campaign, error) {
+	campaigns := []campaignModel.Campaign{}
+	if err := db.xdb.SelectContext(db.ctx, &campaigns, selectCampaignsSQL); err != nil {
+		return nil, err
+	}
+	return campaigns, nil
+}
+
+func (db *storageImpl) GetCampaign(ID int64) (*campaignModel.Campaign, error) {
+	var campaign campaignModel.Campaign
+	if err := db.xdb.GetContext(db.ctx, &campaign, selectCampaignSQL, ID); err == sql.ErrNoRows {
+		return nil, ErrCampaignNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &campaign, nil
+}
+
+// DeleteCampaign deletes the campaign that has not credited any bonus yet, the others can only be ended.
+func (db *storageImpl) DeleteCampaign(ID int64) error {
+	tx, err := db.xdb.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var spent money.Money
+	if err := tx.GetContext(db.ctx, &spent, selectCampaignForUpdateSQL, ID); err == sql.ErrNoRows {
+		return ErrCampaignNotFound
+	} else if err != nil {
+		return err
+	}
+	if spent > 0 {
+		return ErrCampaignInUse
+	}
+	if _, err := tx.ExecContext(db.ctx, deleteCampaignSQL, ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type campaignOrder struct {
+	Number          uint64      `db:"number"`
+	UserID          string      `db:"user_id"`
+	Accrual         money.Money `db:"accrual"`
+	Provider        string      `db:"provider"`
+	Tier            string      `db:"tier"`
+	ProcessedBefore int         `db:"processed_before"`
+}
+
+// applyCampaigns credits bonuses of running campaigns for orders of nums that became PROCESSED, an order gets
+// the bonus of every campaign it matches. The bonus is cut to the rest of the campaign budget.
+func (db *storageImpl) applyCampaigns(tx *sqlx.Tx, nums []int64) error {
+	campaigns := []campaignModel.Campaign{}
+	if err := tx.SelectContext(db.ctx, &campaigns, selectRunningCampaignsSQL); err != nil {
+		return err
+	}
+	if len(campaigns) == 0 {
+		return nil
+	}
+	query, args, err := sqlx.In(selectCampaignOrdersSQL, model.Processed, nums, nums, model.Processed, DefaultCurrency)
+	if err != nil {
+		return err
+	}
+	orders := []campaignOrder{}
+	if err := tx.SelectContext(db.ctx, &orders, tx.Rebind(query), args...); err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, o := range orders {
+		first := o.ProcessedBefore == 0 && !seen[o.UserID]
+		seen[o.UserID] = true
+		for i := range campaigns {
+			c := &campaigns[i]
+			if !campaignMatches(c, o, first) {
+				continue
+			}
+			bonus, err := o.Accrual.Mul(c.Rate())
+			if err != nil {
+				return err
+			}
+			bonus += c.BonusFixed
+			if c.Budget > 0 && bonus > c.Budget-c.Spent {
+				bonus = c.Budget - c.Spent
+			}
+			if bonus <= 0 {
+				continue
+			}
+			if err := db.creditCampaignBonus(tx, c.ID, o, bonus); err != nil {
+				return err
+			}
+			c.Spent += bonus
+		}
+	}
+	return nil
+}
+
+func campaignMatches(c *campaignModel.Campaign, o campaignOrder, first bool) bool {
+	if c.FirstOrder && !first {
+		return false
+	}
+	if o.Accrual < c.MinAccrual {
+		return false
+	}
+	return (len(c.Tiers) == 0 || contains(c.Tiers, o.Tier)) && (len(c.Providers) == 0 || contains(c.Providers, o.Provider))
+}
+
+func (db *storageImpl) creditCampaignBonus(tx *sqlx.Tx, campaignID int64, o campaignOrder, bonus money.Money) error {
+	if _, err := tx.ExecContext(db.ctx, addAccountAccuralForCalc, o.UserID, bonus, DefaultCurrency); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(db.ctx, insertCampaignEntrySQL, o.UserID, bonus, LedgerCampaignBonus, o.Number, campaignID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(db.ctx, insertLotSQL, o.UserID, o.Number, bonus, db.lotExpiresAt(), DefaultCurrency); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(db.ctx, addCampaignSpentSQL, campaignID, bonus)
+	return err
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
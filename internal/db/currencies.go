@@ -0,0 +1,53 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+
+	accountModel "gophermart/internal/account/model/db"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DefaultCurrency is the code of the platform's own points, requests without a currency use it. Partner points
+// are accrued by the providers of ProviderCurrencies. Transfers, loyalty tiers, campaigns, referrals and
+// adjustments work with the default currency only.
+const DefaultCurrency = ""
+
+var ErrUnknownCurrency = errors.New("unknown currency")
+
+// checkCurrency accepts the default currency and the currencies of accrual providers.
+func (db *storageImpl) checkCurrency(currency string) error {
+	if currency == DefaultCurrency {
+		return nil
+	}
+	for _, c := range db.policy.ProviderCurrencies {
+		if c == currency {
+			return nil
+		}
+	}
+	return ErrUnknownCurrency
+}
+
+// providerCurrency is the currency provider pays accruals in.
+func (db *storageImpl) providerCurrency(provider string) string {
+	return db.policy.ProviderCurrencies[provider]
+}
+
+// lockAccount locks the account of the user in currency. Accounts in partner currencies are created by
+// the first accrual, until then the user has a zero balance in them.
+func (db *storageImpl) lockAccount(tx *sqlx.Tx, UserID, currency string) (*accountModel.Account, error) {
+	if err := db.checkCurrency(currency); err != nil {
+		return nil, err
+	}
+	var acc accountModel.Account
+	if err := tx.GetContext(db.ctx, &acc, getUserAccountForUpdate, UserID, currency); err == sql.ErrNoRows {
+		if currency == DefaultCurrency {
+			return nil, ErrUserNotFound
+		}
+		return &accountModel.Account{UserID: UserID, Currency: currency}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &acc, nil
+}
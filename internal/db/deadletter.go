@@ -0,0 +1,156 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"gophermart/internal/money"
+	"gophermart/internal/order/model"
+)
+
+var ErrInvalidResolveStatus = errors.New("dead letter order can be resolved only as PROCESSED or INVALID")
+
+const (
+	deadLetterOrdersSQL = `
+	with old as (
+		select number, status from orders
+		where status in ` + inCalcStatuses + ` and failed_attempts >= $1 for update
+	)
+	update orders o set status = $2 from old where o.number = old.number
+	returning o.number, old.status, o.attempts, o.last_error`
+	selectDeadLetterOrdersSQL = `
+	select
+		number,
+		status,
+		user_id,
+		accrual,
+		uploaded_at,
+		attempts,
+		failed_attempts,
+		last_error,
+		provider
+	from orders where status = $1 order by uploaded_at asc`
+	selectDeadLetterOrderForUpdateSQL = `select user_id, attempts from orders where number = $1 and status = $2 for update`
+	retryDeadLetterOrderSQL           = `update orders set status = $2, failed_attempts = 0 where number = $1`
+	// the error of the last lookup is not shown to the owner of the order as the response
+	insertDeadLetterEventSQL = `
+	insert into order_events(number, old_status, new_status, attempt, error) values($1, $2, $3, $4, $5)`
+)
+
+type deadLettered struct {
+	number    int64
+	oldStatus model.OrderStatus
+	attempts  int
+	lastError *string
+}
+
+// DeadLetterOrders stops polling of orders with at least maxFailedAttempts failed lookups in a row.
+func (db *storageImpl) DeadLetterOrders(maxFailedAttempts int) (int, error) {
+	tx, err := db.xdb.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(db.ctx, deadLetterOrdersSQL, maxFailedAttempts, model.DeadLetter)
+	if err != nil {
+		return 0, err
+	}
+	moved := make([]deadLettered, 0)
+	for rows.Next() {
+		var d deadLettered
+		if err := rows.Scan(&d.number, &d.oldStatus, &d.attempts, &d.lastError); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		moved = append(moved, d)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return 0, rows.Err()
+	}
+
+	for _, d := range moved {
+		if _, err := tx.ExecContext(db.ctx, insertDeadLetterEventSQL,
+			d.number, d.oldStatus, model.DeadLetter, d.attempts, d.lastError); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(moved), nil
+}
+
+func (db *storageImpl) GetDeadLetterOrders() ([]model.DeadLetterOrder, error) {
+	orders := []model.DeadLetterOrder{}
+	if err := db.xdb.SelectContext(db.ctx, &orders, selectDeadLetterOrdersSQL, model.DeadLetter); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// RetryDeadLetterOrder returns the order to polling with a fresh failed attempts counter.
+func (db *storageImpl) RetryDeadLetterOrder(number uint64, actor string) error {
+	tx, err := db.xdb.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var order model.DeadLetterOrder
+	if err := tx.GetContext(db.ctx, &order, selectDeadLetterOrderForUpdateSQL, number, model.DeadLetter); err == sql.ErrNoRows {
+		return ErrOrderNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(db.ctx, retryDeadLetterOrderSQL, number, model.Processing); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(db.ctx, insertOrderEventSQL,
+		number, model.DeadLetter, model.Processing, 0, nil, order.Attempts, actor, "manual retry"); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ResolveDeadLetterOrder sets the final status manually, accrual of PROCESSED order is credited to the owner
+// with campaign, referral and tier bonuses as if it was calculated by the accrual system.
+func (db *storageImpl) ResolveDeadLetterOrder(number uint64, status model.OrderStatus, accrual money.Money, actor, reason string) error {
+	if status != model.Processed && status != model.Invalid {
+		return ErrInvalidResolveStatus
+	}
+	if status == model.Invalid {
+		accrual = 0
+	}
+
+	tx, err := db.xdb.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var order model.DeadLetterOrder
+	if err := tx.GetContext(db.ctx, &order, selectDeadLetterOrderForUpdateSQL, number, model.DeadLetter); err == sql.ErrNoRows {
+		return ErrOrderNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(db.ctx, updateOrdersForCalc, number, status, accrual); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(db.ctx, insertOrderEventSQL,
+		number, model.DeadLetter, status, accrual, nil, order.Attempts+1, actor, reason); err != nil {
+		return err
+	}
+	if status == model.Processed {
+		if err := db.creditAccruals(tx, []int64{int64(number)}); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"gophermart/internal/money"
+	"time"
+
+	accountModel "gophermart/internal/account/model/db"
+	withdrawalsModel "gophermart/internal/withdrawals/model/db"
+)
+
+var ErrWithdrawalNotFound = errors.New("withdrawal not found")
+var ErrWithdrawalNotPending = errors.New("withdrawal is not pending")
+
+const (
+	insertPendingWithdrawalSQL = `
+	insert into withdrawals(user_id, number, sum, status, expires_at, currency)
+	values($1, $2, $3, $4, now() + $5 * interval '1 millisecond', $6)`
+	holdAccountSQL                  = `update accounts set current = current - $2, held = held + $2 where user_id = $1 and currency = $3`
+	releaseAccountSQL               = `update accounts set current = current + $2, held = held - $2 where user_id = $1 and currency = $3`
+	captureAccountSQL               = `update accounts set held = held - $2, withdrawn = withdrawn + $2 where user_id = $1 and currency = $3`
+	selectWithdrawalCurrencySQL     = `select currency from withdrawals where user_id = $1 and number = $2`
+	selectWithdrawalForUpdateSQL    = `select user_id, number, sum, status, refunded from withdrawals where user_id = $1 and number = $2 for update`
+	updateWithdrawalStatusSQL       = `update withdrawals set status = $2, processed_at = now() where number = $1`
+	selectExpiredWithdrawalsSQL     = `select user_id, number from withdrawals where status = $1 and expires_at < now()`
+	updateWithdrawalStatusOfUserSQL = `update withdrawals set status = $3 where user_id = $1 and number = $2`
+)
+
+// HoldWithdrawal creates a pending withdrawal in currency, the sum moves from current to held until the withdrawal
+// is confirmed or cancelled, or until ttl passes and it expires.
+func (db *storageImpl) HoldWithdrawal(UserID, currency string, sum money.Money, number uint64, ttl time.Duration) error {
+	tx, err := db.xdb.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	acc, err := db.lockAccount(tx, UserID, currency)
+	if err != nil {
+		return err
+	}
+	if err := db.checkWithdrawalLimits(tx, UserID, currency, sum, acc.Current); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(db.ctx, holdAccountSQL, UserID, sum, currency); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(db.ctx, insertPendingWithdrawalSQL,
+		UserID, number, sum, withdrawalsModel.Pending, ttl.Milliseconds(), currency); isUniqueViolation(err) {
+		return ErrDuplicateWithdrawal
+	} else if err != nil {
+		return err
+	}
+	if _, err := db.takeFromLots(tx, UserID, currency, number, sum); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(db.ctx, insertLedgerEntrySQL, UserID, -sum, LedgerHold, number, currency); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ConfirmWithdrawal captures the held sum of the pending withdrawal.
+func (db *storageImpl) ConfirmWithdrawal(UserID string, number uint64) error {
+	return db.finishHold(UserID, number, withdrawalsModel.Processed)
+}
+
+// CancelWithdrawal returns the held sum of the pending withdrawal to current.
+func (db *storageImpl) CancelWithdrawal(UserID string, number uint64) error {
+	return db.finishHold(UserID, number, withdrawalsModel.Cancelled)
+}
+
+// ExpireWithdrawals cancels pending withdrawals that were not confirmed in time.
+func (db *storageImpl) ExpireWithdrawals() (int, error) {
+	expired := []withdrawalsModel.Withdrawals{}
+	if err := db.xdb.SelectContext(db.ctx, &expired, selectExpiredWithdrawalsSQL, withdrawalsModel.Pending); err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, w := range expired {
+		// the withdrawal may be confirmed or cancelled since it was selected
+		if err := db.finishHold(w.UserID, w.Number, withdrawalsModel.Expired); errors.Is(err, ErrWithdrawalNotPending) {
+			continue
+		} else if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// finishHold releases the held sum of the pending withdrawal and records it as withdrawn if status is Processed.
+// The account is locked before the withdrawal, in the same order as by HoldWithdrawal.
+func (db *storageImpl) finishHold(UserID string, number uint64, status withdrawalsModel.WithdrawalStatus) error {
+	tx, err := db.xdb.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the currency of a withdrawal never changes, it is read before the account is locked
+	var currency string
+	if err := tx.GetContext(db.ctx, &currency, selectWithdrawalCurrencySQL, UserID, number); err == sql.ErrNoRows {
+		return ErrWithdrawalNotFound
+	} else if err != nil {
+		return err
+	}
+	var acc accountModel.Account
+	if err := tx.GetContext(db.ctx, &acc, getUserAccountForUpdate, UserID, currency); err == sql.ErrNoRows {
+		return ErrWithdrawalNotFound
+	} else if err != nil {
+		return err
+	}
+	var withdrawal withdrawalsModel.Withdrawals
+	if err := tx.GetContext(db.ctx, &withdrawal, selectWithdrawalForUpdateSQL, UserID, number); err == sql.ErrNoRows {
+		return ErrWithdrawalNotFound
+	} else if err != nil {
+		return err
+	}
+	if withdrawal.Status != withdrawalsModel.Pending {
+		return ErrWithdrawalNotPending
+	}
+
+	if _, err := tx.ExecContext(db.ctx, insertLedgerEntrySQL, UserID, withdrawal.Sum, LedgerRelease, number, currency); err != nil {
+		return err
+	}
+	if status == withdrawalsModel.Processed {
+		if _, err := tx.ExecContext(db.ctx, captureAccountSQL, UserID, withdrawal.Sum, currency); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(db.ctx, updateWithdrawalStatusSQL, number, status); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(db.ctx, insertLedgerEntrySQL, UserID, -withdrawal.Sum, LedgerWithdrawal, number, currency); err != nil {
+			return err
+		}
+	} else {
+		if _, err := tx.ExecContext(db.ctx, releaseAccountSQL, UserID, withdrawal.Sum, currency); err != nil {
+			return err
+		}
+		if err := db.returnToLots(tx, UserID, currency, number, withdrawal.Sum); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(db.ctx, updateWithdrawalStatusOfUserSQL, UserID, number, status); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
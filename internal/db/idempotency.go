@@ -0,0 +1,85 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrIdempotencyKeyReused = errors.New("idempotency key is already used with another request")
+var ErrIdempotencyKeyInProgress = errors.New("request with the idempotency key is in progress")
+
+const (
+	deleteExpiredIdempotencyKeySQL = `
+	delete from idempotency_keys
+	where user_id = $1 and scope = $2 and key = $3 and (
+		created_at < now() - $4 * interval '1 millisecond' or
+		(status_code is null and created_at < now() - $5 * interval '1 millisecond'))`
+	insertIdempotencyKeySQL = `
+	insert into idempotency_keys(user_id, scope, key, request_hash) values($1, $2, $3, $4)
+	on conflict do nothing`
+	selectIdempotencyKeySQL = `
+	select request_hash, status_code, content_type, response
+	from idempotency_keys where user_id = $1 and scope = $2 and key = $3`
+	saveIdempotentResponseSQL = `
+	update idempotency_keys set status_code = $4, content_type = $5, response = $6
+	where user_id = $1 and scope = $2 and key = $3`
+	deleteIdempotencyKeySQL = `delete from idempotency_keys where user_id = $1 and scope = $2 and key = $3`
+)
+
+// IdempotentResponse is the response stored for the first request with an idempotency key.
+type IdempotentResponse struct {
+	RequestHash string  `db:"request_hash"`
+	StatusCode  *int    `db:"status_code"`
+	ContentType *string `db:"content_type"`
+	Body        []byte  `db:"response"`
+}
+
+// ReserveIdempotencyKey returns the stored response of the key, or nil when the key is new and reserved
+// for the request, keys older than ttl and reservations without a response older than lease are treated as new.
+func (db *storageImpl) ReserveIdempotencyKey(UserID, scope, key, requestHash string, ttl, lease time.Duration) (*IdempotentResponse, error) {
+	tx, err := db.xdb.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(db.ctx, deleteExpiredIdempotencyKeySQL, UserID, scope, key, ttl.Milliseconds(), lease.Milliseconds()); err != nil {
+		return nil, err
+	}
+	res, err := tx.ExecContext(db.ctx, insertIdempotencyKeySQL, UserID, scope, key, requestHash)
+	if err != nil {
+		return nil, err
+	}
+	if inserted, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if inserted == 1 {
+		return nil, tx.Commit()
+	}
+
+	var stored IdempotentResponse
+	if err := tx.GetContext(db.ctx, &stored, selectIdempotencyKeySQL, UserID, scope, key); err == sql.ErrNoRows {
+		// the concurrent request released the key, the client may retry
+		return nil, ErrIdempotencyKeyInProgress
+	} else if err != nil {
+		return nil, err
+	}
+	if stored.RequestHash != requestHash {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if stored.StatusCode == nil {
+		return nil, ErrIdempotencyKeyInProgress
+	}
+	return &stored, tx.Commit()
+}
+
+func (db *storageImpl) SaveIdempotentResponse(UserID, scope, key string, statusCode int, contentType string, body []byte) error {
+	_, err := db.xdb.ExecContext(db.ctx, saveIdempotentResponseSQL, UserID, scope, key, statusCode, contentType, body)
+	return err
+}
+
+// ReleaseIdempotencyKey forgets the key, so that the request can be retried with it.
+func (db *storageImpl) ReleaseIdempotencyKey(UserID, scope, key string) error {
+	_, err := db.xdb.ExecContext(db.ctx, deleteIdempotencyKeySQL, UserID, scope, key)
+	return err
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"time"
+)
+
+// processingLockKey is the first key of the two-key advisory lock, the second one is the shard number.
+const processingLockKey = 20221001
+
+const (
+	tryAdvisoryLockSQL  = `select pg_try_advisory_lock($1, $2)`
+	advisoryUnlockSQL   = `select pg_advisory_unlock($1, $2)`
+	isAdvisoryLockedSQL = `
+	select count(1) from pg_locks
+	where locktype = 'advisory' and classid = $1 and objid = $2 and pid = pg_backend_pid() and granted`
+	upsertLeaderSQL = `
+	insert into processing_leaders(shard, instance_id, renewed_at) values($1, $2, now())
+	on conflict (shard) do update set instance_id = excluded.instance_id, renewed_at = excluded.renewed_at`
+	deleteLeaderSQL  = `delete from processing_leaders where shard = $1 and instance_id = $2`
+	selectLeadersSQL = `select shard, instance_id, renewed_at from processing_leaders order by shard`
+)
+
+var ErrLeaseLost = errors.New("processing lease is lost")
+
+// Shard selects orders with number % Count = Index.
+type Shard struct {
+	Index int
+	Count int
+}
+
+type Leader struct {
+	Shard      int       `db:"shard"`
+	InstanceID string    `db:"instance_id"`
+	RenewedAt  time.Time `db:"renewed_at"`
+}
+
+// Lease is a session level advisory lock held on a dedicated connection,
+// so it is released by postgres as soon as the holder dies.
+type Lease struct {
+	ctx        context.Context
+	conn       *sql.Conn
+	shard      int
+	instanceID string
+}
+
+func (db *storageImpl) TryAcquireLease(instanceID string, shard int) (*Lease, error) {
+	conn, err := db.xdb.Conn(db.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var locked bool
+	if err := conn.QueryRowContext(db.ctx, tryAdvisoryLockSQL, processingLockKey, shard).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !locked {
+		conn.Close()
+		return nil, nil
+	}
+
+	lease := &Lease{db.ctx, conn, shard, instanceID}
+	if err := lease.Renew(); err != nil {
+		lease.Release()
+		return nil, err
+	}
+	return lease, nil
+}
+
+func (db *storageImpl) GetLeaders() ([]Leader, error) {
+	leaders := []Leader{}
+	if err := db.xdb.SelectContext(db.ctx, &leaders, selectLeadersSQL); err != nil {
+		return nil, err
+	}
+	return leaders, nil
+}
+
+func (l *Lease) Shard() int {
+	return l.shard
+}
+
+// Renew checks the lock is still held by the session and prolongs the published leadership.
+func (l *Lease) Renew() error {
+	if held, err := l.held(); err != nil {
+		return err
+	} else if !held {
+		return ErrLeaseLost
+	}
+	_, err := l.conn.ExecContext(l.ctx, upsertLeaderSQL, l.shard, l.instanceID)
+	return err
+}
+
+// Held checks the lock is still held by the session, work of the shard runs on the pool, so it checks the lease
+// before every write instead of relying on the next Renew. A failed check counts as a lost lock.
+func (l *Lease) Held() bool {
+	held, err := l.held()
+	return err == nil && held
+}
+
+func (l *Lease) held() (bool, error) {
+	var n int
+	if err := l.conn.QueryRowContext(l.ctx, isAdvisoryLockedSQL, processingLockKey, l.shard).Scan(&n); err != nil {
+		return false, err
+	}
+	return n != 0, nil
+}
+
+// Release drops the lock and discards the connection, so it never gets back to the pool still holding the lock.
+func (l *Lease) Release() error {
+	defer l.conn.Raw(func(driverConn interface{}) error { return driver.ErrBadConn })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := l.conn.ExecContext(ctx, deleteLeaderSQL, l.shard, l.instanceID); err != nil {
+		return err
+	}
+	_, err := l.conn.ExecContext(ctx, advisoryUnlockSQL, processingLockKey, l.shard)
+	return err
+}
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"gophermart/internal/money"
+	"gophermart/internal/order/model"
+)
+
+// LedgerEntryType is a kind of balance change recorded in ledger_entries.
+type LedgerEntryType int
+
+const (
+	LedgerAccrual LedgerEntryType = iota
+	LedgerWithdrawal
+	// LedgerAdjustment is a manual adjustment by an admin or a balance found when the ledger was backfilled.
+	LedgerAdjustment
+	// LedgerHold moves the sum of pending withdrawal from current to held, LedgerRelease moves it back
+	// when the withdrawal is cancelled or confirmed, a confirmed one is then recorded as LedgerWithdrawal.
+	LedgerHold
+	LedgerRelease
+	// LedgerRefund returns a part of processed withdrawal, it decreases withdrawn.
+	LedgerRefund
+	// LedgerExpiration debits the remaining points of an expired lot.
+	LedgerExpiration
+	// LedgerTransfer moves points between users, the sender also pays LedgerTransferFee.
+	LedgerTransfer
+	LedgerTransferFee
+	// LedgerTierBonus credits the extra accrual of the owner's loyalty tier.
+	LedgerTierBonus
+	// LedgerCampaignBonus credits the bonus of a promotional campaign, the entry refers to the campaign.
+	LedgerCampaignBonus
+	// LedgerReferralBonus credits the bonus of the referral program to the referrer or the referred user.
+	LedgerReferralBonus
+)
+
+const (
+	insertLedgerEntrySQL    = `insert into ledger_entries(user_id, amount, type, order_number, currency) values($1, $2, $3, $4, $5)`
+	insertAccrualEntriesSQL = `
+	insert into ledger_entries(user_id, amount, type, order_number, currency)
+	select user_id, accrual, ?, number, currency from orders where number in (?) and accrual > 0`
+
+	// Existing balances are moved to the ledger once, when the table is still empty: accruals of processed
+	// orders, withdrawals and an adjustment for whatever the counters hold beyond them.
+	lockLedgerSQL             = `lock table ledger_entries in exclusive mode`
+	countLedgerEntriesSQL     = `select count(1) from ledger_entries`
+	backfillAccrualEntriesSQL = `
+	insert into ledger_entries(user_id, amount, type, order_number, currency, created_at)
+	select o.user_id, o.accrual, $1, o.number, o.currency, coalesce(
+		(select max(e.created_at) from order_events e where e.number = o.number and e.new_status = $2), o.uploaded_at)
+	from orders o where o.status = $2 and o.accrual > 0`
+	backfillWithdrawalEntriesSQL = `
+	insert into ledger_entries(user_id, amount, type, order_number, currency, created_at)
+	select user_id, -sum, $1, number, currency, processed_at from withdrawals`
+	backfillAdjustmentEntriesSQL = `
+	insert into ledger_entries(user_id, amount, type, currency)
+	select a.user_id, a.current - coalesce(sum(l.amount), 0), $1, a.currency
+	from accounts a left join ledger_entries l on l.user_id = a.user_id and l.currency = a.currency
+	group by a.user_id, a.currency, a.current having a.current <> coalesce(sum(l.amount), 0)`
+
+	selectLedgerMismatchesSQL = `
+	select
+		a.user_id,
+		a.currency,
+		a.current,
+		a.withdrawn,
+		coalesce(l.current, 0) as ledger_current,
+		coalesce(l.withdrawn, 0) as ledger_withdrawn,
+		a.held,
+		coalesce(l.held, 0) as ledger_held
+	from accounts a left join (
+		select
+			user_id,
+			currency,
+			sum(amount) as current,
+			-sum(amount) filter (where type in ($1, $4)) as withdrawn,
+			-sum(amount) filter (where type in ($2, $3)) as held
+		from ledger_entries group by user_id, currency
+	) l on l.user_id = a.user_id and l.currency = a.currency
+	where a.current <> coalesce(l.current, 0) or a.withdrawn <> coalesce(l.withdrawn, 0) or a.held <> coalesce(l.held, 0)
+	order by a.user_id, a.currency`
+)
+
+// LedgerMismatch is an account whose cached counters differ from the sums of its ledger entries.
+type LedgerMismatch struct {
+	UserID          string      `db:"user_id" json:"user_id"`
+	Currency        string      `db:"currency" json:"currency,omitempty"`
+	Current         money.Money `db:"current" json:"current"`
+	Withdrawn       money.Money `db:"withdrawn" json:"withdrawn"`
+	LedgerCurrent   money.Money `db:"ledger_current" json:"ledger_current"`
+	LedgerWithdrawn money.Money `db:"ledger_withdrawn" json:"ledger_withdrawn"`
+	Held            money.Money `db:"held" json:"held"`
+	LedgerHeld      money.Money `db:"ledger_held" json:"ledger_held"`
+}
+
+// backfillLedger records balances reached before the ledger existed.
+func (db *storageImpl) backfillLedger() error {
+	tx, err := db.xdb.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(db.ctx, lockLedgerSQL); err != nil {
+		return err
+	}
+	var count int
+	if err := tx.GetContext(db.ctx, &count, countLedgerEntriesSQL); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(db.ctx, backfillAccrualEntriesSQL, LedgerAccrual, model.Processed); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(db.ctx, backfillWithdrawalEntriesSQL, LedgerWithdrawal); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(db.ctx, backfillAdjustmentEntriesSQL, LedgerAdjustment); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CheckLedger compares cached accounts with the ledger, current must be the sum of all entries,
+// withdrawn the sum of withdrawal and refund entries and held the sum of hold and release entries.
+func (db *storageImpl) CheckLedger() ([]LedgerMismatch, error) {
+	mismatches := []LedgerMismatch{}
+	if err := db.xdb.SelectContext(db.ctx, &mismatches, selectLedgerMismatchesSQL, LedgerWithdrawal, LedgerHold, LedgerRelease, LedgerRefund); err != nil {
+		return nil, err
+	}
+	return mismatches, nil
+}
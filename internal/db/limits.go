@@ -0,0 +1,135 @@
+package db
+
+import (
+	"errors"
+	"gophermart/internal/money"
+	"math/big"
+	"time"
+
+	withdrawalsModel "gophermart/internal/withdrawals/model/db"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Policy holds business rules the storage applies to balance changes.
+type Policy struct {
+	// PointsExpireMonths is the lifetime of accrued points, they never expire if it is 0.
+	PointsExpireMonths int
+	WithdrawalLimits   WithdrawalLimits
+	TransferRules      TransferRules
+	TierRules          TierRules
+	ReferralRules      ReferralRules
+	AdjustmentRules    AdjustmentRules
+	// ProviderCurrencies are currencies of accrual providers paying partner points, other providers pay
+	// in DefaultCurrency.
+	ProviderCurrencies map[string]string
+}
+
+// WithdrawalLimits are checked for every new withdrawal, pending ones included, zero disables a rule.
+// Daily and monthly sums are counted for the calendar day and month in UTC, refunded parts are not counted.
+// Limits are checked for each currency separately with the same values.
+type WithdrawalLimits struct {
+	MinSum     money.Money
+	MaxSum     money.Money
+	DailySum   money.Money
+	MonthlySum money.Money
+	// HourlyCount is the number of withdrawals allowed in the last hour, cancelled and expired ones included.
+	HourlyCount int
+	// CoolingOff is how long accrued points can't be withdrawn.
+	CoolingOff time.Duration
+}
+
+// TransferRules are limits and fees of transfers between users, zero disables a limit.
+type TransferRules struct {
+	MinSum money.Money
+	MaxSum money.Money
+	// DailySum is the sum the user can send in the calendar day in UTC, fees are not counted.
+	DailySum money.Money
+	// The sender pays FeeFixed plus FeeRate of the sum in addition to the sum, nil FeeRate means no rate.
+	FeeFixed money.Money
+	FeeRate  *big.Rat
+}
+
+var ErrWithdrawalBelowMin = errors.New("the sum is below the minimal withdrawal")
+var ErrWithdrawalAboveMax = errors.New("the sum is above the maximal withdrawal")
+var ErrWithdrawalDailyLimit = errors.New("the daily withdrawal limit is exceeded")
+var ErrWithdrawalMonthlyLimit = errors.New("the monthly withdrawal limit is exceeded")
+var ErrWithdrawalHourlyCount = errors.New("too many withdrawals in the last hour")
+var ErrWithdrawalCoolingOff = errors.New("the points are accrued too recently to be withdrawn")
+
+// limitedWithdrawalStatuses are withdrawals counted against the limits: the withdrawn ones less their refunds
+// and pending ones, whose sums are held and can be confirmed at any moment. Cancelled and expired ones are not.
+var limitedWithdrawalStatuses = withdrawalsModel.SQLList(withdrawalsModel.Processed, withdrawalsModel.Pending,
+	withdrawalsModel.Reversed, withdrawalsModel.PartiallyRefunded)
+
+// $2 is the start of the period
+var selectWithdrawnSinceSQL = `
+	select coalesce(sum(sum - refunded), 0) from withdrawals
+	where user_id = $1 and currency = $3 and processed_at >= $2 and status in ` + limitedWithdrawalStatuses
+
+const (
+	selectWithdrawalsCountSinceSQL = `
+	select count(1) from withdrawals where user_id = $1 and currency = $3 and processed_at >= $2`
+	selectFreshPointsSQL = `
+	select coalesce(sum(remaining), 0) from point_lots
+	where user_id = $1 and currency = $3 and accrued_at > now() - $2 * interval '1 millisecond'`
+)
+
+// checkWithdrawalLimits checks the new withdrawal of sum from current, the account must be locked by tx so that
+// concurrent withdrawals of the user are counted.
+func (db *storageImpl) checkWithdrawalLimits(tx *sqlx.Tx, UserID, currency string, sum, current money.Money) error {
+	limits := db.policy.WithdrawalLimits
+	if limits.MinSum > 0 && sum < limits.MinSum {
+		return ErrWithdrawalBelowMin
+	}
+	if limits.MaxSum > 0 && sum > limits.MaxSum {
+		return ErrWithdrawalAboveMax
+	}
+	if current < sum {
+		return ErrBalanceLimitExhausted
+	}
+	if limits.CoolingOff > 0 {
+		var fresh money.Money
+		if err := tx.GetContext(db.ctx, &fresh, selectFreshPointsSQL, UserID, limits.CoolingOff.Milliseconds(), currency); err != nil {
+			return err
+		}
+		if current-fresh < sum {
+			return ErrWithdrawalCoolingOff
+		}
+	}
+
+	now := time.Now().UTC()
+	if limits.HourlyCount > 0 {
+		var count int
+		if err := tx.GetContext(db.ctx, &count, selectWithdrawalsCountSinceSQL, UserID, now.Add(-time.Hour), currency); err != nil {
+			return err
+		}
+		if count >= limits.HourlyCount {
+			return ErrWithdrawalHourlyCount
+		}
+	}
+	if limits.DailySum > 0 {
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		if err := db.checkWithdrawnSince(tx, UserID, currency, sum, day, limits.DailySum, ErrWithdrawalDailyLimit); err != nil {
+			return err
+		}
+	}
+	if limits.MonthlySum > 0 {
+		month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		if err := db.checkWithdrawnSince(tx, UserID, currency, sum, month, limits.MonthlySum, ErrWithdrawalMonthlyLimit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *storageImpl) checkWithdrawnSince(tx *sqlx.Tx, UserID, currency string, sum money.Money, since time.Time, limit money.Money, limitErr error) error {
+	var withdrawn money.Money
+	if err := tx.GetContext(db.ctx, &withdrawn, selectWithdrawnSinceSQL, UserID, since, currency); err != nil {
+		return err
+	}
+	if withdrawn+sum > limit {
+		return limitErr
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package db
+
+import (
+	"gophermart/internal/money"
+	"time"
+
+	accountModel "gophermart/internal/account/model/db"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Points are kept in lots, one per accrual. Withdrawals take points from the lots that expire first and
+// remember the taken parts in point_lot_usages, so that cancelled and refunded withdrawals put them back.
+// Remaining points of all lots of the user in a currency always sum up to accounts.current.
+const (
+	insertLotSQL = `
+	insert into point_lots(user_id, order_number, amount, remaining, expires_at, currency) values($1, $2, $3, $3, $4, $5)`
+	insertAccrualLotsSQL = `
+	insert into point_lots(user_id, order_number, amount, remaining, expires_at, currency)
+	select user_id, number, accrual, accrual, ?::timestamptz, currency from orders where number in (?) and accrual > 0`
+	selectLotsForUpdateSQL = `
+	select id, remaining, expires_at from point_lots where user_id = $1 and currency = $2 and remaining > 0
+	order by expires_at asc nulls last, id asc for update`
+	takeFromLotSQL    = `update point_lots set remaining = remaining - $2 where id = $1`
+	insertLotUsageSQL = `
+	insert into point_lot_usages(lot_id, number, amount) values($1, $2, $3)
+	on conflict (lot_id, number) do update set amount = point_lot_usages.amount + excluded.amount`
+	// the latest expiring lots are restored first, the points that have expired meanwhile expire again
+	selectLotUsagesForUpdateSQL = `
+	select u.lot_id as id, u.amount as remaining from point_lot_usages u join point_lots l on l.id = u.lot_id
+	where u.number = $1 and u.amount > 0
+	order by l.expires_at desc nulls first, l.id desc for update`
+	returnToLotSQL    = `update point_lots set remaining = remaining + $2 where id = $1`
+	returnLotUsageSQL = `update point_lot_usages set amount = amount - $3 where lot_id = $1 and number = $2`
+
+	selectAccountsWithExpiredLotsSQL = `
+	select distinct user_id, currency from point_lots where remaining > 0 and expires_at < now()`
+	selectExpiredLotsForUpdateSQL = `
+	select id, order_number, remaining from point_lots
+	where user_id = $1 and currency = $2 and remaining > 0 and expires_at < now()
+	order by expires_at, id for update`
+	expireLotSQL          = `update point_lots set expired = expired + remaining, remaining = 0 where id = $1`
+	expireAccountSQL      = `update accounts set current = current - $2 where user_id = $1 and currency = $3`
+	selectExpiringLotsSQL = `
+	select expires_at, sum(remaining) as sum from point_lots
+	where user_id = $1 and currency = $3 and remaining > 0
+		and expires_at >= now() and expires_at < now() + $2 * interval '1 millisecond'
+	group by expires_at order by expires_at`
+
+	// Balances reached before lots existed become one lot per account that expires as if accrued now.
+	lockLotsSQL     = `lock table point_lots in exclusive mode`
+	countLotsSQL    = `select count(1) from point_lots`
+	backfillLotsSQL = `
+	insert into point_lots(user_id, amount, remaining, expires_at, currency)
+	select user_id, current, current, $1::timestamptz, currency from accounts where current > 0`
+)
+
+type pointLot struct {
+	ID          int64       `db:"id"`
+	OrderNumber *uint64     `db:"order_number"`
+	Remaining   money.Money `db:"remaining"`
+	ExpiresAt   *time.Time  `db:"expires_at"`
+}
+
+// lotExpiresAt is the expiration time of points accrued now, nil when points do not expire.
+func (db *storageImpl) lotExpiresAt() *time.Time {
+	if db.policy.PointsExpireMonths <= 0 {
+		return nil
+	}
+	expiresAt := time.Now().AddDate(0, db.policy.PointsExpireMonths, 0)
+	return &expiresAt
+}
+
+// insertAccrualLots creates lots for accruals of orders nums.
+func (db *storageImpl) insertAccrualLots(tx *sqlx.Tx, nums []int64) error {
+	query, args, err := sqlx.In(insertAccrualLotsSQL, db.lotExpiresAt(), nums)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(db.ctx, tx.Rebind(query), args...)
+	return err
+}
+
+// takeFromLots takes sum from the lots of the user in currency that expire first, the account must be locked by tx.
+// The parts taken by withdrawal number are recorded to be returned later, zero number takes them for good.
+// It returns the taken parts as lots with Remaining set to the part.
+func (db *storageImpl) takeFromLots(tx *sqlx.Tx, UserID, currency string, number uint64, sum money.Money) ([]pointLot, error) {
+	lots := []pointLot{}
+	if err := tx.SelectContext(db.ctx, &lots, selectLotsForUpdateSQL, UserID, currency); err != nil {
+		return nil, err
+	}
+	taken := []pointLot{}
+	for _, lot := range lots {
+		if sum == 0 {
+			break
+		}
+		part := lot.Remaining
+		if part > sum {
+			part = sum
+		}
+		if _, err := tx.ExecContext(db.ctx, takeFromLotSQL, lot.ID, part); err != nil {
+			return nil, err
+		}
+		if number != 0 {
+			if _, err := tx.ExecContext(db.ctx, insertLotUsageSQL, lot.ID, number, part); err != nil {
+				return nil, err
+			}
+		}
+		lot.Remaining = part
+		taken = append(taken, lot)
+		sum -= part
+	}
+	return taken, nil
+}
+
+// returnToLots puts sum taken by the withdrawal back to its lots, the account must be locked by tx. The part
+// not found in the lots, e.g. of withdrawals made before lots existed, becomes a new lot.
+func (db *storageImpl) returnToLots(tx *sqlx.Tx, UserID, currency string, number uint64, sum money.Money) error {
+	lots := []pointLot{}
+	if err := tx.SelectContext(db.ctx, &lots, selectLotUsagesForUpdateSQL, number); err != nil {
+		return err
+	}
+	for _, lot := range lots {
+		if sum == 0 {
+			break
+		}
+		part := lot.Remaining
+		if part > sum {
+			part = sum
+		}
+		if _, err := tx.ExecContext(db.ctx, returnToLotSQL, lot.ID, part); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(db.ctx, returnLotUsageSQL, lot.ID, number, part); err != nil {
+			return err
+		}
+		sum -= part
+	}
+	if sum == 0 {
+		return nil
+	}
+	_, err := tx.ExecContext(db.ctx, insertLotSQL, UserID, nil, sum, db.lotExpiresAt(), currency)
+	return err
+}
+
+// ExpirePoints debits the remaining points of expired lots, the expiration is recorded in the ledger.
+// It returns the number of expired lots.
+func (db *storageImpl) ExpirePoints() (int, error) {
+	accounts := []accountModel.Account{}
+	if err := db.xdb.SelectContext(db.ctx, &accounts, selectAccountsWithExpiredLotsSQL); err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, acc := range accounts {
+		expired, err := db.expireLotsOfAccount(acc.UserID, acc.Currency)
+		if err != nil {
+			return count, err
+		}
+		count += expired
+	}
+	return count, nil
+}
+
+func (db *storageImpl) expireLotsOfAccount(UserID, currency string) (int, error) {
+	tx, err := db.xdb.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var acc accountModel.Account
+	if err := tx.GetContext(db.ctx, &acc, getUserAccountForUpdate, UserID, currency); err != nil {
+		return 0, err
+	}
+	lots := []pointLot{}
+	if err := tx.SelectContext(db.ctx, &lots, selectExpiredLotsForUpdateSQL, UserID, currency); err != nil {
+		return 0, err
+	}
+	var sum money.Money
+	for _, lot := range lots {
+		if _, err := tx.ExecContext(db.ctx, expireLotSQL, lot.ID); err != nil {
+			return 0, err
+		}
+		if _, err := tx.ExecContext(db.ctx, insertLedgerEntrySQL, UserID, -lot.Remaining, LedgerExpiration, lot.OrderNumber, currency); err != nil {
+			return 0, err
+		}
+		sum += lot.Remaining
+	}
+	if _, err := tx.ExecContext(db.ctx, expireAccountSQL, UserID, sum, currency); err != nil {
+		return 0, err
+	}
+	return len(lots), tx.Commit()
+}
+
+// GetExpiringPoints returns the points of the user in currency that expire within the period, grouped by
+// expiration time.
+func (db *storageImpl) GetExpiringPoints(UserID, currency string, within time.Duration) ([]accountModel.ExpiringPoints, error) {
+	expiring := []accountModel.ExpiringPoints{}
+	if err := db.xdb.SelectContext(db.ctx, &expiring, selectExpiringLotsSQL, UserID, within.Milliseconds(), currency); err != nil {
+		return nil, err
+	}
+	return expiring, nil
+}
+
+// backfillLots records balances reached before lots existed.
+func (db *storageImpl) backfillLots() error {
+	tx, err := db.xdb.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(db.ctx, lockLotsSQL); err != nil {
+		return err
+	}
+	var count int
+	if err := tx.GetContext(db.ctx, &count, countLotsSQL); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(db.ctx, backfillLotsSQL, db.lotExpiresAt()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
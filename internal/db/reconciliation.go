@@ -0,0 +1,160 @@
+package db
+
+import (
+	"database/sql"
+	"gophermart/internal/money"
+	"gophermart/internal/order/model"
+	"time"
+
+	adjustmentModel "gophermart/internal/adjustment/model/db"
+	referralModel "gophermart/internal/referral/model/db"
+	withdrawalsModel "gophermart/internal/withdrawals/model/db"
+
+	"github.com/lib/pq"
+)
+
+// expectedBalancesSQL recomputes balances from orders, withdrawals, transfers, referrals, adjustments and
+// expired lots, bonuses of loyalty tiers and campaigns are only recorded in the ledger. Adjustments of the ledger
+// backfill moved balances that predate the ledger, so they are expected too and reported with a real mismatch only.
+// $1 is PROCESSED order status, $2 is PENDING withdrawal status, $3 is REWARDED referral status, $4 is APPLIED
+// adjustment status, $5 are the tier and campaign bonus ledger entry types, $6 is the adjustment one and $7 is
+// the default currency of transfers, referrals and adjustments.
+var expectedBalancesSQL = `
+	with accruals as (
+		select user_id, currency, sum(accrual) as amount from orders where status = $1 group by user_id, currency
+	), withdrawn as (
+		select
+			user_id,
+			currency,
+			coalesce(sum(sum - refunded) filter (where status in ` + deductedWithdrawalStatuses + `), 0) as withdrawn,
+			coalesce(sum(sum) filter (where status = $2), 0) as held
+		from withdrawals group by user_id, currency
+	), transferred as (
+		select user_id, sum(amount) as amount from (
+			select to_user_id as user_id, sum as amount from transfers
+			union all
+			select from_user_id as user_id, -(sum + fee) as amount from transfers
+		) t group by user_id
+	), referred as (
+		select user_id, sum(amount) as amount from (
+			select referrer_id as user_id, referrer_bonus as amount from referrals where status = $3
+			union all
+			select referee_id as user_id, referee_bonus as amount from referrals where status = $3
+		) r group by user_id
+	), adjusted as (
+		select user_id, sum(amount) as amount from adjustments where status = $4 group by user_id
+	), expired as (
+		select user_id, currency, sum(expired) as amount from point_lots group by user_id, currency
+	), ledger_only as (
+		select user_id, currency, sum(amount) as amount from ledger_entries where type = any($5) group by user_id, currency
+	), backfilled as (
+		select user_id, currency, sum(amount) as amount from ledger_entries
+		where type = $6 and adjustment_id is null group by user_id, currency
+	)
+	select
+		a.user_id,
+		a.currency,
+		a.current,
+		a.withdrawn,
+		a.held,
+		coalesce(ac.amount, 0) - coalesce(w.withdrawn, 0) - coalesce(w.held, 0) + coalesce(t.amount, 0)
+			+ coalesce(r.amount, 0) + coalesce(adj.amount, 0) - coalesce(e.amount, 0) + coalesce(l.amount, 0)
+			+ coalesce(b.amount, 0) as expected_current,
+		coalesce(w.withdrawn, 0) as expected_withdrawn,
+		coalesce(w.held, 0) as expected_held,
+		coalesce(b.amount, 0) as backfilled
+	from accounts a
+	left join accruals ac on ac.user_id = a.user_id and ac.currency = a.currency
+	left join withdrawn w on w.user_id = a.user_id and w.currency = a.currency
+	left join transferred t on t.user_id = a.user_id and a.currency = $7
+	left join referred r on r.user_id = a.user_id and a.currency = $7
+	left join adjusted adj on adj.user_id = a.user_id and a.currency = $7
+	left join expired e on e.user_id = a.user_id and e.currency = a.currency
+	left join ledger_only l on l.user_id = a.user_id and l.currency = a.currency
+	left join backfilled b on b.user_id = a.user_id and b.currency = a.currency`
+
+var selectDiscrepanciesSQL = `
+	select * from (` + expectedBalancesSQL + `) b
+	where current <> expected_current or withdrawn <> expected_withdrawn or held <> expected_held
+	order by user_id, currency`
+
+const (
+	countAccountsSQL                = `select count(1) from accounts`
+	insertReconciliationReportSQL   = `insert into reconciliation_reports(started_at, accounts, discrepancies) values($1, $2, $3) returning id`
+	insertReconciliationMismatchSQL = `
+	insert into reconciliation_discrepancies(
+		report_id, user_id, currency, current, expected_current, withdrawn, expected_withdrawn, held, expected_held,
+		backfilled)
+	values($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+)
+
+// Discrepancy is an account of the user in a currency whose balances differ from the ones recomputed by Reconcile,
+// Backfilled is the part of ExpectedCurrent moved by the ledger backfill rather than explained by an operation.
+type Discrepancy struct {
+	UserID            string      `db:"user_id" json:"user_id"`
+	Currency          string      `db:"currency" json:"currency,omitempty"`
+	Current           money.Money `db:"current" json:"current"`
+	ExpectedCurrent   money.Money `db:"expected_current" json:"expected_current"`
+	Withdrawn         money.Money `db:"withdrawn" json:"withdrawn"`
+	ExpectedWithdrawn money.Money `db:"expected_withdrawn" json:"expected_withdrawn"`
+	Held              money.Money `db:"held" json:"held"`
+	ExpectedHeld      money.Money `db:"expected_held" json:"expected_held"`
+	Backfilled        money.Money `db:"backfilled" json:"backfilled,omitempty"`
+}
+
+// ReconciliationReport is a result of Reconcile, ID is 0 when the report is not saved.
+type ReconciliationReport struct {
+	ID            int64
+	StartedAt     time.Time
+	Accounts      int
+	Discrepancies []Discrepancy
+}
+
+// Reconcile recomputes balances of all accounts from a snapshot of the database and reports accounts
+// that differ, the report is saved to reconciliation_reports when save is true.
+func (db *storageImpl) Reconcile(save bool) (*ReconciliationReport, error) {
+	report := ReconciliationReport{StartedAt: time.Now(), Discrepancies: []Discrepancy{}}
+	tx, err := db.xdb.BeginTxx(db.ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.GetContext(db.ctx, &report.Accounts, countAccountsSQL); err != nil {
+		return nil, err
+	}
+	bonusTypes := []int64{int64(LedgerTierBonus), int64(LedgerCampaignBonus)}
+	if err := tx.SelectContext(db.ctx, &report.Discrepancies, selectDiscrepanciesSQL, model.Processed, withdrawalsModel.Pending,
+		referralModel.Rewarded, adjustmentModel.Applied, pq.Array(bonusTypes), LedgerAdjustment, DefaultCurrency); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if save {
+		if err := db.saveReconciliationReport(&report); err != nil {
+			return nil, err
+		}
+	}
+	return &report, nil
+}
+
+func (db *storageImpl) saveReconciliationReport(report *ReconciliationReport) error {
+	tx, err := db.xdb.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := tx.GetContext(db.ctx, &report.ID, insertReconciliationReportSQL,
+		report.StartedAt, report.Accounts, len(report.Discrepancies)); err != nil {
+		return err
+	}
+	for _, d := range report.Discrepancies {
+		if _, err := tx.ExecContext(db.ctx, insertReconciliationMismatchSQL, report.ID, d.UserID, d.Currency,
+			d.Current, d.ExpectedCurrent, d.Withdrawn, d.ExpectedWithdrawn, d.Held, d.ExpectedHeld, d.Backfilled); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"gophermart/internal/money"
+	"gophermart/internal/order/model"
+
+	referralModel "gophermart/internal/referral/model/db"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ReferralRules are bonuses credited to both users when the first order of the referred user is processed.
+type ReferralRules struct {
+	ReferrerBonus money.Money
+	RefereeBonus  money.Money
+}
+
+var ErrReferralCodeNotFound = errors.New("referral code not found")
+
+// Reasons of rejected referrals, they are kept for support and not shown to users.
+const (
+	referralRejectedSelf   = "the referrer registered from the same IP"
+	referralRejectedSameIP = "another user referred by the referrer registered from the same IP"
+)
+
+// referralCodeAlphabet has no look-alike characters, codes are typed by hand.
+const referralCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const referralCodeLength = 8
+
+const (
+	selectReferrerByCodeSQL = `select id, coalesce(registered_ip, '') as registered_ip from users where referral_code = $1`
+	countReferralsFromIPSQL = `
+	select count(1) from referrals r join users u on u.id = r.referee_id where r.referrer_id = $1 and u.registered_ip = $2`
+	insertReferralSQL     = `insert into referrals(referee_id, referrer_id, status, reject_reason) values($1, $2, $3, nullif($4, ''))`
+	selectReferralCodeSQL = `select coalesce(referral_code, '') from users where id = $1`
+	setReferralCodeSQL    = `update users set referral_code = $2 where id = $1 and referral_code is null`
+	selectReferralsSQL    = `
+	select u.login, r.status, r.referrer_bonus, r.created_at, r.rewarded_at
+	from referrals r join users u on u.id = r.referee_id
+	where r.referrer_id = $1 order by r.created_at, u.login`
+
+	selectReferralsToRewardSQL = `
+	select r.referee_id, r.referrer_id, o.number
+	from referrals r join orders o on o.user_id = r.referee_id
+	where o.number in (?) and o.status = ? and r.status = ?
+	order by r.referee_id, o.uploaded_at, o.number for update of r`
+	rewardReferralSQL = `
+	update referrals set status = $2, referrer_bonus = $3, referee_bonus = $4, order_number = $5, rewarded_at = now()
+	where referee_id = $1`
+)
+
+type referrer struct {
+	ID           string `db:"id"`
+	RegisteredIP string `db:"registered_ip"`
+}
+
+// newReferralCode returns a random code, collisions are rejected by the unique constraint.
+func newReferralCode() (string, error) {
+	b := make([]byte, referralCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = referralCodeAlphabet[int(b[i])%len(referralCodeAlphabet)]
+	}
+	return string(b), nil
+}
+
+// saveReferral records that UserID registered from ip with the referral code. The referral is rejected when
+// the referrer or another user referred by them registered from the same ip.
+func (db *storageImpl) saveReferral(tx *sqlx.Tx, UserID, code, ip string) error {
+	var r referrer
+	if err := tx.GetContext(db.ctx, &r, selectReferrerByCodeSQL, code); err == sql.ErrNoRows {
+		return ErrReferralCodeNotFound
+	} else if err != nil {
+		return err
+	}
+
+	status, reason := referralModel.Pending, ""
+	if ip != "" && r.RegisteredIP == ip {
+		status, reason = referralModel.Rejected, referralRejectedSelf
+	} else if ip != "" {
+		var count int
+		if err := tx.GetContext(db.ctx, &count, countReferralsFromIPSQL, r.ID, ip); err != nil {
+			return err
+		}
+		if count > 0 {
+			status, reason = referralModel.Rejected, referralRejectedSameIP
+		}
+	}
+	if status == referralModel.Rejected {
+		db.logger.Warnf("referral of %v by %v is rejected: %v", UserID, r.ID, reason)
+	}
+	_, err := tx.ExecContext(db.ctx, insertReferralSQL, UserID, r.ID, status, reason)
+	return err
+}
+
+// GetReferrals returns the referral code of the user and users registered with it, users registered
+// before referrals existed get the code on the first request.
+func (db *storageImpl) GetReferrals(UserID string) (*referralModel.Referrals, error) {
+	var referrals referralModel.Referrals
+	if err := db.xdb.GetContext(db.ctx, &referrals.Code, selectReferralCodeSQL, UserID); err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	for referrals.Code == "" {
+		code, err := newReferralCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := db.xdb.ExecContext(db.ctx, setReferralCodeSQL, UserID, code); isUniqueViolation(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		// a concurrent request may have set another code
+		if err := db.xdb.GetContext(db.ctx, &referrals.Code, selectReferralCodeSQL, UserID); err != nil {
+			return nil, err
+		}
+	}
+
+	referrals.Referrals = []referralModel.Referral{}
+	if err := db.xdb.SelectContext(db.ctx, &referrals.Referrals, selectReferralsSQL, UserID); err != nil {
+		return nil, err
+	}
+	return &referrals, nil
+}
+
+type referralToReward struct {
+	RefereeID  string `db:"referee_id"`
+	ReferrerID string `db:"referrer_id"`
+	Number     uint64 `db:"number"`
+}
+
+// rewardReferrals credits referral bonuses for pending referrals whose referred users have an order
+// of nums processed, the earliest uploaded order of the batch is the first one.
+func (db *storageImpl) rewardReferrals(tx *sqlx.Tx, nums []int64) error {
+	query, args, err := sqlx.In(selectReferralsToRewardSQL, nums, model.Processed, referralModel.Pending)
+	if err != nil {
+		return err
+	}
+	referrals := []referralToReward{}
+	if err := tx.SelectContext(db.ctx, &referrals, tx.Rebind(query), args...); err != nil {
+		return err
+	}
+
+	rules := db.policy.ReferralRules
+	for i, r := range referrals {
+		if i > 0 && referrals[i-1].RefereeID == r.RefereeID {
+			continue
+		}
+		if err := db.creditReferralBonus(tx, r.ReferrerID, rules.ReferrerBonus, nil); err != nil {
+			return err
+		}
+		if err := db.creditReferralBonus(tx, r.RefereeID, rules.RefereeBonus, &r.Number); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(db.ctx, rewardReferralSQL,
+			r.RefereeID, referralModel.Rewarded, rules.ReferrerBonus, rules.RefereeBonus, r.Number); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// creditReferralBonus credits the bonus in the default currency, the referrer's one has no order.
+func (db *storageImpl) creditReferralBonus(tx *sqlx.Tx, UserID string, bonus money.Money, number *uint64) error {
+	if bonus <= 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(db.ctx, addAccountAccuralForCalc, UserID, bonus, DefaultCurrency); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(db.ctx, insertLedgerEntrySQL, UserID, bonus, LedgerReferralBonus, number, DefaultCurrency); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(db.ctx, insertLotSQL, UserID, number, bonus, db.lotExpiresAt(), DefaultCurrency)
+	return err
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"gophermart/internal/money"
+
+	accountModel "gophermart/internal/account/model/db"
+	withdrawalsModel "gophermart/internal/withdrawals/model/db"
+)
+
+var ErrWithdrawalNotRefundable = errors.New("only processed withdrawals can be refunded")
+var ErrRefundExceedsWithdrawal = errors.New("refund exceeds the withdrawn sum")
+
+// deductedWithdrawalStatuses are withdrawals whose sums were withdrawn from the balance: processed ones, and
+// reversed and partially refunded ones, their refunds are credited back separately. Pending withdrawals are
+// only held, cancelled and expired ones were never withdrawn.
+var deductedWithdrawalStatuses = withdrawalsModel.SQLList(
+	withdrawalsModel.Processed, withdrawalsModel.Reversed, withdrawalsModel.PartiallyRefunded)
+
+const (
+	selectWithdrawalUserIDSQL = `select user_id, currency from withdrawals where number = $1`
+	refundAccountSQL          = `update accounts set current = current + $2, withdrawn = withdrawn - $2 where user_id = $1 and currency = $3`
+	refundWithdrawalSQL       = `
+	update withdrawals set refunded = refunded + $2, status = $3, reversal_reason = $4 where number = $1
+	returning user_id, number, sum, currency, status, processed_at, refunded, reversal_reason`
+	insertWithdrawalRefundSQL = `insert into withdrawal_refunds(number, sum, actor, reason) values($1, $2, $3, $4)`
+)
+
+// RefundWithdrawal credits sum of the processed withdrawal back to the account, zero sum refunds the rest of it.
+// The withdrawal is Reversed when it is refunded in full and PartiallyRefunded otherwise.
+func (db *storageImpl) RefundWithdrawal(number uint64, sum money.Money, actor, reason string) (*withdrawalsModel.Withdrawals, error) {
+	tx, err := db.xdb.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var owner withdrawalsModel.Withdrawals
+	if err := tx.GetContext(db.ctx, &owner, selectWithdrawalUserIDSQL, number); err == sql.ErrNoRows {
+		return nil, ErrWithdrawalNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	UserID, currency := owner.UserID, owner.Currency
+	// the account is locked before the withdrawal as everywhere else
+	var acc accountModel.Account
+	if err := tx.GetContext(db.ctx, &acc, getUserAccountForUpdate, UserID, currency); err != nil {
+		return nil, err
+	}
+	var withdrawal withdrawalsModel.Withdrawals
+	if err := tx.GetContext(db.ctx, &withdrawal, selectWithdrawalForUpdateSQL, UserID, number); err != nil {
+		return nil, err
+	}
+	if withdrawal.Status != withdrawalsModel.Processed && withdrawal.Status != withdrawalsModel.PartiallyRefunded {
+		return nil, ErrWithdrawalNotRefundable
+	}
+	left := withdrawal.Sum - withdrawal.Refunded
+	if sum == 0 {
+		sum = left
+	}
+	if sum > left {
+		return nil, ErrRefundExceedsWithdrawal
+	}
+	status := withdrawalsModel.PartiallyRefunded
+	if sum == left {
+		status = withdrawalsModel.Reversed
+	}
+
+	if _, err := tx.ExecContext(db.ctx, refundAccountSQL, UserID, sum, currency); err != nil {
+		return nil, err
+	}
+	if err := db.returnToLots(tx, UserID, currency, number, sum); err != nil {
+		return nil, err
+	}
+	var refunded withdrawalsModel.Withdrawals
+	if err := tx.GetContext(db.ctx, &refunded, refundWithdrawalSQL, number, sum, status, reason); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(db.ctx, insertWithdrawalRefundSQL, number, sum, actor, reason); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(db.ctx, insertLedgerEntrySQL, UserID, sum, LedgerRefund, number, currency); err != nil {
+		return nil, err
+	}
+
+	return &refunded, tx.Commit()
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"database/sql"
+	"gophermart/internal/order/model"
+	"time"
+
+	statementModel "gophermart/internal/statement/model/db"
+	withdrawalsModel "gophermart/internal/withdrawals/model/db"
+)
+
+// statementOperationsSQL are credits of processed orders at the time they were processed, debits of processed
+// withdrawals, credits of their refunds, debits of expired points, transfers between users with their fees,
+// loyalty tier, campaign and referral bonuses and manual adjustments, $1 is the user, $2 is PROCESSED status, $3, $4,
+// $5, $6 and $7 are the expiration, the tier bonus, the campaign bonus, the referral bonus and the adjustment ledger
+// entry types, $8 is the default currency. Adjustments of the ledger backfill are not operations, neither are
+// operations in partner currencies.
+var statementOperationsSQL = `
+	with operations as (
+		select o.number, o.accrual as amount, coalesce(
+			(select max(e.created_at) from order_events e where e.number = o.number and e.new_status = $2), o.uploaded_at
+		) as processed_at, 'credit' as type
+		from orders o where o.user_id = $1 and o.currency = $8 and o.status = $2 and o.accrual > 0
+		union all
+		select number, -sum as amount, processed_at, 'debit' as type from withdrawals
+		where user_id = $1 and currency = $8 and status in ` + deductedWithdrawalStatuses + `
+		union all
+		select r.number, r.sum as amount, r.created_at as processed_at, 'refund' as type
+		from withdrawal_refunds r join withdrawals w on w.number = r.number where w.user_id = $1 and w.currency = $8
+		union all
+		select coalesce(order_number, 0) as number, amount, created_at as processed_at,
+			case type when $3 then 'expiration' when $4 then 'tier_bonus' when $5 then 'campaign_bonus'
+				else 'referral_bonus' end as type
+		from ledger_entries where user_id = $1 and currency = $8 and type in ($3, $4, $5, $6)
+		union all
+		select 0 as number, amount, created_at as processed_at, 'adjustment' as type
+		from ledger_entries where user_id = $1 and type = $7 and adjustment_id is not null
+		union all
+		select 0 as number, case when from_user_id = $1 then -sum else sum end as amount, created_at as processed_at,
+			case when from_user_id = $1 then 'transfer_out' else 'transfer_in' end as type
+		from transfers where from_user_id = $1 or to_user_id = $1
+		union all
+		select 0 as number, -fee as amount, created_at as processed_at, 'transfer_fee' as type
+		from transfers where from_user_id = $1 and fee > 0
+	)`
+
+var (
+	// $9 and $10 bound the period, null is an open bound.
+	selectStatementTotalsSQL = statementOperationsSQL + `
+	select
+		coalesce(sum(amount) filter (where processed_at < $9), 0) as opening_balance,
+		coalesce(sum(amount) filter (where in_period and amount > 0), 0) as credit,
+		coalesce(-sum(amount) filter (where in_period and amount < 0), 0) as debit,
+		count(1) filter (where in_period) as total
+	from (
+		select amount, processed_at,
+			($9::timestamptz is null or processed_at >= $9) and ($10::timestamptz is null or processed_at < $10) as in_period
+		from operations
+	) p`
+	// selectStatementHeldSQL sums withdrawals placed before the period end that are still pending.
+	selectStatementHeldSQL = `
+	select coalesce(sum(sum), 0) from withdrawals
+	where user_id = $1 and currency = $2 and status = $3 and ($4::timestamptz is null or processed_at < $4)`
+	selectStatementOperationsSQL = statementOperationsSQL + `
+	select number, amount, processed_at, type, balance from (
+		select number, amount, processed_at, type,
+			sum(amount) over (order by processed_at, number, type rows unbounded preceding) as balance
+		from operations
+		where ($9::timestamptz is null or processed_at >= $9) and ($10::timestamptz is null or processed_at < $10)
+	) p
+	order by processed_at, number, type offset $11 limit $12`
+)
+
+// GetStatement returns operations of the period [from, to) in chronological order with the running balance,
+// totals of the statement are calculated for the whole period, not only for the page. Pending withdrawals are not
+// operations until they are confirmed, their sum is returned as Held.
+func (db *storageImpl) GetStatement(UserID string, from, to *time.Time, offset, limit int) (*statementModel.Statement, error) {
+	tx, err := db.xdb.BeginTxx(db.ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var statement statementModel.Statement
+	if err := tx.GetContext(db.ctx, &statement, selectStatementTotalsSQL, UserID, model.Processed, LedgerExpiration, LedgerTierBonus, LedgerCampaignBonus, LedgerReferralBonus, LedgerAdjustment, DefaultCurrency, from, to); err != nil {
+		return nil, err
+	}
+	if err := tx.GetContext(db.ctx, &statement.Held, selectStatementHeldSQL, UserID, DefaultCurrency, withdrawalsModel.Pending, to); err != nil {
+		return nil, err
+	}
+	statement.Operations = []statementModel.Operation{}
+	if err := tx.SelectContext(db.ctx, &statement.Operations, selectStatementOperationsSQL,
+		UserID, model.Processed, LedgerExpiration, LedgerTierBonus, LedgerCampaignBonus, LedgerReferralBonus, LedgerAdjustment, DefaultCurrency, from, to, offset, limit); err != nil {
+		return nil, err
+	}
+	for i := range statement.Operations {
+		statement.Operations[i].Balance += statement.OpeningBalance
+	}
+
+	return &statement, tx.Commit()
+}
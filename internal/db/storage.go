@@ -4,32 +4,86 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"gophermart/internal/money"
 	"gophermart/internal/order/model"
-	"gophermart/internal/utils"
+	"time"
 
 	accountModel "gophermart/internal/account/model/db"
+	adjustmentModel "gophermart/internal/adjustment/model/db"
+	campaignModel "gophermart/internal/campaign/model/db"
+	referralModel "gophermart/internal/referral/model/db"
+	statementModel "gophermart/internal/statement/model/db"
+	transferModel "gophermart/internal/transfer/model/db"
 	withdrawalsModel "gophermart/internal/withdrawals/model/db"
 
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"go.uber.org/zap"
 )
 
+// CalcAmountsUpdateResult is a result of accrual lookup, non empty Error means the lookup failed
+// and only the failed attempts counter of the order is updated.
 type CalcAmountsUpdateResult struct {
-	Accrual int64
-	Status  model.OrderStatus
+	Accrual  money.Money
+	Status   model.OrderStatus
+	Response string
+	Error    string
 }
 type Storage interface {
-	Register(login, password string) (string, error)
+	Ping() error
+
+	// Register creates the user registered from ip, non empty referralCode is the code of the user who referred them.
+	Register(login, password, referralCode, ip string) (string, error)
 	GetByLoginPassword(login, password string) (string, error)
-	SaveOrder(UserID string, number uint64) error
+	SaveOrder(UserID string, number uint64, merchantID, provider string) error
 	GetOrders(UserID string) ([]model.Order, error)
-
-	GetAccount(UserID string) (*accountModel.Account, error)
-	WithdrawFromAccount(UserID string, sum float64, number uint64) error
-	GetWithdrawals(UserID string) ([]withdrawalsModel.Withdrawals, error)
-	CalcAmounts(offset, limit int, updF func(nums []int64) map[int64]CalcAmountsUpdateResult) (int, error)
+	GetOrderHistory(UserID string, number uint64) ([]model.OrderEvent, error)
+
+	// GetAccount, WithdrawFromAccount, HoldWithdrawal, GetExpiringPoints and GetWithdrawals work with the
+	// account in currency, DefaultCurrency is the platform's own points.
+	GetAccount(UserID, currency string) (*accountModel.Account, error)
+	WithdrawFromAccount(UserID, currency string, sum money.Money, number uint64) error
+	HoldWithdrawal(UserID, currency string, sum money.Money, number uint64, ttl time.Duration) error
+	ConfirmWithdrawal(UserID string, number uint64) error
+	CancelWithdrawal(UserID string, number uint64) error
+	ExpireWithdrawals() (int, error)
+	ExpirePoints() (int, error)
+	RecalculateTiers() (int, error)
+	CreateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error)
+	GetCampaigns() ([]campaignModel.Campaign, error)
+	GetCampaign(ID int64) (*campaignModel.Campaign, error)
+	UpdateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error)
+	DeleteCampaign(ID int64) error
+	CreateAdjustment(login string, amount money.Money, reason, ticket, actor string) (*adjustmentModel.Adjustment, error)
+	ApproveAdjustment(ID int64, actor string) (*adjustmentModel.Adjustment, error)
+	RejectAdjustment(ID int64, actor, reason string) (*adjustmentModel.Adjustment, error)
+	GetAdjustments() ([]adjustmentModel.Adjustment, error)
+	GetAdjustment(ID int64) (*adjustmentModel.Adjustment, error)
+	GetExpiringPoints(UserID, currency string, within time.Duration) ([]accountModel.ExpiringPoints, error)
+	RefundWithdrawal(number uint64, sum money.Money, actor, reason string) (*withdrawalsModel.Withdrawals, error)
+	GetWithdrawals(UserID, currency string) ([]withdrawalsModel.Withdrawals, error)
+	TransferPoints(UserID, login string, sum money.Money) (*transferModel.Transfer, error)
+	GetTransfers(UserID string) ([]transferModel.Transfer, error)
+	GetReferrals(UserID string) (*referralModel.Referrals, error)
+	GetStatement(UserID string, from, to *time.Time, offset, limit int) (*statementModel.Statement, error)
+	ReserveIdempotencyKey(UserID, scope, key, requestHash string, ttl, lease time.Duration) (*IdempotentResponse, error)
+	SaveIdempotentResponse(UserID, scope, key string, statusCode int, contentType string, body []byte) error
+	ReleaseIdempotencyKey(UserID, scope, key string) error
+	CalcAmounts(shard Shard, providers []string, offset, limit int, updF func(nums []int64) map[int64]CalcAmountsUpdateResult) (int, error)
+	ApplyCalcResults(providers []string, updates map[int64]CalcAmountsUpdateResult) (int, error)
+	SaveCallbackSignature(signature string, ttl time.Duration) error
+
+	DeadLetterOrders(maxFailedAttempts int) (int, error)
+	GetDeadLetterOrders() ([]model.DeadLetterOrder, error)
+	RetryDeadLetterOrder(number uint64, actor string) error
+	ResolveDeadLetterOrder(number uint64, status model.OrderStatus, accrual money.Money, actor, reason string) error
+
+	TryAcquireLease(instanceID string, shard int) (*Lease, error)
+	GetLeaders() ([]Leader, error)
+
+	CheckLedger() ([]LedgerMismatch, error)
+	Reconcile(save bool) (*ReconciliationReport, error)
 }
 
 var ErrDuplicateLogin = errors.New("login already exist")
@@ -37,14 +91,23 @@ var ErrUserNotFound = errors.New("user not found")
 
 var ErrDuplicateOrder = errors.New("the order number has already been uploaded by this user")
 var ErrOrderOfAnotherUser = errors.New("the order number has already been uploaded by another user")
+var ErrOrderNotFound = errors.New("order not found")
 
 var ErrBalanceLimitExhausted = errors.New("there are not enough funds in the account")
+var ErrDuplicateWithdrawal = errors.New("the order number has already been used for withdrawal")
+
+// inCalcStatuses are NEW, PROCESSING, REGISTERED and UNREGISTERED orders still polled from accrual system.
+const inCalcStatuses = `(0, 1, 5, 6)`
+
+// finalStatuses are INVALID and PROCESSED orders, accrual results never change them.
+const finalStatuses = `(2, 3)`
 
 type storageImpl struct {
 	url    string
 	ctx    context.Context
 	xdb    *sqlx.DB
 	logger *zap.SugaredLogger
+	policy Policy
 }
 
 const (
@@ -60,7 +123,7 @@ const (
 		user_id UUID,
 		status int not null default 0,
 		uploaded_at timestamp with time zone not null default now(),
-		accrual integer not null default 0,
+		accrual bigint not null default 0,
 		CONSTRAINT fk_user
 		FOREIGN KEY(user_id) 
 		REFERENCES users(id)
@@ -68,8 +131,8 @@ const (
 
 	create table if not exists accounts(
 		user_id UUID unique,
-		current integer not null default 0,
-		withdrawn integer not null default 0,
+		current bigint not null default 0,
+		withdrawn bigint not null default 0,
 		CONSTRAINT fk_user
 		FOREIGN KEY(user_id) 
 		REFERENCES users(id)
@@ -78,43 +141,330 @@ const (
 	create table if not exists withdrawals(
 		user_id UUID,
 		number bigint not null unique,
-		sum integer not null,
+		sum bigint not null,
 		processed_at timestamp with time zone not null default now(),
 		CONSTRAINT fk_user
 		FOREIGN KEY(user_id) 
 		REFERENCES users(id)
 	);
+
+	alter table users add column if not exists referral_code varchar(16) unique;
+	alter table users add column if not exists registered_ip varchar(64);
+	alter table orders add column if not exists attempts int not null default 0;
+	alter table orders add column if not exists failed_attempts int not null default 0;
+	alter table orders add column if not exists last_error text;
+	alter table orders add column if not exists merchant_id varchar(256);
+	alter table orders add column if not exists provider varchar(256);
+	alter table accounts add column if not exists held bigint not null default 0;
+	alter table accounts add column if not exists tier varchar(64);
+	alter table accounts add column if not exists tier_updated_at timestamp with time zone;
+	alter table accounts add column if not exists currency varchar(16) not null default '';
+	alter table accounts drop constraint if exists accounts_user_id_key;
+	create unique index if not exists accounts_user_id_currency_idx on accounts(user_id, currency);
+	alter table orders add column if not exists currency varchar(16) not null default '';
+	alter table withdrawals add column if not exists currency varchar(16) not null default '';
+	alter table withdrawals add column if not exists status int not null default 0;
+	alter table withdrawals add column if not exists expires_at timestamp with time zone;
+	create index if not exists withdrawals_pending_idx on withdrawals(expires_at) where status = 1;
+	alter table withdrawals add column if not exists refunded bigint not null default 0;
+	alter table withdrawals add column if not exists reversal_reason text;
+
+	create table if not exists order_events(
+		id bigserial primary key,
+		number bigint not null,
+		old_status int,
+		new_status int not null,
+		accrual bigint not null default 0,
+		response text,
+		attempt int not null default 0,
+		actor varchar(256),
+		reason text,
+		created_at timestamp with time zone not null default now(),
+		CONSTRAINT fk_order
+		FOREIGN KEY(number)
+		REFERENCES orders(number)
+	);
+	create index if not exists order_events_number_idx on order_events(number);
+	-- error of the last lookup is kept for admins only, it was stored as the response before
+	alter table order_events add column if not exists error text;
+	update order_events set error = response, response = null where new_status = 4 and error is null and response is not null;
+
+	create table if not exists processing_leaders(
+		shard int primary key,
+		instance_id varchar(256) not null,
+		renewed_at timestamp with time zone not null default now()
+	);
+
+	create table if not exists ledger_entries(
+		id bigserial primary key,
+		user_id UUID not null,
+		amount bigint not null,
+		type int not null,
+		order_number bigint,
+		created_at timestamp with time zone not null default now(),
+		CONSTRAINT fk_user
+		FOREIGN KEY(user_id)
+		REFERENCES users(id)
+	);
+	create index if not exists ledger_entries_user_id_idx on ledger_entries(user_id, created_at);
+	alter table ledger_entries add column if not exists transfer_id bigint;
+	alter table ledger_entries add column if not exists campaign_id bigint;
+	alter table ledger_entries add column if not exists adjustment_id bigint;
+	alter table ledger_entries add column if not exists currency varchar(16) not null default '';
+
+	create table if not exists withdrawal_refunds(
+		id bigserial primary key,
+		number bigint not null,
+		sum bigint not null,
+		actor varchar(256) not null,
+		reason text not null,
+		created_at timestamp with time zone not null default now(),
+		CONSTRAINT fk_withdrawal
+		FOREIGN KEY(number)
+		REFERENCES withdrawals(number)
+	);
+	create index if not exists withdrawal_refunds_number_idx on withdrawal_refunds(number);
+
+	create table if not exists point_lots(
+		id bigserial primary key,
+		user_id UUID not null,
+		order_number bigint,
+		amount bigint not null,
+		remaining bigint not null,
+		expired bigint not null default 0,
+		accrued_at timestamp with time zone not null default now(),
+		expires_at timestamp with time zone,
+		CONSTRAINT fk_user
+		FOREIGN KEY(user_id)
+		REFERENCES users(id)
+	);
+	alter table point_lots add column if not exists currency varchar(16) not null default '';
+	create index if not exists point_lots_user_id_idx on point_lots(user_id, expires_at) where remaining > 0;
+	create index if not exists point_lots_expires_at_idx on point_lots(expires_at) where remaining > 0;
+
+	create table if not exists point_lot_usages(
+		lot_id bigint not null,
+		number bigint not null,
+		amount bigint not null,
+		primary key(lot_id, number),
+		CONSTRAINT fk_lot
+		FOREIGN KEY(lot_id)
+		REFERENCES point_lots(id)
+	);
+	create index if not exists point_lot_usages_number_idx on point_lot_usages(number);
+
+	create table if not exists transfers(
+		id bigserial primary key,
+		from_user_id UUID not null,
+		to_user_id UUID not null,
+		sum bigint not null,
+		fee bigint not null default 0,
+		created_at timestamp with time zone not null default now(),
+		CONSTRAINT fk_from_user
+		FOREIGN KEY(from_user_id)
+		REFERENCES users(id),
+		CONSTRAINT fk_to_user
+		FOREIGN KEY(to_user_id)
+		REFERENCES users(id)
+	);
+	create index if not exists transfers_from_user_id_idx on transfers(from_user_id, created_at);
+	create index if not exists transfers_to_user_id_idx on transfers(to_user_id, created_at);
+
+	create table if not exists referrals(
+		referee_id UUID primary key,
+		referrer_id UUID not null,
+		status int not null default 0,
+		reject_reason text,
+		referrer_bonus bigint not null default 0,
+		referee_bonus bigint not null default 0,
+		order_number bigint,
+		created_at timestamp with time zone not null default now(),
+		rewarded_at timestamp with time zone,
+		CONSTRAINT fk_referee
+		FOREIGN KEY(referee_id)
+		REFERENCES users(id),
+		CONSTRAINT fk_referrer
+		FOREIGN KEY(referrer_id)
+		REFERENCES users(id)
+	);
+	create index if not exists referrals_referrer_id_idx on referrals(referrer_id, created_at);
+
+	create table if not exists adjustments(
+		id bigserial primary key,
+		user_id UUID not null,
+		amount bigint not null,
+		reason text not null,
+		ticket varchar(256) not null,
+		status int not null default 0,
+		created_by varchar(256) not null,
+		created_at timestamp with time zone not null default now(),
+		decided_by varchar(256),
+		decided_at timestamp with time zone,
+		CONSTRAINT fk_user
+		FOREIGN KEY(user_id)
+		REFERENCES users(id)
+	);
+	create index if not exists adjustments_pending_idx on adjustments(created_at) where status = 1;
+
+	create table if not exists adjustment_events(
+		id bigserial primary key,
+		adjustment_id bigint not null,
+		status int not null,
+		actor varchar(256) not null,
+		comment text,
+		created_at timestamp with time zone not null default now(),
+		CONSTRAINT fk_adjustment
+		FOREIGN KEY(adjustment_id)
+		REFERENCES adjustments(id)
+	);
+	create index if not exists adjustment_events_adjustment_id_idx on adjustment_events(adjustment_id);
+
+	create table if not exists campaigns(
+		id bigserial primary key,
+		name varchar(256) not null,
+		starts_at timestamp with time zone not null,
+		ends_at timestamp with time zone,
+		first_order boolean not null default false,
+		min_accrual bigint not null default 0,
+		tiers text[] not null default '{}',
+		providers text[] not null default '{}',
+		bonus_fixed bigint not null default 0,
+		bonus_percent numeric not null default 0,
+		budget bigint not null default 0,
+		spent bigint not null default 0,
+		created_at timestamp with time zone not null default now()
+	);
+
+	create table if not exists reconciliation_reports(
+		id bigserial primary key,
+		started_at timestamp with time zone not null,
+		finished_at timestamp with time zone not null default now(),
+		accounts int not null,
+		discrepancies int not null
+	);
+
+	create table if not exists reconciliation_discrepancies(
+		report_id bigint not null,
+		user_id UUID not null,
+		currency varchar(16) not null default '',
+		current bigint not null,
+		expected_current bigint not null,
+		withdrawn bigint not null,
+		expected_withdrawn bigint not null,
+		held bigint not null,
+		expected_held bigint not null,
+		backfilled bigint not null default 0,
+		primary key(report_id, user_id, currency),
+		CONSTRAINT fk_report
+		FOREIGN KEY(report_id)
+		REFERENCES reconciliation_reports(id)
+	);
+	alter table reconciliation_discrepancies add column if not exists backfilled bigint not null default 0;
+
+	create table if not exists idempotency_keys(
+		user_id UUID not null,
+		scope varchar(256) not null,
+		key varchar(256) not null,
+		request_hash varchar(64) not null,
+		status_code int,
+		content_type varchar(256),
+		response bytea,
+		created_at timestamp with time zone not null default now(),
+		primary key(user_id, scope, key),
+		CONSTRAINT fk_user
+		FOREIGN KEY(user_id)
+		REFERENCES users(id)
+	);
+
+	create table if not exists accrual_callbacks(
+		signature varchar(64) primary key,
+		received_at timestamp with time zone not null default now()
+	);
+	create index if not exists accrual_callbacks_received_at_idx on accrual_callbacks(received_at);
+
+	-- amounts were int4 before, money.Money of any scale needs int8
+	do $$
+	declare c record;
+	begin
+		for c in select table_name, column_name from information_schema.columns
+			where table_schema = current_schema() and data_type = 'integer' and (table_name, column_name) in (
+				('orders', 'accrual'), ('order_events', 'accrual'),
+				('accounts', 'current'), ('accounts', 'withdrawn'), ('accounts', 'held'),
+				('withdrawals', 'sum'), ('withdrawals', 'refunded'), ('withdrawal_refunds', 'sum'),
+				('point_lots', 'amount'), ('point_lots', 'remaining'), ('point_lots', 'expired'),
+				('point_lot_usages', 'amount'), ('transfers', 'sum'), ('transfers', 'fee'),
+				('referrals', 'referrer_bonus'), ('referrals', 'referee_bonus'),
+				('campaigns', 'min_accrual'), ('campaigns', 'bonus_fixed'), ('campaigns', 'budget'), ('campaigns', 'spent'))
+		loop
+			execute format('alter table %I alter column %I type bigint', c.table_name, c.column_name);
+		end loop;
+	end $$;
 	`
 
 	getUserIDByLoginPasswordSQL = `select id from users where login = $1 and password = $2;`
 	getCountByLoginPasswordSQL  = `select count(*) from users where login = $1 and password = $2;`
-	insertUserSQL               = `insert into users(id, login, password) values($1,$2,$3);`
+	insertUserSQL               = `insert into users(id, login, password, referral_code, registered_ip) values($1,$2,$3,$4,nullif($5, ''));`
 
 	getOrderUserIDSQL          = `select user_id from orders where number = $1;`
-	saveOrderSQL               = `insert into orders(user_id, number) values($1,$2);`
+	saveOrderSQL               = `insert into orders(user_id, number, merchant_id, provider, currency) values($1, $2, nullif($3, ''), $4, $5);`
 	selectAllOrdersOfUserIDSQL = `
 	select
 		number,
 		status,
 		user_id,
 		accrual,
+		currency,
 		uploaded_at 
 	from orders where user_id = $1 order by uploaded_at asc;`
-
-	getUserAccount                  = `select user_id, current, withdrawn from accounts where user_id = $1`
-	getUserAccountForUpdate         = `select user_id, current, withdrawn from accounts where user_id = $1 for update`
-	updateAccount                   = `update accounts set current = $2, withdrawn = $3 where user_id = $1`
-	insertWithdrawals               = `insert into withdrawals(user_id,number,sum) values($1,$2,$3);`
-	selectAllwithdrawalsOfUserIDSQL = `select user_id,number,sum,processed_at from withdrawals where user_id = $1 order by processed_at asc`
-
-	createAccount               = `insert into accounts(user_id) values($1)`
-	selectOrdersForCalc         = `select number from orders where status = 0 or status = 1 offset $1 limit $2 for update`
-	updateOrdersForCalc         = `update orders set status = $2, accrual = $3 where number = $1`
-	selectAccountAccuralForCalc = `select user_id, sum(accrual) as sum from orders where number in (?) group by user_id;`
-	addAccountAccuralForCalc    = `update accounts set current = current + $2 where user_id = $1`
+	getOrderOfUserCountSQL = `select count(1) from orders where user_id = $1 and number = $2;`
+	insertOrderEventSQL    = `
+	insert into order_events(number, old_status, new_status, accrual, response, attempt, actor, reason)
+	values($1, $2, $3, $4, $5, $6, $7, $8);`
+	selectOrderEventsSQL = `
+	select
+		e.number,
+		e.old_status,
+		e.new_status,
+		e.accrual,
+		e.response,
+		e.attempt,
+		e.actor,
+		e.reason,
+		e.created_at
+	from order_events e join orders o on o.number = e.number
+	where o.user_id = $1 and e.number = $2 order by e.created_at asc, e.id asc;`
+
+	getUserAccount                  = `select user_id, currency, current, withdrawn, held, tier from accounts where user_id = $1 and currency = $2`
+	getUserAccountForUpdate         = `select user_id, currency, current, withdrawn, held from accounts where user_id = $1 and currency = $2 for update`
+	updateAccount                   = `update accounts set current = $2, withdrawn = $3 where user_id = $1 and currency = $4`
+	insertWithdrawals               = `insert into withdrawals(user_id,number,sum,currency) values($1,$2,$3,$4);`
+	selectAllwithdrawalsOfUserIDSQL = `select user_id,number,sum,currency,status,processed_at,expires_at,refunded,reversal_reason from withdrawals where user_id = $1 and currency = $2 order by processed_at asc`
+
+	createAccount       = `insert into accounts(user_id) values($1)`
+	selectOrdersForCalc = `
+	select number from orders
+	where status in ` + inCalcStatuses + ` and number % $3 = $4 and coalesce(provider, '') = any($5)
+	offset $1 limit $2 for update`
+	selectOrdersInCalcByNumbers = `
+	select number from orders
+	where number = any($1) and status in ` + inCalcStatuses + ` and coalesce(provider, '') = any($2)
+	for update`
+	updateOrdersForCalc = `
+	with old as (select status from orders where number = $1)
+	update orders set status = $2, accrual = $3, attempts = attempts + 1, failed_attempts = 0
+	where number = $1 and status not in ` + finalStatuses + `
+	returning (select status from old), attempts`
+	updateOrderFailedAttemptSQL = `
+	update orders set attempts = attempts + 1, failed_attempts = failed_attempts + 1, last_error = $2 where number = $1`
+	selectAccountAccuralForCalc = `select user_id, currency, sum(accrual) as sum from orders where number in (?) group by user_id, currency;`
+	// accounts in partner currencies are created by the first accrual
+	addAccountAccuralForCalc = `
+	insert into accounts(user_id, currency, current) values($1, $3, $2)
+	on conflict (user_id, currency) do update set current = accounts.current + excluded.current`
 )
 
-func NewStorage(url string, ctx context.Context, logger *zap.SugaredLogger) (Storage, error) {
+// NewStorage connects to the database, balance changes follow the rules of policy.
+func NewStorage(url string, ctx context.Context, policy Policy, logger *zap.SugaredLogger) (Storage, error) {
 	logger.Infow("start init dbstorage ...")
 	xdb, err := sqlx.Connect("postgres", url)
 	if err != nil {
@@ -122,7 +472,7 @@ func NewStorage(url string, ctx context.Context, logger *zap.SugaredLogger) (Sto
 		return nil, err
 	}
 
-	storage := &storageImpl{url, ctx, xdb, logger}
+	storage := &storageImpl{url, ctx, xdb, logger, policy}
 	if err := storage.initDB(); err != nil {
 		logger.Errorf("error on connect to init db: %v", err)
 		return nil, err
@@ -132,11 +482,20 @@ func NewStorage(url string, ctx context.Context, logger *zap.SugaredLogger) (Sto
 }
 
 func (db *storageImpl) initDB() error {
-	_, err := db.xdb.ExecContext(db.ctx, createTablesIfNeedSQL)
-	return err
+	if _, err := db.xdb.ExecContext(db.ctx, createTablesIfNeedSQL); err != nil {
+		return err
+	}
+	if err := db.backfillLedger(); err != nil {
+		return err
+	}
+	return db.backfillLots()
+}
+
+func (db *storageImpl) Ping() error {
+	return db.xdb.PingContext(db.ctx)
 }
 
-func (db *storageImpl) Register(login, password string) (string, error) {
+func (db *storageImpl) Register(login, password, referralCode, ip string) (string, error) {
 	tx, err := db.xdb.Beginx()
 	if err != nil {
 		return "", err
@@ -144,19 +503,28 @@ func (db *storageImpl) Register(login, password string) (string, error) {
 	defer tx.Rollback()
 
 	var count int
-	if err := db.xdb.GetContext(db.ctx, &count, getCountByLoginPasswordSQL, login, password); err != nil {
+	if err := tx.GetContext(db.ctx, &count, getCountByLoginPasswordSQL, login, password); err != nil {
 		return "", err
 	}
 	if count > 0 {
 		return "", ErrDuplicateLogin
 	}
 	id := uuid.New().String()
-	if _, err := db.xdb.ExecContext(db.ctx, insertUserSQL, id, login, password); err != nil {
+	code, err := newReferralCode()
+	if err != nil {
 		return "", err
 	}
-	if _, err := db.xdb.ExecContext(db.ctx, createAccount, id); err != nil {
+	if _, err := tx.ExecContext(db.ctx, insertUserSQL, id, login, password, code, ip); err != nil {
 		return "", err
 	}
+	if _, err := tx.ExecContext(db.ctx, createAccount, id); err != nil {
+		return "", err
+	}
+	if referralCode != "" {
+		if err := db.saveReferral(tx, id, referralCode, ip); err != nil {
+			return "", err
+		}
+	}
 	if err := tx.Commit(); err != nil {
 		return "", err
 	}
@@ -176,7 +544,8 @@ func (db *storageImpl) GetByLoginPassword(login, password string) (string, error
 	return id, nil
 }
 
-func (db *storageImpl) SaveOrder(UserID string, number uint64) error {
+// SaveOrder saves the order routed to provider, its accrual is paid in the currency of the provider.
+func (db *storageImpl) SaveOrder(UserID string, number uint64, merchantID, provider string) error {
 	tx, err := db.xdb.Beginx()
 	if err != nil {
 		return err
@@ -184,7 +553,7 @@ func (db *storageImpl) SaveOrder(UserID string, number uint64) error {
 	defer tx.Rollback()
 
 	var orderUserID string
-	err = db.xdb.GetContext(db.ctx, &orderUserID, getOrderUserIDSQL, number)
+	err = tx.GetContext(db.ctx, &orderUserID, getOrderUserIDSQL, number)
 
 	if err != nil && err != sql.ErrNoRows {
 		return err
@@ -197,7 +566,11 @@ func (db *storageImpl) SaveOrder(UserID string, number uint64) error {
 		return ErrOrderOfAnotherUser
 	}
 
-	if _, err = db.xdb.ExecContext(db.ctx, saveOrderSQL, UserID, number); err != nil {
+	if _, err = tx.ExecContext(db.ctx, saveOrderSQL, UserID, number, merchantID, provider, db.providerCurrency(provider)); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(db.ctx, insertOrderEventSQL, number, nil, model.New, 0, nil, 0, nil, nil); err != nil {
 		return err
 	}
 
@@ -216,12 +589,34 @@ func (db *storageImpl) GetOrders(UserID string) ([]model.Order, error) {
 	return orders, nil
 }
 
+func (db *storageImpl) GetOrderHistory(UserID string, number uint64) ([]model.OrderEvent, error) {
+	var count int
+	if err := db.xdb.GetContext(db.ctx, &count, getOrderOfUserCountSQL, UserID, number); err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, ErrOrderNotFound
+	}
+
+	events := []model.OrderEvent{}
+	if err := db.xdb.SelectContext(db.ctx, &events, selectOrderEventsSQL, UserID, number); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
 //Account
 
-func (db *storageImpl) GetAccount(UserID string) (*accountModel.Account, error) {
+// GetAccount returns the balance of the user in currency, it is zero in partner currencies not accrued yet.
+func (db *storageImpl) GetAccount(UserID, currency string) (*accountModel.Account, error) {
+	if err := db.checkCurrency(currency); err != nil {
+		return nil, err
+	}
 	var account accountModel.Account
-	err := db.xdb.GetContext(db.ctx, &account, getUserAccount, UserID)
-	if err == sql.ErrNoRows {
+	err := db.xdb.GetContext(db.ctx, &account, getUserAccount, UserID, currency)
+	if err == sql.ErrNoRows && currency != DefaultCurrency {
+		return &accountModel.Account{UserID: UserID, Currency: currency}, nil
+	} else if err == sql.ErrNoRows {
 		return nil, ErrUserNotFound
 	} else if err != nil {
 		return nil, err
@@ -230,33 +625,39 @@ func (db *storageImpl) GetAccount(UserID string) (*accountModel.Account, error)
 	return &account, nil
 }
 
-func (db *storageImpl) WithdrawFromAccount(UserID string, sum float64, number uint64) error {
+// WithdrawFromAccount withdraws the sum in currency for the order number.
+func (db *storageImpl) WithdrawFromAccount(UserID, currency string, withdraw money.Money, number uint64) error {
 	tx, err := db.xdb.Beginx()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	var acc accountModel.Account
-	err = db.xdb.GetContext(db.ctx, &acc, getUserAccountForUpdate, UserID)
-	if err == sql.ErrNoRows {
-		return ErrUserNotFound
-	} else if err != nil {
+	acc, err := db.lockAccount(tx, UserID, currency)
+	if err != nil {
 		return err
 	}
 
-	withdraw := utils.GetPersistentAccrual(sum)
-	if acc.Current < withdraw {
-		return ErrBalanceLimitExhausted
+	if err := db.checkWithdrawalLimits(tx, UserID, currency, withdraw, acc.Current); err != nil {
+		return err
 	}
 	newCurrent := acc.Current - withdraw
 	newWithdrawn := acc.Withdrawn + withdraw
 
-	if _, err := db.xdb.ExecContext(db.ctx, updateAccount, acc.UserID, newCurrent, newWithdrawn); err != nil {
+	if _, err := tx.ExecContext(db.ctx, updateAccount, acc.UserID, newCurrent, newWithdrawn, currency); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(db.ctx, insertWithdrawals, UserID, number, withdraw, currency); isUniqueViolation(err) {
+		return ErrDuplicateWithdrawal
+	} else if err != nil {
+		return err
+	}
+	if _, err := db.takeFromLots(tx, UserID, currency, number, withdraw); err != nil {
 		return err
 	}
 
-	if _, err := db.xdb.ExecContext(db.ctx, insertWithdrawals, UserID, number, withdraw); err != nil {
+	if _, err := tx.ExecContext(db.ctx, insertLedgerEntrySQL, UserID, -withdraw, LedgerWithdrawal, number, currency); err != nil {
 		return err
 	}
 
@@ -267,20 +668,27 @@ func (db *storageImpl) WithdrawFromAccount(UserID string, sum float64, number ui
 	return nil
 }
 
-func (db *storageImpl) GetWithdrawals(UserID string) ([]withdrawalsModel.Withdrawals, error) {
+// GetWithdrawals returns withdrawals of the user in currency.
+func (db *storageImpl) GetWithdrawals(UserID, currency string) ([]withdrawalsModel.Withdrawals, error) {
+	if err := db.checkCurrency(currency); err != nil {
+		return nil, err
+	}
 	withdrawals := []withdrawalsModel.Withdrawals{}
-	if err := db.xdb.SelectContext(db.ctx, &withdrawals, selectAllwithdrawalsOfUserIDSQL, UserID); err != nil {
+	if err := db.xdb.SelectContext(db.ctx, &withdrawals, selectAllwithdrawalsOfUserIDSQL, UserID, currency); err != nil {
 		return nil, err
 	}
 	return withdrawals, nil
 }
 
 type userIDSum struct {
-	userID string `db:"user_id"`
-	sum    int64  `db:"sum"`
+	userID   string      `db:"user_id"`
+	currency string      `db:"currency"`
+	sum      money.Money `db:"sum"`
 }
 
-func (db *storageImpl) CalcAmounts(offset, limit int, updF func(nums []int64) map[int64]CalcAmountsUpdateResult) (int, error) {
+// CalcAmounts selects orders of the shard routed to one of providers, empty provider name selects orders
+// uploaded before providers were stored on the order row.
+func (db *storageImpl) CalcAmounts(shard Shard, providers []string, offset, limit int, updF func(nums []int64) map[int64]CalcAmountsUpdateResult) (int, error) {
 	tx, err := db.xdb.Beginx()
 	if err != nil {
 		return 0, err
@@ -288,52 +696,155 @@ func (db *storageImpl) CalcAmounts(offset, limit int, updF func(nums []int64) ma
 	defer tx.Rollback()
 
 	nums := []int64{}
-	if err := db.xdb.SelectContext(db.ctx, &nums, selectOrdersForCalc, offset, limit); err != nil {
+	if err := tx.SelectContext(db.ctx, &nums, selectOrdersForCalc, offset, limit, shard.Count, shard.Index, pq.Array(providers)); err != nil {
 		return 0, err
 	}
 
 	if len(nums) != 0 {
-		updates := updF(nums)
-		for num, accAndStatus := range updates {
-			if _, err := db.xdb.ExecContext(db.ctx, updateOrdersForCalc, num, accAndStatus.Status, accAndStatus.Accrual); err != nil {
-				if err := tx.Rollback(); err != nil {
-					return 0, err
-				}
-				return 0, err
-			}
+		if err := db.applyCalcResults(tx, nums, updF(nums)); err != nil {
+			return 0, err
 		}
+	}
 
-		userIDUpd := make([]userIDSum, 0)
-		query, args, err := sqlx.In(selectAccountAccuralForCalc, nums)
-		if err != nil {
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(nums), nil
+}
+
+// ApplyCalcResults saves accrual results pushed by the accrual system for orders routed to one of providers,
+// as in CalcAmounts. Orders that are unknown, routed to another provider or already in a final status are skipped.
+func (db *storageImpl) ApplyCalcResults(providers []string, updates map[int64]CalcAmountsUpdateResult) (int, error) {
+	if len(updates) == 0 {
+		return 0, nil
+	}
+	tx, err := db.xdb.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	requested := make([]int64, 0, len(updates))
+	for num := range updates {
+		requested = append(requested, num)
+	}
+	nums := []int64{}
+	if err := tx.SelectContext(db.ctx, &nums, selectOrdersInCalcByNumbers, pq.Array(requested), pq.Array(providers)); err != nil {
+		return 0, err
+	}
+
+	if len(nums) != 0 {
+		if err := db.applyCalcResults(tx, nums, updates); err != nil {
 			return 0, err
 		}
-		query = db.xdb.Rebind(query)
+	}
 
-		if rows, err := db.xdb.QueryContext(db.ctx, query, args...); err != nil || rows.Err() != nil {
-			if err != nil {
-				return 0, err
-			}
-			return 0, rows.Err()
-		} else {
-			for rows.Next() {
-				var r userIDSum
-				if err := rows.Scan(&r.userID, &r.sum); err != nil {
-					return 0, err
-				}
-				userIDUpd = append(userIDUpd, r)
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(nums), nil
+}
+
+// applyCalcResults updates locked orders nums and credits accruals to their owners.
+func (db *storageImpl) applyCalcResults(tx *sqlx.Tx, nums []int64, updates map[int64]CalcAmountsUpdateResult) error {
+	locked := make([]int64, 0, len(nums))
+	for _, num := range nums {
+		accAndStatus, ok := updates[num]
+		if !ok {
+			continue
+		}
+		if accAndStatus.Error != "" {
+			if _, err := tx.ExecContext(db.ctx, updateOrderFailedAttemptSQL, num, accAndStatus.Error); err != nil {
+				return err
 			}
+			continue
 		}
-		for i := 0; i < len(userIDUpd); i++ {
-			if _, err := db.xdb.ExecContext(db.ctx, addAccountAccuralForCalc, userIDUpd[i].userID, userIDUpd[i].sum); err != nil {
-				return 0, err
+
+		var oldStatus model.OrderStatus
+		var attempt int
+		if err := tx.QueryRowxContext(db.ctx, updateOrdersForCalc, num, accAndStatus.Status, accAndStatus.Accrual).
+			Scan(&oldStatus, &attempt); err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if oldStatus != accAndStatus.Status {
+			var response *string
+			if accAndStatus.Response != "" {
+				response = &accAndStatus.Response
+			}
+			if _, err := tx.ExecContext(db.ctx, insertOrderEventSQL,
+				num, oldStatus, accAndStatus.Status, accAndStatus.Accrual, response, attempt, nil, nil); err != nil {
+				return err
 			}
 		}
+		locked = append(locked, num)
+	}
+	if len(locked) == 0 {
+		return nil
 	}
+	return db.creditAccruals(tx, locked)
+}
 
-	if err := tx.Commit(); err != nil {
-		return 0, err
+// creditAccruals credits accruals of updated orders nums to their owners together with campaign,
+// referral and tier bonuses, orders must be locked by tx.
+func (db *storageImpl) creditAccruals(tx *sqlx.Tx, nums []int64) error {
+	// campaigns are locked before any account of the batch
+	if err := db.applyCampaigns(tx, nums); err != nil {
+		return err
+	}
+	if err := db.rewardReferrals(tx, nums); err != nil {
+		return err
 	}
 
-	return len(nums), nil
+	query, args, err := sqlx.In(insertAccrualEntriesSQL, LedgerAccrual, nums)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(db.ctx, tx.Rebind(query), args...); err != nil {
+		return err
+	}
+	if err := db.insertAccrualLots(tx, nums); err != nil {
+		return err
+	}
+	if err := db.creditTierBonuses(tx, nums); err != nil {
+		return err
+	}
+
+	userIDUpd := make([]userIDSum, 0)
+	query, args, err = sqlx.In(selectAccountAccuralForCalc, nums)
+	if err != nil {
+		return err
+	}
+	query = tx.Rebind(query)
+
+	rows, err := tx.QueryContext(db.ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var r userIDSum
+		if err := rows.Scan(&r.userID, &r.currency, &r.sum); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDUpd = append(userIDUpd, r)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	for i := 0; i < len(userIDUpd); i++ {
+		if _, err := tx.ExecContext(db.ctx, addAccountAccuralForCalc, userIDUpd[i].userID, userIDUpd[i].sum, userIDUpd[i].currency); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
 }
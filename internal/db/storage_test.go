@@ -3,13 +3,18 @@ package db
 import (
 	"context"
 	accountModel "gophermart/internal/account/model/db"
+	adjustmentModel "gophermart/internal/adjustment/model/db"
+	campaignModel "gophermart/internal/campaign/model/db"
+	"gophermart/internal/money"
 	"gophermart/internal/order/model"
+	referralModel "gophermart/internal/referral/model/db"
 	withdrawalsModel "gophermart/internal/withdrawals/model/db"
+	"math/big"
 	"testing"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 )
@@ -23,22 +28,52 @@ var connURL = "host=localhost port=5432 user=postgres dbname=postgres sslmode=di
 var xdb = sqlx.MustConnect("postgres", connURL)
 
 func dropTables() {
+	xdb.MustExec("drop table if exists accrual_callbacks;")
+	xdb.MustExec("drop table if exists idempotency_keys;")
+	xdb.MustExec("drop table if exists reconciliation_discrepancies;")
+	xdb.MustExec("drop table if exists reconciliation_reports;")
+	xdb.MustExec("drop table if exists campaigns;")
+	xdb.MustExec("drop table if exists referrals;")
+	xdb.MustExec("drop table if exists adjustment_events;")
+	xdb.MustExec("drop table if exists adjustments;")
+	xdb.MustExec("drop table if exists transfers;")
+	xdb.MustExec("drop table if exists ledger_entries;")
+	xdb.MustExec("drop table if exists point_lot_usages;")
+	xdb.MustExec("drop table if exists point_lots;")
+	xdb.MustExec("drop table if exists withdrawal_refunds;")
 	xdb.MustExec("drop table if exists withdrawals;")
+	xdb.MustExec("drop table if exists order_events;")
 	xdb.MustExec("drop table if exists orders;")
 	xdb.MustExec("drop table if exists accounts;")
 	xdb.MustExec(`drop table if exists users;`)
+	xdb.MustExec(`drop table if exists processing_leaders;`)
 }
 
 func beforeTest() {
+	xdb.MustExec("delete from accrual_callbacks;")
+	xdb.MustExec("delete from idempotency_keys;")
+	xdb.MustExec("delete from reconciliation_discrepancies;")
+	xdb.MustExec("delete from reconciliation_reports;")
+	xdb.MustExec("delete from campaigns;")
+	xdb.MustExec("delete from referrals;")
+	xdb.MustExec("delete from adjustment_events;")
+	xdb.MustExec("delete from adjustments;")
+	xdb.MustExec("delete from transfers;")
+	xdb.MustExec("delete from ledger_entries;")
+	xdb.MustExec("delete from point_lot_usages;")
+	xdb.MustExec("delete from point_lots;")
+	xdb.MustExec("delete from withdrawal_refunds;")
 	xdb.MustExec("delete from withdrawals;")
+	xdb.MustExec(`delete from order_events;`)
 	xdb.MustExec(`delete from orders;`)
 	xdb.MustExec(`delete from accounts;`)
 	xdb.MustExec(`delete from users;`)
+	xdb.MustExec(`delete from processing_leaders;`)
 }
 
 func initNewDB(t *testing.T) Storage {
 	dropTables()
-	if db, err := NewStorage(connURL, context.TODO(), getLogger()); err != nil {
+	if db, err := NewStorage(connURL, context.TODO(), Policy{}, getLogger()); err != nil {
 		t.Fatal(err)
 		return nil
 	} else {
@@ -83,7 +118,7 @@ func Test_storageImpl_Register(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			beforeTest()
 			tt.prepare()
-			tt.check(db.Register(tt.args.login, tt.args.password))
+			tt.check(db.Register(tt.args.login, tt.args.password, "", ""))
 		})
 	}
 }
@@ -152,6 +187,8 @@ func Test_storageImpl_SaveOrder(t *testing.T) {
 				assert.NoError(t, err, "err not eq nil")
 				var number int
 				assert.NoError(t, xdb.Get(&number, "select number from orders where number = 1 and user_id = 'cfbe7630-32b3-11ed-a261-0242ac120002'"))
+				assert.NoError(t, xdb.Get(&number, "select number from order_events where number = 1 and old_status is null and new_status = 0"))
+				assert.NoError(t, xdb.Get(&number, "select number from orders where number = 1 and merchant_id = 'shop' and provider = 'partner'"))
 			},
 		},
 		{
@@ -186,7 +223,7 @@ func Test_storageImpl_SaveOrder(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			beforeTest()
 			tt.prepare()
-			tt.check(db.SaveOrder("cfbe7630-32b3-11ed-a261-0242ac120002", tt.order))
+			tt.check(db.SaveOrder("cfbe7630-32b3-11ed-a261-0242ac120002", tt.order, "shop", "partner"))
 		})
 	}
 }
@@ -279,7 +316,7 @@ func Test_storageImpl_GetAccount(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			beforeTest()
 			tt.prepare()
-			tt.check(db.GetAccount("cfbe7630-32b3-11ed-a261-0242ac120002"))
+			tt.check(db.GetAccount("cfbe7630-32b3-11ed-a261-0242ac120002", DefaultCurrency))
 		})
 	}
 }
@@ -288,13 +325,13 @@ func Test_storageImpl_WithdrawFromAccount(t *testing.T) {
 	db := initNewDB(t)
 	tests := []struct {
 		name    string
-		sum     float64
+		sum     money.Money
 		prepare func()
 		check   func(error)
 	}{
 		{
 			name: "successfull withdraw",
-			sum:  5.0,
+			sum:  500,
 			prepare: func() {
 				xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
 				xdb.MustExec(`insert into accounts(user_id, current, withdrawn) values('cfbe7630-32b3-11ed-a261-0242ac120002', 1000, 1000)`)
@@ -304,11 +341,12 @@ func Test_storageImpl_WithdrawFromAccount(t *testing.T) {
 				var UserID string
 				assert.NoError(t, xdb.Get(&UserID, "select user_id from accounts where user_id = 'cfbe7630-32b3-11ed-a261-0242ac120002' and current = 500 and withdrawn = 1500"))
 				assert.NoError(t, xdb.Get(&UserID, "select user_id from withdrawals where user_id = 'cfbe7630-32b3-11ed-a261-0242ac120002' and number = 1 and sum = 500"))
+				assert.NoError(t, xdb.Get(&UserID, "select user_id from ledger_entries where user_id = 'cfbe7630-32b3-11ed-a261-0242ac120002' and order_number = 1 and amount = -500 and type = 1"))
 			},
 		},
 		{
 			name: "user not found",
-			sum:  5.0,
+			sum:  500,
 			prepare: func() {
 				xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120003', 'login','password');`)
 				xdb.MustExec(`insert into accounts(user_id, current, withdrawn) values('cfbe7630-32b3-11ed-a261-0242ac120003', 1000, 1000)`)
@@ -319,7 +357,7 @@ func Test_storageImpl_WithdrawFromAccount(t *testing.T) {
 		},
 		{
 			name: "fail withdraw: out of limit",
-			sum:  5.0,
+			sum:  500,
 			prepare: func() {
 				xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
 				xdb.MustExec(`insert into accounts(user_id, current, withdrawn) values('cfbe7630-32b3-11ed-a261-0242ac120002', 10, 10)`)
@@ -328,12 +366,24 @@ func Test_storageImpl_WithdrawFromAccount(t *testing.T) {
 				assert.ErrorIs(t, err, ErrBalanceLimitExhausted)
 			},
 		},
+		{
+			name: "fail withdraw: order number already used",
+			sum:  500,
+			prepare: func() {
+				xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+				xdb.MustExec(`insert into accounts(user_id, current, withdrawn) values('cfbe7630-32b3-11ed-a261-0242ac120002', 1000, 0)`)
+				xdb.MustExec(`insert into withdrawals(user_id, number, sum) values('cfbe7630-32b3-11ed-a261-0242ac120002', 1, 10)`)
+			},
+			check: func(err error) {
+				assert.ErrorIs(t, err, ErrDuplicateWithdrawal)
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			beforeTest()
 			tt.prepare()
-			tt.check(db.WithdrawFromAccount("cfbe7630-32b3-11ed-a261-0242ac120002", tt.sum, 1))
+			tt.check(db.WithdrawFromAccount("cfbe7630-32b3-11ed-a261-0242ac120002", DefaultCurrency, tt.sum, 1))
 		})
 	}
 }
@@ -384,7 +434,7 @@ func Test_storageImpl_GetWithdrawals(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			beforeTest()
 			tt.prepare()
-			tt.check(db.GetWithdrawals("cfbe7630-32b3-11ed-a261-0242ac120002"))
+			tt.check(db.GetWithdrawals("cfbe7630-32b3-11ed-a261-0242ac120002", DefaultCurrency))
 		})
 	}
 }
@@ -440,6 +490,7 @@ func Test_storageImpl_CalcAmounts(t *testing.T) {
 						0
 					)
 					`)
+				xdb.MustExec(`insert into orders(number, user_id, provider) values(5, 'cfbe7630-32b3-11ed-a261-0242ac120002', 'partner')`)
 			},
 			updF: func(nums []int64) map[int64]CalcAmountsUpdateResult {
 				m := make(map[int64]CalcAmountsUpdateResult)
@@ -456,6 +507,10 @@ func Test_storageImpl_CalcAmounts(t *testing.T) {
 				assert.Equal(t, 2, n)
 				assert.NoError(t, xdb.Get(&n, "select count(1) from accounts where user_id = 'cfbe7630-32b3-11ed-a261-0242ac120002' and current = 20"))
 				assert.Equal(t, 1, n)
+				assert.NoError(t, xdb.Get(&n, "select count(1) from order_events where number in (1,2) and new_status = 3 and attempt = 1"))
+				assert.Equal(t, 2, n)
+				assert.NoError(t, xdb.Get(&n, "select count(1) from ledger_entries where order_number in (1,2) and amount = 10 and type = 0"))
+				assert.Equal(t, 2, n)
 			},
 			offset: 0,
 			limit:  10,
@@ -465,7 +520,982 @@ func Test_storageImpl_CalcAmounts(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			beforeTest()
 			tt.prepare()
-			tt.check(db.CalcAmounts(tt.offset, tt.limit, tt.updF))
+			tt.check(db.CalcAmounts(Shard{Index: 0, Count: 1}, []string{"default", ""}, tt.offset, tt.limit, tt.updF))
+		})
+	}
+}
+
+func Test_storageImpl_ApplyCalcResults(t *testing.T) {
+	db := initNewDB(t)
+	tests := []struct {
+		name    string
+		prepare func()
+		updates map[int64]CalcAmountsUpdateResult
+		check   func(int, error)
+	}{
+		{
+			name: "only orders in calculation are updated",
+			prepare: func() {
+				xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+				xdb.MustExec(`insert into accounts(user_id, current, withdrawn) values('cfbe7630-32b3-11ed-a261-0242ac120002', 0, 0)`)
+				xdb.MustExec(`
+				insert into orders(number, user_id, status, accrual) values
+					(1, 'cfbe7630-32b3-11ed-a261-0242ac120002', 0, 0),
+					(2, 'cfbe7630-32b3-11ed-a261-0242ac120002', 1, 0),
+					(3, 'cfbe7630-32b3-11ed-a261-0242ac120002', 3, 5)
+				`)
+			},
+			updates: map[int64]CalcAmountsUpdateResult{
+				1: {Accrual: 10, Status: model.Processed},
+				2: {Accrual: 0, Status: model.Processing},
+				3: {Accrual: 10, Status: model.Processed},
+				4: {Accrual: 10, Status: model.Processed},
+			},
+			check: func(updated int, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, 2, updated)
+				var n int
+				assert.NoError(t, xdb.Get(&n, "select count(1) from orders where number = 1 and status = 3 and accrual = 10"))
+				assert.Equal(t, 1, n)
+				assert.NoError(t, xdb.Get(&n, "select count(1) from orders where number = 3 and status = 3 and accrual = 5"))
+				assert.Equal(t, 1, n)
+				assert.NoError(t, xdb.Get(&n, "select count(1) from accounts where user_id = 'cfbe7630-32b3-11ed-a261-0242ac120002' and current = 10"))
+				assert.Equal(t, 1, n)
+			},
+		},
+		{
+			name: "orders of another provider are not updated",
+			prepare: func() {
+				xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+				xdb.MustExec(`insert into accounts(user_id, current, withdrawn) values('cfbe7630-32b3-11ed-a261-0242ac120002', 0, 0)`)
+				xdb.MustExec(`
+				insert into orders(number, user_id, status, provider) values
+					(1, 'cfbe7630-32b3-11ed-a261-0242ac120002', 0, 'main'),
+					(2, 'cfbe7630-32b3-11ed-a261-0242ac120002', 0, 'partner')
+				`)
+			},
+			updates: map[int64]CalcAmountsUpdateResult{
+				1: {Accrual: 10, Status: model.Processed},
+				2: {Accrual: 10, Status: model.Processed},
+			},
+			check: func(updated int, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, 1, updated)
+				var n int
+				assert.NoError(t, xdb.Get(&n, "select count(1) from orders where number = 2 and status = 0"))
+				assert.Equal(t, 1, n)
+				assert.NoError(t, xdb.Get(&n, "select count(1) from accounts where user_id = 'cfbe7630-32b3-11ed-a261-0242ac120002' and current = 10"))
+				assert.Equal(t, 1, n)
+			},
+		},
+		{
+			name: "invalid order is not moved back",
+			prepare: func() {
+				xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+				xdb.MustExec(`insert into accounts(user_id, current, withdrawn) values('cfbe7630-32b3-11ed-a261-0242ac120002', 0, 0)`)
+				xdb.MustExec(`insert into orders(number, user_id, status) values(1, 'cfbe7630-32b3-11ed-a261-0242ac120002', 2)`)
+			},
+			updates: map[int64]CalcAmountsUpdateResult{
+				1: {Status: model.Registered},
+			},
+			check: func(updated int, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, 0, updated)
+				var n int
+				assert.NoError(t, xdb.Get(&n, "select count(1) from orders where number = 1 and status = 2"))
+				assert.Equal(t, 1, n)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			beforeTest()
+			tt.prepare()
+			tt.check(db.ApplyCalcResults([]string{"main", ""}, tt.updates))
+		})
+	}
+}
+
+func Test_storageImpl_TryAcquireLease(t *testing.T) {
+	db := initNewDB(t)
+	beforeTest()
+
+	first, err := db.TryAcquireLease("replica-1", 0)
+	assert.NoError(t, err)
+	assert.NotNil(t, first)
+
+	second, err := db.TryAcquireLease("replica-2", 0)
+	assert.NoError(t, err)
+	assert.Nil(t, second, "shard lease must be held by one instance")
+
+	other, err := db.TryAcquireLease("replica-2", 1)
+	assert.NoError(t, err)
+	assert.NotNil(t, other)
+
+	leaders, err := db.GetLeaders()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(leaders))
+	assert.Equal(t, "replica-1", leaders[0].InstanceID)
+	assert.Equal(t, "replica-2", leaders[1].InstanceID)
+
+	assert.NoError(t, first.Release())
+	assert.NoError(t, other.Release())
+
+	second, err = db.TryAcquireLease("replica-2", 0)
+	assert.NoError(t, err)
+	assert.NotNil(t, second, "released lease must be acquired by another instance")
+	assert.True(t, second.Held())
+	assert.NoError(t, second.Renew())
+
+	// the lock dies with the session, e.g. when postgres terminates the connection
+	xdb.MustExec(`select pg_terminate_backend(pid) from pg_locks where locktype = 'advisory' and classid = $1 and objid = 0`, processingLockKey)
+	assert.False(t, second.Held())
+	assert.Error(t, second.Renew())
+	second.Release()
+}
+
+func Test_storageImpl_GetOrderHistory(t *testing.T) {
+	db := initNewDB(t)
+	tests := []struct {
+		name    string
+		prepare func()
+		check   func([]model.OrderEvent, error)
+	}{
+		{
+			name: "history of own order",
+			prepare: func() {
+				xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+				xdb.MustExec(`insert into orders(number, user_id, status, accrual) values(1, 'cfbe7630-32b3-11ed-a261-0242ac120002', 3, 10)`)
+				xdb.MustExec(`
+				insert into order_events(number, old_status, new_status, accrual, response, attempt, created_at) values
+					(1, null, 0, 0, null, 0, '2020-12-10T15:15:45+03:00'),
+					(1, 0, 3, 10, '{"status":"PROCESSED"}', 1, '2020-12-10T15:16:45+03:00')
+				`)
+			},
+			check: func(arr []model.OrderEvent, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, 2, len(arr))
+				assert.Nil(t, arr[0].OldStatus)
+				assert.Equal(t, model.New, arr[0].NewStatus)
+				assert.Equal(t, model.New, *arr[1].OldStatus)
+				assert.Equal(t, model.Processed, arr[1].NewStatus)
+				assert.Equal(t, money.Money(10), arr[1].Accrual)
+				assert.Equal(t, `{"status":"PROCESSED"}`, *arr[1].Response)
+				assert.Equal(t, 1, arr[1].Attempt)
+			},
+		},
+		{
+			name: "order of another user",
+			prepare: func() {
+				xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120003', 'login','password');`)
+				xdb.MustExec(`insert into orders(number, user_id) values(1, 'cfbe7630-32b3-11ed-a261-0242ac120003')`)
+			},
+			check: func(arr []model.OrderEvent, err error) {
+				assert.ErrorIs(t, err, ErrOrderNotFound)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			beforeTest()
+			tt.prepare()
+			tt.check(db.GetOrderHistory("cfbe7630-32b3-11ed-a261-0242ac120002", 1))
 		})
 	}
 }
+
+func Test_storageImpl_DeadLetter(t *testing.T) {
+	db := initNewDB(t)
+	prepare := func() {
+		xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+		xdb.MustExec(`insert into accounts(user_id, current, withdrawn) values('cfbe7630-32b3-11ed-a261-0242ac120002', 0, 0)`)
+		xdb.MustExec(`
+		insert into orders(number, user_id, status, attempts, failed_attempts, last_error) values
+			(1, 'cfbe7630-32b3-11ed-a261-0242ac120002', 1, 5, 3, 'accrual system responded 500 Internal Server Error'),
+			(2, 'cfbe7630-32b3-11ed-a261-0242ac120002', 1, 5, 2, null)
+		`)
+	}
+
+	t.Run("failed orders are moved to dead letter", func(t *testing.T) {
+		beforeTest()
+		prepare()
+		moved, err := db.DeadLetterOrders(3)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, moved)
+
+		orders, err := db.GetDeadLetterOrders()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(orders))
+		assert.Equal(t, uint64(1), orders[0].Number)
+		assert.Equal(t, "accrual system responded 500 Internal Server Error", *orders[0].LastError)
+
+		var n int
+		assert.NoError(t, xdb.Get(&n, "select count(1) from order_events where number = 1 and old_status = 1 and new_status = 4 and response is null and error like 'accrual system responded 500%'"))
+		assert.Equal(t, 1, n)
+	})
+
+	t.Run("retry returns order to processing", func(t *testing.T) {
+		beforeTest()
+		prepare()
+		_, err := db.DeadLetterOrders(3)
+		assert.NoError(t, err)
+
+		assert.NoError(t, db.RetryDeadLetterOrder(1, "admin"))
+		assert.ErrorIs(t, db.RetryDeadLetterOrder(2, "admin"), ErrOrderNotFound)
+		var n int
+		assert.NoError(t, xdb.Get(&n, "select count(1) from orders where number = 1 and status = 1 and failed_attempts = 0"))
+		assert.Equal(t, 1, n)
+	})
+
+	t.Run("resolve credits accrual", func(t *testing.T) {
+		beforeTest()
+		prepare()
+		_, err := db.DeadLetterOrders(3)
+		assert.NoError(t, err)
+
+		assert.NoError(t, db.ResolveDeadLetterOrder(1, model.Processed, 1050, "admin", "confirmed by partner"))
+		var n int
+		assert.NoError(t, xdb.Get(&n, "select count(1) from orders where number = 1 and status = 3 and accrual = 1050"))
+		assert.Equal(t, 1, n)
+		assert.NoError(t, xdb.Get(&n, "select count(1) from accounts where user_id = 'cfbe7630-32b3-11ed-a261-0242ac120002' and current = 1050"))
+		assert.Equal(t, 1, n)
+		assert.NoError(t, xdb.Get(&n, "select count(1) from order_events where number = 1 and new_status = 3 and actor = 'admin' and reason = 'confirmed by partner'"))
+		assert.Equal(t, 1, n)
+	})
+
+	t.Run("resolve applies campaigns", func(t *testing.T) {
+		beforeTest()
+		prepare()
+		_, err := db.DeadLetterOrders(3)
+		assert.NoError(t, err)
+		_, err = db.CreateCampaign(campaignModel.Campaign{
+			Name: "double points", StartsAt: time.Now().Add(-time.Hour), BonusPercent: "100",
+			Tiers: pq.StringArray{}, Providers: pq.StringArray{},
+		})
+		assert.NoError(t, err)
+
+		assert.NoError(t, db.ResolveDeadLetterOrder(1, model.Processed, 1050, "admin", "confirmed by partner"))
+		acc, err := db.GetAccount("cfbe7630-32b3-11ed-a261-0242ac120002", DefaultCurrency)
+		assert.NoError(t, err)
+		assert.Equal(t, money.Money(2100), acc.Current)
+		mismatches, err := db.CheckLedger()
+		assert.NoError(t, err)
+		assert.Empty(t, mismatches)
+	})
+}
+
+func Test_storageImpl_CheckLedger(t *testing.T) {
+	db := initNewDB(t)
+	prepare := func() {
+		xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+		xdb.MustExec(`insert into accounts(user_id, current, withdrawn) values('cfbe7630-32b3-11ed-a261-0242ac120002', 1000, 0)`)
+		xdb.MustExec(`insert into orders(number, user_id, status, accrual) values(1, 'cfbe7630-32b3-11ed-a261-0242ac120002', 3, 1000)`)
+	}
+
+	t.Run("existing balances are moved to the ledger", func(t *testing.T) {
+		beforeTest()
+		prepare()
+		xdb.MustExec(`insert into withdrawals(user_id, number, sum) values('cfbe7630-32b3-11ed-a261-0242ac120002', 2, 300)`)
+		xdb.MustExec(`update accounts set current = 800, withdrawn = 300`)
+
+		assert.NoError(t, db.(*storageImpl).backfillLedger())
+		var n int
+		assert.NoError(t, xdb.Get(&n, "select count(1) from ledger_entries where type = 2 and amount = 100"))
+		assert.Equal(t, 1, n)
+		mismatches, err := db.CheckLedger()
+		assert.NoError(t, err)
+		assert.Empty(t, mismatches)
+	})
+
+	t.Run("changed account is reported", func(t *testing.T) {
+		beforeTest()
+		prepare()
+		xdb.MustExec(`insert into ledger_entries(user_id, amount, type, order_number) values('cfbe7630-32b3-11ed-a261-0242ac120002', 1000, 0, 1)`)
+		assert.NoError(t, db.WithdrawFromAccount("cfbe7630-32b3-11ed-a261-0242ac120002", DefaultCurrency, 400, 2))
+		xdb.MustExec(`update accounts set current = current + 50`)
+
+		mismatches, err := db.CheckLedger()
+		assert.NoError(t, err)
+		expected := []LedgerMismatch{{
+			UserID:          "cfbe7630-32b3-11ed-a261-0242ac120002",
+			Current:         650,
+			Withdrawn:       400,
+			LedgerCurrent:   600,
+			LedgerWithdrawn: 400,
+		}}
+		assert.Equal(t, expected, mismatches)
+	})
+}
+
+func Test_storageImpl_GetStatement(t *testing.T) {
+	db := initNewDB(t)
+	beforeTest()
+	xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+	xdb.MustExec(`
+	insert into orders(number, user_id, status, uploaded_at, accrual) values
+		(1, 'cfbe7630-32b3-11ed-a261-0242ac120002', 3, '2020-11-10T10:00:00Z', 1000),
+		(2, 'cfbe7630-32b3-11ed-a261-0242ac120002', 3, '2020-12-01T10:00:00Z', 500),
+		(3, 'cfbe7630-32b3-11ed-a261-0242ac120002', 1, '2020-12-02T10:00:00Z', 0)
+	`)
+	xdb.MustExec(`insert into order_events(number, old_status, new_status, created_at) values(2, 1, 3, '2020-12-05T10:00:00Z')`)
+	xdb.MustExec(`
+	insert into withdrawals(user_id, number, sum, processed_at) values
+		('cfbe7630-32b3-11ed-a261-0242ac120002', 4, 300, '2020-12-03T10:00:00Z'),
+		('cfbe7630-32b3-11ed-a261-0242ac120002', 5, 100, '2021-01-03T10:00:00Z')
+	`)
+	xdb.MustExec(`
+	insert into withdrawals(user_id, number, sum, status, processed_at) values
+		('cfbe7630-32b3-11ed-a261-0242ac120002', 6, 50, $1, '2020-12-20T10:00:00Z'),
+		('cfbe7630-32b3-11ed-a261-0242ac120002', 7, 20, $1, '2021-01-05T10:00:00Z')
+	`, withdrawalsModel.Pending)
+
+	from, _ := time.Parse(time.RFC3339, "2020-12-01T00:00:00Z")
+	to, _ := time.Parse(time.RFC3339, "2021-01-01T00:00:00Z")
+	statement, err := db.GetStatement("cfbe7630-32b3-11ed-a261-0242ac120002", &from, &to, 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(1000), statement.OpeningBalance)
+	assert.Equal(t, money.Money(500), statement.Credit)
+	assert.Equal(t, money.Money(300), statement.Debit)
+	assert.Equal(t, 2, statement.Total)
+	assert.Equal(t, 2, len(statement.Operations))
+	assert.Equal(t, uint64(4), statement.Operations[0].Number)
+	assert.Equal(t, money.Money(-300), statement.Operations[0].Amount)
+	assert.Equal(t, money.Money(700), statement.Operations[0].Balance)
+	assert.Equal(t, uint64(2), statement.Operations[1].Number)
+	assert.Equal(t, money.Money(1200), statement.Operations[1].Balance)
+	assert.Equal(t, money.Money(50), statement.Held, "holds placed after the period are not reserved")
+
+	page, err := db.GetStatement("cfbe7630-32b3-11ed-a261-0242ac120002", nil, nil, 2, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, page.Total)
+	assert.Equal(t, 2, len(page.Operations))
+	assert.Equal(t, money.Money(1200), page.Operations[0].Balance)
+	assert.Equal(t, money.Money(1100), page.Operations[1].Balance)
+	assert.Equal(t, money.Money(1100), page.ClosingBalance())
+	// pending withdrawals are reserved from the balance instead of being debited
+	assert.Equal(t, money.Money(70), page.Held)
+	assert.Equal(t, money.Money(1030), page.ToAPI(nil, nil, 2, 10).Available)
+}
+
+func Test_storageImpl_IdempotencyKey(t *testing.T) {
+	db := initNewDB(t)
+	beforeTest()
+	xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+	const userID, scope = "cfbe7630-32b3-11ed-a261-0242ac120002", "POST /api/user/orders"
+
+	stored, err := db.ReserveIdempotencyKey(userID, scope, "key", "hash", time.Hour, time.Minute)
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+
+	_, err = db.ReserveIdempotencyKey(userID, scope, "key", "hash", time.Hour, time.Minute)
+	assert.ErrorIs(t, err, ErrIdempotencyKeyInProgress)
+
+	// the reservation of a request that never saved its response expires after the lease
+	xdb.MustExec(`update idempotency_keys set created_at = now() - interval '2 minutes'`)
+	stored, err = db.ReserveIdempotencyKey(userID, scope, "key", "hash", time.Hour, time.Minute)
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+
+	assert.NoError(t, db.SaveIdempotentResponse(userID, scope, "key", 202, "", nil))
+	stored, err = db.ReserveIdempotencyKey(userID, scope, "key", "hash", time.Hour, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 202, *stored.StatusCode)
+
+	_, err = db.ReserveIdempotencyKey(userID, scope, "key", "other", time.Hour, time.Minute)
+	assert.ErrorIs(t, err, ErrIdempotencyKeyReused)
+
+	xdb.MustExec(`update idempotency_keys set created_at = now() - interval '2 hours'`)
+	stored, err = db.ReserveIdempotencyKey(userID, scope, "key", "other", time.Hour, time.Minute)
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+
+	assert.NoError(t, db.ReleaseIdempotencyKey(userID, scope, "key"))
+	stored, err = db.ReserveIdempotencyKey(userID, scope, "key", "hash", time.Hour, time.Minute)
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+}
+
+func Test_storageImpl_HoldWithdrawal(t *testing.T) {
+	db := initNewDB(t)
+	const userID = "cfbe7630-32b3-11ed-a261-0242ac120002"
+	prepare := func() {
+		xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+		xdb.MustExec(`insert into accounts(user_id, current, withdrawn) values('cfbe7630-32b3-11ed-a261-0242ac120002', 1000, 0)`)
+		xdb.MustExec(`insert into ledger_entries(user_id, amount, type) values('cfbe7630-32b3-11ed-a261-0242ac120002', 1000, 2)`)
+	}
+	account := func() *accountModel.Account {
+		acc, err := db.GetAccount(userID, DefaultCurrency)
+		assert.NoError(t, err)
+		return acc
+	}
+
+	t.Run("confirmed hold is withdrawn", func(t *testing.T) {
+		beforeTest()
+		prepare()
+		assert.NoError(t, db.HoldWithdrawal(userID, DefaultCurrency, 400, 1, time.Hour))
+		assert.ErrorIs(t, db.HoldWithdrawal(userID, DefaultCurrency, 700, 2, time.Hour), ErrBalanceLimitExhausted)
+		assert.Equal(t, &accountModel.Account{UserID: userID, Current: 600, Held: 400}, account())
+
+		assert.NoError(t, db.ConfirmWithdrawal(userID, 1))
+		assert.ErrorIs(t, db.CancelWithdrawal(userID, 1), ErrWithdrawalNotPending)
+		assert.Equal(t, &accountModel.Account{UserID: userID, Current: 600, Withdrawn: 400}, account())
+
+		mismatches, err := db.CheckLedger()
+		assert.NoError(t, err)
+		assert.Empty(t, mismatches)
+	})
+
+	t.Run("cancelled and expired holds are returned", func(t *testing.T) {
+		beforeTest()
+		prepare()
+		assert.NoError(t, db.HoldWithdrawal(userID, DefaultCurrency, 400, 1, time.Hour))
+		assert.NoError(t, db.HoldWithdrawal(userID, DefaultCurrency, 100, 2, time.Millisecond))
+		assert.ErrorIs(t, db.CancelWithdrawal(userID, 3), ErrWithdrawalNotFound)
+		assert.NoError(t, db.CancelWithdrawal(userID, 1))
+
+		time.Sleep(10 * time.Millisecond)
+		expired, err := db.ExpireWithdrawals()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, expired)
+		assert.Equal(t, &accountModel.Account{UserID: userID, Current: 1000}, account())
+
+		withdrawals, err := db.GetWithdrawals(userID, DefaultCurrency)
+		assert.NoError(t, err)
+		assert.Equal(t, withdrawalsModel.Cancelled, withdrawals[0].Status)
+		assert.Equal(t, withdrawalsModel.Expired, withdrawals[1].Status)
+
+		mismatches, err := db.CheckLedger()
+		assert.NoError(t, err)
+		assert.Empty(t, mismatches)
+	})
+}
+
+func Test_storageImpl_RefundWithdrawal(t *testing.T) {
+	db := initNewDB(t)
+	const userID = "cfbe7630-32b3-11ed-a261-0242ac120002"
+	beforeTest()
+	xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+	xdb.MustExec(`insert into accounts(user_id, current, withdrawn) values('cfbe7630-32b3-11ed-a261-0242ac120002', 1000, 0)`)
+	xdb.MustExec(`insert into ledger_entries(user_id, amount, type) values('cfbe7630-32b3-11ed-a261-0242ac120002', 1000, 2)`)
+	assert.NoError(t, db.WithdrawFromAccount(userID, DefaultCurrency, 600, 1))
+	assert.NoError(t, db.HoldWithdrawal(userID, DefaultCurrency, 100, 2, time.Hour))
+
+	_, err := db.RefundWithdrawal(2, 0, "admin", "order cancelled")
+	assert.ErrorIs(t, err, ErrWithdrawalNotRefundable)
+	_, err = db.RefundWithdrawal(3, 0, "admin", "order cancelled")
+	assert.ErrorIs(t, err, ErrWithdrawalNotFound)
+	_, err = db.RefundWithdrawal(1, 700, "admin", "order cancelled")
+	assert.ErrorIs(t, err, ErrRefundExceedsWithdrawal)
+
+	withdrawal, err := db.RefundWithdrawal(1, 200, "admin", "item returned")
+	assert.NoError(t, err)
+	assert.Equal(t, withdrawalsModel.PartiallyRefunded, withdrawal.Status)
+	assert.Equal(t, money.Money(200), withdrawal.Refunded)
+
+	withdrawal, err = db.RefundWithdrawal(1, 0, "partner", "order cancelled")
+	assert.NoError(t, err)
+	assert.Equal(t, withdrawalsModel.Reversed, withdrawal.Status)
+	assert.Equal(t, money.Money(600), withdrawal.Refunded)
+	assert.Equal(t, "order cancelled", *withdrawal.ReversalReason)
+
+	acc, err := db.GetAccount(userID, DefaultCurrency)
+	assert.NoError(t, err)
+	assert.Equal(t, &accountModel.Account{UserID: userID, Current: 900, Held: 100}, acc)
+	var n int
+	assert.NoError(t, xdb.Get(&n, "select count(1) from withdrawal_refunds where number = 1"))
+	assert.Equal(t, 2, n)
+	mismatches, err := db.CheckLedger()
+	assert.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func Test_storageImpl_ExpirePoints(t *testing.T) {
+	db := initNewDB(t)
+	const userID = "cfbe7630-32b3-11ed-a261-0242ac120002"
+	beforeTest()
+	xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+	xdb.MustExec(`insert into accounts(user_id, current, withdrawn) values('cfbe7630-32b3-11ed-a261-0242ac120002', 1000, 0)`)
+	xdb.MustExec(`insert into ledger_entries(user_id, amount, type) values('cfbe7630-32b3-11ed-a261-0242ac120002', 1000, 2)`)
+	xdb.MustExec(`insert into point_lots(user_id, order_number, amount, remaining, expires_at) values
+		('cfbe7630-32b3-11ed-a261-0242ac120002', 1, 300, 300, now() + interval '1 second'),
+		('cfbe7630-32b3-11ed-a261-0242ac120002', 2, 500, 500, now() + interval '1 day'),
+		('cfbe7630-32b3-11ed-a261-0242ac120002', 3, 200, 200, null)`)
+
+	// the lot of order 1 is used first, the cancelled hold returns to it
+	assert.NoError(t, db.WithdrawFromAccount(userID, DefaultCurrency, 100, 4))
+	assert.NoError(t, db.HoldWithdrawal(userID, DefaultCurrency, 150, 5, time.Hour))
+	assert.NoError(t, db.CancelWithdrawal(userID, 5))
+
+	expiring, err := db.GetExpiringPoints(userID, DefaultCurrency, time.Hour)
+	assert.NoError(t, err)
+	assert.Len(t, expiring, 1)
+	assert.Equal(t, money.Money(200), expiring[0].Sum)
+
+	time.Sleep(1100 * time.Millisecond)
+	expired, err := db.ExpirePoints()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	acc, err := db.GetAccount(userID, DefaultCurrency)
+	assert.NoError(t, err)
+	assert.Equal(t, &accountModel.Account{UserID: userID, Current: 700, Withdrawn: 100}, acc)
+
+	// the refund returns points to the expired lot, they expire again
+	_, err = db.RefundWithdrawal(4, 0, "admin", "order cancelled")
+	assert.NoError(t, err)
+	expired, err = db.ExpirePoints()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	acc, err = db.GetAccount(userID, DefaultCurrency)
+	assert.NoError(t, err)
+	assert.Equal(t, &accountModel.Account{UserID: userID, Current: 700}, acc)
+
+	statement, err := db.GetStatement(userID, nil, nil, 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(100), statement.Credit)
+	assert.Equal(t, money.Money(400), statement.Debit)
+	assert.Equal(t, "expiration", statement.Operations[3].Type)
+
+	mismatches, err := db.CheckLedger()
+	assert.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func Test_storageImpl_WithdrawalLimits(t *testing.T) {
+	db := initNewDB(t).(*storageImpl)
+	const userID = "cfbe7630-32b3-11ed-a261-0242ac120002"
+	prepare := func(limits WithdrawalLimits) {
+		beforeTest()
+		db.policy.WithdrawalLimits = limits
+		xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+		xdb.MustExec(`insert into accounts(user_id, current, withdrawn) values('cfbe7630-32b3-11ed-a261-0242ac120002', 1000, 0)`)
+		xdb.MustExec(`insert into point_lots(user_id, amount, remaining, accrued_at) values
+			('cfbe7630-32b3-11ed-a261-0242ac120002', 700, 700, now() - interval '1 day'),
+			('cfbe7630-32b3-11ed-a261-0242ac120002', 300, 300, now())`)
+	}
+
+	t.Run("sum of withdrawal", func(t *testing.T) {
+		prepare(WithdrawalLimits{MinSum: 100, MaxSum: 500})
+		assert.ErrorIs(t, db.WithdrawFromAccount(userID, DefaultCurrency, 50, 1), ErrWithdrawalBelowMin)
+		assert.ErrorIs(t, db.HoldWithdrawal(userID, DefaultCurrency, 600, 1, time.Hour), ErrWithdrawalAboveMax)
+		assert.NoError(t, db.WithdrawFromAccount(userID, DefaultCurrency, 500, 1))
+	})
+
+	t.Run("daily sum", func(t *testing.T) {
+		prepare(WithdrawalLimits{DailySum: 500})
+		assert.NoError(t, db.HoldWithdrawal(userID, DefaultCurrency, 300, 1, time.Hour))
+		assert.ErrorIs(t, db.WithdrawFromAccount(userID, DefaultCurrency, 300, 2), ErrWithdrawalDailyLimit)
+		assert.NoError(t, db.CancelWithdrawal(userID, 1))
+		assert.NoError(t, db.WithdrawFromAccount(userID, DefaultCurrency, 500, 2))
+	})
+
+	t.Run("monthly sum", func(t *testing.T) {
+		prepare(WithdrawalLimits{MonthlySum: 600})
+		assert.NoError(t, db.WithdrawFromAccount(userID, DefaultCurrency, 500, 1))
+		_, err := db.RefundWithdrawal(1, 100, "admin", "item returned")
+		assert.NoError(t, err)
+		assert.NoError(t, db.WithdrawFromAccount(userID, DefaultCurrency, 200, 2))
+		assert.ErrorIs(t, db.WithdrawFromAccount(userID, DefaultCurrency, 1, 3), ErrWithdrawalMonthlyLimit)
+	})
+
+	t.Run("withdrawals per hour", func(t *testing.T) {
+		prepare(WithdrawalLimits{HourlyCount: 2})
+		assert.NoError(t, db.WithdrawFromAccount(userID, DefaultCurrency, 10, 1))
+		assert.NoError(t, db.WithdrawFromAccount(userID, DefaultCurrency, 10, 2))
+		assert.ErrorIs(t, db.WithdrawFromAccount(userID, DefaultCurrency, 10, 3), ErrWithdrawalHourlyCount)
+	})
+
+	t.Run("cooling-off of accrued points", func(t *testing.T) {
+		prepare(WithdrawalLimits{CoolingOff: time.Hour})
+		assert.ErrorIs(t, db.WithdrawFromAccount(userID, DefaultCurrency, 800, 1), ErrWithdrawalCoolingOff)
+		assert.ErrorIs(t, db.WithdrawFromAccount(userID, DefaultCurrency, 1100, 1), ErrBalanceLimitExhausted)
+		assert.NoError(t, db.WithdrawFromAccount(userID, DefaultCurrency, 700, 1))
+	})
+}
+
+func Test_storageImpl_TransferPoints(t *testing.T) {
+	db := initNewDB(t).(*storageImpl)
+	const userID = "cfbe7630-32b3-11ed-a261-0242ac120002"
+	const friendID = "cfbe7630-32b3-11ed-a261-0242ac120003"
+	beforeTest()
+	db.policy.TransferRules = TransferRules{MaxSum: 600, DailySum: 800, FeeFixed: 5, FeeRate: big.NewRat(1, 100)}
+	xdb.MustExec(`insert into users(id, login, password) values
+		('cfbe7630-32b3-11ed-a261-0242ac120002', 'login', 'password'),
+		('cfbe7630-32b3-11ed-a261-0242ac120003', 'friend', 'password')`)
+	xdb.MustExec(`insert into accounts(user_id, current) values
+		('cfbe7630-32b3-11ed-a261-0242ac120002', 1000), ('cfbe7630-32b3-11ed-a261-0242ac120003', 0)`)
+	xdb.MustExec(`insert into ledger_entries(user_id, amount, type) values('cfbe7630-32b3-11ed-a261-0242ac120002', 1000, 2)`)
+	xdb.MustExec(`insert into point_lots(user_id, amount, remaining, expires_at) values
+		('cfbe7630-32b3-11ed-a261-0242ac120002', 300, 300, now() + interval '1 day'),
+		('cfbe7630-32b3-11ed-a261-0242ac120002', 700, 700, null)`)
+
+	_, err := db.TransferPoints(userID, "stranger", 100)
+	assert.ErrorIs(t, err, ErrRecipientNotFound)
+	_, err = db.TransferPoints(userID, "login", 100)
+	assert.ErrorIs(t, err, ErrTransferToSelf)
+	_, err = db.TransferPoints(userID, "friend", 700)
+	assert.ErrorIs(t, err, ErrTransferAboveMax)
+
+	transfer, err := db.TransferPoints(userID, "friend", 500)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(10), transfer.Fee)
+	_, err = db.TransferPoints(userID, "friend", 400)
+	assert.ErrorIs(t, err, ErrTransferDailyLimit)
+	_, err = db.TransferPoints(friendID, "login", 100)
+	assert.NoError(t, err)
+
+	acc, err := db.GetAccount(userID, DefaultCurrency)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(1000-500-10+100), acc.Current)
+	acc, err = db.GetAccount(friendID, DefaultCurrency)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(500-100-6), acc.Current)
+
+	// the friend got 300 points expiring tomorrow and 200 that don't expire, the expiring ones are spent first
+	expiring, err := db.GetExpiringPoints(friendID, DefaultCurrency, 48*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(300-106), expiring[0].Sum)
+
+	transfers, err := db.GetTransfers(friendID)
+	assert.NoError(t, err)
+	assert.Len(t, transfers, 2)
+	assert.False(t, transfers[0].Outgoing)
+	assert.Equal(t, "login", transfers[0].Login)
+	assert.True(t, transfers[1].Outgoing)
+
+	statement, err := db.GetStatement(friendID, nil, nil, 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(500), statement.Credit)
+	assert.Equal(t, money.Money(106), statement.Debit)
+
+	mismatches, err := db.CheckLedger()
+	assert.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func Test_storageImpl_RecalculateTiers(t *testing.T) {
+	db := initNewDB(t).(*storageImpl)
+	const userID = "cfbe7630-32b3-11ed-a261-0242ac120002"
+	beforeTest()
+	db.policy.TierRules = TierRules{
+		Tiers: []Tier{
+			{Name: "silver", Threshold: 1000, Multiplier: big.NewRat(11, 10)},
+			{Name: "gold", Threshold: 5000, Multiplier: big.NewRat(3, 2)},
+		},
+		Basis:  TierBasisAccrual,
+		Period: 24 * time.Hour,
+	}
+	xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+	xdb.MustExec(`insert into accounts(user_id, current) values('cfbe7630-32b3-11ed-a261-0242ac120002', 6000)`)
+	xdb.MustExec(`insert into ledger_entries(user_id, amount, type, created_at) values
+		('cfbe7630-32b3-11ed-a261-0242ac120002', 5000, 0, now() - interval '2 days'),
+		('cfbe7630-32b3-11ed-a261-0242ac120002', 1000, 0, now())`)
+	xdb.MustExec(`insert into orders(number, user_id, status, accrual) values (1, 'cfbe7630-32b3-11ed-a261-0242ac120002', 1, 0)`)
+
+	updated, err := db.RecalculateTiers()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, updated)
+	updated, err = db.RecalculateTiers()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, updated)
+	acc, err := db.GetAccount(userID, DefaultCurrency)
+	assert.NoError(t, err)
+	assert.Equal(t, "silver", *acc.Tier)
+
+	// the silver tier adds a tenth of the accrual
+	_, err = db.ApplyCalcResults([]string{""}, map[int64]CalcAmountsUpdateResult{1: {Accrual: 1005, Status: model.Processed}})
+	assert.NoError(t, err)
+	acc, err = db.GetAccount(userID, DefaultCurrency)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(6000+1005+101), acc.Current)
+
+	statement, err := db.GetStatement(userID, nil, nil, 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "tier_bonus", statement.Operations[1].Type)
+	assert.Equal(t, money.Money(101), statement.Operations[1].Amount)
+
+	mismatches, err := db.CheckLedger()
+	assert.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func Test_storageImpl_Campaigns(t *testing.T) {
+	db := initNewDB(t).(*storageImpl)
+	const userID = "cfbe7630-32b3-11ed-a261-0242ac120002"
+	beforeTest()
+	xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+	xdb.MustExec(`insert into accounts(user_id) values('cfbe7630-32b3-11ed-a261-0242ac120002')`)
+	xdb.MustExec(`insert into orders(number, user_id, status, uploaded_at) values
+		(1, 'cfbe7630-32b3-11ed-a261-0242ac120002', 1, now() - interval '1 minute'),
+		(2, 'cfbe7630-32b3-11ed-a261-0242ac120002', 1, now())`)
+
+	first, err := db.CreateCampaign(campaignModel.Campaign{
+		Name: "first order", StartsAt: time.Now().Add(-time.Hour), FirstOrder: true, BonusFixed: 10000,
+		Tiers: pq.StringArray{}, Providers: pq.StringArray{}, BonusPercent: "0",
+	})
+	assert.NoError(t, err)
+	double, err := db.CreateCampaign(campaignModel.Campaign{
+		Name: "double points", StartsAt: time.Now().Add(-time.Hour), BonusPercent: "100", Budget: 1500,
+		Tiers: pq.StringArray{}, Providers: pq.StringArray{},
+	})
+	assert.NoError(t, err)
+	_, err = db.CreateCampaign(campaignModel.Campaign{
+		Name: "not started", StartsAt: time.Now().Add(time.Hour), BonusFixed: 100,
+		Tiers: pq.StringArray{}, Providers: pq.StringArray{}, BonusPercent: "0",
+	})
+	assert.NoError(t, err)
+
+	// both orders are doubled within the budget, only the first one gets the first order bonus
+	_, err = db.ApplyCalcResults([]string{""}, map[int64]CalcAmountsUpdateResult{
+		1: {Accrual: 1000, Status: model.Processed},
+		2: {Accrual: 1000, Status: model.Processed},
+	})
+	assert.NoError(t, err)
+	acc, err := db.GetAccount(userID, DefaultCurrency)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(2000+10000+1500), acc.Current)
+
+	double, err = db.GetCampaign(double.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(1500), double.Spent)
+	assert.ErrorIs(t, db.DeleteCampaign(first.ID), ErrCampaignInUse)
+	_, err = db.GetCampaign(-1)
+	assert.ErrorIs(t, err, ErrCampaignNotFound)
+
+	double.Budget = 0
+	_, err = db.UpdateCampaign(*double)
+	assert.NoError(t, err)
+	campaigns, err := db.GetCampaigns()
+	assert.NoError(t, err)
+	assert.Len(t, campaigns, 3)
+	assert.NoError(t, db.DeleteCampaign(campaigns[2].ID))
+
+	statement, err := db.GetStatement(userID, nil, nil, 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, statement.Total)
+	mismatches, err := db.CheckLedger()
+	assert.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func Test_storageImpl_Referrals(t *testing.T) {
+	db := initNewDB(t).(*storageImpl)
+	beforeTest()
+	db.policy.ReferralRules = ReferralRules{ReferrerBonus: 5000, RefereeBonus: 1000}
+
+	referrerID, err := db.Register("referrer", "password", "", "10.0.0.1")
+	assert.NoError(t, err)
+	referrals, err := db.GetReferrals(referrerID)
+	assert.NoError(t, err)
+	assert.Len(t, referrals.Code, referralCodeLength)
+	assert.Empty(t, referrals.Referrals)
+
+	_, err = db.Register("stranger", "password", "NOSUCHCODE", "10.0.0.2")
+	assert.ErrorIs(t, err, ErrReferralCodeNotFound)
+	friendID, err := db.Register("friend", "password", referrals.Code, "10.0.0.2")
+	assert.NoError(t, err)
+	// the same ip as the referrer and as the friend
+	_, err = db.Register("self", "password", referrals.Code, "10.0.0.1")
+	assert.NoError(t, err)
+	_, err = db.Register("friend's twin", "password", referrals.Code, "10.0.0.2")
+	assert.NoError(t, err)
+
+	xdb.MustExec(`insert into orders(number, user_id, status) values ($1, $2, 1), ($3, $2, 1)`, 1, friendID, 2)
+	_, err = db.ApplyCalcResults([]string{""}, map[int64]CalcAmountsUpdateResult{
+		1: {Accrual: 100, Status: model.Processed},
+		2: {Accrual: 100, Status: model.Processed},
+	})
+	assert.NoError(t, err)
+
+	acc, err := db.GetAccount(referrerID, DefaultCurrency)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(5000), acc.Current)
+	acc, err = db.GetAccount(friendID, DefaultCurrency)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(200+1000), acc.Current)
+
+	referrals, err = db.GetReferrals(referrerID)
+	assert.NoError(t, err)
+	assert.Len(t, referrals.Referrals, 3)
+	assert.Equal(t, referralModel.Rewarded, referrals.Referrals[0].Status)
+	assert.Equal(t, money.Money(5000), referrals.Referrals[0].Reward)
+	assert.Equal(t, referralModel.Rejected, referrals.Referrals[1].Status)
+	assert.Equal(t, referralModel.Rejected, referrals.Referrals[2].Status)
+
+	// an order resolved manually rewards the referral as well
+	colleagueID, err := db.Register("colleague", "password", referrals.Code, "10.0.0.3")
+	assert.NoError(t, err)
+	xdb.MustExec(`insert into orders(number, user_id, status) values ($1, $2, $3)`, 3, colleagueID, model.DeadLetter)
+	assert.NoError(t, db.ResolveDeadLetterOrder(3, model.Processed, 100, "admin", "confirmed by partner"))
+	acc, err = db.GetAccount(referrerID, DefaultCurrency)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(10000), acc.Current)
+	acc, err = db.GetAccount(colleagueID, DefaultCurrency)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(100+1000), acc.Current)
+
+	mismatches, err := db.CheckLedger()
+	assert.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func Test_storageImpl_Adjustments(t *testing.T) {
+	db := initNewDB(t).(*storageImpl)
+	const userID = "cfbe7630-32b3-11ed-a261-0242ac120002"
+	beforeTest()
+	db.policy.AdjustmentRules.ApprovalThreshold = 10000
+	xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+	xdb.MustExec(`insert into accounts(user_id) values('cfbe7630-32b3-11ed-a261-0242ac120002')`)
+
+	_, err := db.CreateAdjustment("unknown", 500, "lost accrual", "SUP-1", "admin1")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	_, err = db.CreateAdjustment("login", -500, "wrong accrual", "SUP-1", "admin1")
+	assert.ErrorIs(t, err, ErrBalanceLimitExhausted)
+
+	credit, err := db.CreateAdjustment("login", 500, "lost accrual", "SUP-2", "admin1")
+	assert.NoError(t, err)
+	assert.Equal(t, adjustmentModel.Applied, credit.Status)
+	large, err := db.CreateAdjustment("login", 20000, "lost order", "SUP-3", "admin1")
+	assert.NoError(t, err)
+	assert.Equal(t, adjustmentModel.Pending, large.Status)
+	acc, err := db.GetAccount(userID, DefaultCurrency)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(500), acc.Current)
+
+	_, err = db.ApproveAdjustment(large.ID, "admin1")
+	assert.ErrorIs(t, err, ErrAdjustmentSelfApproval)
+	large, err = db.ApproveAdjustment(large.ID, "admin2")
+	assert.NoError(t, err)
+	assert.Equal(t, adjustmentModel.Applied, large.Status)
+	assert.Equal(t, "admin2", *large.DecidedBy)
+	assert.Len(t, large.History, 2)
+	_, err = db.RejectAdjustment(large.ID, "admin2", "duplicate")
+	assert.ErrorIs(t, err, ErrAdjustmentNotPending)
+
+	debit, err := db.CreateAdjustment("login", -300, "duplicate accrual", "SUP-4", "admin1")
+	assert.NoError(t, err)
+	assert.Equal(t, adjustmentModel.Applied, debit.Status)
+	acc, err = db.GetAccount(userID, DefaultCurrency)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(500+20000-300), acc.Current)
+
+	adjustments, err := db.GetAdjustments()
+	assert.NoError(t, err)
+	assert.Len(t, adjustments, 3)
+	statement, err := db.GetStatement(userID, nil, nil, 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, statement.Total)
+	assert.Equal(t, "adjustment", statement.Operations[0].Type)
+	mismatches, err := db.CheckLedger()
+	assert.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func Test_storageImpl_Reconcile(t *testing.T) {
+	db := initNewDB(t).(*storageImpl)
+	const userID = "cfbe7630-32b3-11ed-a261-0242ac120002"
+	beforeTest()
+	xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+	xdb.MustExec(`insert into accounts(user_id) values('cfbe7630-32b3-11ed-a261-0242ac120002')`)
+
+	_, err := db.CreateAdjustment("login", 500, "lost accrual", "SUP-1", "admin1")
+	assert.NoError(t, err)
+	report, err := db.Reconcile(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Accounts)
+	assert.Empty(t, report.Discrepancies)
+	assert.Zero(t, report.ID)
+
+	xdb.MustExec(`update accounts set current = current + 1 where user_id = $1`, userID)
+	report, err = db.Reconcile(true)
+	assert.NoError(t, err)
+	assert.NotZero(t, report.ID)
+	if assert.Len(t, report.Discrepancies, 1) {
+		assert.Equal(t, money.Money(501), report.Discrepancies[0].Current)
+		assert.Equal(t, money.Money(500), report.Discrepancies[0].ExpectedCurrent)
+		assert.Zero(t, report.Discrepancies[0].Backfilled)
+	}
+
+	// a balance moved by the ledger backfill is expected
+	xdb.MustExec(`update accounts set current = current + 99 where user_id = $1`, userID)
+	xdb.MustExec(`insert into ledger_entries(user_id, amount, type) values($1, 100, $2)`, userID, LedgerAdjustment)
+	report, err = db.Reconcile(false)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Discrepancies)
+
+	// only a real mismatch is reported, with the backfilled part of the expected balance
+	xdb.MustExec(`update accounts set current = current + 1 where user_id = $1`, userID)
+	report, err = db.Reconcile(false)
+	assert.NoError(t, err)
+	if assert.Len(t, report.Discrepancies, 1) {
+		assert.Equal(t, money.Money(601), report.Discrepancies[0].Current)
+		assert.Equal(t, money.Money(600), report.Discrepancies[0].ExpectedCurrent)
+		assert.Equal(t, money.Money(100), report.Discrepancies[0].Backfilled)
+	}
+}
+
+func Test_storageImpl_Currencies(t *testing.T) {
+	db := initNewDB(t).(*storageImpl)
+	const userID = "cfbe7630-32b3-11ed-a261-0242ac120002"
+	beforeTest()
+	db.policy.ProviderCurrencies = map[string]string{"partner": "MILES"}
+	xdb.MustExec(`insert into users(id, login, password) values('cfbe7630-32b3-11ed-a261-0242ac120002', 'login','password');`)
+	xdb.MustExec(`insert into accounts(user_id) values('cfbe7630-32b3-11ed-a261-0242ac120002')`)
+
+	assert.NoError(t, db.SaveOrder(userID, 1, "", "default"))
+	assert.NoError(t, db.SaveOrder(userID, 2, "", "partner"))
+	_, err := db.ApplyCalcResults([]string{"default", "partner"}, map[int64]CalcAmountsUpdateResult{
+		1: {Accrual: 100, Status: model.Processed},
+		2: {Accrual: 300, Status: model.Processed},
+	})
+	assert.NoError(t, err)
+	acc, err := db.GetAccount(userID, DefaultCurrency)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(100), acc.Current)
+	acc, err = db.GetAccount(userID, "MILES")
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(300), acc.Current)
+	_, err = db.GetAccount(userID, "POINTS")
+	assert.ErrorIs(t, err, ErrUnknownCurrency)
+
+	assert.ErrorIs(t, db.WithdrawFromAccount(userID, "MILES", 400, 3), ErrBalanceLimitExhausted)
+	assert.NoError(t, db.WithdrawFromAccount(userID, "MILES", 200, 3))
+	assert.NoError(t, db.HoldWithdrawal(userID, "MILES", 50, 4, time.Hour))
+	assert.NoError(t, db.CancelWithdrawal(userID, 4))
+	acc, err = db.GetAccount(userID, "MILES")
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(100), acc.Current)
+	assert.Equal(t, money.Money(200), acc.Withdrawn)
+	acc, err = db.GetAccount(userID, DefaultCurrency)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Money(100), acc.Current)
+
+	withdrawals, err := db.GetWithdrawals(userID, "MILES")
+	assert.NoError(t, err)
+	assert.Len(t, withdrawals, 2)
+	withdrawals, err = db.GetWithdrawals(userID, DefaultCurrency)
+	assert.NoError(t, err)
+	assert.Empty(t, withdrawals)
+
+	statement, err := db.GetStatement(userID, nil, nil, 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, statement.Total)
+	mismatches, err := db.CheckLedger()
+	assert.NoError(t, err)
+	assert.Empty(t, mismatches)
+	report, err := db.Reconcile(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Accounts)
+	assert.Empty(t, report.Discrepancies)
+}
+
+func Test_storageImpl_SaveCallbackSignature(t *testing.T) {
+	db := initNewDB(t)
+	beforeTest()
+
+	assert.NoError(t, db.SaveCallbackSignature("signature", time.Minute))
+	assert.ErrorIs(t, db.SaveCallbackSignature("signature", time.Minute), ErrCallbackReplayed)
+	assert.NoError(t, db.SaveCallbackSignature("other", time.Minute))
+
+	xdb.MustExec(`update accrual_callbacks set received_at = now() - interval '2 minutes'`)
+	assert.NoError(t, db.SaveCallbackSignature("signature", time.Minute))
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"gophermart/internal/money"
+	"math/big"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Bases of loyalty tiers, the activity of the user in TierRules.Period is compared with tier thresholds.
+const (
+	// TierBasisAccrual counts accruals of processed orders.
+	TierBasisAccrual = "accrual"
+	// TierBasisSpend counts withdrawals less their refunds.
+	TierBasisSpend = "spend"
+)
+
+// Tier is reached by users whose activity is at least Threshold, accruals of its members are multiplied.
+type Tier struct {
+	Name       string
+	Threshold  money.Money
+	Multiplier *big.Rat
+}
+
+// TierRules define loyalty tiers, users below the lowest threshold have no tier.
+type TierRules struct {
+	Tiers  []Tier
+	Basis  string
+	Period time.Duration
+}
+
+// multiplier of the tier, accruals of users without a known tier are not multiplied.
+func (r TierRules) multiplier(name string) *big.Rat {
+	for _, t := range r.Tiers {
+		if t.Name == name {
+			return t.Multiplier
+		}
+	}
+	return nil
+}
+
+const (
+	// tiers are set on the accounts in the default currency only, accruals in partner currencies get no bonus
+	selectTierAccrualsSQL = `
+	select o.number, o.user_id, o.accrual, a.tier
+	from orders o join accounts a on a.user_id = o.user_id and a.currency = o.currency
+	where o.number in (?) and o.accrual > 0 and a.tier is not null`
+	// $1 and $2 are names and thresholds of tiers, $3 are the ledger entry types of the activity, $4 is -1 for
+	// debits and 1 for credits, $5 is the period in milliseconds, $6 is the default currency
+	recalculateTiersSQL = `
+	with activity as (
+		select a.user_id, coalesce(sum(l.amount), 0) * $4 as value
+		from accounts a left join ledger_entries l on l.user_id = a.user_id and l.currency = a.currency
+			and l.type = any($3) and l.created_at >= now() - $5 * interval '1 millisecond'
+		where a.currency = $6
+		group by a.user_id
+	), tiers as (
+		select user_id, (
+			select t.name from unnest($1::text[], $2::bigint[]) as t(name, threshold)
+			where t.threshold <= activity.value order by t.threshold desc limit 1
+		) as tier
+		from activity
+	)
+	update accounts a set tier = tiers.tier, tier_updated_at = now() from tiers
+	where a.user_id = tiers.user_id and a.currency = $6 and a.tier is distinct from tiers.tier`
+)
+
+type tierAccrual struct {
+	Number  uint64      `db:"number"`
+	UserID  string      `db:"user_id"`
+	Accrual money.Money `db:"accrual"`
+	Tier    string      `db:"tier"`
+}
+
+// creditTierBonuses credits the bonus of the owner's tier for accruals of orders nums, the bonus is
+// the accrual multiplied by the tier multiplier less the accrual itself.
+func (db *storageImpl) creditTierBonuses(tx *sqlx.Tx, nums []int64) error {
+	if len(db.policy.TierRules.Tiers) == 0 {
+		return nil
+	}
+	query, args, err := sqlx.In(selectTierAccrualsSQL, nums)
+	if err != nil {
+		return err
+	}
+	accruals := []tierAccrual{}
+	if err := tx.SelectContext(db.ctx, &accruals, tx.Rebind(query), args...); err != nil {
+		return err
+	}
+	for _, a := range accruals {
+		multiplier := db.policy.TierRules.multiplier(a.Tier)
+		if multiplier == nil {
+			continue
+		}
+		multiplied, err := a.Accrual.Mul(multiplier)
+		if err != nil {
+			return err
+		}
+		bonus := multiplied - a.Accrual
+		if bonus <= 0 {
+			continue
+		}
+		if _, err := tx.ExecContext(db.ctx, addAccountAccuralForCalc, a.UserID, bonus, DefaultCurrency); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(db.ctx, insertLedgerEntrySQL, a.UserID, bonus, LedgerTierBonus, a.Number, DefaultCurrency); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(db.ctx, insertLotSQL, a.UserID, a.Number, bonus, db.lotExpiresAt(), DefaultCurrency); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecalculateTiers updates tiers of all users by their activity in the period, it returns the number of
+// users whose tier has changed.
+func (db *storageImpl) RecalculateTiers() (int, error) {
+	rules := db.policy.TierRules
+	if len(rules.Tiers) == 0 {
+		return 0, nil
+	}
+	names := make([]string, len(rules.Tiers))
+	thresholds := make([]int64, len(rules.Tiers))
+	for i, t := range rules.Tiers {
+		names[i], thresholds[i] = t.Name, int64(t.Threshold)
+	}
+	types, sign := []int64{int64(LedgerAccrual)}, 1
+	if rules.Basis == TierBasisSpend {
+		types, sign = []int64{int64(LedgerWithdrawal), int64(LedgerRefund)}, -1
+	}
+
+	result, err := db.xdb.ExecContext(db.ctx, recalculateTiersSQL,
+		pq.Array(names), pq.Array(thresholds), pq.Array(types), sign, rules.Period.Milliseconds(), DefaultCurrency)
+	if err != nil {
+		return 0, err
+	}
+	updated, err := result.RowsAffected()
+	return int(updated), err
+}
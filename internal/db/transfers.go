@@ -0,0 +1,179 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"gophermart/internal/money"
+	"time"
+
+	accountModel "gophermart/internal/account/model/db"
+	transferModel "gophermart/internal/transfer/model/db"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrRecipientNotFound = errors.New("recipient not found")
+var ErrTransferToSelf = errors.New("points can't be transferred to the sender")
+var ErrTransferBelowMin = errors.New("the sum is below the minimal transfer")
+var ErrTransferAboveMax = errors.New("the sum is above the maximal transfer")
+var ErrTransferDailyLimit = errors.New("the daily transfer limit is exceeded")
+
+const (
+	getUserIDByLoginSQL = `select id from users where login = $1`
+	// accounts of both sides are locked in the order of user ids, so that opposite transfers don't deadlock
+	selectTransferAccountsForUpdateSQL = `
+	select user_id, currency, current, withdrawn, held from accounts
+	where user_id in ($1, $2) and currency = $3 order by user_id for update`
+	debitAccountSQL        = `update accounts set current = current - $2 where user_id = $1 and currency = $3`
+	creditAccountSQL       = `update accounts set current = current + $2 where user_id = $1 and currency = $3`
+	insertTransferSQL      = `insert into transfers(from_user_id, to_user_id, sum, fee) values($1, $2, $3, $4) returning id, created_at`
+	insertTransferEntrySQL = `insert into ledger_entries(user_id, amount, type, transfer_id) values($1, $2, $3, $4)`
+	selectSentSinceSQL     = `select coalesce(sum(sum), 0) from transfers where from_user_id = $1 and created_at >= $2`
+	selectTransfersSQL     = `
+	select t.id, t.from_user_id = $1 as outgoing, u.login, t.sum, t.fee, t.created_at
+	from transfers t join users u on u.id = case when t.from_user_id = $1 then t.to_user_id else t.from_user_id end
+	where t.from_user_id = $1 or t.to_user_id = $1
+	order by t.created_at asc, t.id asc`
+)
+
+// TransferPoints moves sum from the user to the user with login, the sender also pays the fee of the transfer.
+// The recipient gets the points with the same expiration as they had for the sender. Only the points of
+// the default currency are transferred.
+func (db *storageImpl) TransferPoints(UserID, login string, sum money.Money) (*transferModel.Transfer, error) {
+	var recipientID string
+	if err := db.xdb.GetContext(db.ctx, &recipientID, getUserIDByLoginSQL, login); err == sql.ErrNoRows {
+		return nil, ErrRecipientNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if recipientID == UserID {
+		return nil, ErrTransferToSelf
+	}
+	fee, err := db.transferFee(sum)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.xdb.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	accounts := []accountModel.Account{}
+	if err := tx.SelectContext(db.ctx, &accounts, selectTransferAccountsForUpdateSQL, UserID, recipientID, DefaultCurrency); err != nil {
+		return nil, err
+	}
+	var sender *accountModel.Account
+	for i := range accounts {
+		if accounts[i].UserID == UserID {
+			sender = &accounts[i]
+		}
+	}
+	if sender == nil {
+		return nil, ErrUserNotFound
+	} else if len(accounts) != 2 {
+		return nil, ErrRecipientNotFound
+	}
+	if err := db.checkTransferLimits(tx, UserID, sum, fee, sender.Current); err != nil {
+		return nil, err
+	}
+
+	transfer := transferModel.Transfer{Outgoing: true, Login: login, Sum: sum, Fee: fee}
+	if err := tx.QueryRowxContext(db.ctx, insertTransferSQL, UserID, recipientID, sum, fee).
+		Scan(&transfer.ID, &transfer.CreatedAt); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(db.ctx, debitAccountSQL, UserID, sum+fee, DefaultCurrency); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(db.ctx, creditAccountSQL, recipientID, sum, DefaultCurrency); err != nil {
+		return nil, err
+	}
+	lots, err := db.takeFromLots(tx, UserID, DefaultCurrency, 0, sum+fee)
+	if err != nil {
+		return nil, err
+	}
+	// the sum is taken from the lots before the fee
+	for _, lot := range lots {
+		part := lot.Remaining
+		if part > sum {
+			part = sum
+		}
+		if part == 0 {
+			break
+		}
+		if _, err := tx.ExecContext(db.ctx, insertLotSQL, recipientID, nil, part, lot.ExpiresAt, DefaultCurrency); err != nil {
+			return nil, err
+		}
+		sum -= part
+	}
+
+	entries := []struct {
+		userID    string
+		amount    money.Money
+		entryType LedgerEntryType
+	}{
+		{UserID, -transfer.Sum, LedgerTransfer},
+		{recipientID, transfer.Sum, LedgerTransfer},
+		{UserID, -fee, LedgerTransferFee},
+	}
+	for _, e := range entries {
+		if e.amount == 0 {
+			continue
+		}
+		if _, err := tx.ExecContext(db.ctx, insertTransferEntrySQL, e.userID, e.amount, e.entryType, transfer.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return &transfer, tx.Commit()
+}
+
+func (db *storageImpl) transferFee(sum money.Money) (money.Money, error) {
+	rules := db.policy.TransferRules
+	fee := rules.FeeFixed
+	if rules.FeeRate != nil {
+		part, err := sum.Mul(rules.FeeRate)
+		if err != nil {
+			return 0, err
+		}
+		fee += part
+	}
+	return fee, nil
+}
+
+// checkTransferLimits checks the new transfer of sum and fee from current, the account must be locked by tx.
+func (db *storageImpl) checkTransferLimits(tx *sqlx.Tx, UserID string, sum, fee, current money.Money) error {
+	rules := db.policy.TransferRules
+	if sum <= 0 || (rules.MinSum > 0 && sum < rules.MinSum) {
+		return ErrTransferBelowMin
+	}
+	if rules.MaxSum > 0 && sum > rules.MaxSum {
+		return ErrTransferAboveMax
+	}
+	if current < sum+fee {
+		return ErrBalanceLimitExhausted
+	}
+	if rules.DailySum > 0 {
+		now := time.Now().UTC()
+		var sent money.Money
+		if err := tx.GetContext(db.ctx, &sent, selectSentSinceSQL,
+			UserID, time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)); err != nil {
+			return err
+		}
+		if sent+sum > rules.DailySum {
+			return ErrTransferDailyLimit
+		}
+	}
+	return nil
+}
+
+// GetTransfers returns transfers sent and received by the user in chronological order.
+func (db *storageImpl) GetTransfers(UserID string) ([]transferModel.Transfer, error) {
+	transfers := []transferModel.Transfer{}
+	if err := db.xdb.SelectContext(db.ctx, &transfers, selectTransfersSQL, UserID); err != nil {
+		return nil, err
+	}
+	return transfers, nil
+}
@@ -0,0 +1,27 @@
+package health
+
+import (
+	"gophermart/internal/db"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+type handler struct {
+	db     db.Storage
+	logger *zap.SugaredLogger
+}
+
+func NewHandler(db db.Storage, logger *zap.SugaredLogger) *handler {
+	return &handler{db, logger}
+}
+
+func (h *handler) GetHealth(w http.ResponseWriter, r *http.Request) {
+	if err := h.db.Ping(); err != nil {
+		// 503 — нет соединения с базой данных.
+		h.logger.Errorf("failed to GetHealth: %v", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,138 @@
+// Package idempotency replays responses of retried requests carrying the same Idempotency-Key.
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"gophermart/internal/db"
+	"gophermart/internal/utils"
+	"io"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	KeyHeader = "Idempotency-Key"
+	// ReplayedHeader marks a stored response returned for a retried request.
+	ReplayedHeader = "Idempotent-Replayed"
+	MaxKeyLength   = 256
+)
+
+type middleware struct {
+	db     db.Storage
+	secret string
+	ttl    time.Duration
+	lease  time.Duration
+	logger *zap.SugaredLogger
+}
+
+// NewMiddleware stores the first response of an authenticated request with Idempotency-Key and replays it
+// for requests with the same key and body, the key is scoped by user, method and path. Responses with
+// 5xx status are not stored, the request can be retried with the same key. A key reserved by a request
+// that panicked is released, the one of a request that never finished is reserved for lease only.
+func NewMiddleware(db db.Storage, secret string, ttl, lease time.Duration, logger *zap.SugaredLogger) func(http.Handler) http.Handler {
+	m := &middleware{db, secret, ttl, lease, logger}
+	return m.handler
+}
+
+func (m *middleware) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(KeyHeader)
+		userID, isAuthed := utils.GetUserID(r, m.secret)
+		if key == "" || !isAuthed {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > MaxKeyLength {
+			// 400 — слишком длинный ключ идемпотентности.
+			m.logger.Warnf("idempotency key of %v bytes is too long", len(key))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			// 400 — неверный формат запроса.
+			m.logger.Warnf("failed to read request with idempotency key: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(body)
+		scope := r.Method + " " + r.URL.Path
+
+		stored, err := m.db.ReserveIdempotencyKey(userID, scope, key, hex.EncodeToString(hash[:]), m.ttl, m.lease)
+		if errors.Is(err, db.ErrIdempotencyKeyReused) {
+			// 422 — ключ уже использован с другим телом запроса.
+			m.logger.Warnf("idempotency key %q of user %v: %v", key, userID, err)
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		} else if errors.Is(err, db.ErrIdempotencyKeyInProgress) {
+			// 409 — запрос с тем же ключом ещё выполняется.
+			m.logger.Warnf("idempotency key %q of user %v: %v", key, userID, err)
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err != nil {
+			// 500 — внутренняя ошибка сервера.
+			m.logger.Errorf("failed to reserve idempotency key: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if stored != nil {
+			replay(w, stored)
+			return
+		}
+
+		defer func() {
+			if p := recover(); p != nil {
+				if err := m.db.ReleaseIdempotencyKey(userID, scope, key); err != nil {
+					m.logger.Errorf("failed to release idempotency key %q: %v", key, err)
+				}
+				panic(p)
+			}
+		}()
+		rec := &recorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if rec.code >= http.StatusInternalServerError {
+			err = m.db.ReleaseIdempotencyKey(userID, scope, key)
+		} else {
+			err = m.db.SaveIdempotentResponse(userID, scope, key, rec.code, rec.Header().Get("Content-Type"), rec.body.Bytes())
+		}
+		if err != nil {
+			m.logger.Errorf("failed to save response of idempotency key %q: %v", key, err)
+		}
+	})
+}
+
+func replay(w http.ResponseWriter, stored *db.IdempotentResponse) {
+	if stored.ContentType != nil && *stored.ContentType != "" {
+		w.Header().Set("Content-Type", *stored.ContentType)
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(*stored.StatusCode)
+	w.Write(stored.Body)
+}
+
+// recorder passes the response through and keeps a copy of it.
+type recorder struct {
+	http.ResponseWriter
+	code        int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.code, r.wroteHeader = code, true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
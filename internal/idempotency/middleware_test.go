@@ -0,0 +1,375 @@
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"gophermart/internal/db"
+	"gophermart/internal/money"
+	"gophermart/internal/order/model"
+	"gophermart/internal/utils"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	accountModel "gophermart/internal/account/model/db"
+	adjustmentModel "gophermart/internal/adjustment/model/db"
+	campaignModel "gophermart/internal/campaign/model/db"
+	referralModel "gophermart/internal/referral/model/db"
+	statementModel "gophermart/internal/statement/model/db"
+	transferModel "gophermart/internal/transfer/model/db"
+	withdrawalsModel "gophermart/internal/withdrawals/model/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.uber.org/zap"
+)
+
+var logger = zap.NewExample().Sugar()
+
+type mockDBStorage struct {
+	mock.Mock
+}
+
+func (m *mockDBStorage) Register(login, password, referralCode, ip string) (string, error) {
+	return "", nil
+}
+
+func (m *mockDBStorage) GetByLoginPassword(login string, password string) (string, error) {
+	return "", nil
+}
+
+func (m *mockDBStorage) SaveOrder(UserID string, number uint64, merchantID, provider string) error {
+	args := m.Called(UserID, number)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) GetOrders(UserID string) ([]model.Order, error) {
+	args := m.Called(UserID)
+	return args.Get(0).([]model.Order), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAccount(UserID, currency string) (*accountModel.Account, error) {
+	return nil, nil
+}
+func (m *mockDBStorage) WithdrawFromAccount(UserID, currency string, sum money.Money, number uint64) error {
+	return nil
+}
+func (m *mockDBStorage) HoldWithdrawal(UserID, currency string, sum money.Money, number uint64, ttl time.Duration) error {
+	return nil
+}
+
+func (m *mockDBStorage) ConfirmWithdrawal(UserID string, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) CancelWithdrawal(UserID string, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) ExpireWithdrawals() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) ExpirePoints() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) RecalculateTiers() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) CreateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaigns() ([]campaignModel.Campaign, error) {
+	args := m.Called()
+	return args.Get(0).([]campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaign(ID int64) (*campaignModel.Campaign, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) UpdateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) DeleteCampaign(ID int64) error {
+	args := m.Called(ID)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) CreateAdjustment(login string, amount money.Money, reason, ticket, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(login, amount, reason, ticket, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) ApproveAdjustment(ID int64, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) RejectAdjustment(ID int64, actor, reason string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor, reason)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustments() ([]adjustmentModel.Adjustment, error) {
+	args := m.Called()
+	return args.Get(0).([]adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustment(ID int64) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetExpiringPoints(UserID, currency string, within time.Duration) ([]accountModel.ExpiringPoints, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) RefundWithdrawal(number uint64, sum money.Money, actor, reason string) (*withdrawalsModel.Withdrawals, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetWithdrawals(UserID, currency string) ([]withdrawalsModel.Withdrawals, error) {
+	args := m.Called(UserID)
+	return args.Get(0).([]withdrawalsModel.Withdrawals), args.Error(1)
+}
+
+func (m *mockDBStorage) TransferPoints(UserID, login string, sum money.Money) (*transferModel.Transfer, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetTransfers(UserID string) ([]transferModel.Transfer, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetReferrals(UserID string) (*referralModel.Referrals, error) {
+	args := m.Called(UserID)
+	return args.Get(0).(*referralModel.Referrals), args.Error(1)
+}
+
+func (m *mockDBStorage) GetStatement(UserID string, from, to *time.Time, offset, limit int) (*statementModel.Statement, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) ReserveIdempotencyKey(UserID, scope, key, requestHash string, ttl, lease time.Duration) (*db.IdempotentResponse, error) {
+	args := m.Called(UserID, scope, key, requestHash, ttl, lease)
+	return args.Get(0).(*db.IdempotentResponse), args.Error(1)
+}
+
+func (m *mockDBStorage) SaveIdempotentResponse(UserID, scope, key string, statusCode int, contentType string, body []byte) error {
+	args := m.Called(UserID, scope, key, statusCode, contentType, body)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) ReleaseIdempotencyKey(UserID, scope, key string) error {
+	args := m.Called(UserID, scope, key)
+	return args.Error(0)
+}
+func (m *mockDBStorage) CalcAmounts(shard db.Shard, providers []string, offset, limit int,
+	updF func(nums []int64) map[int64]db.CalcAmountsUpdateResult) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) ApplyCalcResults(providers []string, updates map[int64]db.CalcAmountsUpdateResult) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) SaveCallbackSignature(signature string, ttl time.Duration) error {
+	args := m.Called(signature, ttl)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) TryAcquireLease(instanceID string, shard int) (*db.Lease, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetLeaders() ([]db.Leader, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) CheckLedger() ([]db.LedgerMismatch, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) Reconcile(save bool) (*db.ReconciliationReport, error) {
+	args := m.Called(save)
+	return args.Get(0).(*db.ReconciliationReport), args.Error(1)
+}
+
+func (m *mockDBStorage) Ping() error {
+	return nil
+}
+
+func (m *mockDBStorage) GetOrderHistory(UserID string, number uint64) ([]model.OrderEvent, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) DeadLetterOrders(maxFailedAttempts int) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) GetDeadLetterOrders() ([]model.DeadLetterOrder, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) RetryDeadLetterOrder(number uint64, actor string) error {
+	return nil
+}
+
+func (m *mockDBStorage) ResolveDeadLetterOrder(number uint64, status model.OrderStatus, accrual money.Money, actor, reason string) error {
+	return nil
+}
+
+const (
+	testScope = "POST /api/user/balance/withdraw"
+	testBody  = `{"order": "79927398713", "sum": 5}`
+)
+
+var testHash = fmt.Sprintf("%x", sha256.Sum256([]byte(testBody)))
+
+func Test_middleware(t *testing.T) {
+	stored := func(code int, body string) *db.IdempotentResponse {
+		contentType := "application/json"
+		return &db.IdempotentResponse{RequestHash: testHash, StatusCode: &code, ContentType: &contentType, Body: []byte(body)}
+	}
+
+	tests := []struct {
+		name       string
+		key        string
+		storage    func() *mockDBStorage
+		handler    int
+		code       int
+		body       string
+		replayed   bool
+		wantCalled bool
+	}{
+		{
+			name:       "запрос без ключа",
+			storage:    func() *mockDBStorage { return new(mockDBStorage) },
+			handler:    http.StatusOK,
+			code:       http.StatusOK,
+			body:       "handled",
+			wantCalled: true,
+		},
+		{
+			name: "первый запрос с ключом",
+			key:  "key",
+			storage: func() *mockDBStorage {
+				storage := new(mockDBStorage)
+				storage.On("ReserveIdempotencyKey", "1", testScope, "key", testHash, time.Hour, time.Minute).Return((*db.IdempotentResponse)(nil), nil)
+				storage.On("SaveIdempotentResponse", "1", testScope, "key", http.StatusPaymentRequired, "text/plain", []byte("handled")).Return(nil)
+				return storage
+			},
+			handler:    http.StatusPaymentRequired,
+			code:       http.StatusPaymentRequired,
+			body:       "handled",
+			wantCalled: true,
+		},
+		{
+			name: "повтор запроса",
+			key:  "key",
+			storage: func() *mockDBStorage {
+				storage := new(mockDBStorage)
+				storage.On("ReserveIdempotencyKey", "1", testScope, "key", testHash, time.Hour, time.Minute).Return(stored(http.StatusOK, "stored"), nil)
+				return storage
+			},
+			code:     http.StatusOK,
+			body:     "stored",
+			replayed: true,
+		},
+		{
+			name: "ключ использован с другим телом запроса",
+			key:  "key",
+			storage: func() *mockDBStorage {
+				storage := new(mockDBStorage)
+				storage.On("ReserveIdempotencyKey", "1", testScope, "key", testHash, time.Hour, time.Minute).
+					Return((*db.IdempotentResponse)(nil), db.ErrIdempotencyKeyReused)
+				return storage
+			},
+			code: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "запрос с ключом ещё выполняется",
+			key:  "key",
+			storage: func() *mockDBStorage {
+				storage := new(mockDBStorage)
+				storage.On("ReserveIdempotencyKey", "1", testScope, "key", testHash, time.Hour, time.Minute).
+					Return((*db.IdempotentResponse)(nil), db.ErrIdempotencyKeyInProgress)
+				return storage
+			},
+			code: http.StatusConflict,
+		},
+		{
+			name: "ошибка сервера не сохраняется",
+			key:  "key",
+			storage: func() *mockDBStorage {
+				storage := new(mockDBStorage)
+				storage.On("ReserveIdempotencyKey", "1", testScope, "key", testHash, time.Hour, time.Minute).Return((*db.IdempotentResponse)(nil), nil)
+				storage.On("ReleaseIdempotencyKey", "1", testScope, "key").Return(nil)
+				return storage
+			},
+			handler:    http.StatusInternalServerError,
+			code:       http.StatusInternalServerError,
+			body:       "handled",
+			wantCalled: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				body, _ := io.ReadAll(r.Body)
+				assert.Equal(t, testBody, string(body))
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(tt.handler)
+				w.Write([]byte("handled"))
+			})
+			storage := tt.storage()
+			request := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", bytes.NewBufferString(testBody))
+			request.AddCookie(&http.Cookie{Name: "token", Value: utils.TestToken})
+			if tt.key != "" {
+				request.Header.Set(KeyHeader, tt.key)
+			}
+
+			w := httptest.NewRecorder()
+			NewMiddleware(storage, utils.TestSecret, time.Hour, time.Minute, logger)(next).ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+
+			body, _ := io.ReadAll(res.Body)
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+			assert.Equal(t, tt.body, string(body))
+			assert.Equal(t, tt.wantCalled, called)
+			assert.Equal(t, tt.replayed, res.Header.Get(ReplayedHeader) == "true")
+			storage.AssertExpectations(t)
+		})
+	}
+}
+
+func Test_middleware_panic(t *testing.T) {
+	storage := new(mockDBStorage)
+	storage.On("ReserveIdempotencyKey", "1", testScope, "key", testHash, time.Hour, time.Minute).Return((*db.IdempotentResponse)(nil), nil)
+	storage.On("ReleaseIdempotencyKey", "1", testScope, "key").Return(nil)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("unexpected")
+	})
+	request := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", bytes.NewBufferString(testBody))
+	request.AddCookie(&http.Cookie{Name: "token", Value: utils.TestToken})
+	request.Header.Set(KeyHeader, "key")
+
+	assert.PanicsWithValue(t, "unexpected", func() {
+		NewMiddleware(storage, utils.TestSecret, time.Hour, time.Minute, logger)(next).ServeHTTP(httptest.NewRecorder(), request)
+	})
+	storage.AssertExpectations(t)
+}
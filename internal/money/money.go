@@ -0,0 +1,190 @@
+// Package money implements exact decimal amounts of points and money.
+package money
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in minor units, one unit is 10^-scale, by default scale is 2 and Money counts cents.
+// It is stored in bigint columns as is, so the scale must not change once amounts are stored.
+type Money int64
+
+// Rounding decides how amounts with more fraction digits than the scale are rounded.
+type Rounding int
+
+const (
+	// HalfUp rounds half away from zero.
+	HalfUp Rounding = iota
+	// HalfEven rounds half to the even unit.
+	HalfEven
+	// Down truncates extra digits.
+	Down
+	// Up rounds away from zero.
+	Up
+)
+
+var roundingNames = map[string]Rounding{
+	"half_up":   HalfUp,
+	"half_even": HalfEven,
+	"down":      Down,
+	"up":        Up,
+}
+
+func ParseRounding(s string) (Rounding, error) {
+	if r, ok := roundingNames[s]; ok {
+		return r, nil
+	}
+	return HalfUp, fmt.Errorf("unknown rounding mode %q", s)
+}
+
+// MaxScale keeps at least 10^9 whole units within int64.
+const MaxScale = 9
+
+var (
+	ErrInvalid  = errors.New("invalid amount")
+	ErrOverflow = errors.New("amount is out of range")
+)
+
+var (
+	scale    = 2
+	rounding = HalfUp
+	unit     = big.NewInt(100)
+)
+
+// Configure sets the scale and the rounding mode, it is called once on start before amounts are parsed.
+func Configure(s int, r Rounding) error {
+	if s < 0 || s > MaxScale {
+		return fmt.Errorf("scale %v is out of [0, %v]", s, MaxScale)
+	}
+	if r < HalfUp || r > Up {
+		return fmt.Errorf("unknown rounding mode %v", r)
+	}
+	scale, rounding = s, r
+	unit = new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(s)), nil)
+	return nil
+}
+
+// Scale is the number of fraction digits kept.
+func Scale() int {
+	return scale
+}
+
+// decimal is JSON number grammar with leading zeros allowed, exponent is limited to keep parsing cheap.
+var decimal = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?([eE][+-]?[0-9]{1,3})?$`)
+
+// Parse parses a decimal number, exponent is allowed as in JSON, extra fraction digits are rounded.
+func Parse(s string) (Money, error) {
+	if !decimal.MatchString(s) {
+		return 0, fmt.Errorf("%w: %q", ErrInvalid, s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrInvalid, s)
+	}
+	q := round(r.Mul(r, new(big.Rat).SetInt(unit)))
+	if !q.IsInt64() {
+		return 0, fmt.Errorf("%w: %q", ErrOverflow, s)
+	}
+	return Money(q.Int64()), nil
+}
+
+// Mul multiplies the amount by factor, e.g. by a fee rate, extra fraction digits are rounded as by Parse.
+func (m Money) Mul(factor *big.Rat) (Money, error) {
+	q := round(new(big.Rat).Mul(new(big.Rat).SetInt64(int64(m)), factor))
+	if !q.IsInt64() {
+		return 0, fmt.Errorf("%w: %v * %v", ErrOverflow, m, factor)
+	}
+	return Money(q.Int64()), nil
+}
+
+// round rounds r in minor units to an integer.
+func round(r *big.Rat) *big.Int {
+	q, rem := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if rem.Sign() != 0 && roundAway(q, rem, r.Denom()) {
+		q.Add(q, big.NewInt(int64(rem.Sign())))
+	}
+	return q
+}
+
+// roundAway reports whether q truncated toward zero with non zero remainder rem of denom should move away from zero.
+func roundAway(q, rem, denom *big.Int) bool {
+	switch rounding {
+	case Down:
+		return false
+	case Up:
+		return true
+	}
+	twice := new(big.Int).Abs(rem)
+	twice.Lsh(twice, 1)
+	switch twice.Cmp(denom) {
+	case 1:
+		return true
+	case 0:
+		return rounding == HalfUp || q.Bit(0) == 1
+	}
+	return false
+}
+
+// MustParse is Parse for constants, it panics on error.
+func MustParse(s string) Money {
+	m, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// String formats the amount with trailing fraction zeros trimmed, e.g. 500, 500.5, 0.29.
+func (m Money) String() string {
+	digits := strconv.FormatUint(abs(m), 10)
+	if scale > 0 {
+		if len(digits) <= scale {
+			digits = strings.Repeat("0", scale-len(digits)+1) + digits
+		}
+		digits = strings.TrimRight(digits[:len(digits)-scale]+"."+digits[len(digits)-scale:], "0")
+		digits = strings.TrimSuffix(digits, ".")
+	}
+	if m < 0 {
+		return "-" + digits
+	}
+	return digits
+}
+
+func abs(m Money) uint64 {
+	if m < 0 {
+		return uint64(-(m + 1)) + 1
+	}
+	return uint64(m)
+}
+
+// MarshalJSON writes the amount as an exact JSON number.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a string with a number, null keeps the amount as is.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if string(data) == "null" {
+		return nil
+	}
+	if len(data) > 1 && data[0] == '"' {
+		s, err := strconv.Unquote(string(data))
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalid, data)
+		}
+		data = []byte(s)
+	}
+	parsed, err := Parse(string(data))
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
@@ -0,0 +1,217 @@
+package money
+
+import (
+	"encoding/json"
+	"math"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withConfig runs f with the scale and the rounding mode and restores defaults.
+func withConfig(t *testing.T, s int, r Rounding, f func()) {
+	if err := Configure(s, r); err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(2, HalfUp)
+	f()
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in       string
+		rounding Rounding
+		expected Money
+		err      error
+	}{
+		{in: "0.29", expected: 29},
+		{in: "500.5", expected: 50050},
+		{in: "100", expected: 10000},
+		{in: "-1.01", expected: -101},
+		{in: "1e2", expected: 10000},
+		{in: "1.5E-1", expected: 15},
+		{in: "0.125", rounding: HalfUp, expected: 13},
+		{in: "-0.125", rounding: HalfUp, expected: -13},
+		{in: "0.125", rounding: HalfEven, expected: 12},
+		{in: "0.135", rounding: HalfEven, expected: 14},
+		{in: "0.129", rounding: Down, expected: 12},
+		{in: "-0.129", rounding: Down, expected: -12},
+		{in: "0.121", rounding: Up, expected: 13},
+		{in: "0.124", rounding: HalfUp, expected: 12},
+		{in: "92233720368547758.07", expected: math.MaxInt64},
+		{in: "-92233720368547758.08", expected: math.MinInt64},
+		{in: "92233720368547758.08", err: ErrOverflow},
+		{in: "", err: ErrInvalid},
+		{in: "abc", err: ErrInvalid},
+		{in: "1/2", err: ErrInvalid},
+		{in: "0x10", err: ErrInvalid},
+		{in: "+1", err: ErrInvalid},
+		{in: ".5", err: ErrInvalid},
+		{in: "1e10000", err: ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			withConfig(t, 2, tt.rounding, func() {
+				m, err := Parse(tt.in)
+				if tt.err != nil {
+					assert.ErrorIs(t, err, tt.err)
+					return
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expected, m)
+			})
+		})
+	}
+}
+
+func TestMoney_String(t *testing.T) {
+	tests := []struct {
+		scale    int
+		m        Money
+		expected string
+	}{
+		{2, 29, "0.29"},
+		{2, 50050, "500.5"},
+		{2, 10000, "100"},
+		{2, 0, "0"},
+		{2, -5, "-0.05"},
+		{2, math.MinInt64, "-92233720368547758.08"},
+		{0, 42, "42"},
+		{4, 12345, "1.2345"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			withConfig(t, tt.scale, HalfUp, func() {
+				assert.Equal(t, tt.expected, tt.m.String())
+			})
+		})
+	}
+}
+
+func TestMoney_JSON(t *testing.T) {
+	var data struct {
+		Sum     Money  `json:"sum"`
+		Accrual *Money `json:"accrual,omitempty"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(`{"sum": 751.29, "accrual": "0.29"}`), &data))
+	assert.Equal(t, Money(75129), data.Sum)
+	assert.Equal(t, Money(29), *data.Accrual)
+
+	out, err := json.Marshal(data)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"sum":751.29,"accrual":0.29}`, string(out))
+
+	assert.Error(t, json.Unmarshal([]byte(`{"sum": "abc"}`), &data))
+	assert.Error(t, json.Unmarshal([]byte(`{"sum": true}`), &data))
+}
+
+func quickConfig() *quick.Config {
+	return &quick.Config{
+		MaxCount: 2000,
+		Values: func(values []reflect.Value, r *rand.Rand) {
+			values[0] = reflect.ValueOf(Money(r.Int63() - r.Int63()))
+			values[1] = reflect.ValueOf(r.Intn(MaxScale + 1))
+		},
+	}
+}
+
+func TestMoney_roundTrip(t *testing.T) {
+	defer Configure(2, HalfUp)
+
+	stringRoundTrip := func(m Money, s int) bool {
+		Configure(s, HalfUp)
+		parsed, err := Parse(m.String())
+		return err == nil && parsed == m
+	}
+	if err := quick.Check(stringRoundTrip, quickConfig()); err != nil {
+		t.Error(err)
+	}
+
+	jsonRoundTrip := func(m Money, s int) bool {
+		Configure(s, HalfEven)
+		data, err := json.Marshal(m)
+		if err != nil {
+			return false
+		}
+		var parsed Money
+		return json.Unmarshal(data, &parsed) == nil && parsed == m
+	}
+	if err := quick.Check(jsonRoundTrip, quickConfig()); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestParse_rounding checks Parse against exact rational arithmetic for amounts with extra digits.
+func TestParse_rounding(t *testing.T) {
+	defer Configure(2, HalfUp)
+
+	modes := []Rounding{HalfUp, HalfEven, Down, Up}
+	f := func(m Money, s int) bool {
+		mode := modes[rand.Intn(len(modes))]
+		Configure(s, mode)
+		// m is parsed with three more fraction digits than the scale
+		in := new(big.Rat).SetFrac(big.NewInt(int64(m)), new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(s+3)), nil))
+		parsed, err := Parse(in.FloatString(s + 3))
+		if err != nil {
+			return false
+		}
+
+		expected, rem := int64(m)/1000, int64(m)%1000
+		sign := int64(1)
+		if rem < 0 {
+			rem, sign = -rem, -1
+		}
+		switch {
+		case rem == 0:
+		case mode == Up, mode == HalfUp && rem >= 500, mode == HalfEven && (rem > 500 || rem == 500 && expected%2 != 0):
+			expected += sign
+		}
+		return int64(parsed) == expected
+	}
+	if err := quick.Check(f, quickConfig()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseRounding(t *testing.T) {
+	for name, r := range roundingNames {
+		parsed, err := ParseRounding(name)
+		assert.NoError(t, err)
+		assert.Equal(t, r, parsed)
+	}
+	_, err := ParseRounding("ceil")
+	assert.Error(t, err)
+	assert.Error(t, Configure(MaxScale+1, HalfUp))
+}
+
+func TestMoney_Mul(t *testing.T) {
+	tests := []struct {
+		m        Money
+		factor   string
+		rounding Rounding
+		expected Money
+	}{
+		{m: 10000, factor: "0.015", expected: 150},
+		{m: 999, factor: "0.015", rounding: HalfUp, expected: 15},
+		{m: 999, factor: "0.015", rounding: Down, expected: 14},
+		{m: 50, factor: "1/2", rounding: HalfEven, expected: 25},
+		{m: 25, factor: "1/10", rounding: HalfEven, expected: 2},
+		{m: -999, factor: "0.015", rounding: HalfUp, expected: -15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.m.String()+"*"+tt.factor, func(t *testing.T) {
+			withConfig(t, 2, tt.rounding, func() {
+				factor, _ := new(big.Rat).SetString(tt.factor)
+				m, err := tt.m.Mul(factor)
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expected, m)
+			})
+		})
+	}
+	_, err := Money(math.MaxInt64).Mul(big.NewRat(2, 1))
+	assert.ErrorIs(t, err, ErrOverflow)
+}
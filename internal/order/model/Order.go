@@ -1,8 +1,8 @@
 package model
 
 import (
+	"gophermart/internal/money"
 	"gophermart/internal/order/model/api"
-	"gophermart/internal/utils"
 	"strconv"
 	"time"
 )
@@ -11,7 +11,11 @@ import (
 NEW — заказ загружен в систему, но не попал в обработку;
 PROCESSING — вознаграждение за заказ рассчитывается;
 INVALID — система расчёта вознаграждений отказала в расчёте;
-PROCESSED — данные по заказу проверены и информация о расчёте успешно получена.
+PROCESSED — данные по заказу проверены и информация о расчёте успешно получена;
+DEAD_LETTER — расчёт остановлен после исчерпания попыток, пользователю заказ показывается как PROCESSING;
+REGISTERED — заказ зарегистрирован в системе расчёта, но расчёт ещё не начат;
+UNREGISTERED — система расчёта ещё не знает о заказе (ответ 204).
+Статусы DEAD_LETTER, REGISTERED и UNREGISTERED пользователю показываются как PROCESSING, уточнение передаётся в progress.
 */
 type OrderStatus int
 
@@ -20,39 +24,128 @@ const (
 	Processing
 	Invalid
 	Processed
+	DeadLetter
+	Registered
+	Unregistered
 )
 
+var statusNames = map[OrderStatus]string{
+	New:          api.New,
+	Processing:   api.Processing,
+	Invalid:      api.Invalid,
+	Processed:    api.Processed,
+	DeadLetter:   api.DeadLetter,
+	Registered:   api.Registered,
+	Unregistered: api.Unregistered,
+}
+
+// Name is the precise status name, ToAPI collapses it to the statuses of the public API.
+func (s OrderStatus) Name() string {
+	return statusNames[s]
+}
+
+func ParseStatus(name string) (OrderStatus, bool) {
+	for s, n := range statusNames {
+		if n == name {
+			return s, true
+		}
+	}
+	return New, false
+}
+
 type Order struct {
 	Number     uint64      `db:"number"`
 	UserID     string      `db:"user_id"`
 	Status     OrderStatus `db:"status"`
 	UploadedAt time.Time   `db:"uploaded_at"`
-	Accrual    int64       `db:"accrual"` //целая часть * 100 + дробная часть
+	Accrual    money.Money `db:"accrual"`
+	// Currency is the currency of the accrual provider the order is routed to.
+	Currency string `db:"currency"`
 }
 
-func NewOrder(number uint64, UserID string, status OrderStatus, accrual float64) *Order {
-	return &Order{Number: number, UserID: UserID, Status: status, Accrual: utils.GetPersistentAccrual(accrual)}
+func NewOrder(number uint64, UserID string, status OrderStatus, accrual money.Money) *Order {
+	return &Order{Number: number, UserID: UserID, Status: status, Accrual: accrual}
 }
 
-func (o *Order) ToAPI() api.Order {
-	s := ""
-	accrual := utils.GetAPIAccrual(o.Accrual)
-
-	switch o.Status {
+func (s OrderStatus) ToAPI() string {
+	switch s {
 	case New:
-		s = api.New
-	case Processing:
-		s = api.Processing
+		return api.New
+	case Processing, DeadLetter, Registered, Unregistered:
+		return api.Processing
 	case Invalid:
-		s = api.Invalid
+		return api.Invalid
 	case Processed:
-		s = api.Processed
+		return api.Processed
+	}
+	return ""
+}
+
+// Progress details PROCESSING status of the public API.
+func (s OrderStatus) Progress() string {
+	switch s {
+	case Processing, Registered, Unregistered:
+		return s.Name()
 	}
+	return ""
+}
 
-	var ac *float64
+func (o *Order) ToAPI() api.Order {
+	s := o.Status.ToAPI()
+	accrual := o.Accrual
+
+	var ac *money.Money
 	if o.Status == Processed {
 		ac = &accrual
 	}
 
-	return api.Order{Number: strconv.FormatUint(o.Number, 10), UserID: o.UserID, Status: s, UploadedAt: o.UploadedAt, Accrual: ac}
+	return api.Order{
+		Number:     strconv.FormatUint(o.Number, 10),
+		UserID:     o.UserID,
+		Status:     s,
+		Progress:   o.Status.Progress(),
+		UploadedAt: o.UploadedAt,
+		Accrual:    ac,
+		Currency:   o.Currency,
+	}
+}
+
+// DeadLetterOrder is an order whose accrual lookups failed too many times.
+type DeadLetterOrder struct {
+	Order
+	Attempts       int     `db:"attempts"`
+	FailedAttempts int     `db:"failed_attempts"`
+	LastError      *string `db:"last_error"`
+	Provider       *string `db:"provider"`
+}
+
+func (o *DeadLetterOrder) ToAPI() api.DeadLetterOrder {
+	lastError, provider := "", ""
+	if o.LastError != nil {
+		lastError = *o.LastError
+	}
+	if o.Provider != nil {
+		provider = *o.Provider
+	}
+	return api.DeadLetterOrder{
+		Number:         strconv.FormatUint(o.Number, 10),
+		UserID:         o.UserID,
+		Status:         api.DeadLetter,
+		UploadedAt:     o.UploadedAt,
+		Attempts:       o.Attempts,
+		FailedAttempts: o.FailedAttempts,
+		LastError:      lastError,
+		Provider:       provider,
+	}
+}
+
+// ParseFinalStatus parses status a dead letter order can be resolved with.
+func ParseFinalStatus(s string) (OrderStatus, bool) {
+	switch s {
+	case api.Processed:
+		return Processed, true
+	case api.Invalid:
+		return Invalid, true
+	}
+	return New, false
 }
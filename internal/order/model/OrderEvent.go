@@ -0,0 +1,46 @@
+package model
+
+import (
+	"gophermart/internal/money"
+	"gophermart/internal/order/model/api"
+	"strconv"
+	"time"
+)
+
+// OrderEvent is a status transition of the order, OldStatus is nil for the upload.
+type OrderEvent struct {
+	Number    uint64       `db:"number"`
+	OldStatus *OrderStatus `db:"old_status"`
+	NewStatus OrderStatus  `db:"new_status"`
+	Accrual   money.Money  `db:"accrual"`
+	Response  *string      `db:"response"`
+	Attempt   int          `db:"attempt"`
+	Actor     *string      `db:"actor"`
+	Reason    *string      `db:"reason"`
+	CreatedAt time.Time    `db:"created_at"`
+}
+
+// ToAPI shows statuses as the public API does, see OrderStatus.ToAPI.
+func (e *OrderEvent) ToAPI() api.OrderEvent {
+	event := api.OrderEvent{
+		Number:    strconv.FormatUint(e.Number, 10),
+		Status:    e.NewStatus.ToAPI(),
+		Progress:  e.NewStatus.Progress(),
+		Attempt:   e.Attempt,
+		CreatedAt: e.CreatedAt,
+	}
+	if e.OldStatus != nil {
+		event.OldStatus = e.OldStatus.ToAPI()
+	}
+	if e.NewStatus == Processed {
+		accrual := e.Accrual
+		event.Accrual = &accrual
+	}
+	if e.Response != nil {
+		event.Response = *e.Response
+	}
+	if e.Reason != nil {
+		event.Reason = *e.Reason
+	}
+	return event
+}
@@ -1,18 +1,51 @@
 package api
 
-import "time"
+import (
+	"gophermart/internal/money"
+	"time"
+)
 
 const (
 	New        = "NEW"
 	Processing = "PROCESSING"
 	Invalid    = "INVALID"
 	Processed  = "PROCESSED"
+	DeadLetter = "DEAD_LETTER"
+
+	Registered   = "REGISTERED"
+	Unregistered = "UNREGISTERED"
 )
 
 type Order struct {
-	Number     string    `json:"number"`
-	UserID     string    `json:"user_id"`
-	Status     string    `json:"status"`
-	UploadedAt time.Time `json:"uploaded_at"`
-	Accrual    *float64  `json:"accrual,omitempty"`
+	Number     string       `json:"number"`
+	UserID     string       `json:"user_id"`
+	Status     string       `json:"status"`
+	Progress   string       `json:"progress,omitempty"`
+	UploadedAt time.Time    `json:"uploaded_at"`
+	Accrual    *money.Money `json:"accrual,omitempty"`
+	// Currency the accrual is paid in, it is empty for the platform's own points.
+	Currency string `json:"currency,omitempty"`
+}
+
+type OrderEvent struct {
+	Number    string       `json:"number"`
+	OldStatus string       `json:"old_status,omitempty"`
+	Status    string       `json:"status"`
+	Progress  string       `json:"progress,omitempty"`
+	Accrual   *money.Money `json:"accrual,omitempty"`
+	Response  string       `json:"accrual_response,omitempty"`
+	Reason    string       `json:"reason,omitempty"`
+	Attempt   int          `json:"attempt"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+type DeadLetterOrder struct {
+	Number         string    `json:"number"`
+	UserID         string    `json:"user_id"`
+	Status         string    `json:"status"`
+	UploadedAt     time.Time `json:"uploaded_at"`
+	Attempts       int       `json:"attempts"`
+	FailedAttempts int       `json:"failed_attempts"`
+	LastError      string    `json:"last_error,omitempty"`
+	Provider       string    `json:"provider,omitempty"`
 }
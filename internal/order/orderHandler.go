@@ -10,17 +10,32 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/go-chi/chi"
 	"go.uber.org/zap"
 )
 
+// MerchantHeader carries id of the merchant the order was made at, it is used for accrual provider routing.
+// The merchant signs the order number into MerchantSignatureHeader, the id isn't trusted without it.
+const (
+	MerchantHeader          = "X-Merchant-ID"
+	MerchantSignatureHeader = "X-Merchant-Signature"
+)
+
+// Router chooses accrual provider of a new order.
+type Router interface {
+	VerifyMerchant(number uint64, merchantID, signature string) bool
+	Route(number uint64, merchantID string) string
+}
+
 type handler struct {
 	db     db.Storage
 	secret string
+	router Router
 	logger *zap.SugaredLogger
 }
 
-func NewHandler(db db.Storage, secret string, logger *zap.SugaredLogger) *handler {
-	return &handler{db, secret, logger}
+func NewHandler(db db.Storage, secret string, router Router, logger *zap.SugaredLogger) *handler {
+	return &handler{db, secret, router, logger}
 }
 
 func (h *handler) PostOrder(w http.ResponseWriter, r *http.Request) {
@@ -51,7 +66,14 @@ func (h *handler) PostOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.db.SaveOrder(userID, order); err != nil {
+	merchantID := r.Header.Get(MerchantHeader)
+	if merchantID != "" && !h.router.VerifyMerchant(order, merchantID, r.Header.Get(MerchantSignatureHeader)) {
+		// 403 — магазин не подтвердил заказ
+		h.logger.Warnf("failed to PostOrder: merchant %q is not verified", merchantID)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err := h.db.SaveOrder(userID, order, merchantID, h.router.Route(order, merchantID)); err != nil {
 		if errors.Is(err, db.ErrDuplicateOrder) {
 			// 200 -  номер заказа уже был загружен этим пользователем;
 			h.logger.Warnf("failed to PostOrder: %w", err)
@@ -93,3 +115,33 @@ func (h *handler) GetOrders(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(apiOrders)
 	}
 }
+
+func (h *handler) GetOrderHistory(w http.ResponseWriter, r *http.Request) {
+	if UserID, isAuthed := utils.GetUserID(r, h.secret); !isAuthed {
+		// 401 — пользователь не авторизован.
+		h.logger.Warnf("failed to auth")
+		w.WriteHeader(http.StatusUnauthorized)
+	} else if number, err := strconv.ParseUint(chi.URLParam(r, "number"), 10, 64); err != nil {
+		// 400 — неверный формат номера заказа.
+		h.logger.Warnf("failed to GetOrderHistory: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if events, err := h.db.GetOrderHistory(UserID, number); err != nil {
+		if errors.Is(err, db.ErrOrderNotFound) {
+			// 404 — заказ не найден у пользователя.
+			h.logger.Warnf("failed to GetOrderHistory: %v", err)
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			// 500 — внутренняя ошибка сервера.
+			h.logger.Errorf("failed to GetOrderHistory: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		apiEvents := make([]api.OrderEvent, len(events))
+		for i := 0; i < len(events); i++ {
+			apiEvents[i] = events[i].ToAPI()
+		}
+		json.NewEncoder(w).Encode(apiEvents)
+	}
+}
@@ -2,9 +2,11 @@ package order
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"gophermart/internal/db"
+	"gophermart/internal/money"
 	"gophermart/internal/order/model"
 	"gophermart/internal/order/model/api"
 	"gophermart/internal/utils"
@@ -15,11 +17,17 @@ import (
 	"testing"
 	"time"
 
+	"github.com/go-chi/chi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"go.uber.org/zap"
 
 	accountModel "gophermart/internal/account/model/db"
+	adjustmentModel "gophermart/internal/adjustment/model/db"
+	campaignModel "gophermart/internal/campaign/model/db"
+	referralModel "gophermart/internal/referral/model/db"
+	statementModel "gophermart/internal/statement/model/db"
+	transferModel "gophermart/internal/transfer/model/db"
 	withdrawalsModel "gophermart/internal/withdrawals/model/db"
 )
 
@@ -27,7 +35,7 @@ type mockDBStorage struct {
 	mock.Mock
 }
 
-func (m *mockDBStorage) Register(login string, password string) (string, error) {
+func (m *mockDBStorage) Register(login, password, referralCode, ip string) (string, error) {
 	return "", nil
 }
 
@@ -35,8 +43,8 @@ func (m *mockDBStorage) GetByLoginPassword(login string, password string) (strin
 	return "", nil
 }
 
-func (m *mockDBStorage) SaveOrder(UserID string, number uint64) error {
-	args := m.Called(UserID, number)
+func (m *mockDBStorage) SaveOrder(UserID string, number uint64, merchantID, provider string) error {
+	args := m.Called(UserID, number, merchantID, provider)
 	return args.Error(0)
 }
 
@@ -45,28 +53,204 @@ func (m *mockDBStorage) GetOrders(UserID string) ([]model.Order, error) {
 	return args.Get(0).([]model.Order), args.Error(1)
 }
 
-func (m *mockDBStorage) GetAccount(UserID string) (*accountModel.Account, error) {
+func (m *mockDBStorage) GetAccount(UserID, currency string) (*accountModel.Account, error) {
 	return nil, nil
 }
-func (m *mockDBStorage) WithdrawFromAccount(UserID string, sum float64, number uint64) error {
+func (m *mockDBStorage) WithdrawFromAccount(UserID, currency string, sum money.Money, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) HoldWithdrawal(UserID, currency string, sum money.Money, number uint64, ttl time.Duration) error {
+	return nil
+}
+
+func (m *mockDBStorage) ConfirmWithdrawal(UserID string, number uint64) error {
 	return nil
 }
 
-func (m *mockDBStorage) GetWithdrawals(UserID string) ([]withdrawalsModel.Withdrawals, error) {
+func (m *mockDBStorage) CancelWithdrawal(UserID string, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) ExpireWithdrawals() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) ExpirePoints() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) RecalculateTiers() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) CreateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaigns() ([]campaignModel.Campaign, error) {
+	args := m.Called()
+	return args.Get(0).([]campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaign(ID int64) (*campaignModel.Campaign, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) UpdateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) DeleteCampaign(ID int64) error {
+	args := m.Called(ID)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) CreateAdjustment(login string, amount money.Money, reason, ticket, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(login, amount, reason, ticket, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) ApproveAdjustment(ID int64, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) RejectAdjustment(ID int64, actor, reason string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor, reason)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustments() ([]adjustmentModel.Adjustment, error) {
+	args := m.Called()
+	return args.Get(0).([]adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustment(ID int64) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetExpiringPoints(UserID, currency string, within time.Duration) ([]accountModel.ExpiringPoints, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) RefundWithdrawal(number uint64, sum money.Money, actor, reason string) (*withdrawalsModel.Withdrawals, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetWithdrawals(UserID, currency string) ([]withdrawalsModel.Withdrawals, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) TransferPoints(UserID, login string, sum money.Money) (*transferModel.Transfer, error) {
 	return nil, nil
 }
 
-func (m *mockDBStorage) CalcAmounts(offset, limit int,
+func (m *mockDBStorage) GetTransfers(UserID string) ([]transferModel.Transfer, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetReferrals(UserID string) (*referralModel.Referrals, error) {
+	args := m.Called(UserID)
+	return args.Get(0).(*referralModel.Referrals), args.Error(1)
+}
+
+func (m *mockDBStorage) GetStatement(UserID string, from, to *time.Time, offset, limit int) (*statementModel.Statement, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) ReserveIdempotencyKey(UserID, scope, key, requestHash string, ttl, lease time.Duration) (*db.IdempotentResponse, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) SaveIdempotentResponse(UserID, scope, key string, statusCode int, contentType string, body []byte) error {
+	return nil
+}
+
+func (m *mockDBStorage) ReleaseIdempotencyKey(UserID, scope, key string) error {
+	return nil
+}
+
+func (m *mockDBStorage) CalcAmounts(shard db.Shard, providers []string, offset, limit int,
 	updF func(nums []int64) map[int64]db.CalcAmountsUpdateResult) (int, error) {
 	return 0, nil
 }
 
+func (m *mockDBStorage) ApplyCalcResults(providers []string, updates map[int64]db.CalcAmountsUpdateResult) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) SaveCallbackSignature(signature string, ttl time.Duration) error {
+	args := m.Called(signature, ttl)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) TryAcquireLease(instanceID string, shard int) (*db.Lease, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetLeaders() ([]db.Leader, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) CheckLedger() ([]db.LedgerMismatch, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) Reconcile(save bool) (*db.ReconciliationReport, error) {
+	args := m.Called(save)
+	return args.Get(0).(*db.ReconciliationReport), args.Error(1)
+}
+
+func (m *mockDBStorage) Ping() error {
+	return nil
+}
+
+func (m *mockDBStorage) GetOrderHistory(UserID string, number uint64) ([]model.OrderEvent, error) {
+	args := m.Called(UserID, number)
+	return args.Get(0).([]model.OrderEvent), args.Error(1)
+}
+
+func (m *mockDBStorage) DeadLetterOrders(maxFailedAttempts int) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) GetDeadLetterOrders() ([]model.DeadLetterOrder, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) RetryDeadLetterOrder(number uint64, actor string) error {
+	return nil
+}
+
+func (m *mockDBStorage) ResolveDeadLetterOrder(number uint64, status model.OrderStatus, accrual money.Money, actor, reason string) error {
+	return nil
+}
+
 var logger = zap.NewExample().Sugar()
 
+// testRouter sends orders of merchants to "shop" provider, merchants are verified by "signed" signature.
+type testRouter struct{}
+
+func (testRouter) VerifyMerchant(number uint64, merchantID, signature string) bool {
+	return signature == "signed"
+}
+
+func (testRouter) Route(number uint64, merchantID string) string {
+	if merchantID != "" {
+		return "shop"
+	}
+	return "default"
+}
+
 func Test_handler_PostOrder(t *testing.T) {
 	defaultStorage := new(mockDBStorage)
 	defaultHandler := func() *handler {
-		return &handler{defaultStorage, utils.TestSecret, logger}
+		return &handler{defaultStorage, utils.TestSecret, testRouter{}, logger}
 	}
 	defaultBody := func(number uint64) string { return strconv.FormatUint(number, 10) }
 	var defaultNumber uint64 = 79927398713
@@ -76,6 +260,8 @@ func Test_handler_PostOrder(t *testing.T) {
 		code       int
 		token      string
 		number     uint64
+		merchant   string
+		signature  string
 		body       func(number uint64) string
 		getHandler func() *handler
 	}{
@@ -87,8 +273,8 @@ func Test_handler_PostOrder(t *testing.T) {
 			body:   defaultBody,
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
-				storage.On("SaveOrder", "1", defaultNumber).Return(db.ErrDuplicateOrder)
-				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
+				storage.On("SaveOrder", "1", defaultNumber, "", "default").Return(db.ErrDuplicateOrder)
+				return &handler{db: storage, secret: utils.TestSecret, router: testRouter{}, logger: logger}
 			},
 		},
 		{
@@ -99,8 +285,22 @@ func Test_handler_PostOrder(t *testing.T) {
 			body:   defaultBody,
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
-				storage.On("SaveOrder", "1", defaultNumber).Return(nil)
-				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
+				storage.On("SaveOrder", "1", defaultNumber, "", "default").Return(nil)
+				return &handler{db: storage, secret: utils.TestSecret, router: testRouter{}, logger: logger}
+			},
+		},
+		{
+			name:      "заказ магазина направлен его системе расчёта",
+			code:      202,
+			number:    defaultNumber,
+			token:     utils.TestToken,
+			merchant:  "shop-1",
+			signature: "signed",
+			body:      defaultBody,
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("SaveOrder", "1", defaultNumber, "shop-1", "shop").Return(nil)
+				return &handler{db: storage, secret: utils.TestSecret, router: testRouter{}, logger: logger}
 			},
 		},
 		{
@@ -119,6 +319,25 @@ func Test_handler_PostOrder(t *testing.T) {
 			body:       defaultBody,
 			getHandler: defaultHandler,
 		},
+		{
+			name:       "магазин не подписал заказ",
+			code:       403,
+			number:     defaultNumber,
+			token:      utils.TestToken,
+			merchant:   "shop-1",
+			body:       defaultBody,
+			getHandler: defaultHandler,
+		},
+		{
+			name:       "подпись другого магазина",
+			code:       403,
+			number:     defaultNumber,
+			token:      utils.TestToken,
+			merchant:   "shop-1",
+			signature:  "wrong",
+			body:       defaultBody,
+			getHandler: defaultHandler,
+		},
 		{
 			name:   "номер заказа уже был загружен другим пользователем",
 			code:   409,
@@ -127,8 +346,8 @@ func Test_handler_PostOrder(t *testing.T) {
 			body:   defaultBody,
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
-				storage.On("SaveOrder", "1", defaultNumber).Return(db.ErrOrderOfAnotherUser)
-				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
+				storage.On("SaveOrder", "1", defaultNumber, "", "default").Return(db.ErrOrderOfAnotherUser)
+				return &handler{db: storage, secret: utils.TestSecret, router: testRouter{}, logger: logger}
 			},
 		},
 		{
@@ -147,8 +366,8 @@ func Test_handler_PostOrder(t *testing.T) {
 			body:   defaultBody,
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
-				storage.On("SaveOrder", "1", defaultNumber).Return(errors.New("unexpected exception"))
-				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
+				storage.On("SaveOrder", "1", defaultNumber, "", "default").Return(errors.New("unexpected exception"))
+				return &handler{db: storage, secret: utils.TestSecret, router: testRouter{}, logger: logger}
 			},
 		},
 	}
@@ -156,6 +375,10 @@ func Test_handler_PostOrder(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			request := httptest.NewRequest(http.MethodPost, "/api/user/orders", bytes.NewReader([]byte(tt.body(tt.number))))
 			request.Header.Set("Content-Type", "text/plain")
+			if tt.merchant != "" {
+				request.Header.Set(MerchantHeader, tt.merchant)
+				request.Header.Set(MerchantSignatureHeader, tt.signature)
+			}
 			request.AddCookie(&http.Cookie{Name: "token", Value: tt.token})
 
 			w := httptest.NewRecorder()
@@ -171,7 +394,7 @@ func Test_handler_PostOrder(t *testing.T) {
 func Test_handler_GetOrders(t *testing.T) {
 	defaultStorage := new(mockDBStorage)
 	defaultHandler := func() *handler {
-		return &handler{defaultStorage, utils.TestSecret, logger}
+		return &handler{defaultStorage, utils.TestSecret, testRouter{}, logger}
 	}
 
 	tests := []struct {
@@ -188,7 +411,7 @@ func Test_handler_GetOrders(t *testing.T) {
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
 				result := make([]model.Order, 4)
-				result[0] = *model.NewOrder(9278923470, "1", model.Processed, 500.0)
+				result[0] = *model.NewOrder(9278923470, "1", model.Processed, money.MustParse("500"))
 				result[1] = *model.NewOrder(12345678903, "1", model.Processing, 0)
 				result[2] = *model.NewOrder(346436439, "1", model.Invalid, 0)
 				result[3] = *model.NewOrder(346436431, "1", model.New, 0)
@@ -197,15 +420,15 @@ func Test_handler_GetOrders(t *testing.T) {
 				}
 
 				storage.On("GetOrders", "1").Return(result, nil)
-				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
+				return &handler{db: storage, secret: utils.TestSecret, router: testRouter{}, logger: logger}
 			},
 			checkResponeBody: func(res *http.Response) {
 				uploadedAt, _ := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
 				expected := make([]api.Order, 4)
-				prcsAcc := 500.0
+				prcsAcc := money.MustParse("500")
 
 				expected[0] = api.Order{Number: "9278923470", UserID: "1", Status: "PROCESSED", UploadedAt: uploadedAt, Accrual: &prcsAcc}
-				expected[1] = api.Order{Number: "12345678903", UserID: "1", Status: "PROCESSING", UploadedAt: uploadedAt, Accrual: nil}
+				expected[1] = api.Order{Number: "12345678903", UserID: "1", Status: "PROCESSING", Progress: "PROCESSING", UploadedAt: uploadedAt, Accrual: nil}
 				expected[2] = api.Order{Number: "346436439", UserID: "1", Status: "INVALID", UploadedAt: uploadedAt, Accrual: nil}
 				expected[3] = api.Order{Number: "346436431", UserID: "1", Status: "NEW", UploadedAt: uploadedAt, Accrual: nil}
 
@@ -221,7 +444,7 @@ func Test_handler_GetOrders(t *testing.T) {
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
 				storage.On("GetOrders", "1").Return(make([]model.Order, 0), nil)
-				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
+				return &handler{db: storage, secret: utils.TestSecret, router: testRouter{}, logger: logger}
 			},
 			checkResponeBody: func(res *http.Response) {
 				var result []api.Order
@@ -242,7 +465,7 @@ func Test_handler_GetOrders(t *testing.T) {
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
 				storage.On("GetOrders", "1").Return([]model.Order{}, errors.New("unexpected exception"))
-				return &handler{db: storage, secret: utils.TestSecret, logger: logger}
+				return &handler{db: storage, secret: utils.TestSecret, router: testRouter{}, logger: logger}
 			},
 		},
 	}
@@ -264,3 +487,119 @@ func Test_handler_GetOrders(t *testing.T) {
 		})
 	}
 }
+
+func Test_handler_GetOrderHistory(t *testing.T) {
+	defaultStorage := new(mockDBStorage)
+	defaultHandler := func() *handler {
+		return &handler{defaultStorage, utils.TestSecret, testRouter{}, logger}
+	}
+	var defaultNumber uint64 = 79927398713
+
+	tests := []struct {
+		name             string
+		code             int
+		token            string
+		number           string
+		getHandler       func() *handler
+		checkResponeBody func(res *http.Response)
+	}{
+		{
+			name:   "успешная обработка запроса",
+			code:   200,
+			token:  utils.TestToken,
+			number: "79927398713",
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				createdAt, _ := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+				newStatus, registered, deadLetter := model.New, model.Registered, model.DeadLetter
+				response := `{"order":"79927398713","status":"PROCESSED","accrual":500}`
+				result := []model.OrderEvent{
+					{Number: defaultNumber, NewStatus: model.New, CreatedAt: createdAt},
+					{Number: defaultNumber, OldStatus: &newStatus, NewStatus: model.Registered, Attempt: 1, CreatedAt: createdAt},
+					{Number: defaultNumber, OldStatus: &registered, NewStatus: model.DeadLetter, Attempt: 2, CreatedAt: createdAt},
+					{Number: defaultNumber, OldStatus: &deadLetter, NewStatus: model.Processed, Accrual: 50000, Response: &response, Attempt: 3, CreatedAt: createdAt},
+				}
+				storage.On("GetOrderHistory", "1", defaultNumber).Return(result, nil)
+				return &handler{db: storage, secret: utils.TestSecret, router: testRouter{}, logger: logger}
+			},
+			checkResponeBody: func(res *http.Response) {
+				createdAt, _ := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+				accrual := money.MustParse("500")
+				expected := []api.OrderEvent{
+					{Number: "79927398713", Status: "NEW", CreatedAt: createdAt},
+					{Number: "79927398713", OldStatus: "NEW", Status: "PROCESSING", Progress: "REGISTERED", Attempt: 1, CreatedAt: createdAt},
+					{Number: "79927398713", OldStatus: "PROCESSING", Status: "PROCESSING", Attempt: 2, CreatedAt: createdAt},
+					{
+						Number:    "79927398713",
+						OldStatus: "PROCESSING",
+						Status:    "PROCESSED",
+						Accrual:   &accrual,
+						Response:  `{"order":"79927398713","status":"PROCESSED","accrual":500}`,
+						Attempt:   3,
+						CreatedAt: createdAt,
+					},
+				}
+
+				var result []api.OrderEvent
+				json.NewDecoder(res.Body).Decode(&result)
+				assert.Equal(t, expected, result, "wrong response")
+			},
+		},
+		{
+			name:       "неверный формат номера заказа",
+			code:       400,
+			token:      utils.TestToken,
+			number:     "abc",
+			getHandler: defaultHandler,
+		},
+		{
+			name:       "пользователь не аутентифицирован",
+			code:       401,
+			token:      "wrong token",
+			number:     "79927398713",
+			getHandler: defaultHandler,
+		},
+		{
+			name:   "заказ не найден",
+			code:   404,
+			token:  utils.TestToken,
+			number: "79927398713",
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("GetOrderHistory", "1", defaultNumber).Return([]model.OrderEvent{}, db.ErrOrderNotFound)
+				return &handler{db: storage, secret: utils.TestSecret, router: testRouter{}, logger: logger}
+			},
+		},
+		{
+			name:   "внутренняя ошибка сервера.",
+			code:   500,
+			token:  utils.TestToken,
+			number: "79927398713",
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("GetOrderHistory", "1", defaultNumber).Return([]model.OrderEvent{}, errors.New("unexpected exception"))
+				return &handler{db: storage, secret: utils.TestSecret, router: testRouter{}, logger: logger}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/user/orders/"+tt.number+"/history", nil)
+			request.AddCookie(&http.Cookie{Name: "token", Value: tt.token})
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("number", tt.number)
+			request = request.WithContext(context.WithValue(request.Context(), chi.RouteCtxKey, rctx))
+
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc(tt.getHandler().GetOrderHistory)
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+			if tt.checkResponeBody != nil {
+				tt.checkResponeBody(res)
+			}
+
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+		})
+	}
+}
@@ -0,0 +1,68 @@
+// Package partner serves requests of partner systems signed with the shared secret, see processing.Sign.
+package partner
+
+import (
+	"encoding/json"
+	"gophermart/internal/admin"
+	"gophermart/internal/db"
+	"gophermart/internal/money"
+	"gophermart/internal/processing"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+)
+
+// Actor is recorded as the author of partner refunds.
+const Actor = "partner"
+
+type handler struct {
+	db     db.Storage
+	secret string
+	logger *zap.SugaredLogger
+}
+
+func NewHandler(db db.Storage, secret string, logger *zap.SugaredLogger) *handler {
+	return &handler{db, secret, logger}
+}
+
+type refundData struct {
+	Sum    money.Money `json:"sum"`
+	Reason string      `json:"reason"`
+}
+
+// PostRefundWithdrawal refunds the withdrawal when the merchant order it paid for is cancelled.
+func (h *handler) PostRefundWithdrawal(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		h.logger.Warnf("failed to PostRefundWithdrawal: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !processing.IsValidSignature(body, r.Header.Get(processing.SignatureHeader), h.secret) {
+		// 401 — неверная подпись запроса.
+		h.logger.Warn("failed to PostRefundWithdrawal: bad signature")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var data refundData
+	if number, err := strconv.ParseUint(chi.URLParam(r, "number"), 10, 64); err != nil {
+		// 400 — неверный формат номера заказа.
+		h.logger.Warnf("failed to PostRefundWithdrawal: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if err := json.Unmarshal(body, &data); err != nil || data.Reason == "" || data.Sum < 0 {
+		// 400 — неверный формат запроса, причина обязательна.
+		h.logger.Warnf("failed to PostRefundWithdrawal: bad request %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if withdrawal, err := h.db.RefundWithdrawal(number, data.Sum, Actor, data.Reason); err != nil {
+		admin.WriteRefundErr(w, h.logger, err)
+	} else {
+		h.logger.Infof("partner refunded withdrawal %v: %v", number, data.Reason)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(withdrawal.ToAPI())
+	}
+}
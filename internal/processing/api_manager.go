@@ -1,119 +1,274 @@
 package processing
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"gophermart/internal/config"
 	"gophermart/internal/db"
+	"gophermart/internal/money"
 	"gophermart/internal/order/model"
-	"gophermart/internal/utils"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 )
 
+var (
+	// reconciliationRuns and reconciliationDiscrepancies count reconciliations done by this process and
+	// accounts found to differ in them, reconciliationLastDiscrepancies is the number found by the last one.
+	reconciliationRuns              = expvar.NewInt("reconciliation_runs")
+	reconciliationDiscrepancies     = expvar.NewInt("reconciliation_discrepancies")
+	reconciliationLastDiscrepancies = expvar.NewInt("reconciliation_last_discrepancies")
+)
+
+// apiManager polls one accrual provider.
 type apiManager struct {
-	client http.Client
-	host   string
-	db     db.Storage
-	logger *zap.SugaredLogger
-	cfg    *config.Config
+	client   http.Client
+	provider config.AccrualProvider
+	db       db.Storage
+	logger   *zap.SugaredLogger
+	cfg      *config.Config
+	statuses statusMapping
+	auth     outboundAuth
+	limiter  *limiter
+	// batch is 1 while batch lookup is enabled and supported by accrual system, shards are polled concurrently.
+	batch int32
+	// tiersRecalculatedAt is the time of the last loyalty tiers recalculation by the first shard leader.
+	tiersRecalculatedAt time.Time
+	// reconciledOn is the UTC date of the last balance reconciliation by the first shard leader.
+	reconciledOn string
 }
 
-type response struct {
-	Order   string  `json:"order"`
-	Status  string  `json:"status"`
-	Accrual float64 `json:"accrual"`
+func newAPIManager(client http.Client, provider config.AccrualProvider, db db.Storage, logger *zap.SugaredLogger, cfg *config.Config) (*apiManager, error) {
+	auth, err := newOutboundAuth(provider.AccrualAuth, &client)
+	if err != nil {
+		return nil, fmt.Errorf("accrual provider %v: %w", provider.Name, err)
+	}
+	m := &apiManager{
+		client:   client,
+		provider: provider,
+		db:       db,
+		logger:   logger,
+		cfg:      cfg,
+		statuses: providerStatuses(cfg, provider),
+		auth:     auth,
+		limiter:  newLimiter(provider.RateLimit),
+	}
+	if provider.Batch {
+		m.batch = 1
+	}
+	return m, nil
 }
 
-const url = "%v/api/orders/%v"
+// providers are names of orders to poll.
+func (m *apiManager) providers() []string {
+	return orderProviders(m.cfg, m.provider.Name)
+}
 
-type ProcessResult int
+// providerStatuses is the status mapping of the provider, its statuses override ACCRUAL_STATUS_MAPPING.
+func providerStatuses(cfg *config.Config, provider config.AccrualProvider) statusMapping {
+	statuses := make(map[string]string, len(cfg.AccrualStatuses)+len(provider.Statuses))
+	for k, v := range cfg.AccrualStatuses {
+		statuses[k] = v
+	}
+	for k, v := range provider.Statuses {
+		statuses[k] = v
+	}
+	return newStatusMapping(statuses)
+}
+
+// orderProviders are provider names stored on orders of the provider, orders without provider belong to the
+// default one.
+func orderProviders(cfg *config.Config, provider string) []string {
+	if provider == cfg.DefaultAccrualProvider {
+		return []string{provider, ""}
+	}
+	return []string{provider}
+}
+
+func (m *apiManager) do(r *http.Request, body []byte) (*http.Response, error) {
+	m.auth.authenticate(r, body)
+	m.limiter.wait()
+	return m.client.Do(r)
+}
+
+type response struct {
+	Order   string      `json:"order"`
+	Status  string      `json:"status"`
+	Accrual money.Money `json:"accrual"`
+}
 
 const (
-	InProgress = iota
-	Completed
-	Failed
-	Undefined
+	url      = "%v/api/orders/%v"
+	batchURL = "%v/api/orders/batch"
 )
 
-const (
-	Registered = "REGISTERED"
-	Processing = "PROCESSING"
-	Invalid    = "INVALID"
-	Processed  = "PROCESSED"
+var (
+	errRateLimited      = errors.New("accrual system rate limit exceeded")
+	errBatchUnsupported = errors.New("accrual system does not support batch lookup")
 )
 
-func getResult(status string) (ProcessResult, error) {
-	switch status {
-	case Registered, Processing:
-		return InProgress, nil
-	case Invalid:
-		return Failed, nil
-	case Processed:
-		return Completed, nil
-	default:
-		return Undefined, errors.New("undefined status")
+// getCalc also returns raw accrual system response, it is kept in the order history.
+func (m *apiManager) getCalc(number int64) (money.Money, model.OrderStatus, string, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(url, m.provider.URL, number), nil)
+	if err != nil {
+		return 0, model.Processing, "", err
 	}
-}
-
-func (m *apiManager) getCalc(number int64) (float64, ProcessResult, error) {
-	if r, err := m.client.Get(fmt.Sprintf(url, m.host, number)); err != nil {
-		return 0, Undefined, err
+	if r, err := m.do(req, nil); err != nil {
+		return 0, model.Processing, "", err
 	} else {
 		defer r.Body.Close()
 		switch r.StatusCode {
 		case 200:
 			body, err := ioutil.ReadAll(r.Body)
 			if err != nil {
-				return 0, Undefined, err
+				return 0, model.Processing, "", err
 			}
 			res := &response{}
-			json.Unmarshal(body, &res)
-			result, err := getResult(res.Status)
-			return res.Accrual, result, err
-			//429, 500
+			if err := json.Unmarshal(body, res); err != nil {
+				return 0, model.Processing, string(body), fmt.Errorf("malformed accrual system response: %w", err)
+			}
+			status, err := m.statuses.get(res.Status)
+			return res.Accrual, status, string(body), err
+		case 204:
+			return 0, model.Unregistered, r.Status, nil
+		case 429:
+			return 0, model.Processing, r.Status, errRateLimited
 		default:
-			return 0, InProgress, nil
+			return 0, model.Processing, r.Status, fmt.Errorf("accrual system responded %v", r.Status)
 		}
 	}
 }
 
-func mapResultOnStatus(r ProcessResult) model.OrderStatus {
-	switch r {
-	case Completed:
-		return model.Processed
-	case Failed:
-		return model.Invalid
+// getCalcs looks up all nums with one request, orders missing in the response are not registered yet
+// unless the response has malformed items, then the lookup of the missing orders is failed.
+func (m *apiManager) getCalcs(nums []int64) (map[int64]db.CalcAmountsUpdateResult, string, error) {
+	numbers := make([]string, len(nums))
+	for i, n := range nums {
+		numbers[i] = strconv.FormatInt(n, 10)
+	}
+	body, err := json.Marshal(numbers)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf(batchURL, m.provider.URL), bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	r, err := m.do(req, body)
+	if err != nil {
+		return nil, "", err
+	}
+	defer r.Body.Close()
+	switch r.StatusCode {
+	case 200:
+	case 404, 405, 501:
+		return nil, r.Status, errBatchUnsupported
+	case 429:
+		return nil, r.Status, errRateLimited
 	default:
-		return model.Processing
+		return nil, r.Status, fmt.Errorf("accrual system responded %v", r.Status)
+	}
+
+	var raws []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raws); err != nil {
+		return nil, "", err
 	}
+	result := make(map[int64]db.CalcAmountsUpdateResult, len(nums))
+	var malformed db.CalcAmountsUpdateResult
+	for _, raw := range raws {
+		res := &response{}
+		if err := json.Unmarshal(raw, res); err != nil {
+			m.logger.Warnf("malformed item %s in batch response: %v", raw, err)
+			malformed = db.CalcAmountsUpdateResult{Response: string(raw), Error: fmt.Sprintf("malformed accrual system response: %v", err)}
+			continue
+		}
+		number, err := strconv.ParseInt(res.Order, 10, 64)
+		if err != nil {
+			m.logger.Warnf("unexpected order %q in batch response", res.Order)
+			malformed = db.CalcAmountsUpdateResult{Response: string(raw), Error: fmt.Sprintf("unexpected order %q in accrual system response", res.Order)}
+			continue
+		}
+		if status, err := m.statuses.get(res.Status); err != nil {
+			result[number] = db.CalcAmountsUpdateResult{Response: string(raw), Error: err.Error()}
+		} else {
+			result[number] = db.CalcAmountsUpdateResult{Accrual: res.Accrual, Status: status, Response: string(raw)}
+		}
+	}
+	for _, n := range nums {
+		if _, ok := result[n]; !ok && malformed.Error != "" {
+			result[n] = malformed
+		} else if !ok {
+			result[n] = db.CalcAmountsUpdateResult{Status: model.Unregistered}
+		}
+	}
+	return result, "", nil
 }
 
+// updF skips rate limited lookups, they are neither a result nor a failure of the order.
 func (m *apiManager) updF(nums []int64) map[int64]db.CalcAmountsUpdateResult {
+	if atomic.LoadInt32(&m.batch) == 1 {
+		result, raw, err := m.getCalcs(nums)
+		switch {
+		case err == nil:
+			return result
+		case errors.Is(err, errBatchUnsupported):
+			m.logger.Warnf("provider %v: %v (%v), falling back to per order lookups", m.provider.Name, err, raw)
+			atomic.StoreInt32(&m.batch, 0)
+		case errors.Is(err, errRateLimited):
+			m.logger.Warnf("update orders %v skipped: %v", nums, err)
+			return map[int64]db.CalcAmountsUpdateResult{}
+		default:
+			m.logger.Errorf("update orders %v failed: %v", nums, err)
+			result := make(map[int64]db.CalcAmountsUpdateResult, len(nums))
+			for _, n := range nums {
+				result[n] = db.CalcAmountsUpdateResult{Response: raw, Error: err.Error()}
+			}
+			return result
+		}
+	}
+
 	result := make(map[int64]db.CalcAmountsUpdateResult)
 	for i := 0; i < len(nums); i++ {
-		if accrual, respResult, err := m.getCalc(nums[i]); err != nil {
-			m.logger.Errorf("update order by number %v failed: %w", nums[i], err)
+		if accrual, status, raw, err := m.getCalc(nums[i]); errors.Is(err, errRateLimited) {
+			m.logger.Warnf("update order by number %v skipped: %v", nums[i], err)
+		} else if err != nil {
+			m.logger.Errorf("update order by number %v failed: %v", nums[i], err)
+			result[nums[i]] = db.CalcAmountsUpdateResult{Response: raw, Error: err.Error()}
 		} else {
-			result[nums[i]] = db.CalcAmountsUpdateResult{Accrual: utils.GetPersistentAccrual(accrual), Status: mapResultOnStatus(respResult)}
+			result[nums[i]] = db.CalcAmountsUpdateResult{Accrual: accrual, Status: status, Response: raw}
 		}
 	}
 	return result
 }
 
-func (m *apiManager) runCollectСalcs() {
+// runCollectСalcs polls orders of the shard batch by batch while the lease of the shard is held, results of a batch
+// polled after the lease is lost are dropped, the orders are polled again by the next leader.
+func (m *apiManager) runCollectСalcs(shard db.Shard, held func() bool) {
 	offset := 0
+	updF := func(nums []int64) map[int64]db.CalcAmountsUpdateResult {
+		result := m.updF(nums)
+		if !held() {
+			m.logger.Warnf("lease of shard %v is lost, %v results of provider %v are dropped", shard.Index, len(result), m.provider.Name)
+			return nil
+		}
+		return result
+	}
 
-	for {
-		selectedCount, err := m.db.CalcAmounts(offset, m.cfg.OrdersUpdateCountInPar, m.updF)
+	for held() {
+		selectedCount, err := m.db.CalcAmounts(shard, m.providers(), offset, m.cfg.OrdersUpdateCountInPar, updF)
 		if err != nil {
-			m.logger.Errorf("error on runCollectСalcs: %w", err)
+			m.logger.Errorf("error on runCollectСalcs of provider %v: %v", m.provider.Name, err)
 			return
 		}
 		if selectedCount < m.cfg.OrdersUpdateCountInPar {
@@ -124,31 +279,168 @@ func (m *apiManager) runCollectСalcs() {
 	}
 }
 
+// managers poll all providers, each shard leader polls orders of the shard from every provider.
+type managers []*apiManager
+
+// deadLetter stops polling of orders that failed too many times, it is done by the first shard leader only.
+func (ms managers) deadLetter(shard db.Shard) {
+	m := ms[0]
+	if m.cfg.MaxFailedAttempts <= 0 || shard.Index != 0 {
+		return
+	}
+	if moved, err := m.db.DeadLetterOrders(m.cfg.MaxFailedAttempts); err != nil {
+		m.logger.Errorf("error on deadLetter: %v", err)
+	} else if moved > 0 {
+		m.logger.Warnf("%v orders moved to dead letter after %v failed attempts", moved, m.cfg.MaxFailedAttempts)
+	}
+}
+
+// expireHolds cancels pending withdrawals not confirmed in time, it is done by the first shard leader only.
+func (ms managers) expireHolds(shard db.Shard) {
+	m := ms[0]
+	if shard.Index != 0 {
+		return
+	}
+	if expired, err := m.db.ExpireWithdrawals(); err != nil {
+		m.logger.Errorf("error on expireHolds: %v", err)
+	} else if expired > 0 {
+		m.logger.Infof("%v pending withdrawals expired", expired)
+	}
+}
+
+// expirePoints debits expired points, it is done by the first shard leader only.
+func (ms managers) expirePoints(shard db.Shard) {
+	m := ms[0]
+	if shard.Index != 0 {
+		return
+	}
+	if expired, err := m.db.ExpirePoints(); err != nil {
+		m.logger.Errorf("error on expirePoints: %v", err)
+	} else if expired > 0 {
+		m.logger.Infof("%v point lots expired", expired)
+	}
+}
+
+// recalculateTiers updates loyalty tiers of users once in LoyaltyTierRecalcInterval, it is done by the first
+// shard leader only.
+func (ms managers) recalculateTiers(shard db.Shard) {
+	m := ms[0]
+	if shard.Index != 0 || m.cfg.LoyaltyTiers == "" || time.Since(m.tiersRecalculatedAt) < m.cfg.LoyaltyTierRecalcInterval {
+		return
+	}
+	m.tiersRecalculatedAt = time.Now()
+	if updated, err := m.db.RecalculateTiers(); err != nil {
+		m.logger.Errorf("error on recalculateTiers: %v", err)
+	} else if updated > 0 {
+		m.logger.Infof("loyalty tiers of %v users changed", updated)
+	}
+}
+
+// reconcile compares balances with the ones recomputed from orders and withdrawals once a day at
+// ReconciliationHour, it is done by the first shard leader only, see runReconcile.
+func (ms managers) reconcile(shard db.Shard) {
+	m := ms[0]
+	now := time.Now().UTC()
+	today := now.Format("2006-01-02")
+	if shard.Index != 0 || m.cfg.ReconciliationHour < 0 || now.Hour() != m.cfg.ReconciliationHour || m.reconciledOn == today {
+		return
+	}
+	m.reconciledOn = today
+	report, err := m.db.Reconcile(m.cfg.ReconciliationReport)
+	if err != nil {
+		m.logger.Errorf("error on reconcile: %v", err)
+		return
+	}
+	reconciliationRuns.Add(1)
+	reconciliationDiscrepancies.Add(int64(len(report.Discrepancies)))
+	reconciliationLastDiscrepancies.Set(int64(len(report.Discrepancies)))
+	for _, d := range report.Discrepancies {
+		m.logger.Warnw("account differs from recomputed balances", "user_id", d.UserID,
+			"current", d.Current, "expected_current", d.ExpectedCurrent,
+			"withdrawn", d.Withdrawn, "expected_withdrawn", d.ExpectedWithdrawn,
+			"held", d.Held, "expected_held", d.ExpectedHeld, "backfilled", d.Backfilled)
+	}
+	if len(report.Discrepancies) > 0 {
+		m.logger.Errorf("%v of %v accounts differ from recomputed balances, report %v", len(report.Discrepancies), report.Accounts, report.ID)
+	} else {
+		m.logger.Infof("%v accounts are reconciled", report.Accounts)
+	}
+}
+
+// runReconcile checks every minute whether balances are due to be reconciled, it runs beside the polling of the
+// first shard, so a long reconciliation doesn't stall it. The reconciliation is read only, so it isn't waited for
+// when the shard work stops.
+func (ms managers) runReconcile(ctx context.Context, shard db.Shard, held func() bool) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if held() {
+				ms.reconcile(shard)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runShard polls the shard until ctx is done, the elector cancels it after the lease is lost, meanwhile writes are
+// skipped once held reports the loss.
+func (ms managers) runShard(ctx context.Context, shard db.Shard, held func() bool) {
+	if shard.Index == 0 {
+		go ms.runReconcile(ctx, shard, held)
+	}
+
+	ticker := time.NewTicker(time.Second * 1)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ms[0].logger.Infof("run update orders of shard %v...", shard.Index)
+			for _, m := range ms {
+				m.runCollectСalcs(shard, held)
+			}
+			if !held() {
+				ms[0].logger.Warnf("lease of shard %v is lost, waiting for the elector to step down", shard.Index)
+				continue
+			}
+			ms.deadLetter(shard)
+			ms.expireHolds(shard)
+			ms.expirePoints(shard)
+			ms.recalculateTiers(shard)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 var once sync.Once
 
+// RunDaemon polls accrual providers for the shards whose lease this instance holds,
+// it fails when outbound auth of a provider can't be set up.
 func RunDaemon(
 	client http.Client,
-	host string, db db.Storage,
+	db db.Storage,
 	logger *zap.SugaredLogger,
 	ctx context.Context,
 	wg *sync.WaitGroup,
-	cfg *config.Config) {
-	go once.Do(func() {
-		wg.Add(1)
-		defer wg.Done()
-
-		ticker := time.NewTicker(time.Second * 1)
-		m := &apiManager{client, host, db, logger, cfg}
-		for {
-			select {
-			case <-ticker.C:
-				logger.Infof("run update orders...")
-				m.runCollectСalcs()
-
-			case <-ctx.Done():
-				ticker.Stop()
+	cfg *config.Config) error {
+	var err error
+	once.Do(func() {
+		ms := make(managers, len(cfg.AccrualProviders))
+		for i, provider := range cfg.AccrualProviders {
+			if ms[i], err = newAPIManager(client, provider, db, logger, cfg); err != nil {
 				return
 			}
 		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			newElector(db, logger, cfg, ms.runShard).run(ctx)
+		}()
 	})
+	return err
 }
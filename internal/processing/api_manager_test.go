@@ -0,0 +1,314 @@
+package processing
+
+import (
+	"gophermart/internal/accrualsim"
+	"gophermart/internal/config"
+	"gophermart/internal/db"
+	"gophermart/internal/money"
+	"gophermart/internal/order/model"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+var logger = zap.NewExample().Sugar()
+
+func newTestAPIManager(t *testing.T, provider config.AccrualProvider, cfg *config.Config) *apiManager {
+	m, err := newAPIManager(http.Client{}, provider, nil, logger, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func newSimManager(t *testing.T, cfg accrualsim.Config) (*apiManager, func()) {
+	return newSimBatchManager(t, cfg, false)
+}
+
+func newSimBatchManager(t *testing.T, cfg accrualsim.Config, batch bool) (*apiManager, func()) {
+	if cfg.Rules == nil {
+		cfg.Rules = accrualsim.DefaultRules
+	}
+	if cfg.OrderAmount == 0 {
+		cfg.OrderAmount = 1000
+	}
+	sim, err := accrualsim.NewServer(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(sim.Handler())
+	m := newTestAPIManager(t, config.AccrualProvider{Name: "default", URL: srv.URL, Batch: batch}, &config.Config{OrdersUpdateCountInPar: 10})
+	return m, srv.Close
+}
+
+func Test_apiManager_getCalc(t *testing.T) {
+	type result struct {
+		accrual money.Money
+		status  model.OrderStatus
+	}
+	tests := []struct {
+		name     string
+		cfg      accrualsim.Config
+		number   int64
+		expected []result
+	}{
+		{
+			name:   "заказ проходит статусы до PROCESSED",
+			cfg:    accrualsim.Config{RegisteredPolls: 1, ProcessingPolls: 1},
+			number: 79927398713,
+			expected: []result{
+				{0, model.Registered},
+				{0, model.Processing},
+				{10000, model.Processed},
+				{10000, model.Processed},
+			},
+		},
+		{
+			name:     "начисление фиксированными баллами по шаблону номера",
+			cfg:      accrualsim.Config{Rules: []accrualsim.Rule{{Match: "^7992", Reward: 42.5, RewardType: accrualsim.RewardPoints}}},
+			number:   79927398713,
+			expected: []result{{4250, model.Processed}},
+		},
+		{
+			name:     "номер не подходит ни под одно правило",
+			cfg:      accrualsim.Config{Rules: []accrualsim.Rule{{Match: "^1", Reward: 5, RewardType: accrualsim.RewardPercent}}},
+			number:   79927398713,
+			expected: []result{{0, model.Invalid}},
+		},
+		{
+			name:     "неверный номер заказа",
+			cfg:      accrualsim.Config{},
+			number:   79927398714,
+			expected: []result{{0, model.Invalid}},
+		},
+		{
+			name:     "заказ не зарегистрирован",
+			cfg:      accrualsim.Config{UnregisteredRate: 1},
+			number:   79927398713,
+			expected: []result{{0, model.Unregistered}, {0, model.Unregistered}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, stop := newSimManager(t, tt.cfg)
+			defer stop()
+
+			for i, exp := range tt.expected {
+				accrual, res, _, err := m.getCalc(tt.number)
+				assert.NoError(t, err)
+				assert.Equal(t, exp, result{accrual, res}, "poll %v", i+1)
+			}
+		})
+	}
+}
+
+func Test_apiManager_getCalc_internalError(t *testing.T) {
+	m, stop := newSimManager(t, accrualsim.Config{InternalErrRate: 1})
+	defer stop()
+
+	_, res, raw, err := m.getCalc(79927398713)
+	assert.Error(t, err)
+	assert.Equal(t, model.Processing, res)
+	assert.Equal(t, "500 Internal Server Error", raw)
+}
+
+func Test_apiManager_getCalc_rateLimited(t *testing.T) {
+	m, stop := newSimManager(t, accrualsim.Config{TooManyRate: 1})
+	defer stop()
+
+	_, _, _, err := m.getCalc(79927398713)
+	assert.ErrorIs(t, err, errRateLimited)
+	assert.Empty(t, m.updF([]int64{79927398713}))
+}
+
+func Test_apiManager_getCalc_statuses(t *testing.T) {
+	tests := []struct {
+		name     string
+		mapping  map[string]string
+		code     int
+		body     string
+		expected model.OrderStatus
+		wantErr  bool
+	}{
+		{
+			name:     "заказ не зарегистрирован в системе расчёта",
+			code:     http.StatusNoContent,
+			expected: model.Unregistered,
+		},
+		{
+			name:    "неизвестный статус",
+			code:    http.StatusOK,
+			body:    `{"order":"79927398713","status":"ACCEPTED"}`,
+			wantErr: true,
+		},
+		{
+			name:    "некорректный ответ",
+			code:    http.StatusOK,
+			body:    `{"order":"79927398713","status":1,"accrual":100}`,
+			wantErr: true,
+		},
+		{
+			name:     "статус из настроек",
+			mapping:  map[string]string{"ACCEPTED": "REGISTERED"},
+			code:     http.StatusOK,
+			body:     `{"order":"79927398713","status":"ACCEPTED"}`,
+			expected: model.Registered,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.code)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			m := newTestAPIManager(t, config.AccrualProvider{URL: srv.URL}, &config.Config{AccrualStatuses: tt.mapping})
+
+			_, status, _, err := m.getCalc(79927398713)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expected, status)
+			}
+		})
+	}
+}
+
+func Test_apiManager_updF(t *testing.T) {
+	m, stop := newSimManager(t, accrualsim.Config{})
+	defer stop()
+
+	expected := map[int64]db.CalcAmountsUpdateResult{
+		79927398713: {Accrual: 10000, Status: model.Processed, Response: `{"order":"79927398713","status":"PROCESSED","accrual":100}` + "\n"},
+		79927398714: {Accrual: 0, Status: model.Invalid, Response: `{"order":"79927398714","status":"INVALID"}` + "\n"},
+	}
+	assert.Equal(t, expected, m.updF([]int64{79927398713, 79927398714}))
+}
+
+func Test_apiManager_updF_failedLookup(t *testing.T) {
+	m, stop := newSimManager(t, accrualsim.Config{InternalErrRate: 1})
+	defer stop()
+
+	expected := map[int64]db.CalcAmountsUpdateResult{
+		79927398713: {Response: "500 Internal Server Error", Error: "accrual system responded 500 Internal Server Error"},
+	}
+	assert.Equal(t, expected, m.updF([]int64{79927398713}))
+}
+
+func Test_apiManager_updF_batch(t *testing.T) {
+	processed := map[int64]db.CalcAmountsUpdateResult{
+		79927398713: {Accrual: 10000, Status: model.Processed, Response: `{"order":"79927398713","status":"PROCESSED","accrual":100}`},
+		79927398714: {Accrual: 0, Status: model.Invalid, Response: `{"order":"79927398714","status":"INVALID"}`},
+	}
+	tests := []struct {
+		name      string
+		cfg       accrualsim.Config
+		expected  map[int64]db.CalcAmountsUpdateResult
+		wantBatch int32
+	}{
+		{
+			name:      "пакетный запрос",
+			cfg:       accrualsim.Config{},
+			expected:  processed,
+			wantBatch: 1,
+		},
+		{
+			name: "система расчёта не поддерживает пакетный запрос",
+			cfg:  accrualsim.Config{BatchDisabled: true},
+			expected: map[int64]db.CalcAmountsUpdateResult{
+				79927398713: {Accrual: 10000, Status: model.Processed, Response: processed[79927398713].Response + "\n"},
+				79927398714: {Accrual: 0, Status: model.Invalid, Response: processed[79927398714].Response + "\n"},
+			},
+			wantBatch: 0,
+		},
+		{
+			name: "заказы не зарегистрированы",
+			cfg:  accrualsim.Config{UnregisteredRate: 1},
+			expected: map[int64]db.CalcAmountsUpdateResult{
+				79927398713: {Status: model.Unregistered},
+				79927398714: {Status: model.Unregistered},
+			},
+			wantBatch: 1,
+		},
+		{
+			name:      "превышено количество запросов",
+			cfg:       accrualsim.Config{TooManyRate: 1},
+			expected:  map[int64]db.CalcAmountsUpdateResult{},
+			wantBatch: 1,
+		},
+		{
+			name: "внутренняя ошибка системы расчёта",
+			cfg:  accrualsim.Config{InternalErrRate: 1},
+			expected: map[int64]db.CalcAmountsUpdateResult{
+				79927398713: {Response: "500 Internal Server Error", Error: "accrual system responded 500 Internal Server Error"},
+				79927398714: {Response: "500 Internal Server Error", Error: "accrual system responded 500 Internal Server Error"},
+			},
+			wantBatch: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, stop := newSimBatchManager(t, tt.cfg, true)
+			defer stop()
+
+			assert.Equal(t, tt.expected, m.updF([]int64{79927398713, 79927398714}))
+			assert.Equal(t, tt.wantBatch, m.batch)
+		})
+	}
+}
+
+func Test_apiManager_getCalcs_unregistered(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`[{"order":"79927398713","status":"REGISTERED"}]`))
+	}))
+	defer srv.Close()
+	m := newTestAPIManager(t, config.AccrualProvider{URL: srv.URL, Batch: true}, &config.Config{})
+
+	expected := map[int64]db.CalcAmountsUpdateResult{
+		79927398713: {Status: model.Registered, Response: `{"order":"79927398713","status":"REGISTERED"}`},
+		12345678903: {Status: model.Unregistered},
+	}
+	assert.Equal(t, expected, m.updF([]int64{79927398713, 12345678903}))
+}
+
+func Test_apiManager_getCalcs_malformed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`[{"order":"79927398713","status":"REGISTERED"},{"order":"12345678903","status":1,"accrual":100}]`))
+	}))
+	defer srv.Close()
+	m := newTestAPIManager(t, config.AccrualProvider{URL: srv.URL, Batch: true}, &config.Config{})
+
+	result := m.updF([]int64{79927398713, 12345678903})
+	assert.Equal(t, db.CalcAmountsUpdateResult{Status: model.Registered, Response: `{"order":"79927398713","status":"REGISTERED"}`}, result[79927398713])
+	assert.Equal(t, `{"order":"12345678903","status":1,"accrual":100}`, result[12345678903].Response)
+	assert.NotEmpty(t, result[12345678903].Error)
+}
+
+func Test_apiManager_getCalc_provider(t *testing.T) {
+	var apiKey string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey = r.Header.Get(APIKeyHeader)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"order":"79927398713","status":"CALCULATING"}`))
+	}))
+	defer srv.Close()
+	provider := config.AccrualProvider{
+		Name:        "partner",
+		URL:         srv.URL,
+		AccrualAuth: config.AccrualAuth{APIKey: "partner-key"},
+		Statuses:    map[string]string{"CALCULATING": "PROCESSING"},
+	}
+	m := newTestAPIManager(t, provider, &config.Config{DefaultAccrualProvider: "default"})
+
+	_, status, _, err := m.getCalc(79927398713)
+	assert.NoError(t, err)
+	assert.Equal(t, model.Processing, status)
+	assert.Equal(t, "partner-key", apiKey)
+	assert.Equal(t, []string{"partner"}, m.providers())
+}
@@ -0,0 +1,106 @@
+package processing
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"gophermart/internal/config"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// APIKeyHeader carries api key of the provider unless api_key_header is set.
+	APIKeyHeader = "X-Api-Key"
+	// TimestampHeader carries unix time the outbound request was signed at.
+	TimestampHeader = "X-Timestamp"
+)
+
+// outboundAuth authenticates requests to an accrual provider.
+type outboundAuth interface {
+	authenticate(r *http.Request, body []byte)
+}
+
+type noAuth struct{}
+
+func (noAuth) authenticate(r *http.Request, body []byte) {}
+
+type apiKeyAuth struct {
+	header string
+	key    string
+}
+
+func (a apiKeyAuth) authenticate(r *http.Request, body []byte) {
+	r.Header.Set(a.header, a.key)
+}
+
+// hmacAuth signs method, path with query, timestamp and body joined by new lines, see Sign.
+type hmacAuth struct {
+	secret string
+	now    func() time.Time
+}
+
+func (a hmacAuth) authenticate(r *http.Request, body []byte) {
+	timestamp := strconv.FormatInt(a.now().Unix(), 10)
+	r.Header.Set(TimestampHeader, timestamp)
+	r.Header.Set(SignatureHeader, Sign(signedPayload(r.Method, r.URL.RequestURI(), timestamp, body), a.secret))
+}
+
+func signedPayload(method, uri, timestamp string, body []byte) []byte {
+	payload := []byte(method + "\n" + uri + "\n" + timestamp + "\n")
+	return append(payload, body...)
+}
+
+// newOutboundAuth returns request authentication of the provider, the client gets TLS config
+// with the client certificate for mtls and with the CA bundle when it is set.
+func newOutboundAuth(auth config.AccrualAuth, client *http.Client) (outboundAuth, error) {
+	if auth.CAFile != "" || auth.Strategy() == config.AuthMTLS {
+		tlsConfig, err := newTLSConfig(auth)
+		if err != nil {
+			return nil, err
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		client.Transport = transport
+	}
+
+	switch auth.Strategy() {
+	case config.AuthNone, config.AuthMTLS:
+		return noAuth{}, nil
+	case config.AuthAPIKey:
+		header := auth.APIKeyHeader
+		if header == "" {
+			header = APIKeyHeader
+		}
+		return apiKeyAuth{header, auth.APIKey}, nil
+	case config.AuthHMAC:
+		return hmacAuth{auth.HMACSecret, time.Now}, nil
+	}
+	return nil, fmt.Errorf("unknown auth type %q", auth.AuthType)
+}
+
+func newTLSConfig(auth config.AccrualAuth) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if auth.CAFile != "" {
+		pem, err := os.ReadFile(auth.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + auth.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if auth.Strategy() == config.AuthMTLS {
+		cert, err := tls.LoadX509KeyPair(auth.CertFile, auth.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
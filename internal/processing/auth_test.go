@@ -0,0 +1,179 @@
+package processing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"gophermart/internal/config"
+	"gophermart/internal/money"
+	"gophermart/internal/order/model"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testOrderResponse = `{"order":"79927398713","status":"PROCESSED","accrual":100}`
+
+// writeClientCert writes self signed client certificate and its key to dir.
+func writeClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gophermart"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return cert, certFile, keyFile
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newMTLSServer is an accrual system stand-in accepting only clientCert.
+func newMTLSServer(t *testing.T, clientCert *x509.Certificate) (*httptest.Server, string) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(testOrderResponse))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", srv.Certificate().Raw)
+	return srv, caFile
+}
+
+func Test_apiManager_getCalc_mtls(t *testing.T) {
+	clientCert, certFile, keyFile := writeClientCert(t, t.TempDir())
+	srv, caFile := newMTLSServer(t, clientCert)
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		auth    config.AccrualAuth
+		wantErr bool
+	}{
+		{
+			name: "клиентский сертификат",
+			auth: config.AccrualAuth{AuthType: config.AuthMTLS, CertFile: certFile, KeyFile: keyFile, CAFile: caFile},
+		},
+		{
+			name:    "без клиентского сертификата",
+			auth:    config.AccrualAuth{CAFile: caFile},
+			wantErr: true,
+		},
+		{
+			name:    "сертификат системы расчёта не проверен",
+			auth:    config.AccrualAuth{AuthType: config.AuthMTLS, CertFile: certFile, KeyFile: keyFile},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestAPIManager(t, config.AccrualProvider{URL: srv.URL, AccrualAuth: tt.auth}, &config.Config{})
+
+			accrual, status, _, err := m.getCalc(79927398713)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, model.Processed, status)
+			assert.Equal(t, money.Money(10000), accrual)
+		})
+	}
+}
+
+func Test_newOutboundAuth_badFiles(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, auth := range []config.AccrualAuth{
+		{CAFile: filepath.Join(dir, "missing.pem")},
+		{CAFile: notPEM},
+		{AuthType: config.AuthMTLS, CertFile: filepath.Join(dir, "client.crt"), KeyFile: filepath.Join(dir, "client.key")},
+	} {
+		_, err := newOutboundAuth(auth, &http.Client{})
+		assert.Error(t, err)
+	}
+}
+
+func Test_outboundAuth_headers(t *testing.T) {
+	var request *http.Request
+	var body []byte
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodPost {
+			w.Write([]byte(`[` + testOrderResponse + `]`))
+		} else {
+			w.Write([]byte(testOrderResponse))
+		}
+	}))
+	defer srv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", srv.Certificate().Raw)
+
+	t.Run("ключ в заголовке", func(t *testing.T) {
+		auth := config.AccrualAuth{APIKey: "key", APIKeyHeader: "Authorization", CAFile: caFile}
+		m := newTestAPIManager(t, config.AccrualProvider{URL: srv.URL, AccrualAuth: auth}, &config.Config{})
+
+		_, _, _, err := m.getCalc(79927398713)
+		assert.NoError(t, err)
+		assert.Equal(t, "key", request.Header.Get("Authorization"))
+	})
+
+	t.Run("подпись запроса", func(t *testing.T) {
+		auth := config.AccrualAuth{AuthType: config.AuthHMAC, HMACSecret: "secret", CAFile: caFile}
+		m := newTestAPIManager(t, config.AccrualProvider{URL: srv.URL, AccrualAuth: auth, Batch: true}, &config.Config{})
+
+		_, _, err := m.getCalcs([]int64{79927398713})
+		assert.NoError(t, err)
+		timestamp := request.Header.Get(TimestampHeader)
+		assert.NotEmpty(t, timestamp)
+		payload := signedPayload(http.MethodPost, "/api/orders/batch", timestamp, body)
+		assert.True(t, IsValidSignature(payload, request.Header.Get(SignatureHeader), "secret"))
+		assert.Equal(t, `["79927398713"]`, string(body))
+	})
+}
@@ -0,0 +1,177 @@
+package processing
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gophermart/internal/config"
+	"gophermart/internal/db"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+)
+
+// SignatureHeader carries hex encoded HMAC-SHA256 of the request body, callbacks sign it as outbound
+// requests do, see hmacAuth.
+const SignatureHeader = "X-Signature"
+
+// maxCallbackSize limits the body read before the signature is checked.
+const maxCallbackSize = 1 << 20
+
+// callbackProvider verifies and maps callbacks of one accrual provider.
+type callbackProvider struct {
+	secret   string
+	statuses statusMapping
+	// orders are provider names of orders the provider settles, see orderProviders.
+	orders []string
+}
+
+type callbackHandler struct {
+	db db.Storage
+	// providers accepting callbacks by name, the route without name is the default provider's.
+	providers       map[string]callbackProvider
+	defaultProvider string
+	maxAge          time.Duration
+	now             func() time.Time
+	logger          *zap.SugaredLogger
+}
+
+func NewCallbackHandler(db db.Storage, cfg *config.Config, logger *zap.SugaredLogger) *callbackHandler {
+	providers := make(map[string]callbackProvider, len(cfg.AccrualProviders))
+	for _, p := range cfg.AccrualProviders {
+		if p.CallbackSecret != "" {
+			providers[p.Name] = callbackProvider{p.CallbackSecret, providerStatuses(cfg, p), orderProviders(cfg, p.Name)}
+		}
+	}
+	return &callbackHandler{db, providers, cfg.DefaultAccrualProvider, cfg.AccrualCallbackMaxAge, time.Now, logger}
+}
+
+// isFresh checks that the signed time is within maxAge from now.
+func (h *callbackHandler) isFresh(timestamp string) bool {
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := h.now().Sub(time.Unix(signedAt, 0))
+	return age <= h.maxAge && age >= -h.maxAge
+}
+
+func Sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func IsValidSignature(body []byte, signature, secret string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(expected, mac.Sum(nil))
+}
+
+// parseCallback accepts either one accrual response or an array of them.
+func (h *callbackHandler) parseCallback(statuses statusMapping, body []byte) (map[int64]db.CalcAmountsUpdateResult, error) {
+	var raws []json.RawMessage
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &raws); err != nil {
+			return nil, err
+		}
+	} else {
+		raws = append(raws, trimmed)
+	}
+
+	updates := make(map[int64]db.CalcAmountsUpdateResult, len(raws))
+	for _, raw := range raws {
+		var resp response
+		if err := json.Unmarshal(raw, &resp); err != nil {
+			return nil, err
+		}
+		number, err := strconv.ParseInt(resp.Order, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("order %q: %w", resp.Order, err)
+		}
+		status, err := statuses.get(resp.Status)
+		if err != nil {
+			return nil, fmt.Errorf("order %q: %w", resp.Order, err)
+		}
+		updates[number] = db.CalcAmountsUpdateResult{
+			Accrual:  resp.Accrual,
+			Status:   status,
+			Response: string(raw),
+		}
+	}
+	return updates, nil
+}
+
+func (h *callbackHandler) PostCallback(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCallbackSize))
+	if err != nil {
+		h.logger.Warnf("failed to PostCallback: %v", err)
+		if len(body) >= maxCallbackSize {
+			// 413 — тело запроса слишком большое
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return
+	}
+
+	name := chi.URLParam(r, "provider")
+	if name == "" {
+		name = h.defaultProvider
+	}
+	provider, ok := h.providers[name]
+	if !ok {
+		// 404 — система расчёта неизвестна или не присылает результаты
+		h.logger.Warnf("failed to PostCallback: no callbacks of accrual provider %q", name)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	timestamp := r.Header.Get(TimestampHeader)
+	payload := signedPayload(r.Method, r.URL.RequestURI(), timestamp, body)
+	if !h.isFresh(timestamp) || !IsValidSignature(payload, r.Header.Get(SignatureHeader), provider.secret) {
+		// 401 — подпись неверна или устарела
+		h.logger.Warn("failed to PostCallback: bad signature")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// the signature is kept in the canonical form, signatures of both earlier and later times than now are
+	// kept until they are stale
+	if err := h.db.SaveCallbackSignature(Sign(payload, provider.secret), 2*h.maxAge); errors.Is(err, db.ErrCallbackReplayed) {
+		// 409 — запрос уже был получен
+		h.logger.Warnf("failed to PostCallback: %v", err)
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		h.logger.Errorf("failed to PostCallback: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	updates, err := h.parseCallback(provider.statuses, body)
+	if err != nil {
+		h.logger.Warnf("failed to PostCallback: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if updated, err := h.db.ApplyCalcResults(provider.orders, updates); err != nil {
+		h.logger.Errorf("failed to PostCallback: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		h.logger.Infof("accrual callback of %v updated %v of %v orders", name, updated, len(updates))
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,449 @@
+package processing
+
+import (
+	"bytes"
+	"errors"
+	"gophermart/internal/db"
+	"gophermart/internal/money"
+	"gophermart/internal/order/model"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	accountModel "gophermart/internal/account/model/db"
+	adjustmentModel "gophermart/internal/adjustment/model/db"
+	campaignModel "gophermart/internal/campaign/model/db"
+	referralModel "gophermart/internal/referral/model/db"
+	statementModel "gophermart/internal/statement/model/db"
+	transferModel "gophermart/internal/transfer/model/db"
+	withdrawalsModel "gophermart/internal/withdrawals/model/db"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockDBStorage struct {
+	mock.Mock
+}
+
+func (m *mockDBStorage) Register(login, password, referralCode, ip string) (string, error) {
+	return "", nil
+}
+
+func (m *mockDBStorage) GetByLoginPassword(login string, password string) (string, error) {
+	return "", nil
+}
+
+func (m *mockDBStorage) SaveOrder(UserID string, number uint64, merchantID, provider string) error {
+	return nil
+}
+
+func (m *mockDBStorage) GetOrders(UserID string) ([]model.Order, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetAccount(UserID, currency string) (*accountModel.Account, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) WithdrawFromAccount(UserID, currency string, sum money.Money, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) HoldWithdrawal(UserID, currency string, sum money.Money, number uint64, ttl time.Duration) error {
+	return nil
+}
+
+func (m *mockDBStorage) ConfirmWithdrawal(UserID string, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) CancelWithdrawal(UserID string, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) ExpireWithdrawals() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) ExpirePoints() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) RecalculateTiers() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) CreateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaigns() ([]campaignModel.Campaign, error) {
+	args := m.Called()
+	return args.Get(0).([]campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaign(ID int64) (*campaignModel.Campaign, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) UpdateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) DeleteCampaign(ID int64) error {
+	args := m.Called(ID)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) CreateAdjustment(login string, amount money.Money, reason, ticket, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(login, amount, reason, ticket, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) ApproveAdjustment(ID int64, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) RejectAdjustment(ID int64, actor, reason string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor, reason)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustments() ([]adjustmentModel.Adjustment, error) {
+	args := m.Called()
+	return args.Get(0).([]adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustment(ID int64) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetExpiringPoints(UserID, currency string, within time.Duration) ([]accountModel.ExpiringPoints, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) RefundWithdrawal(number uint64, sum money.Money, actor, reason string) (*withdrawalsModel.Withdrawals, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetWithdrawals(UserID, currency string) ([]withdrawalsModel.Withdrawals, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) TransferPoints(UserID, login string, sum money.Money) (*transferModel.Transfer, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetTransfers(UserID string) ([]transferModel.Transfer, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetReferrals(UserID string) (*referralModel.Referrals, error) {
+	args := m.Called(UserID)
+	return args.Get(0).(*referralModel.Referrals), args.Error(1)
+}
+
+func (m *mockDBStorage) GetStatement(UserID string, from, to *time.Time, offset, limit int) (*statementModel.Statement, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) ReserveIdempotencyKey(UserID, scope, key, requestHash string, ttl, lease time.Duration) (*db.IdempotentResponse, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) SaveIdempotentResponse(UserID, scope, key string, statusCode int, contentType string, body []byte) error {
+	return nil
+}
+
+func (m *mockDBStorage) ReleaseIdempotencyKey(UserID, scope, key string) error {
+	return nil
+}
+
+func (m *mockDBStorage) CalcAmounts(shard db.Shard, providers []string, offset, limit int,
+	updF func(nums []int64) map[int64]db.CalcAmountsUpdateResult) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) ApplyCalcResults(providers []string, updates map[int64]db.CalcAmountsUpdateResult) (int, error) {
+	args := m.Called(providers, updates)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *mockDBStorage) SaveCallbackSignature(signature string, ttl time.Duration) error {
+	args := m.Called(signature, ttl)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) TryAcquireLease(instanceID string, shard int) (*db.Lease, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetLeaders() ([]db.Leader, error) {
+	args := m.Called()
+	return args.Get(0).([]db.Leader), args.Error(1)
+}
+
+func (m *mockDBStorage) CheckLedger() ([]db.LedgerMismatch, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) Reconcile(save bool) (*db.ReconciliationReport, error) {
+	args := m.Called(save)
+	return args.Get(0).(*db.ReconciliationReport), args.Error(1)
+}
+
+func (m *mockDBStorage) Ping() error {
+	return nil
+}
+
+func (m *mockDBStorage) GetOrderHistory(UserID string, number uint64) ([]model.OrderEvent, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) DeadLetterOrders(maxFailedAttempts int) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) GetDeadLetterOrders() ([]model.DeadLetterOrder, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) RetryDeadLetterOrder(number uint64, actor string) error {
+	return nil
+}
+
+func (m *mockDBStorage) ResolveDeadLetterOrder(number uint64, status model.OrderStatus, accrual money.Money, actor, reason string) error {
+	return nil
+}
+
+const (
+	testCallbackSecret        = "callback-secret"
+	testPartnerCallbackSecret = "partner-callback-secret"
+)
+
+func Test_callbackHandler_PostCallback(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	newHandler := func(storage *mockDBStorage) *callbackHandler {
+		providers := map[string]callbackProvider{
+			"main":    {testCallbackSecret, newStatusMapping(nil), []string{"main", ""}},
+			"partner": {testPartnerCallbackSecret, newStatusMapping(map[string]string{"CALCULATING": "PROCESSING"}), []string{"partner"}},
+		}
+		return &callbackHandler{storage, providers, "main", 5 * time.Minute, func() time.Time { return now }, logger}
+	}
+	defaultStorage := new(mockDBStorage)
+	defaultStorage.On("SaveCallbackSignature", mock.Anything, 10*time.Minute).Return(nil)
+	defaultHandler := func() *callbackHandler { return newHandler(defaultStorage) }
+	signWith := func(secret string) func(path, timestamp, body string) string {
+		return func(path, timestamp, body string) string {
+			return Sign(signedPayload(http.MethodPost, path, timestamp, []byte(body)), secret)
+		}
+	}
+	sign := signWith(testCallbackSecret)
+	fresh := strconv.FormatInt(now.Unix(), 10)
+
+	tests := []struct {
+		name       string
+		code       int
+		path       string
+		body       string
+		timestamp  string
+		signature  func(path, timestamp, body string) string
+		getHandler func() *callbackHandler
+	}{
+		{
+			name:      "обновление одного заказа",
+			code:      200,
+			body:      `{"order": "79927398713", "status": "PROCESSED", "accrual": 500.5}`,
+			timestamp: fresh,
+			signature: sign,
+			getHandler: func() *callbackHandler {
+				storage := new(mockDBStorage)
+				storage.On("SaveCallbackSignature", sign("/internal/accrual/callback", fresh, `{"order": "79927398713", "status": "PROCESSED", "accrual": 500.5}`), 10*time.Minute).Return(nil)
+				storage.On("ApplyCalcResults", []string{"main", ""}, map[int64]db.CalcAmountsUpdateResult{
+					79927398713: {Accrual: 50050, Status: model.Processed, Response: `{"order": "79927398713", "status": "PROCESSED", "accrual": 500.5}`},
+				}).Return(1, nil)
+				return newHandler(storage)
+			},
+		},
+		{
+			name: "обновление нескольких заказов",
+			code: 200,
+			body: `[
+				{"order": "79927398713", "status": "INVALID"},
+				{"order": "12345678903", "status": "REGISTERED"}
+			]`,
+			timestamp: fresh,
+			signature: sign,
+			getHandler: func() *callbackHandler {
+				storage := new(mockDBStorage)
+				storage.On("SaveCallbackSignature", mock.Anything, 10*time.Minute).Return(nil)
+				storage.On("ApplyCalcResults", []string{"main", ""}, map[int64]db.CalcAmountsUpdateResult{
+					79927398713: {Accrual: 0, Status: model.Invalid, Response: `{"order": "79927398713", "status": "INVALID"}`},
+					12345678903: {Accrual: 0, Status: model.Registered, Response: `{"order": "12345678903", "status": "REGISTERED"}`},
+				}).Return(2, nil)
+				return newHandler(storage)
+			},
+		},
+		{
+			name:      "результат системы из адреса",
+			code:      200,
+			path:      "/internal/accrual/callback/partner",
+			body:      `{"order": "79927398713", "status": "CALCULATING"}`,
+			timestamp: fresh,
+			signature: signWith(testPartnerCallbackSecret),
+			getHandler: func() *callbackHandler {
+				storage := new(mockDBStorage)
+				storage.On("SaveCallbackSignature", mock.Anything, 10*time.Minute).Return(nil)
+				storage.On("ApplyCalcResults", []string{"partner"}, map[int64]db.CalcAmountsUpdateResult{
+					79927398713: {Accrual: 0, Status: model.Processing, Response: `{"order": "79927398713", "status": "CALCULATING"}`},
+				}).Return(1, nil)
+				return newHandler(storage)
+			},
+		},
+		{
+			name:       "статус другой системы",
+			code:       400,
+			body:       `{"order": "79927398713", "status": "CALCULATING"}`,
+			timestamp:  fresh,
+			signature:  sign,
+			getHandler: defaultHandler,
+		},
+		{
+			name:       "подпись секретом другой системы",
+			code:       401,
+			path:       "/internal/accrual/callback/partner",
+			body:       `{"order": "79927398713", "status": "PROCESSED", "accrual": 500}`,
+			timestamp:  fresh,
+			signature:  sign,
+			getHandler: defaultHandler,
+		},
+		{
+			name:       "неизвестная система",
+			code:       404,
+			path:       "/internal/accrual/callback/unknown",
+			body:       `{"order": "79927398713", "status": "PROCESSED", "accrual": 500}`,
+			timestamp:  fresh,
+			signature:  sign,
+			getHandler: defaultHandler,
+		},
+		{
+			name:       "неизвестный статус",
+			code:       400,
+			body:       `{"order": "79927398713", "status": "UNKNOWN"}`,
+			timestamp:  fresh,
+			signature:  sign,
+			getHandler: defaultHandler,
+		},
+		{
+			name:       "неверный формат запроса",
+			code:       400,
+			body:       `abc`,
+			timestamp:  fresh,
+			signature:  sign,
+			getHandler: defaultHandler,
+		},
+		{
+			name:       "неверная подпись",
+			code:       401,
+			body:       `{"order": "79927398713", "status": "PROCESSED", "accrual": 500}`,
+			timestamp:  fresh,
+			signature:  signWith("wrong secret"),
+			getHandler: defaultHandler,
+		},
+		{
+			name:       "подпись только тела запроса",
+			code:       401,
+			body:       `{"order": "79927398713", "status": "PROCESSED", "accrual": 500}`,
+			timestamp:  fresh,
+			signature:  func(path, timestamp, body string) string { return Sign([]byte(body), testCallbackSecret) },
+			getHandler: defaultHandler,
+		},
+		{
+			name:       "нет подписи",
+			code:       401,
+			body:       `{"order": "79927398713", "status": "PROCESSED", "accrual": 500}`,
+			timestamp:  fresh,
+			signature:  func(path, timestamp, body string) string { return "" },
+			getHandler: defaultHandler,
+		},
+		{
+			name:       "нет времени подписи",
+			code:       401,
+			body:       `{"order": "79927398713", "status": "PROCESSED", "accrual": 500}`,
+			signature:  sign,
+			getHandler: defaultHandler,
+		},
+		{
+			name:       "подпись устарела",
+			code:       401,
+			body:       `{"order": "79927398713", "status": "PROCESSED", "accrual": 500}`,
+			timestamp:  strconv.FormatInt(now.Add(-6*time.Minute).Unix(), 10),
+			signature:  sign,
+			getHandler: defaultHandler,
+		},
+		{
+			name:      "повтор полученного запроса",
+			code:      409,
+			body:      `{"order": "79927398713", "status": "PROCESSED", "accrual": 500}`,
+			timestamp: fresh,
+			signature: sign,
+			getHandler: func() *callbackHandler {
+				storage := new(mockDBStorage)
+				storage.On("SaveCallbackSignature", mock.Anything, 10*time.Minute).Return(db.ErrCallbackReplayed)
+				return newHandler(storage)
+			},
+		},
+		{
+			name:       "слишком большой запрос",
+			code:       413,
+			body:       `[` + strings.Repeat(`{"order": "79927398713", "status": "PROCESSED", "accrual": 500},`, maxCallbackSize/64) + `]`,
+			timestamp:  fresh,
+			signature:  sign,
+			getHandler: defaultHandler,
+		},
+		{
+			name:      "внутренняя ошибка сервера.",
+			code:      500,
+			body:      `{"order": "79927398713", "status": "PROCESSING"}`,
+			timestamp: fresh,
+			signature: sign,
+			getHandler: func() *callbackHandler {
+				storage := new(mockDBStorage)
+				storage.On("SaveCallbackSignature", mock.Anything, 10*time.Minute).Return(nil)
+				storage.On("ApplyCalcResults", mock.Anything, mock.Anything).Return(0, errors.New("unexpected exception"))
+				return newHandler(storage)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.path == "" {
+				tt.path = "/internal/accrual/callback"
+			}
+			request := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader([]byte(tt.body)))
+			request.Header.Set("Content-Type", "application/json")
+			request.Header.Set(TimestampHeader, tt.timestamp)
+			request.Header.Set(SignatureHeader, tt.signature(tt.path, tt.timestamp, tt.body))
+
+			w := httptest.NewRecorder()
+			handler := tt.getHandler()
+			r := chi.NewRouter()
+			r.Post("/internal/accrual/callback", handler.PostCallback)
+			r.Post("/internal/accrual/callback/{provider}", handler.PostCallback)
+			r.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package processing
+
+import (
+	"context"
+	"gophermart/internal/config"
+	"gophermart/internal/db"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type shardWorker struct {
+	lease  *db.Lease
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// elector keeps advisory lock leases on processing shards and runs work for every held shard.
+type elector struct {
+	db     db.Storage
+	logger *zap.SugaredLogger
+	cfg    *config.Config
+	// work runs while the shard lease is held, held checks the lease before writes of the shard.
+	work    func(ctx context.Context, shard db.Shard, held func() bool)
+	workers map[int]*shardWorker
+}
+
+func newElector(db db.Storage, logger *zap.SugaredLogger, cfg *config.Config, work func(ctx context.Context, shard db.Shard, held func() bool)) *elector {
+	return &elector{db, logger, cfg, work, make(map[int]*shardWorker)}
+}
+
+func (e *elector) run(ctx context.Context) {
+	ticker := time.NewTicker(e.cfg.LeaseRenewInterval)
+	defer ticker.Stop()
+
+	e.tick(ctx)
+	for {
+		select {
+		case <-ticker.C:
+			e.tick(ctx)
+		case <-ctx.Done():
+			for shard := range e.workers {
+				e.stepDown(shard)
+			}
+			return
+		}
+	}
+}
+
+func (e *elector) tick(ctx context.Context) {
+	for shard, w := range e.workers {
+		if err := w.lease.Renew(); err != nil {
+			e.logger.Errorf("failed to renew lease on shard %v: %v", shard, err)
+			e.stepDown(shard)
+		}
+	}
+
+	for shard := 0; shard < e.cfg.ProcessingShards; shard++ {
+		if _, ok := e.workers[shard]; ok {
+			continue
+		}
+		if e.cfg.ProcessingMaxShards > 0 && len(e.workers) >= e.cfg.ProcessingMaxShards {
+			return
+		}
+		lease, err := e.db.TryAcquireLease(e.cfg.InstanceID, shard)
+		if err != nil {
+			e.logger.Errorf("failed to acquire lease on shard %v: %v", shard, err)
+			continue
+		}
+		if lease == nil {
+			continue
+		}
+		e.logger.Infof("instance %v became leader of shard %v", e.cfg.InstanceID, shard)
+		e.start(ctx, lease)
+	}
+}
+
+func (e *elector) start(ctx context.Context, lease *db.Lease) {
+	wctx, cancel := context.WithCancel(ctx)
+	w := &shardWorker{lease, cancel, make(chan struct{})}
+	e.workers[lease.Shard()] = w
+	go func() {
+		defer close(w.done)
+		e.work(wctx, db.Shard{Index: lease.Shard(), Count: e.cfg.ProcessingShards}, lease.Held)
+	}()
+}
+
+// stepDown waits for the shard work to stop before the lease is released,
+// so the next leader never runs concurrently with this one.
+func (e *elector) stepDown(shard int) {
+	w := e.workers[shard]
+	delete(e.workers, shard)
+	w.cancel()
+	<-w.done
+	if err := w.lease.Release(); err != nil {
+		e.logger.Errorf("failed to release lease on shard %v: %v", shard, err)
+	}
+	e.logger.Infof("instance %v stepped down from shard %v", e.cfg.InstanceID, shard)
+}
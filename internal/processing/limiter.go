@@ -0,0 +1,36 @@
+package processing
+
+import (
+	"sync"
+	"time"
+)
+
+// limiter spaces requests to a provider evenly to stay within its requests per minute limit.
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// newLimiter returns nil limiter that never waits when perMinute is not positive.
+func newLimiter(perMinute int) *limiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &limiter{interval: time.Minute / time.Duration(perMinute)}
+}
+
+func (l *limiter) wait() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	d := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+	time.Sleep(d)
+}
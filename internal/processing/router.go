@@ -0,0 +1,46 @@
+package processing
+
+import (
+	"gophermart/internal/config"
+	"strconv"
+	"strings"
+)
+
+// Router chooses accrual provider of an order by the routing rules of config, the first matching rule wins.
+type Router struct {
+	routes          []config.AccrualRoute
+	defaultProvider string
+	merchants       map[string]string
+}
+
+func NewRouter(cfg *config.Config) *Router {
+	return &Router{cfg.AccrualRoutes, cfg.DefaultAccrualProvider, cfg.MerchantSecrets}
+}
+
+// MerchantPayload is signed by the merchant secret to confirm that the order number was made at the merchant.
+func MerchantPayload(number uint64, merchantID string) []byte {
+	return []byte(merchantID + "\n" + strconv.FormatUint(number, 10))
+}
+
+// VerifyMerchant checks hex encoded HMAC-SHA256 of MerchantPayload, merchants without secret are never verified.
+func (r *Router) VerifyMerchant(number uint64, merchantID, signature string) bool {
+	secret, ok := r.merchants[merchantID]
+	return ok && secret != "" && IsValidSignature(MerchantPayload(number, merchantID), signature, secret)
+}
+
+func (r *Router) Route(number uint64, merchantID string) string {
+	s := strconv.FormatUint(number, 10)
+	for _, route := range r.routes {
+		if route.Prefix != "" && !strings.HasPrefix(s, route.Prefix) {
+			continue
+		}
+		if number < route.From || (route.To != 0 && number > route.To) {
+			continue
+		}
+		if route.Merchant != "" && route.Merchant != merchantID {
+			continue
+		}
+		return route.Provider
+	}
+	return r.defaultProvider
+}
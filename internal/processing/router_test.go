@@ -0,0 +1,64 @@
+package processing
+
+import (
+	"gophermart/internal/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter_Route(t *testing.T) {
+	router := NewRouter(&config.Config{
+		DefaultAccrualProvider: "main",
+		AccrualRoutes: []config.AccrualRoute{
+			{Provider: "shop", Merchant: "shop-1"},
+			{Provider: "partner", Prefix: "4"},
+			{Provider: "range", From: 1000, To: 1999},
+			{Provider: "partner-range", Prefix: "7", From: 70000},
+		},
+	})
+	tests := []struct {
+		name     string
+		number   uint64
+		merchant string
+		expected string
+	}{
+		{name: "по магазину", number: 79927398713, merchant: "shop-1", expected: "shop"},
+		{name: "по префиксу номера", number: 4561261212345467, expected: "partner"},
+		{name: "по диапазону номеров", number: 1008, expected: "range"},
+		{name: "префикс и диапазон", number: 79927398713, expected: "partner-range"},
+		{name: "префикс вне диапазона", number: 7992, expected: "main"},
+		{name: "нет подходящего правила", number: 12345678903, merchant: "shop-2", expected: "main"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, router.Route(tt.number, tt.merchant))
+		})
+	}
+}
+
+func TestRouter_VerifyMerchant(t *testing.T) {
+	router := NewRouter(&config.Config{
+		MerchantSecrets: map[string]string{"shop-1": "shop-secret", "shop-2": ""},
+	})
+	var number uint64 = 79927398713
+	tests := []struct {
+		name      string
+		number    uint64
+		merchant  string
+		signature string
+		expected  bool
+	}{
+		{name: "подпись магазина", number: number, merchant: "shop-1", signature: Sign(MerchantPayload(number, "shop-1"), "shop-secret"), expected: true},
+		{name: "подпись другого номера", number: number + 1, merchant: "shop-1", signature: Sign(MerchantPayload(number, "shop-1"), "shop-secret")},
+		{name: "подпись чужим секретом", number: number, merchant: "shop-1", signature: Sign(MerchantPayload(number, "shop-1"), "wrong")},
+		{name: "нет подписи", number: number, merchant: "shop-1"},
+		{name: "магазин без секрета", number: number, merchant: "shop-2", signature: Sign(MerchantPayload(number, "shop-2"), "")},
+		{name: "неизвестный магазин", number: number, merchant: "shop-3", signature: Sign(MerchantPayload(number, "shop-3"), "")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, router.VerifyMerchant(tt.number, tt.merchant, tt.signature))
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package processing
+
+import (
+	"encoding/json"
+	"gophermart/internal/config"
+	"gophermart/internal/db"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type shardStatus struct {
+	Shard     int        `json:"shard"`
+	Leader    string     `json:"leader,omitempty"`
+	RenewedAt *time.Time `json:"renewed_at,omitempty"`
+	Alive     bool       `json:"alive"`
+	Self      bool       `json:"self"`
+}
+
+type status struct {
+	InstanceID string        `json:"instance_id"`
+	Shards     []shardStatus `json:"shards"`
+}
+
+type statusHandler struct {
+	db     db.Storage
+	cfg    *config.Config
+	logger *zap.SugaredLogger
+}
+
+func NewStatusHandler(db db.Storage, cfg *config.Config, logger *zap.SugaredLogger) *statusHandler {
+	return &statusHandler{db, cfg, logger}
+}
+
+func (h *statusHandler) getStatus(leaders []db.Leader, now time.Time) status {
+	s := status{InstanceID: h.cfg.InstanceID, Shards: make([]shardStatus, h.cfg.ProcessingShards)}
+	for i := range s.Shards {
+		s.Shards[i].Shard = i
+	}
+	for _, l := range leaders {
+		if l.Shard >= len(s.Shards) {
+			continue
+		}
+		renewedAt := l.RenewedAt
+		s.Shards[l.Shard] = shardStatus{
+			Shard:     l.Shard,
+			Leader:    l.InstanceID,
+			RenewedAt: &renewedAt,
+			Alive:     now.Sub(l.RenewedAt) < h.cfg.LeaseTTL,
+			Self:      l.InstanceID == h.cfg.InstanceID,
+		}
+	}
+	return s
+}
+
+func (h *statusHandler) GetStatus(w http.ResponseWriter, r *http.Request) {
+	if leaders, err := h.db.GetLeaders(); err != nil {
+		h.logger.Errorf("failed to GetStatus: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(h.getStatus(leaders, time.Now()))
+	}
+}
@@ -0,0 +1,84 @@
+package processing
+
+import (
+	"encoding/json"
+	"errors"
+	"gophermart/internal/config"
+	"gophermart/internal/db"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_statusHandler_GetStatus(t *testing.T) {
+	cfg := &config.Config{InstanceID: "replica-1", ProcessingShards: 3, LeaseTTL: time.Hour}
+	renewedAt, _ := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+	fresh := time.Now().Truncate(time.Second)
+
+	tests := []struct {
+		name             string
+		code             int
+		getHandler       func() *statusHandler
+		checkResponeBody func(res *http.Response)
+	}{
+		{
+			name: "лидеры шардов",
+			code: 200,
+			getHandler: func() *statusHandler {
+				storage := new(mockDBStorage)
+				storage.On("GetLeaders").Return([]db.Leader{
+					{Shard: 0, InstanceID: "replica-1", RenewedAt: fresh},
+					{Shard: 1, InstanceID: "replica-2", RenewedAt: renewedAt},
+				}, nil)
+				return &statusHandler{storage, cfg, logger}
+			},
+			checkResponeBody: func(res *http.Response) {
+				expected := status{
+					InstanceID: "replica-1",
+					Shards: []shardStatus{
+						{Shard: 0, Leader: "replica-1", RenewedAt: &fresh, Alive: true, Self: true},
+						{Shard: 1, Leader: "replica-2", RenewedAt: &renewedAt, Alive: false, Self: false},
+						{Shard: 2},
+					},
+				}
+				var result status
+				json.NewDecoder(res.Body).Decode(&result)
+				assert.Equal(t, len(expected.Shards), len(result.Shards))
+				for i := range expected.Shards {
+					assert.Equal(t, expected.Shards[i].Leader, result.Shards[i].Leader)
+					assert.Equal(t, expected.Shards[i].Alive, result.Shards[i].Alive)
+					assert.Equal(t, expected.Shards[i].Self, result.Shards[i].Self)
+				}
+				assert.Equal(t, expected.InstanceID, result.InstanceID)
+			},
+		},
+		{
+			name: "внутренняя ошибка сервера.",
+			code: 500,
+			getHandler: func() *statusHandler {
+				storage := new(mockDBStorage)
+				storage.On("GetLeaders").Return([]db.Leader{}, errors.New("unexpected exception"))
+				return &statusHandler{storage, cfg, logger}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/internal/processing/status", nil)
+
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc(tt.getHandler().GetStatus)
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+			if tt.checkResponeBody != nil {
+				tt.checkResponeBody(res)
+			}
+
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+		})
+	}
+}
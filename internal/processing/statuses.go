@@ -0,0 +1,42 @@
+package processing
+
+import (
+	"fmt"
+	"gophermart/internal/order/model"
+)
+
+// Statuses of the accrual system.
+const (
+	Registered = "REGISTERED"
+	Processing = "PROCESSING"
+	Invalid    = "INVALID"
+	Processed  = "PROCESSED"
+)
+
+// statusMapping maps statuses of the accrual system on order statuses.
+type statusMapping map[string]model.OrderStatus
+
+// newStatusMapping extends the default mapping with overrides of external status on order status name,
+// the names are validated by config.
+func newStatusMapping(overrides map[string]string) statusMapping {
+	m := statusMapping{
+		Registered: model.Registered,
+		Processing: model.Processing,
+		Invalid:    model.Invalid,
+		Processed:  model.Processed,
+	}
+	for external, name := range overrides {
+		if status, ok := model.ParseStatus(name); ok {
+			m[external] = status
+		}
+	}
+	return m
+}
+
+// get fails on unknown status, so the order is counted as failed and ends up in dead letter instead of stalling.
+func (m statusMapping) get(status string) (model.OrderStatus, error) {
+	if s, ok := m[status]; ok {
+		return s, nil
+	}
+	return model.Processing, fmt.Errorf("undefined accrual status %q", status)
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"gophermart/internal/money"
+	"time"
+)
+
+const (
+	// Pending referrals are rewarded when the first order of the referred user is processed.
+	Pending  = "PENDING"
+	Rewarded = "REWARDED"
+	// Rejected referrals are never rewarded, they failed anti-abuse checks.
+	Rejected = "REJECTED"
+)
+
+// Referral is a user registered with the referral code, Reward is the bonus credited to the referrer.
+type Referral struct {
+	Login      string      `json:"login"`
+	Status     string      `json:"status"`
+	Reward     money.Money `json:"reward"`
+	CreatedAt  time.Time   `json:"created_at"`
+	RewardedAt *time.Time  `json:"rewarded_at,omitempty"`
+}
+
+// Referrals are the referral code of the user, users registered with it and the sum of rewards.
+type Referrals struct {
+	Code      string      `json:"code"`
+	Earned    money.Money `json:"earned"`
+	Referrals []Referral  `json:"referrals"`
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"gophermart/internal/money"
+	"gophermart/internal/referral/model/api"
+	"time"
+)
+
+type ReferralStatus int
+
+const (
+	Pending ReferralStatus = iota
+	Rewarded
+	Rejected
+)
+
+var statusNames = map[ReferralStatus]string{
+	Pending:  api.Pending,
+	Rewarded: api.Rewarded,
+	Rejected: api.Rejected,
+}
+
+func (s ReferralStatus) ToAPI() string {
+	return statusNames[s]
+}
+
+// Referral is seen by the referrer, Login is the referred user.
+type Referral struct {
+	Login      string         `db:"login"`
+	Status     ReferralStatus `db:"status"`
+	Reward     money.Money    `db:"referrer_bonus"`
+	CreatedAt  time.Time      `db:"created_at"`
+	RewardedAt *time.Time     `db:"rewarded_at"`
+}
+
+func (r *Referral) ToAPI() api.Referral {
+	return api.Referral{
+		Login:      r.Login,
+		Status:     r.Status.ToAPI(),
+		Reward:     r.Reward,
+		CreatedAt:  r.CreatedAt,
+		RewardedAt: r.RewardedAt,
+	}
+}
+
+type Referrals struct {
+	Code      string
+	Referrals []Referral
+}
+
+func (r *Referrals) ToAPI() api.Referrals {
+	referrals := api.Referrals{Code: r.Code, Referrals: make([]api.Referral, len(r.Referrals))}
+	for i := range r.Referrals {
+		referrals.Referrals[i] = r.Referrals[i].ToAPI()
+		referrals.Earned += r.Referrals[i].Reward
+	}
+	return referrals
+}
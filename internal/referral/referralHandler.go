@@ -0,0 +1,41 @@
+package referral
+
+import (
+	"encoding/json"
+	"gophermart/internal/db"
+	"gophermart/internal/utils"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+type handler struct {
+	db     db.Storage
+	secret string
+	logger *zap.SugaredLogger
+}
+
+func NewHandler(db db.Storage, secret string, logger *zap.SugaredLogger) *handler {
+	return &handler{db, secret, logger}
+}
+
+// GetReferrals returns the referral code of the user, users registered with it and rewards earned for them.
+func (h *handler) GetReferrals(w http.ResponseWriter, r *http.Request) {
+	UserID, isAuthed := utils.GetUserID(r, h.secret)
+	if !isAuthed {
+		// 401 — пользователь не авторизован.
+		h.logger.Warn("failed to auth user")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	referrals, err := h.db.GetReferrals(UserID)
+	if err != nil {
+		// 500 — внутренняя ошибка сервера.
+		h.logger.Errorf("failed to GetReferrals: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(referrals.ToAPI())
+}
@@ -3,12 +3,22 @@ package server
 import (
 	"context"
 	"errors"
+	"expvar"
 	"gophermart/internal/account"
+	"gophermart/internal/admin"
 	"gophermart/internal/auth"
 	"gophermart/internal/db"
+	"gophermart/internal/health"
+	"gophermart/internal/idempotency"
 	"gophermart/internal/order"
+	"gophermart/internal/partner"
+	"gophermart/internal/processing"
+	"gophermart/internal/referral"
+	"gophermart/internal/statement"
+	"gophermart/internal/transfer"
 	"gophermart/internal/withdrawals"
 	"net/http"
+	"time"
 
 	"gophermart/internal/config"
 
@@ -26,33 +36,95 @@ func Run(db db.Storage, authSecret string, cfg *config.Config, logger *zap.Sugar
 	r.Use(middleware.Compress(5))
 
 	authHandler := auth.NewHandler(db, authSecret, logger)
-	orderHandler := order.NewHandler(db, authSecret, logger)
-	accountHandler := account.NewAccountHandler(db, authSecret, logger)
+	orderHandler := order.NewHandler(db, authSecret, processing.NewRouter(cfg), logger)
+	accountHandler := account.NewAccountHandler(db, authSecret, cfg.WithdrawalHoldTTL, cfg.PointsExpiringWithin, logger)
 	withdrawalsHandler := withdrawals.NewHandler(db, authSecret)
+	statementHandler := statement.NewHandler(db, authSecret, logger)
+	transferHandler := transfer.NewHandler(db, authSecret, logger)
+	referralHandler := referral.NewHandler(db, authSecret, logger)
+	healthHandler := health.NewHandler(db, logger)
+	adminHandler := admin.NewHandler(db, authSecret, cfg.AdminIDs, logger)
+	idempotent := idempotency.NewMiddleware(db, authSecret, cfg.IdempotencyKeyTTL, cfg.IdempotencyKeyLease, logger)
+
+	r.Get("/health", healthHandler.GetHealth)
 
 	r.Route("/api/user", func(r chi.Router) {
 		r.Post("/register", authHandler.Register)
 		r.Post("/login", authHandler.Auth)
-		r.Post("/orders", orderHandler.PostOrder)
+		r.With(idempotent).Post("/orders", orderHandler.PostOrder)
 		r.Get("/orders", orderHandler.GetOrders)
+		r.Get("/orders/{number}/history", orderHandler.GetOrderHistory)
 		r.Get("/balance", accountHandler.GetAccount)
-		r.Post("/balance/withdraw", accountHandler.PostWithdraw)
+		r.With(idempotent).Post("/balance/withdraw", accountHandler.PostWithdraw)
+		r.With(idempotent).Post("/balance/transfer", transferHandler.PostTransfer)
+		r.Get("/transfers", transferHandler.GetTransfers)
+		r.Get("/referrals", referralHandler.GetReferrals)
 		r.Get("/withdrawals", withdrawalsHandler.GetWithdrawals)
+		r.With(idempotent).Post("/withdrawals/{number}/confirm", withdrawalsHandler.PostConfirm)
+		r.With(idempotent).Post("/withdrawals/{number}/cancel", withdrawalsHandler.PostCancel)
+		r.Get("/statement", statementHandler.GetStatement)
+	})
+
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Get("/orders/dead-letter", adminHandler.GetDeadLetterOrders)
+		r.Post("/orders/{number}/retry", adminHandler.PostRetryOrder)
+		r.Post("/orders/{number}/resolve", adminHandler.PostResolveOrder)
+		r.Post("/withdrawals/{number}/refund", adminHandler.PostRefundWithdrawal)
+		r.Get("/ledger/check", adminHandler.GetLedgerCheck)
+		r.Post("/campaigns", adminHandler.PostCampaign)
+		r.Get("/campaigns", adminHandler.GetCampaigns)
+		r.Get("/campaigns/{id}", adminHandler.GetCampaign)
+		r.Put("/campaigns/{id}", adminHandler.PutCampaign)
+		r.Delete("/campaigns/{id}", adminHandler.DeleteCampaign)
+		r.Post("/adjustments", adminHandler.PostAdjustment)
+		r.Get("/adjustments", adminHandler.GetAdjustments)
+		r.Get("/adjustments/{id}", adminHandler.GetAdjustment)
+		r.Post("/adjustments/{id}/approve", adminHandler.PostApproveAdjustment)
+		r.Post("/adjustments/{id}/reject", adminHandler.PostRejectAdjustment)
 	})
 
-	server := &http.Server{Addr: cfg.Address, Handler: r}
+	if cfg.HasAccrualCallbacks() {
+		callbackHandler := processing.NewCallbackHandler(db, cfg, logger)
+		r.Post("/internal/accrual/callback", callbackHandler.PostCallback)
+		r.Post("/internal/accrual/callback/{provider}", callbackHandler.PostCallback)
+	}
+
+	if cfg.PartnerAPISecret != "" {
+		partnerHandler := partner.NewHandler(db, cfg.PartnerAPISecret, logger)
+		r.Post("/internal/partner/withdrawals/{number}/refund", partnerHandler.PostRefundWithdrawal)
+	}
+
+	serve(&http.Server{Addr: cfg.Address, Handler: r}, logger, ctx)
+}
+
+// RunWorker serves health, processing status and metrics endpoints of the standalone accrual worker.
+func RunWorker(db db.Storage, cfg *config.Config, logger *zap.SugaredLogger, ctx context.Context) {
+	r := chi.NewRouter()
+	r.Use(middleware.Recoverer)
+
+	healthHandler := health.NewHandler(db, logger)
+	statusHandler := processing.NewStatusHandler(db, cfg, logger)
+	r.Get("/health", healthHandler.GetHealth)
+	r.Get("/internal/processing/status", statusHandler.GetStatus)
+	r.Handle("/debug/vars", expvar.Handler())
+
+	serve(&http.Server{Addr: cfg.HealthAddress, Handler: r}, logger, ctx)
+}
 
+func serve(server *http.Server, logger *zap.SugaredLogger, ctx context.Context) {
 	go func() {
-		if err := server.ListenAndServe(); err != nil && errors.Is(err, http.ErrServerClosed) {
-			logger.Fatalf("server start error: %w", err)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatalf("server start error: %v", err)
 		}
 	}()
-	logger.Info("server started successfuly")
+	logger.Infof("server started successfuly on %v", server.Addr)
 
 	<-ctx.Done()
 	logger.Info("get stop signal, start shutdown server")
-	if err := server.Shutdown(ctx); err != nil && errors.Is(err, context.Canceled) {
-		logger.Fatalf("Server Shutdown Failed:%w", err)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Errorf("Server Shutdown Failed:%v", err)
 	} else {
 		logger.Info("server stopped successfully")
 	}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"gophermart/internal/money"
+	"time"
+)
+
+const (
+	Credit = "credit"
+	Debit  = "debit"
+	// Refund is a credit of withdrawal refund, Order is the number of the withdrawal.
+	Refund = "refund"
+	// Expiration is a debit of expired points, Order is the number of the order they were accrued for.
+	Expiration = "expiration"
+	// Transfers between users have no order, the sender pays TransferFee in addition to TransferOut.
+	TransferIn  = "transfer_in"
+	TransferOut = "transfer_out"
+	TransferFee = "transfer_fee"
+	// TierBonus is the extra accrual of the loyalty tier for the order.
+	TierBonus = "tier_bonus"
+	// CampaignBonus is the bonus of a promotional campaign for the order.
+	CampaignBonus = "campaign_bonus"
+	// ReferralBonus is the bonus of the referral program, the referrer's one has no order.
+	ReferralBonus = "referral_bonus"
+	// Adjustment is a manual credit or debit made by support.
+	Adjustment = "adjustment"
+)
+
+type Operation struct {
+	Type        string      `json:"type"`
+	Order       string      `json:"order,omitempty"`
+	Amount      money.Money `json:"amount"`
+	Balance     money.Money `json:"balance"`
+	ProcessedAt time.Time   `json:"processed_at"`
+}
+
+// Statement is a page of operations of the period [From, To), totals are calculated for the whole period.
+// Pending withdrawals are not operations, they are reserved in Held, so Available is the balance without them and
+// matches current of the account for the statement up to now.
+type Statement struct {
+	From           *time.Time  `json:"from,omitempty"`
+	To             *time.Time  `json:"to,omitempty"`
+	OpeningBalance money.Money `json:"opening_balance"`
+	ClosingBalance money.Money `json:"closing_balance"`
+	Held           money.Money `json:"held"`
+	Available      money.Money `json:"available"`
+	Credit         money.Money `json:"credit"`
+	Debit          money.Money `json:"debit"`
+	Total          int         `json:"total"`
+	Offset         int         `json:"offset"`
+	Limit          int         `json:"limit"`
+	Operations     []Operation `json:"operations"`
+}
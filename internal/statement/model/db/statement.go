@@ -0,0 +1,70 @@
+package db
+
+import (
+	"gophermart/internal/money"
+	"gophermart/internal/statement/model/api"
+	"strconv"
+	"time"
+)
+
+// Operation is a credit of processed order accrual, a debit of withdrawal, a credit of withdrawal refund
+// a debit of expired points, a transfer or a tier bonus, Type is one of api operation types. Amount of debit is negative.
+type Operation struct {
+	Number      uint64      `db:"number"`
+	Amount      money.Money `db:"amount"`
+	Type        string      `db:"type"`
+	Balance     money.Money `db:"balance"`
+	ProcessedAt time.Time   `db:"processed_at"`
+}
+
+type Statement struct {
+	OpeningBalance money.Money `db:"opening_balance"`
+	Credit         money.Money `db:"credit"`
+	Debit          money.Money `db:"debit"`
+	Total          int         `db:"total"`
+	// Held is the sum of withdrawals placed before the period end that are still pending.
+	Held       money.Money `db:"held"`
+	Operations []Operation
+}
+
+func (o *Operation) ToAPI() api.Operation {
+	op := api.Operation{
+		Type:        o.Type,
+		Amount:      o.Amount,
+		Balance:     o.Balance,
+		ProcessedAt: o.ProcessedAt,
+	}
+	// points accrued before lots existed expire without an order
+	if o.Number != 0 {
+		op.Order = strconv.FormatUint(o.Number, 10)
+	}
+	if o.Amount < 0 {
+		op.Amount = -o.Amount
+	}
+	return op
+}
+
+func (s *Statement) ClosingBalance() money.Money {
+	return s.OpeningBalance + s.Credit - s.Debit
+}
+
+func (s *Statement) ToAPI(from, to *time.Time, offset, limit int) api.Statement {
+	operations := make([]api.Operation, len(s.Operations))
+	for i := 0; i < len(s.Operations); i++ {
+		operations[i] = s.Operations[i].ToAPI()
+	}
+	return api.Statement{
+		From:           from,
+		To:             to,
+		OpeningBalance: s.OpeningBalance,
+		ClosingBalance: s.ClosingBalance(),
+		Held:           s.Held,
+		Available:      s.ClosingBalance() - s.Held,
+		Credit:         s.Credit,
+		Debit:          s.Debit,
+		Total:          s.Total,
+		Offset:         offset,
+		Limit:          limit,
+		Operations:     operations,
+	}
+}
@@ -0,0 +1,147 @@
+package statement
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"gophermart/internal/db"
+	"gophermart/internal/statement/model/api"
+	"gophermart/internal/utils"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+
+	dateLayout = "2006-01-02"
+)
+
+type handler struct {
+	db     db.Storage
+	secret string
+	logger *zap.SugaredLogger
+}
+
+func NewHandler(db db.Storage, secret string, logger *zap.SugaredLogger) *handler {
+	return &handler{db, secret, logger}
+}
+
+type query struct {
+	from   *time.Time
+	to     *time.Time
+	offset int
+	limit  int
+	format string
+}
+
+// parseQuery reads from and to as RFC3339 time or a date, the date in to includes the whole day.
+func parseQuery(values url.Values) (*query, error) {
+	q := &query{limit: DefaultLimit, format: FormatJSON}
+	var err error
+	if q.from, err = parseTime(values.Get("from"), false); err != nil {
+		return nil, err
+	}
+	if q.to, err = parseTime(values.Get("to"), true); err != nil {
+		return nil, err
+	}
+	if q.from != nil && q.to != nil && !q.from.Before(*q.to) {
+		return nil, errors.New("from must be before to")
+	}
+	if v := values.Get("offset"); v != "" {
+		if q.offset, err = strconv.Atoi(v); err != nil || q.offset < 0 {
+			return nil, errors.New("bad offset " + v)
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		if q.limit, err = strconv.Atoi(v); err != nil || q.limit <= 0 || q.limit > MaxLimit {
+			return nil, errors.New("bad limit " + v)
+		}
+	}
+	if v := values.Get("format"); v != "" {
+		if v != FormatJSON && v != FormatCSV {
+			return nil, errors.New("unknown format " + v)
+		}
+		q.format = v
+	}
+	return q, nil
+}
+
+func parseTime(v string, endOfDay bool) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse(dateLayout, v)
+	if err != nil {
+		return nil, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
+
+func (h *handler) GetStatement(w http.ResponseWriter, r *http.Request) {
+	UserID, isAuthed := utils.GetUserID(r, h.secret)
+	if !isAuthed {
+		// 401 — пользователь не авторизован.
+		h.logger.Warn("failed to auth user")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	q, err := parseQuery(r.URL.Query())
+	if err != nil {
+		// 400 — неверный формат запроса.
+		h.logger.Warnf("failed to GetStatement: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	statement, err := h.db.GetStatement(UserID, q.from, q.to, q.offset, q.limit)
+	if err != nil {
+		// 500 — внутренняя ошибка сервера.
+		h.logger.Errorf("failed to GetStatement: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	apiStatement := statement.ToAPI(q.from, q.to, q.offset, q.limit)
+	if q.format == FormatCSV {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="statement.csv"`)
+		w.WriteHeader(http.StatusOK)
+		if err := writeCSV(w, apiStatement); err != nil {
+			h.logger.Errorf("failed to GetStatement: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(apiStatement)
+}
+
+// writeCSV writes operations of the page between opening and closing balance rows of the period, the held row
+// reserves pending withdrawals from the closing balance.
+func writeCSV(w io.Writer, statement api.Statement) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"processed_at", "type", "order", "amount", "balance"})
+	out.Write([]string{"", "opening", "", "", statement.OpeningBalance.String()})
+	for _, op := range statement.Operations {
+		out.Write([]string{op.ProcessedAt.Format(time.RFC3339), op.Type, op.Order, op.Amount.String(), op.Balance.String()})
+	}
+	out.Write([]string{"", "closing", "", "", statement.ClosingBalance.String()})
+	out.Write([]string{"", "held", "", statement.Held.String(), statement.Available.String()})
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,349 @@
+package statement
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	accountModel "gophermart/internal/account/model/db"
+	adjustmentModel "gophermart/internal/adjustment/model/db"
+	campaignModel "gophermart/internal/campaign/model/db"
+	"gophermart/internal/db"
+	"gophermart/internal/money"
+	"gophermart/internal/order/model"
+	referralModel "gophermart/internal/referral/model/db"
+	"gophermart/internal/statement/model/api"
+	statementModel "gophermart/internal/statement/model/db"
+	transferModel "gophermart/internal/transfer/model/db"
+	"gophermart/internal/utils"
+	withdrawalsModel "gophermart/internal/withdrawals/model/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.uber.org/zap"
+)
+
+var logger = zap.NewExample().Sugar()
+
+type mockDBStorage struct {
+	mock.Mock
+}
+
+func (m *mockDBStorage) Register(login, password, referralCode, ip string) (string, error) {
+	return "", nil
+}
+
+func (m *mockDBStorage) GetByLoginPassword(login string, password string) (string, error) {
+	return "", nil
+}
+
+func (m *mockDBStorage) SaveOrder(UserID string, number uint64, merchantID, provider string) error {
+	args := m.Called(UserID, number)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) GetOrders(UserID string) ([]model.Order, error) {
+	args := m.Called(UserID)
+	return args.Get(0).([]model.Order), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAccount(UserID, currency string) (*accountModel.Account, error) {
+	return nil, nil
+}
+func (m *mockDBStorage) WithdrawFromAccount(UserID, currency string, sum money.Money, number uint64) error {
+	return nil
+}
+func (m *mockDBStorage) HoldWithdrawal(UserID, currency string, sum money.Money, number uint64, ttl time.Duration) error {
+	return nil
+}
+
+func (m *mockDBStorage) ConfirmWithdrawal(UserID string, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) CancelWithdrawal(UserID string, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) ExpireWithdrawals() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) ExpirePoints() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) RecalculateTiers() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) CreateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaigns() ([]campaignModel.Campaign, error) {
+	args := m.Called()
+	return args.Get(0).([]campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaign(ID int64) (*campaignModel.Campaign, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) UpdateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) DeleteCampaign(ID int64) error {
+	args := m.Called(ID)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) CreateAdjustment(login string, amount money.Money, reason, ticket, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(login, amount, reason, ticket, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) ApproveAdjustment(ID int64, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) RejectAdjustment(ID int64, actor, reason string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor, reason)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustments() ([]adjustmentModel.Adjustment, error) {
+	args := m.Called()
+	return args.Get(0).([]adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustment(ID int64) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetExpiringPoints(UserID, currency string, within time.Duration) ([]accountModel.ExpiringPoints, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) RefundWithdrawal(number uint64, sum money.Money, actor, reason string) (*withdrawalsModel.Withdrawals, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetWithdrawals(UserID, currency string) ([]withdrawalsModel.Withdrawals, error) {
+	args := m.Called(UserID)
+	return args.Get(0).([]withdrawalsModel.Withdrawals), args.Error(1)
+}
+
+func (m *mockDBStorage) TransferPoints(UserID, login string, sum money.Money) (*transferModel.Transfer, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetTransfers(UserID string) ([]transferModel.Transfer, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetReferrals(UserID string) (*referralModel.Referrals, error) {
+	args := m.Called(UserID)
+	return args.Get(0).(*referralModel.Referrals), args.Error(1)
+}
+
+func (m *mockDBStorage) GetStatement(UserID string, from, to *time.Time, offset, limit int) (*statementModel.Statement, error) {
+	args := m.Called(UserID, from, to, offset, limit)
+	return args.Get(0).(*statementModel.Statement), args.Error(1)
+}
+
+func (m *mockDBStorage) ReserveIdempotencyKey(UserID, scope, key, requestHash string, ttl, lease time.Duration) (*db.IdempotentResponse, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) SaveIdempotentResponse(UserID, scope, key string, statusCode int, contentType string, body []byte) error {
+	return nil
+}
+
+func (m *mockDBStorage) ReleaseIdempotencyKey(UserID, scope, key string) error {
+	return nil
+}
+func (m *mockDBStorage) CalcAmounts(shard db.Shard, providers []string, offset, limit int,
+	updF func(nums []int64) map[int64]db.CalcAmountsUpdateResult) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) ApplyCalcResults(providers []string, updates map[int64]db.CalcAmountsUpdateResult) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) SaveCallbackSignature(signature string, ttl time.Duration) error {
+	args := m.Called(signature, ttl)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) TryAcquireLease(instanceID string, shard int) (*db.Lease, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetLeaders() ([]db.Leader, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) CheckLedger() ([]db.LedgerMismatch, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) Reconcile(save bool) (*db.ReconciliationReport, error) {
+	args := m.Called(save)
+	return args.Get(0).(*db.ReconciliationReport), args.Error(1)
+}
+
+func (m *mockDBStorage) Ping() error {
+	return nil
+}
+
+func (m *mockDBStorage) GetOrderHistory(UserID string, number uint64) ([]model.OrderEvent, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) DeadLetterOrders(maxFailedAttempts int) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) GetDeadLetterOrders() ([]model.DeadLetterOrder, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) RetryDeadLetterOrder(number uint64, actor string) error {
+	return nil
+}
+
+func (m *mockDBStorage) ResolveDeadLetterOrder(number uint64, status model.OrderStatus, accrual money.Money, actor, reason string) error {
+	return nil
+}
+
+func Test_handler_GetStatement(t *testing.T) {
+	processedAt, _ := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+	from, _ := time.Parse(time.RFC3339, "2020-12-01T00:00:00Z")
+	to, _ := time.Parse(time.RFC3339, "2021-01-01T00:00:00Z")
+	statement := &statementModel.Statement{
+		OpeningBalance: 1000,
+		Credit:         550,
+		Debit:          200,
+		Total:          2,
+		Held:           150,
+		Operations: []statementModel.Operation{
+			{Number: 79927398713, Amount: 550, Type: api.Credit, Balance: 1550, ProcessedAt: processedAt},
+			{Number: 9278923470, Amount: -200, Type: api.Debit, Balance: 1350, ProcessedAt: processedAt},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		query   string
+		token   string
+		storage func() *mockDBStorage
+		code    int
+		body    string
+	}{
+		{
+			name:  "выписка за период",
+			query: "?from=2020-12-01&to=2020-12-31&limit=10",
+			token: utils.TestToken,
+			storage: func() *mockDBStorage {
+				storage := new(mockDBStorage)
+				storage.On("GetStatement", "1", &from, &to, 0, 10).Return(statement, nil)
+				return storage
+			},
+			code: 200,
+			body: `{
+				"from": "2020-12-01T00:00:00Z", "to": "2021-01-01T00:00:00Z",
+				"opening_balance": 10, "closing_balance": 13.5, "held": 1.5, "available": 12, "credit": 5.5, "debit": 2,
+				"total": 2, "offset": 0, "limit": 10,
+				"operations": [
+					{"type": "credit", "order": "79927398713", "amount": 5.5, "balance": 15.5, "processed_at": "2020-12-10T15:15:45+03:00"},
+					{"type": "debit", "order": "9278923470", "amount": 2, "balance": 13.5, "processed_at": "2020-12-10T15:15:45+03:00"}
+				]}`,
+		},
+		{
+			name:  "выгрузка в csv",
+			query: "?format=csv&offset=5",
+			token: utils.TestToken,
+			storage: func() *mockDBStorage {
+				storage := new(mockDBStorage)
+				storage.On("GetStatement", "1", (*time.Time)(nil), (*time.Time)(nil), 5, DefaultLimit).Return(statement, nil)
+				return storage
+			},
+			code: 200,
+			body: "processed_at,type,order,amount,balance\n" +
+				",opening,,,10\n" +
+				"2020-12-10T15:15:45+03:00,credit,79927398713,5.5,15.5\n" +
+				"2020-12-10T15:15:45+03:00,debit,9278923470,2,13.5\n" +
+				",closing,,,13.5\n" +
+				",held,,1.5,12\n",
+		},
+		{
+			name:    "неверный период",
+			query:   "?from=2021-01-01&to=2020-12-01",
+			token:   utils.TestToken,
+			storage: func() *mockDBStorage { return new(mockDBStorage) },
+			code:    400,
+		},
+		{
+			name:    "слишком большая страница",
+			query:   "?limit=100000",
+			token:   utils.TestToken,
+			storage: func() *mockDBStorage { return new(mockDBStorage) },
+			code:    400,
+		},
+		{
+			name:    "неизвестный формат",
+			query:   "?format=xml",
+			token:   utils.TestToken,
+			storage: func() *mockDBStorage { return new(mockDBStorage) },
+			code:    400,
+		},
+		{
+			name:    "пользователь не аутентифицирован",
+			token:   "wrong token",
+			storage: func() *mockDBStorage { return new(mockDBStorage) },
+			code:    401,
+		},
+		{
+			name:  "внутренняя ошибка сервера",
+			token: utils.TestToken,
+			storage: func() *mockDBStorage {
+				storage := new(mockDBStorage)
+				storage.On("GetStatement", "1", (*time.Time)(nil), (*time.Time)(nil), 0, DefaultLimit).
+					Return((*statementModel.Statement)(nil), errors.New("unexpected exception"))
+				return storage
+			},
+			code: 500,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/user/statement"+tt.query, nil)
+			request.AddCookie(&http.Cookie{Name: "token", Value: tt.token})
+
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc(NewHandler(tt.storage(), utils.TestSecret, logger).GetStatement)
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+			body, _ := io.ReadAll(res.Body)
+			if res.Header.Get("Content-Type") == "application/json" {
+				assert.JSONEq(t, tt.body, string(body))
+			} else if tt.body != "" {
+				assert.Equal(t, tt.body, string(body))
+			}
+		})
+	}
+}
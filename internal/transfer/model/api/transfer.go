@@ -0,0 +1,21 @@
+package api
+
+import (
+	"gophermart/internal/money"
+	"time"
+)
+
+const (
+	Outgoing = "OUT"
+	Incoming = "IN"
+)
+
+// Transfer is a transfer of points to or from the user, Login is the other user.
+type Transfer struct {
+	ID        int64        `json:"id"`
+	Direction string       `json:"direction"`
+	Login     string       `json:"login"`
+	Sum       money.Money  `json:"sum"`
+	Fee       *money.Money `json:"fee,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+}
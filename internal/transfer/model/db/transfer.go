@@ -0,0 +1,33 @@
+package db
+
+import (
+	"gophermart/internal/money"
+	"gophermart/internal/transfer/model/api"
+	"time"
+)
+
+// Transfer is a transfer seen by one of its sides, Login is the other side. Fee is paid by the sender
+// in addition to Sum.
+type Transfer struct {
+	ID        int64       `db:"id"`
+	Outgoing  bool        `db:"outgoing"`
+	Login     string      `db:"login"`
+	Sum       money.Money `db:"sum"`
+	Fee       money.Money `db:"fee"`
+	CreatedAt time.Time   `db:"created_at"`
+}
+
+func (t *Transfer) ToAPI() api.Transfer {
+	transfer := api.Transfer{
+		ID:        t.ID,
+		Direction: api.Incoming,
+		Login:     t.Login,
+		Sum:       t.Sum,
+		CreatedAt: t.CreatedAt,
+	}
+	if t.Outgoing {
+		transfer.Direction = api.Outgoing
+		transfer.Fee = &t.Fee
+	}
+	return transfer
+}
@@ -0,0 +1,126 @@
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"gophermart/internal/account"
+	"gophermart/internal/db"
+	"gophermart/internal/money"
+	"gophermart/internal/transfer/model/api"
+	"gophermart/internal/utils"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// Codes of transfer limits returned in account.LimitError.
+const (
+	LimitMinSum   = "TRANSFER_MIN_SUM"
+	LimitMaxSum   = "TRANSFER_MAX_SUM"
+	LimitDailySum = "TRANSFER_DAILY_LIMIT"
+)
+
+var limitCodes = map[error]string{
+	db.ErrTransferBelowMin:   LimitMinSum,
+	db.ErrTransferAboveMax:   LimitMaxSum,
+	db.ErrTransferDailyLimit: LimitDailySum,
+}
+
+type handler struct {
+	db     db.Storage
+	secret string
+	logger *zap.SugaredLogger
+}
+
+func NewHandler(db db.Storage, secret string, logger *zap.SugaredLogger) *handler {
+	return &handler{db, secret, logger}
+}
+
+type TransferData struct {
+	// Login of the recipient.
+	Login string      `json:"login"`
+	Sum   money.Money `json:"sum"`
+}
+
+func (h *handler) PostTransfer(w http.ResponseWriter, r *http.Request) {
+	UserID, isAuthed := utils.GetUserID(r, h.secret)
+	if !isAuthed {
+		// 401 — пользователь не авторизован.
+		h.logger.Warn("failed to auth user")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var data TransferData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Login == "" || data.Sum <= 0 {
+		// 400 — неверный формат запроса.
+		h.logger.Warnf("failed to PostTransfer: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	transfer, err := h.db.TransferPoints(UserID, data.Login, data.Sum)
+	if err != nil {
+		h.logger.Warnf("failed to PostTransfer: %v", err)
+		var code string
+		for limitErr, c := range limitCodes {
+			if errors.Is(err, limitErr) {
+				code = c
+			}
+		}
+		switch {
+		case code != "":
+			// 403 — нарушено ограничение на переводы, код ограничения передаётся в теле ответа.
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(account.LimitError{Code: code})
+		case errors.Is(err, db.ErrRecipientNotFound):
+			// 404 — получатель не найден.
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, db.ErrTransferToSelf):
+			// 422 — перевод самому себе.
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		case errors.Is(err, db.ErrBalanceLimitExhausted):
+			// 402 — на счету недостаточно средств для перевода и комиссии.
+			w.WriteHeader(http.StatusPaymentRequired)
+		default:
+			// 500 — внутренняя ошибка сервера.
+			h.logger.Errorf("failed to PostTransfer: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(transfer.ToAPI())
+}
+
+func (h *handler) GetTransfers(w http.ResponseWriter, r *http.Request) {
+	UserID, isAuthed := utils.GetUserID(r, h.secret)
+	if !isAuthed {
+		// 401 — пользователь не авторизован.
+		h.logger.Warn("failed to auth user")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	transfers, err := h.db.GetTransfers(UserID)
+	if err != nil {
+		// 500 — внутренняя ошибка сервера.
+		h.logger.Errorf("failed to GetTransfers: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(transfers) == 0 {
+		// 204 — нет данных для ответа.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	apiTransfers := make([]api.Transfer, len(transfers))
+	for i := range transfers {
+		apiTransfers[i] = transfers[i].ToAPI()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(apiTransfers)
+}
@@ -0,0 +1,372 @@
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	accountModel "gophermart/internal/account/model/db"
+	adjustmentModel "gophermart/internal/adjustment/model/db"
+	campaignModel "gophermart/internal/campaign/model/db"
+	"gophermart/internal/db"
+	"gophermart/internal/money"
+	"gophermart/internal/order/model"
+	referralModel "gophermart/internal/referral/model/db"
+	statementModel "gophermart/internal/statement/model/db"
+	transferModel "gophermart/internal/transfer/model/db"
+	"gophermart/internal/utils"
+	withdrawalsModel "gophermart/internal/withdrawals/model/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.uber.org/zap"
+)
+
+var logger = zap.NewExample().Sugar()
+
+type mockDBStorage struct {
+	mock.Mock
+}
+
+func (m *mockDBStorage) Register(login, password, referralCode, ip string) (string, error) {
+	return "", nil
+}
+
+func (m *mockDBStorage) GetByLoginPassword(login string, password string) (string, error) {
+	return "", nil
+}
+
+func (m *mockDBStorage) SaveOrder(UserID string, number uint64, merchantID, provider string) error {
+	args := m.Called(UserID, number)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) GetOrders(UserID string) ([]model.Order, error) {
+	args := m.Called(UserID)
+	return args.Get(0).([]model.Order), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAccount(UserID, currency string) (*accountModel.Account, error) {
+	return nil, nil
+}
+func (m *mockDBStorage) WithdrawFromAccount(UserID, currency string, sum money.Money, number uint64) error {
+	return nil
+}
+func (m *mockDBStorage) HoldWithdrawal(UserID, currency string, sum money.Money, number uint64, ttl time.Duration) error {
+	return nil
+}
+
+func (m *mockDBStorage) ConfirmWithdrawal(UserID string, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) CancelWithdrawal(UserID string, number uint64) error {
+	return nil
+}
+
+func (m *mockDBStorage) ExpireWithdrawals() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) ExpirePoints() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) RecalculateTiers() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) CreateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaigns() ([]campaignModel.Campaign, error) {
+	args := m.Called()
+	return args.Get(0).([]campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaign(ID int64) (*campaignModel.Campaign, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) UpdateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) DeleteCampaign(ID int64) error {
+	args := m.Called(ID)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) CreateAdjustment(login string, amount money.Money, reason, ticket, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(login, amount, reason, ticket, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) ApproveAdjustment(ID int64, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) RejectAdjustment(ID int64, actor, reason string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor, reason)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustments() ([]adjustmentModel.Adjustment, error) {
+	args := m.Called()
+	return args.Get(0).([]adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustment(ID int64) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetExpiringPoints(UserID, currency string, within time.Duration) ([]accountModel.ExpiringPoints, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) RefundWithdrawal(number uint64, sum money.Money, actor, reason string) (*withdrawalsModel.Withdrawals, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetWithdrawals(UserID, currency string) ([]withdrawalsModel.Withdrawals, error) {
+	args := m.Called(UserID)
+	return args.Get(0).([]withdrawalsModel.Withdrawals), args.Error(1)
+}
+
+func (m *mockDBStorage) TransferPoints(UserID, login string, sum money.Money) (*transferModel.Transfer, error) {
+	args := m.Called(UserID, login, sum)
+	return args.Get(0).(*transferModel.Transfer), args.Error(1)
+}
+
+func (m *mockDBStorage) GetTransfers(UserID string) ([]transferModel.Transfer, error) {
+	args := m.Called(UserID)
+	return args.Get(0).([]transferModel.Transfer), args.Error(1)
+}
+
+func (m *mockDBStorage) GetReferrals(UserID string) (*referralModel.Referrals, error) {
+	args := m.Called(UserID)
+	return args.Get(0).(*referralModel.Referrals), args.Error(1)
+}
+
+func (m *mockDBStorage) GetStatement(UserID string, from, to *time.Time, offset, limit int) (*statementModel.Statement, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) ReserveIdempotencyKey(UserID, scope, key, requestHash string, ttl, lease time.Duration) (*db.IdempotentResponse, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) SaveIdempotentResponse(UserID, scope, key string, statusCode int, contentType string, body []byte) error {
+	return nil
+}
+
+func (m *mockDBStorage) ReleaseIdempotencyKey(UserID, scope, key string) error {
+	return nil
+}
+func (m *mockDBStorage) CalcAmounts(shard db.Shard, providers []string, offset, limit int,
+	updF func(nums []int64) map[int64]db.CalcAmountsUpdateResult) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) ApplyCalcResults(providers []string, updates map[int64]db.CalcAmountsUpdateResult) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) SaveCallbackSignature(signature string, ttl time.Duration) error {
+	args := m.Called(signature, ttl)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) TryAcquireLease(instanceID string, shard int) (*db.Lease, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetLeaders() ([]db.Leader, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) CheckLedger() ([]db.LedgerMismatch, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) Reconcile(save bool) (*db.ReconciliationReport, error) {
+	args := m.Called(save)
+	return args.Get(0).(*db.ReconciliationReport), args.Error(1)
+}
+
+func (m *mockDBStorage) Ping() error {
+	return nil
+}
+
+func (m *mockDBStorage) GetOrderHistory(UserID string, number uint64) ([]model.OrderEvent, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) DeadLetterOrders(maxFailedAttempts int) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) GetDeadLetterOrders() ([]model.DeadLetterOrder, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) RetryDeadLetterOrder(number uint64, actor string) error {
+	return nil
+}
+
+func (m *mockDBStorage) ResolveDeadLetterOrder(number uint64, status model.OrderStatus, accrual money.Money, actor, reason string) error {
+	return nil
+}
+
+func Test_handler_PostTransfer(t *testing.T) {
+	createdAt, _ := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+	tests := []struct {
+		name    string
+		body    string
+		token   string
+		storage func() *mockDBStorage
+		code    int
+		resp    string
+	}{
+		{
+			name:  "успешный перевод",
+			body:  `{"login": "friend", "sum": 10.5}`,
+			token: utils.TestToken,
+			storage: func() *mockDBStorage {
+				storage := new(mockDBStorage)
+				storage.On("TransferPoints", "1", "friend", money.MustParse("10.5")).Return(&transferModel.Transfer{
+					ID: 1, Outgoing: true, Login: "friend", Sum: money.MustParse("10.5"), Fee: money.MustParse("0.1"), CreatedAt: createdAt,
+				}, nil)
+				return storage
+			},
+			code: 200,
+			resp: `{"id": 1, "direction": "OUT", "login": "friend", "sum": 10.5, "fee": 0.1, "created_at": "2020-12-10T15:15:45+03:00"}`,
+		},
+		{
+			name:  "превышен дневной лимит переводов",
+			body:  `{"login": "friend", "sum": 10.5}`,
+			token: utils.TestToken,
+			storage: func() *mockDBStorage {
+				storage := new(mockDBStorage)
+				storage.On("TransferPoints", "1", "friend", money.MustParse("10.5")).
+					Return((*transferModel.Transfer)(nil), db.ErrTransferDailyLimit)
+				return storage
+			},
+			code: 403,
+			resp: `{"code": "TRANSFER_DAILY_LIMIT"}`,
+		},
+		{
+			name:  "на счету недостаточно средств",
+			body:  `{"login": "friend", "sum": 10.5}`,
+			token: utils.TestToken,
+			storage: func() *mockDBStorage {
+				storage := new(mockDBStorage)
+				storage.On("TransferPoints", "1", "friend", money.MustParse("10.5")).
+					Return((*transferModel.Transfer)(nil), db.ErrBalanceLimitExhausted)
+				return storage
+			},
+			code: 402,
+		},
+		{
+			name:  "получатель не найден",
+			body:  `{"login": "stranger", "sum": 1}`,
+			token: utils.TestToken,
+			storage: func() *mockDBStorage {
+				storage := new(mockDBStorage)
+				storage.On("TransferPoints", "1", "stranger", money.MustParse("1")).
+					Return((*transferModel.Transfer)(nil), db.ErrRecipientNotFound)
+				return storage
+			},
+			code: 404,
+		},
+		{
+			name:  "перевод самому себе",
+			body:  `{"login": "me", "sum": 1}`,
+			token: utils.TestToken,
+			storage: func() *mockDBStorage {
+				storage := new(mockDBStorage)
+				storage.On("TransferPoints", "1", "me", money.MustParse("1")).
+					Return((*transferModel.Transfer)(nil), db.ErrTransferToSelf)
+				return storage
+			},
+			code: 422,
+		},
+		{
+			name:    "неположительная сумма",
+			body:    `{"login": "friend", "sum": 0}`,
+			token:   utils.TestToken,
+			storage: func() *mockDBStorage { return new(mockDBStorage) },
+			code:    400,
+		},
+		{
+			name:    "пользователь не аутентифицирован",
+			body:    `{"login": "friend", "sum": 1}`,
+			token:   "wrong token",
+			storage: func() *mockDBStorage { return new(mockDBStorage) },
+			code:    401,
+		},
+		{
+			name:  "внутренняя ошибка сервера",
+			body:  `{"login": "friend", "sum": 1}`,
+			token: utils.TestToken,
+			storage: func() *mockDBStorage {
+				storage := new(mockDBStorage)
+				storage.On("TransferPoints", "1", "friend", money.MustParse("1")).
+					Return((*transferModel.Transfer)(nil), errors.New("unexpected exception"))
+				return storage
+			},
+			code: 500,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/user/balance/transfer", bytes.NewReader([]byte(tt.body)))
+			request.AddCookie(&http.Cookie{Name: "token", Value: tt.token})
+
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc(NewHandler(tt.storage(), utils.TestSecret, logger).PostTransfer)
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+			if tt.resp != "" {
+				body, _ := io.ReadAll(res.Body)
+				assert.JSONEq(t, tt.resp, string(body))
+			}
+		})
+	}
+}
+
+func Test_handler_GetTransfers(t *testing.T) {
+	createdAt, _ := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
+	storage := new(mockDBStorage)
+	storage.On("GetTransfers", "1").Return([]transferModel.Transfer{
+		{ID: 1, Outgoing: true, Login: "friend", Sum: 1000, Fee: 10, CreatedAt: createdAt},
+		{ID: 2, Login: "friend", Sum: 500, CreatedAt: createdAt},
+	}, nil)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/user/transfers", nil)
+	request.AddCookie(&http.Cookie{Name: "token", Value: utils.TestToken})
+	w := httptest.NewRecorder()
+	http.HandlerFunc(NewHandler(storage, utils.TestSecret, logger).GetTransfers).ServeHTTP(w, request)
+	res := w.Result()
+	defer res.Body.Close()
+
+	assert.Equal(t, 200, res.StatusCode, "wrong status")
+	body, _ := io.ReadAll(res.Body)
+	assert.JSONEq(t, `[
+		{"id": 1, "direction": "OUT", "login": "friend", "sum": 10, "fee": 0.1, "created_at": "2020-12-10T15:15:45+03:00"},
+		{"id": 2, "direction": "IN", "login": "friend", "sum": 5, "created_at": "2020-12-10T15:15:45+03:00"}
+	]`, string(body))
+}
@@ -1,9 +1,28 @@
 package api
 
-import "time"
+import (
+	"gophermart/internal/money"
+	"time"
+)
+
+const (
+	Processed = "PROCESSED"
+	Pending   = "PENDING"
+	Cancelled = "CANCELLED"
+	Expired   = "EXPIRED"
+
+	Reversed          = "REVERSED"
+	PartiallyRefunded = "PARTIALLY_REFUNDED"
+)
 
 type Withdrawals struct {
-	Order       string    `json:"order"`
-	Sum         float64   `json:"sum"`
-	ProcessedAt time.Time `json:"processed_at"`
+	Order string      `json:"order"`
+	Sum   money.Money `json:"sum"`
+	// Currency is empty for the platform's own points.
+	Currency       string       `json:"currency,omitempty"`
+	Status         string       `json:"status"`
+	ProcessedAt    time.Time    `json:"processed_at"`
+	ExpiresAt      *time.Time   `json:"expires_at,omitempty"`
+	Refunded       *money.Money `json:"refunded,omitempty"`
+	ReversalReason string       `json:"reversal_reason,omitempty"`
 }
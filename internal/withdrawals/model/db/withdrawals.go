@@ -1,23 +1,83 @@
 package db
 
 import (
-	"gophermart/internal/utils"
+	"gophermart/internal/money"
 	"gophermart/internal/withdrawals/model/api"
 	"strconv"
+	"strings"
 	"time"
 )
 
+type WithdrawalStatus int
+
+const (
+	// Processed withdrawals are deducted from the balance, it is the status of immediate withdrawals.
+	Processed WithdrawalStatus = iota
+	// Pending withdrawals hold the sum until they are confirmed, cancelled or expired.
+	Pending
+	Cancelled
+	Expired
+	// Reversed withdrawals are refunded in full, PartiallyRefunded ones can be refunded further.
+	Reversed
+	PartiallyRefunded
+)
+
+var statusNames = map[WithdrawalStatus]string{
+	Processed: api.Processed,
+	Pending:   api.Pending,
+	Cancelled: api.Cancelled,
+	Expired:   api.Expired,
+
+	Reversed:          api.Reversed,
+	PartiallyRefunded: api.PartiallyRefunded,
+}
+
+func (s WithdrawalStatus) ToAPI() string {
+	return statusNames[s]
+}
+
+// SQLList formats statuses as a list for the SQL in operator, e.g. "(0, 4, 5)".
+func SQLList(statuses ...WithdrawalStatus) string {
+	list := make([]string, len(statuses))
+	for i, s := range statuses {
+		list[i] = strconv.Itoa(int(s))
+	}
+	return "(" + strings.Join(list, ", ") + ")"
+}
+
 type Withdrawals struct {
-	UserID      string    `db:"user_id"`
-	Sum         int64     `db:"sum"`
-	Number      uint64    `db:"number"`
-	ProcessedAt time.Time `db:"processed_at"`
+	UserID      string           `db:"user_id"`
+	Sum         money.Money      `db:"sum"`
+	Number      uint64           `db:"number"`
+	Currency    string           `db:"currency"`
+	Status      WithdrawalStatus `db:"status"`
+	ProcessedAt time.Time        `db:"processed_at"`
+	ExpiresAt   *time.Time       `db:"expires_at"`
+	Refunded    money.Money      `db:"refunded"`
+	// ReversalReason is the reason of the last refund.
+	ReversalReason *string `db:"reversal_reason"`
 }
 
-func NewWithdrawals(UserID string, sum float64, number uint64) *Withdrawals {
-	return &Withdrawals{UserID: UserID, Sum: utils.GetPersistentAccrual(sum), Number: number}
+func NewWithdrawals(UserID string, sum money.Money, number uint64) *Withdrawals {
+	return &Withdrawals{UserID: UserID, Sum: sum, Number: number}
 }
 
 func (w *Withdrawals) ToAPI() api.Withdrawals {
-	return api.Withdrawals{Order: strconv.FormatUint(w.Number, 10), Sum: utils.GetAPIAccrual(w.Sum), ProcessedAt: w.ProcessedAt}
+	withdrawal := api.Withdrawals{
+		Order:       strconv.FormatUint(w.Number, 10),
+		Sum:         w.Sum,
+		Currency:    w.Currency,
+		Status:      w.Status.ToAPI(),
+		ProcessedAt: w.ProcessedAt,
+	}
+	if w.Status == Pending {
+		withdrawal.ExpiresAt = w.ExpiresAt
+	}
+	if w.Refunded > 0 {
+		withdrawal.Refunded = &w.Refunded
+	}
+	if w.ReversalReason != nil {
+		withdrawal.ReversalReason = *w.ReversalReason
+	}
+	return withdrawal
 }
@@ -2,10 +2,14 @@ package withdrawals
 
 import (
 	"encoding/json"
+	"errors"
 	"gophermart/internal/db"
 	"gophermart/internal/utils"
 	"gophermart/internal/withdrawals/model/api"
 	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
 )
 
 type handler struct {
@@ -17,11 +21,18 @@ func NewHandler(db db.Storage, secret string) *handler {
 	return &handler{db, secret}
 }
 
+// CurrencyParam is the query parameter of the withdrawals currency.
+const CurrencyParam = "currency"
+
+// GetWithdrawals returns withdrawals in the currency of the query parameter, of the platform's own points without it.
 func (h *handler) GetWithdrawals(w http.ResponseWriter, r *http.Request) {
 	if UserID, isAuthed := utils.GetUserID(r, h.secret); !isAuthed {
 		// 401 — пользователь не авторизован.
 		w.WriteHeader(http.StatusUnauthorized)
-	} else if withdrawals, err := h.db.GetWithdrawals(UserID); err != nil {
+	} else if withdrawals, err := h.db.GetWithdrawals(UserID, r.URL.Query().Get(CurrencyParam)); errors.Is(err, db.ErrUnknownCurrency) {
+		// 400 — неизвестная валюта.
+		w.WriteHeader(http.StatusBadRequest)
+	} else if err != nil {
 		// 500 — внутренняя ошибка сервера.
 		w.WriteHeader(http.StatusInternalServerError)
 	} else if len(withdrawals) == 0 {
@@ -37,3 +48,32 @@ func (h *handler) GetWithdrawals(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(apiWithdrawals)
 	}
 }
+
+func (h *handler) PostConfirm(w http.ResponseWriter, r *http.Request) {
+	h.finishHold(w, r, h.db.ConfirmWithdrawal)
+}
+
+func (h *handler) PostCancel(w http.ResponseWriter, r *http.Request) {
+	h.finishHold(w, r, h.db.CancelWithdrawal)
+}
+
+func (h *handler) finishHold(w http.ResponseWriter, r *http.Request, finish func(UserID string, number uint64) error) {
+	if UserID, isAuthed := utils.GetUserID(r, h.secret); !isAuthed {
+		// 401 — пользователь не авторизован.
+		w.WriteHeader(http.StatusUnauthorized)
+	} else if number, err := strconv.ParseUint(chi.URLParam(r, "number"), 10, 64); err != nil {
+		// 400 — неверный формат номера заказа.
+		w.WriteHeader(http.StatusBadRequest)
+	} else if err := finish(UserID, number); errors.Is(err, db.ErrWithdrawalNotFound) {
+		// 404 — списание не найдено.
+		w.WriteHeader(http.StatusNotFound)
+	} else if errors.Is(err, db.ErrWithdrawalNotPending) {
+		// 409 — списание уже подтверждено, отменено или истекло.
+		w.WriteHeader(http.StatusConflict)
+	} else if err != nil {
+		// 500 — внутренняя ошибка сервера.
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -1,6 +1,7 @@
 package withdrawals
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -10,12 +11,19 @@ import (
 	"time"
 
 	accountModel "gophermart/internal/account/model/db"
+	adjustmentModel "gophermart/internal/adjustment/model/db"
+	campaignModel "gophermart/internal/campaign/model/db"
 	"gophermart/internal/db"
+	"gophermart/internal/money"
 	"gophermart/internal/order/model"
+	referralModel "gophermart/internal/referral/model/db"
+	statementModel "gophermart/internal/statement/model/db"
+	transferModel "gophermart/internal/transfer/model/db"
 	"gophermart/internal/utils"
 	"gophermart/internal/withdrawals/model/api"
 	withdrawalsModel "gophermart/internal/withdrawals/model/db"
 
+	"github.com/go-chi/chi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -24,7 +32,7 @@ type mockDBStorage struct {
 	mock.Mock
 }
 
-func (m *mockDBStorage) Register(login string, password string) (string, error) {
+func (m *mockDBStorage) Register(login, password, referralCode, ip string) (string, error) {
 	return "", nil
 }
 
@@ -32,7 +40,7 @@ func (m *mockDBStorage) GetByLoginPassword(login string, password string) (strin
 	return "", nil
 }
 
-func (m *mockDBStorage) SaveOrder(UserID string, number uint64) error {
+func (m *mockDBStorage) SaveOrder(UserID string, number uint64, merchantID, provider string) error {
 	args := m.Called(UserID, number)
 	return args.Error(0)
 }
@@ -42,21 +50,184 @@ func (m *mockDBStorage) GetOrders(UserID string) ([]model.Order, error) {
 	return args.Get(0).([]model.Order), args.Error(1)
 }
 
-func (m *mockDBStorage) GetAccount(UserID string) (*accountModel.Account, error) {
+func (m *mockDBStorage) GetAccount(UserID, currency string) (*accountModel.Account, error) {
 	return nil, nil
 }
-func (m *mockDBStorage) WithdrawFromAccount(UserID string, sum float64, number uint64) error {
+func (m *mockDBStorage) WithdrawFromAccount(UserID, currency string, sum money.Money, number uint64) error {
 	return nil
 }
-func (m *mockDBStorage) GetWithdrawals(UserID string) ([]withdrawalsModel.Withdrawals, error) {
-	args := m.Called(UserID)
+func (m *mockDBStorage) HoldWithdrawal(UserID, currency string, sum money.Money, number uint64, ttl time.Duration) error {
+	return nil
+}
+
+func (m *mockDBStorage) ConfirmWithdrawal(UserID string, number uint64) error {
+	args := m.Called(UserID, number)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) CancelWithdrawal(UserID string, number uint64) error {
+	args := m.Called(UserID, number)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) ExpireWithdrawals() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) ExpirePoints() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) RecalculateTiers() (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) CreateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaigns() ([]campaignModel.Campaign, error) {
+	args := m.Called()
+	return args.Get(0).([]campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) GetCampaign(ID int64) (*campaignModel.Campaign, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) UpdateCampaign(campaign campaignModel.Campaign) (*campaignModel.Campaign, error) {
+	args := m.Called(campaign)
+	return args.Get(0).(*campaignModel.Campaign), args.Error(1)
+}
+
+func (m *mockDBStorage) DeleteCampaign(ID int64) error {
+	args := m.Called(ID)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) CreateAdjustment(login string, amount money.Money, reason, ticket, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(login, amount, reason, ticket, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) ApproveAdjustment(ID int64, actor string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) RejectAdjustment(ID int64, actor, reason string) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID, actor, reason)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustments() ([]adjustmentModel.Adjustment, error) {
+	args := m.Called()
+	return args.Get(0).([]adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetAdjustment(ID int64) (*adjustmentModel.Adjustment, error) {
+	args := m.Called(ID)
+	return args.Get(0).(*adjustmentModel.Adjustment), args.Error(1)
+}
+
+func (m *mockDBStorage) GetExpiringPoints(UserID, currency string, within time.Duration) ([]accountModel.ExpiringPoints, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) RefundWithdrawal(number uint64, sum money.Money, actor, reason string) (*withdrawalsModel.Withdrawals, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetWithdrawals(UserID, currency string) ([]withdrawalsModel.Withdrawals, error) {
+	args := m.Called(UserID, currency)
 	return args.Get(0).([]withdrawalsModel.Withdrawals), args.Error(1)
 }
-func (m *mockDBStorage) CalcAmounts(offset, limit int,
+
+func (m *mockDBStorage) TransferPoints(UserID, login string, sum money.Money) (*transferModel.Transfer, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetTransfers(UserID string) ([]transferModel.Transfer, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetReferrals(UserID string) (*referralModel.Referrals, error) {
+	args := m.Called(UserID)
+	return args.Get(0).(*referralModel.Referrals), args.Error(1)
+}
+
+func (m *mockDBStorage) GetStatement(UserID string, from, to *time.Time, offset, limit int) (*statementModel.Statement, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) ReserveIdempotencyKey(UserID, scope, key, requestHash string, ttl, lease time.Duration) (*db.IdempotentResponse, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) SaveIdempotentResponse(UserID, scope, key string, statusCode int, contentType string, body []byte) error {
+	return nil
+}
+
+func (m *mockDBStorage) ReleaseIdempotencyKey(UserID, scope, key string) error {
+	return nil
+}
+func (m *mockDBStorage) CalcAmounts(shard db.Shard, providers []string, offset, limit int,
 	updF func(nums []int64) map[int64]db.CalcAmountsUpdateResult) (int, error) {
 	return 0, nil
 }
 
+func (m *mockDBStorage) ApplyCalcResults(providers []string, updates map[int64]db.CalcAmountsUpdateResult) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) SaveCallbackSignature(signature string, ttl time.Duration) error {
+	args := m.Called(signature, ttl)
+	return args.Error(0)
+}
+
+func (m *mockDBStorage) TryAcquireLease(instanceID string, shard int) (*db.Lease, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) GetLeaders() ([]db.Leader, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) CheckLedger() ([]db.LedgerMismatch, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) Reconcile(save bool) (*db.ReconciliationReport, error) {
+	args := m.Called(save)
+	return args.Get(0).(*db.ReconciliationReport), args.Error(1)
+}
+
+func (m *mockDBStorage) Ping() error {
+	return nil
+}
+
+func (m *mockDBStorage) GetOrderHistory(UserID string, number uint64) ([]model.OrderEvent, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) DeadLetterOrders(maxFailedAttempts int) (int, error) {
+	return 0, nil
+}
+
+func (m *mockDBStorage) GetDeadLetterOrders() ([]model.DeadLetterOrder, error) {
+	return nil, nil
+}
+
+func (m *mockDBStorage) RetryDeadLetterOrder(number uint64, actor string) error {
+	return nil
+}
+
+func (m *mockDBStorage) ResolveDeadLetterOrder(number uint64, status model.OrderStatus, accrual money.Money, actor, reason string) error {
+	return nil
+}
+
 func Test_handler_GetWithdrawals(t *testing.T) {
 	defaultStorage := new(mockDBStorage)
 	defaultHandler := func() *handler {
@@ -66,6 +237,7 @@ func Test_handler_GetWithdrawals(t *testing.T) {
 		name             string
 		code             int
 		token            string
+		query            string
 		getHandler       func() *handler
 		checkResponeBody func(res *http.Response)
 	}{
@@ -79,13 +251,13 @@ func Test_handler_GetWithdrawals(t *testing.T) {
 				result[0] = *withdrawalsModel.NewWithdrawals("1", 10, 9278923470)
 				result[0].ProcessedAt, _ = time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
 
-				storage.On("GetWithdrawals", "1").Return(result, nil)
+				storage.On("GetWithdrawals", "1", "").Return(result, nil)
 				return &handler{db: storage, secret: utils.TestSecret}
 			},
 			checkResponeBody: func(res *http.Response) {
 				processedAt, _ := time.Parse(time.RFC3339, "2020-12-10T15:15:45+03:00")
 				expected := make([]api.Withdrawals, 1)
-				expected[0] = api.Withdrawals{Order: "9278923470", Sum: 10, ProcessedAt: processedAt}
+				expected[0] = api.Withdrawals{Order: "9278923470", Sum: 10, Status: api.Processed, ProcessedAt: processedAt}
 
 				var result []api.Withdrawals
 				json.NewDecoder(res.Body).Decode(&result)
@@ -98,7 +270,7 @@ func Test_handler_GetWithdrawals(t *testing.T) {
 			token: utils.TestToken,
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
-				storage.On("GetWithdrawals", "1").Return([]withdrawalsModel.Withdrawals{}, nil)
+				storage.On("GetWithdrawals", "1", "").Return([]withdrawalsModel.Withdrawals{}, nil)
 				return &handler{db: storage, secret: utils.TestSecret}
 			},
 			checkResponeBody: func(res *http.Response) {
@@ -107,6 +279,37 @@ func Test_handler_GetWithdrawals(t *testing.T) {
 				assert.ErrorIs(t, e, io.EOF)
 			},
 		},
+		{
+			name:  "списания в валюте партнёра",
+			code:  200,
+			token: utils.TestToken,
+			query: "?currency=MILES",
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				result := []withdrawalsModel.Withdrawals{*withdrawalsModel.NewWithdrawals("1", 10, 9278923470)}
+				result[0].Currency = "MILES"
+				storage.On("GetWithdrawals", "1", "MILES").Return(result, nil)
+				return &handler{db: storage, secret: utils.TestSecret}
+			},
+			checkResponeBody: func(res *http.Response) {
+				var result []api.Withdrawals
+				json.NewDecoder(res.Body).Decode(&result)
+				if assert.Len(t, result, 1) {
+					assert.Equal(t, "MILES", result[0].Currency)
+				}
+			},
+		},
+		{
+			name:  "неизвестная валюта",
+			code:  400,
+			token: utils.TestToken,
+			query: "?currency=UNKNOWN",
+			getHandler: func() *handler {
+				storage := new(mockDBStorage)
+				storage.On("GetWithdrawals", "1", "UNKNOWN").Return([]withdrawalsModel.Withdrawals(nil), db.ErrUnknownCurrency)
+				return &handler{db: storage, secret: utils.TestSecret}
+			},
+		},
 		{
 			name:       "пользователь не аутентифицирован",
 			code:       401,
@@ -119,14 +322,14 @@ func Test_handler_GetWithdrawals(t *testing.T) {
 			token: utils.TestToken,
 			getHandler: func() *handler {
 				storage := new(mockDBStorage)
-				storage.On("GetWithdrawals", "1").Return([]withdrawalsModel.Withdrawals{}, errors.New("unexpected exception"))
+				storage.On("GetWithdrawals", "1", "").Return([]withdrawalsModel.Withdrawals{}, errors.New("unexpected exception"))
 				return &handler{db: storage, secret: utils.TestSecret}
 			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			request := httptest.NewRequest(http.MethodGet, "/api/user/withdrawals", nil)
+			request := httptest.NewRequest(http.MethodGet, "/api/user/withdrawals"+tt.query, nil)
 			request.AddCookie(&http.Cookie{Name: "token", Value: tt.token})
 
 			w := httptest.NewRecorder()
@@ -142,3 +345,46 @@ func Test_handler_GetWithdrawals(t *testing.T) {
 		})
 	}
 }
+
+func Test_handler_finishHold(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		number string
+		token  string
+		err    error
+		code   int
+	}{
+		{name: "подтверждение списания", method: "ConfirmWithdrawal", number: "9278923470", token: utils.TestToken, code: 200},
+		{name: "отмена списания", method: "CancelWithdrawal", number: "9278923470", token: utils.TestToken, code: 200},
+		{name: "списание не найдено", method: "ConfirmWithdrawal", number: "9278923470", token: utils.TestToken, err: db.ErrWithdrawalNotFound, code: 404},
+		{name: "списание уже отменено", method: "ConfirmWithdrawal", number: "9278923470", token: utils.TestToken, err: db.ErrWithdrawalNotPending, code: 409},
+		{name: "внутренняя ошибка сервера", method: "CancelWithdrawal", number: "9278923470", token: utils.TestToken, err: errors.New("unexpected exception"), code: 500},
+		{name: "неверный номер заказа", method: "CancelWithdrawal", number: "abc", token: utils.TestToken, code: 400},
+		{name: "пользователь не аутентифицирован", method: "CancelWithdrawal", number: "9278923470", token: "wrong token", code: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := new(mockDBStorage)
+			storage.On(tt.method, "1", uint64(9278923470)).Return(tt.err)
+			h := &handler{db: storage, secret: utils.TestSecret}
+			handle := h.PostConfirm
+			if tt.method == "CancelWithdrawal" {
+				handle = h.PostCancel
+			}
+
+			request := httptest.NewRequest(http.MethodPost, "/api/user/withdrawals/"+tt.number+"/confirm", nil)
+			request.AddCookie(&http.Cookie{Name: "token", Value: tt.token})
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("number", tt.number)
+			request = request.WithContext(context.WithValue(request.Context(), chi.RouteCtxKey, rctx))
+
+			w := httptest.NewRecorder()
+			http.HandlerFunc(handle).ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+		})
+	}
+}